@@ -3,38 +3,68 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
 
 	_ "github.com/lib/pq"
 	"go.uber.org/zap"
 
 	"github.com/vshulcz/Golectra/internal/adapters/persistence/file"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/embedded"
 	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
 	pgrepo "github.com/vshulcz/Golectra/internal/adapters/repository/postgres"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/resilient"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/tiered"
 	"github.com/vshulcz/Golectra/internal/config"
 	"github.com/vshulcz/Golectra/internal/misc"
 	"github.com/vshulcz/Golectra/internal/ports"
 )
 
-func buildRepoAndPersister(cfg config.ServerConfig, logger *zap.Logger) (ports.MetricsRepo, ports.Persister) {
+const (
+	// dbConnectTimeout bounds the first connection attempt of a non-strict start.
+	dbConnectTimeout = 10 * time.Second
+	// cacheFlushTimeout bounds the final flush of cached writes at shutdown.
+	cacheFlushTimeout = 30 * time.Second
+)
+
+// buildRepoAndPersister builds the configured storage engine. Postgres is wrapped in a
+// resilient repo that journals writes while the database is unreachable and replays them once
+// it is back; in strict mode an unreachable database fails the start. With the DB cache enabled
+// reads are served from memory and writes flushed behind. The embedded engine logs every write
+// to its own files, and memory alone is saved by the returned file persister.
+// The returned *sql.DB is nil unless Postgres is in use; closeRepo flushes and closes
+// whatever the engine holds open.
+func buildRepoAndPersister(cfg config.ServerConfig, logger *zap.Logger) (ports.MetricsRepo, ports.Persister, *sql.DB, func(), error) {
 	ctx := context.Background()
-	if cfg.DSN != "" {
-		db, err := sql.Open("postgres", cfg.DSN)
-		if err == nil {
-			op := func() error {
-				if err := db.PingContext(ctx); err != nil {
-					return err
-				}
-				return pgrepo.Migrate(db)
-			}
-			if err = misc.Retry(ctx, misc.DefaultBackoff, pgrepo.IsRetryable, op); err == nil {
-				logger.Info("db connected & migrated")
-				return pgrepo.New(db), nil
+	switch cfg.StorageOptions.Engine {
+	case config.StoragePostgres:
+		return buildPostgresStorage(ctx, cfg, logger)
+	case config.StorageEmbedded:
+		repo, err := buildEmbeddedRepo(ctx, cfg, logger)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		closeRepo := func() {
+			if err := repo.Close(); err != nil {
+				logger.Warn("close embedded storage", zap.Error(err))
 			}
 		}
-		logger.Warn("postgres init failed, falling back to memory", zap.Error(err))
+		return repo, nil, nil, closeRepo, nil
 	}
-	repo := memrepo.New()
-	var p ports.Persister = file.New(cfg.File)
+	// Revisions start at the wall clock, and Restore moves them past the saved ones, so
+	// ETags and since values from before a restart never match different data.
+	repo := memrepo.New(memrepo.WithRevisionBase(time.Now().UnixMicro()))
+	fileOpts := cfg.FileOptions
+	var p ports.Persister = file.New(cfg.File,
+		file.WithGenerations(fileOpts.Generations),
+		file.WithCompression(fileOpts.Compress),
+		file.WithRestoreGeneration(fileOpts.RestoreGeneration),
+		file.WithErrorHandler(func(err error) {
+			logger.Warn("skipping invalid snapshot", zap.Error(err))
+		}),
+	)
 	if cfg.Restore {
 		if err := p.Restore(ctx, repo); err != nil {
 			logger.Warn("restore failed", zap.Error(err))
@@ -42,5 +72,143 @@ func buildRepoAndPersister(cfg config.ServerConfig, logger *zap.Logger) (ports.M
 			logger.Info("restore ok", zap.String("file", cfg.File))
 		}
 	}
-	return repo, p
+	return repo, p, nil, func() {}, nil
+}
+
+func buildPostgresStorage(ctx context.Context, cfg config.ServerConfig, logger *zap.Logger) (ports.MetricsRepo, ports.Persister, *sql.DB, func(), error) {
+	pg, db, err := buildPostgresRepo(ctx, cfg, logger)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	closeRepo := func() {
+		if err := pg.Close(); err != nil {
+			logger.Warn("close db journal", zap.Error(err))
+		}
+	}
+	if !cfg.DBOptions.Cache {
+		return pg, nil, db, closeRepo, nil
+	}
+	cache, err := buildCachedRepo(ctx, cfg, pg, logger)
+	if err != nil {
+		closeRepo()
+		_ = db.Close()
+		return nil, nil, nil, nil, err
+	}
+	closeCache := func() {
+		flushCtx, cancel := context.WithTimeout(ctx, cacheFlushTimeout)
+		defer cancel()
+		if err := cache.Close(flushCtx); err != nil {
+			logger.Error("final db flush failed", zap.Error(err))
+		}
+		closeRepo()
+	}
+	return cache, nil, db, closeCache, nil
+}
+
+// buildEmbeddedRepo recovers the embedded storage from its data directory.
+func buildEmbeddedRepo(ctx context.Context, cfg config.ServerConfig, logger *zap.Logger) (*embedded.Repo, error) {
+	opts := cfg.StorageOptions
+	repo, err := embedded.Open(ctx, opts.Dir,
+		embedded.WithCompactSize(opts.CompactSize),
+		embedded.WithErrorHandler(func(err error) {
+			logger.Warn("embedded storage compaction failed", zap.Error(err))
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("open embedded storage: %w", err)
+	}
+	st := repo.Stats()
+	logger.Info("embedded storage recovered", zap.String("dir", opts.Dir), zap.Int64("replayed", st.Recovered), zap.Uint64("log", st.LogSegment))
+	expvar.Publish("storage_embedded", expvar.Func(func() any { return repo.Stats() }))
+	return repo, nil
+}
+
+func buildPostgresRepo(ctx context.Context, cfg config.ServerConfig, logger *zap.Logger) (*resilient.Repo, *sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open postgres: %w", err)
+	}
+	migrator, err := pgrepo.NewMigrator(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	probe := func(ctx context.Context) error {
+		if err := db.PingContext(ctx); err != nil {
+			return err
+		}
+		return prepareSchema(ctx, migrator, cfg.DBOptions.SkipMigrate, logger)
+	}
+	if cfg.DBOptions.Strict {
+		op := func() error { return probe(ctx) }
+		if err := misc.Retry(ctx, misc.DefaultBackoff, pgrepo.IsRetryable, op); err != nil {
+			_ = db.Close()
+			return nil, nil, fmt.Errorf("postgres unavailable in strict mode: %w", err)
+		}
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, dbConnectTimeout)
+	defer cancel()
+	if !cfg.DBOptions.Strict && db.PingContext(connectCtx) == nil {
+		// An outage only degrades the start, but a schema from a newer build never heals.
+		if err := migrator.Check(connectCtx); errors.Is(err, pgrepo.ErrSchemaTooNew) {
+			_ = db.Close()
+			return nil, nil, err
+		}
+	}
+	repo, err := resilient.Open(connectCtx, pgrepo.New(db), cfg.DBOptions.JournalPath,
+		resilient.WithProbe(probe),
+		resilient.WithOutageCheck(pgrepo.IsRetryable),
+		resilient.WithReconnectInterval(cfg.DBOptions.ReconnectInterval),
+		resilient.WithStateHandler(func(degraded bool, err error) {
+			if degraded {
+				logger.Warn("postgres unavailable, journaling writes", zap.String("journal", cfg.DBOptions.JournalPath), zap.Error(err))
+				return
+			}
+			logger.Info("db connected & migrated")
+		}),
+	)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, fmt.Errorf("open db journal: %w", err)
+	}
+	expvar.Publish("db_failover", expvar.Func(func() any { return repo.Stats() }))
+	return repo, db, nil
+}
+
+// prepareSchema applies pending migrations. With skipMigrate it only refuses a schema newer
+// than this build and warns when migrations are pending.
+func prepareSchema(ctx context.Context, m *pgrepo.Migrator, skipMigrate bool, logger *zap.Logger) error {
+	if !skipMigrate {
+		_, err := m.Up(ctx)
+		return err
+	}
+	if err := m.Check(ctx); err != nil {
+		return err
+	}
+	current, latest, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current < latest {
+		logger.Warn("database schema is behind this build, run \"server migrate up\"", zap.Int64("version", current), zap.Int64("latest", latest))
+	}
+	return nil
+}
+
+// buildCachedRepo loads every metric into memory and writes behind to the failover repo,
+// which journals flushes that arrive during an outage.
+func buildCachedRepo(ctx context.Context, cfg config.ServerConfig, backing ports.MetricsRepo, logger *zap.Logger) (*tiered.Repo, error) {
+	cache, err := tiered.Open(ctx, backing,
+		tiered.WithFlushInterval(cfg.DBOptions.FlushInterval),
+		tiered.WithFlushSize(cfg.DBOptions.FlushSize),
+		tiered.WithErrorHandler(func(err error) {
+			logger.Warn("db cache flush or reload failed, will retry", zap.Error(err))
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load db cache: %w", err)
+	}
+	expvar.Publish("db_cache", expvar.Func(func() any { return cache.Stats() }))
+	return cache, nil
 }
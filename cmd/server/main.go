@@ -2,24 +2,42 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	auditfile "github.com/vshulcz/Golectra/internal/adapters/audit/file"
+	auditpg "github.com/vshulcz/Golectra/internal/adapters/audit/postgres"
 	auditremote "github.com/vshulcz/Golectra/internal/adapters/audit/remote"
+	auditsyslog "github.com/vshulcz/Golectra/internal/adapters/audit/syslog"
 	"github.com/vshulcz/Golectra/internal/adapters/http/ginserver"
 	"github.com/vshulcz/Golectra/internal/adapters/http/ginserver/middlewares"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/traced"
 	"github.com/vshulcz/Golectra/internal/config"
 	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
 	"github.com/vshulcz/Golectra/internal/services/audit"
 	"github.com/vshulcz/Golectra/internal/services/metrics"
+	"github.com/vshulcz/Golectra/pkg/observer"
+	"github.com/vshulcz/Golectra/pkg/trace"
 	"github.com/vshulcz/Golectra/pkg/util"
 	"go.uber.org/zap"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take after a stop signal.
+const shutdownTimeout = 10 * time.Second
+
+// saveTimeout bounds one coalesced snapshot save, which no single request's deadline governs.
+const saveTimeout = 30 * time.Second
+
 var (
 	buildVersion string
 	buildDate    string
@@ -35,6 +53,17 @@ func main() {
 }
 
 func run(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "verify":
+			return runVerify(args[1:], os.Stdout)
+		case "migrate":
+			return runMigrate(args[1:], os.Stdout)
+		case "migrate-data":
+			return runMigrateData(args[1:], os.Stdout)
+		}
+	}
+
 	cfg, err := config.LoadServerConfig(args, nil)
 	if err != nil {
 		return err
@@ -50,38 +79,61 @@ func run(args []string) error {
 		}
 	}()
 
-	repo, persister := buildRepoAndPersister(cfg, logger)
-	onChanged := func(ctx context.Context, s domain.Snapshot) {
-		if persister != nil {
-			if err := persister.Save(ctx, s); err != nil {
-				logger.Warn("save failed", zap.Error(err))
-			}
-		}
+	repo, persister, db, closeRepo, err := buildRepoAndPersister(cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+	changes := metrics.NewChangeBus()
+	changes.SetErrorHandler(func(err error) {
+		logger.Warn("metrics change subscriber failed", zap.Error(err))
+	})
+	defer changes.Close()
+	if persister != nil && cfg.Interval == 0 {
+		// Sync mode: every write is saved before the response goes out.
+		changes.Subscribe(persistOnChange(repo, persister), observer.WithName("persister"))
 	}
 
-	auditor := buildAuditor(cfg, logger)
-	svc := metrics.New(repo, onChanged, auditor)
-	defer svc.Close()
-	h := ginserver.NewHandler(svc)
+	auditor, auditReader, closeAuditor := buildAuditor(cfg, db, logger)
+	defer closeAuditor()
+	tracer, closeTracer := buildTracer(cfg, logger)
+	defer closeTracer()
+	svcRepo := repo
+	if tracer != nil {
+		svcRepo = traced.New(repo, tracer)
+	}
+	svc := metrics.New(svcRepo, auditor,
+		metrics.WithReadAudit(cfg.AuditReads),
+		metrics.WithChangePublisher(changes),
+	)
+	h := ginserver.NewHandler(svc,
+		ginserver.WithAuditReader(auditReader),
+		ginserver.WithAuditToken(cfg.AuditAPIToken),
+		ginserver.WithDebugVarsToken(cfg.DebugVarsToken),
+	)
 
 	r := ginserver.NewRouter(h, logger,
+		middlewares.Traceparent(tracer),
+		middlewares.RequestID(),
 		middlewares.ZapLogger(logger),
 		middlewares.GzipRequest(),
 		middlewares.GzipResponse(),
 		middlewares.HashSHA256(cfg.Key),
 	)
 
-	log.Printf("cfg: addr=%s file=%s interval=%v restore=%v dsn=%q audit_file=%q audit_url=%q",
-		cfg.Address, cfg.File, cfg.Interval, cfg.Restore, cfg.DSN, cfg.AuditFile, cfg.AuditURL)
+	log.Printf("cfg: addr=%s storage=%s storage_dir=%q file=%s interval=%v restore=%v dsn=%q audit_file=%q audit_url=%q audit_syslog=%q audit_reads=%v audit_queue=%s/%d trace_file=%q db_journal=%q db_strict=%v db_cache=%v db_flush=%s/%d",
+		cfg.Address, cfg.StorageOptions.Engine, cfg.StorageOptions.Dir, cfg.File, cfg.Interval, cfg.Restore, cfg.DSN, cfg.AuditFile, cfg.AuditURL, cfg.AuditSyslog, cfg.AuditReads,
+		cfg.AuditQueueOptions.Policy, cfg.AuditQueueOptions.Size, cfg.TraceFile,
+		cfg.DBOptions.JournalPath, cfg.DBOptions.Strict, cfg.DBOptions.Cache, cfg.DBOptions.FlushInterval, cfg.DBOptions.FlushSize)
 
-	if cfg.DSN == "" && cfg.Interval > 0 {
+	if persister != nil && cfg.Interval > 0 {
 		if cfg.Interval < 0 {
 			cfg.Interval = 300 * time.Second
 		}
 		ticker := time.NewTicker(cfg.Interval)
 		go func() {
 			for range ticker.C {
-				if s, err := repo.Snapshot(context.Background()); err == nil && persister != nil {
+				if s, err := repo.Snapshot(context.Background()); err == nil {
 					if err := persister.Save(context.Background(), s); err != nil {
 						logger.Warn("periodic save failed", zap.Error(err))
 					}
@@ -98,31 +150,368 @@ func run(args []string) error {
 		WriteTimeout:      15 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	return serve(srv, logger)
+}
+
+// serve runs srv until it fails or the process receives SIGINT or SIGTERM, then drains
+// in-flight requests so the deferred closers in run can flush what they hold.
+func serve(srv *http.Server, logger *zap.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
 		return err
+	case <-ctx.Done():
+	}
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
+// persistOnChange saves a snapshot that includes the change before the write returns.
+// Writes that land while a save is running share the next one, so a burst of concurrent
+// updates costs two snapshots instead of one per request.
+func persistOnChange(repo ports.MetricsRepo, persister ports.Persister) metrics.ChangeObserver {
+	s := &coalescedSaver{repo: repo, persister: persister, timeout: saveTimeout}
+	return metrics.ChangeObserverFunc(func(ctx context.Context, _ domain.MetricsChanged) error {
+		return s.save(ctx)
+	})
+}
+
+// saveRound is one snapshot save shared by every write that joined it.
+type saveRound struct {
+	done chan struct{}
+	err  error
+}
+
+type coalescedSaver struct {
+	repo      ports.MetricsRepo
+	persister ports.Persister
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	next    *saveRound
+	running bool
+}
+
+// save joins the round that starts after the caller's write and waits for it. The round
+// runs detached from the caller, so a cancelled request stops waiting without failing
+// the save for the writes that share it.
+func (s *coalescedSaver) save(ctx context.Context) error {
+	s.mu.Lock()
+	if s.next == nil {
+		s.next = &saveRound{done: make(chan struct{})}
+	}
+	round := s.next
+	if !s.running {
+		s.running = true
+		go s.loop(context.WithoutCancel(ctx))
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-round.done:
+		return round.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *coalescedSaver) loop(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		round := s.next
+		s.next = nil
+		if round == nil {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		round.err = s.saveOnce(ctx)
+		close(round.done)
+	}
+}
+
+func (s *coalescedSaver) saveOnce(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	snap, err := s.repo.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("snapshot for save: %w", err)
+	}
+	if err := s.persister.Save(ctx, snap); err != nil {
+		return fmt.Errorf("save: %w", err)
 	}
 	return nil
 }
 
-func buildAuditor(cfg config.ServerConfig, logger *zap.Logger) audit.Publisher {
-	if cfg.AuditFile == "" && cfg.AuditURL == "" {
-		return nil
+// buildTracer opens the span file when tracing is configured. Without it the server still
+// propagates trace IDs but records no spans, and the returned tracer is nil.
+func buildTracer(cfg config.ServerConfig, logger *zap.Logger) (*trace.Tracer, func()) {
+	if cfg.TraceFile == "" {
+		return nil, func() {}
+	}
+	exp, err := trace.NewFileExporter(cfg.TraceFile)
+	if err != nil {
+		logger.Warn("trace file disabled", zap.Error(err))
+		return nil, func() {}
+	}
+	tracer := trace.NewTracer(exp)
+	tracer.SetErrorHandler(func(err error) {
+		logger.Warn("span export failed", zap.Error(err))
+	})
+	return tracer, func() {
+		if err := exp.Close(); err != nil {
+			logger.Warn("close trace file", zap.Error(err))
+		}
+	}
+}
+
+// buildAuditor wires the configured audit sinks and picks the reader behind `GET /api/v1/audit`:
+// the Postgres table when enabled, otherwise the audit file.
+func buildAuditor(cfg config.ServerConfig, db *sql.DB, logger *zap.Logger) (audit.Publisher, audit.Reader, func()) {
+	useDB := cfg.AuditDB && db != nil
+	if cfg.AuditDB && db == nil {
+		logger.Warn("audit db requested but postgres is not in use")
+	}
+	if cfg.AuditFile == "" && cfg.AuditURL == "" && cfg.AuditSyslog == "" && !useDB {
+		return nil, nil, func() {}
 	}
+	var reader audit.Reader
 	subject := audit.NewSubject()
-	subject.SetErrorHandler(func(err error) {
+	logErr := func(err error) {
 		logger.Warn("audit delivery failed", zap.Error(err))
-	})
+	}
+	subject.SetErrorHandler(logErr)
+
+	routes := audit.Routes(nil)
+	if cfg.AuditRoutes != "" {
+		var err error
+		if routes, err = audit.LoadRoutes(cfg.AuditRoutes); err != nil {
+			logger.Fatal("audit routes init failed", zap.Error(err))
+		}
+	}
+
+	queues := make(map[string]*audit.Queue, 4)
+	routers := make(map[string]*audit.Router, 4)
+	attach := func(name string, sink audit.Observer) {
+		q, err := newAuditQueue(cfg.AuditQueueOptions, name, sink)
+		if err != nil {
+			logger.Fatal("audit queue init failed", zap.String("sink", name), zap.Error(err))
+		}
+		q.SetErrorHandler(logErr)
+		queues[name] = q
+		// Route before queueing so filtered events never take queue space.
+		rt, err := audit.NewRouter(q, routes[name])
+		if err != nil {
+			logger.Fatal("audit routes init failed", zap.String("sink", name), zap.Error(err))
+		}
+		routers[name] = rt
+		subject.Subscribe(rt, observer.WithName(name))
+	}
+
+	closers := make([]func(), 0, 3)
 	if cfg.AuditFile != "" {
-		subject.Attach(auditfile.New(cfg.AuditFile))
+		w := newAuditFileWriter(cfg, logger)
+		attach("file", w)
+		reader = w.Reader()
+		stopHUP := onSIGHUP(func() {
+			if err := w.Reopen(); err != nil {
+				logger.Warn("audit file reopen failed", zap.Error(err))
+			}
+		})
+		closers = append(closers, func() {
+			stopHUP()
+			if err := w.Close(); err != nil {
+				logger.Warn("audit file close failed", zap.Error(err))
+			}
+		})
 	}
 	if cfg.AuditURL != "" {
-		client, err := auditremote.New(cfg.AuditURL, nil)
-		if err != nil {
-			logger.Fatal("invalid audit url", zap.Error(err))
+		d := newAuditDeliverer(cfg, logger)
+		attach("remote", d)
+		expvar.Publish("audit_remote", expvar.Func(func() any { return d.Stats() }))
+		closers = append(closers, func() {
+			if err := d.Close(); err != nil {
+				logger.Warn("audit delivery close failed", zap.Error(err))
+			}
+		})
+	}
+	if cfg.AuditSyslog != "" {
+		sw := newAuditSyslogWriter(cfg, logger)
+		attach("syslog", sw)
+		closers = append(closers, func() {
+			if err := sw.Close(); err != nil {
+				logger.Warn("audit syslog close failed", zap.Error(err))
+			}
+		})
+	}
+	if useDB {
+		store := auditpg.New(db)
+		attach("db", store)
+		reader = store
+	}
+	expvar.Publish("audit_queues", expvar.Func(func() any {
+		stats := make(map[string]audit.QueueStats, len(queues))
+		for name, q := range queues {
+			stats[name] = q.Stats()
+		}
+		return stats
+	}))
+	expvar.Publish("audit_routes_filtered", expvar.Func(func() any {
+		filtered := make(map[string]int64, len(routers))
+		for name, rt := range routers {
+			filtered[name] = rt.Filtered()
+		}
+		return filtered
+	}))
+
+	stopReload := func() {}
+	if cfg.AuditRoutes != "" {
+		warnUnknownRoutes(routes, routers, logger)
+		stopReload = onSIGHUP(func() { reloadAuditRoutes(cfg.AuditRoutes, routers, logger) })
+	}
+
+	return subject, reader, func() {
+		stopReload()
+		subject.Close()
+		// Drain the queues before closing the sinks they feed.
+		for _, q := range queues {
+			_ = q.Close()
+		}
+		for _, c := range closers {
+			c()
+		}
+	}
+}
+
+func newAuditQueue(opts config.AuditQueueConfig, name string, sink audit.Observer) (*audit.Queue, error) {
+	policy, err := audit.ParseOverflowPolicy(opts.Policy)
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewQueue(name, sink, audit.QueueConfig{
+		Policy:       policy,
+		SpillDir:     opts.SpillDir,
+		Size:         opts.Size,
+		BlockTimeout: opts.Timeout,
+	})
+}
+
+func newAuditFileWriter(cfg config.ServerConfig, logger *zap.Logger) *auditfile.Writer {
+	opts := cfg.AuditFileOptions
+	policy, err := auditfile.ParseSyncPolicy(opts.Fsync)
+	if err != nil {
+		logger.Warn("invalid audit fsync policy, using flush", zap.Error(err))
+	}
+	return auditfile.New(cfg.AuditFile,
+		auditfile.WithFlushInterval(opts.FlushInterval),
+		auditfile.WithSyncPolicy(policy),
+		auditfile.WithMaxSize(opts.MaxSize),
+		auditfile.WithRotateInterval(opts.RotateInterval),
+		auditfile.WithMaxBackups(opts.MaxBackups),
+		auditfile.WithMaxAge(opts.MaxAge),
+		auditfile.WithHMACKey([]byte(opts.HMACKey)),
+		auditfile.WithCheckpointInterval(opts.CheckpointInterval),
+	)
+}
+
+func newAuditDeliverer(cfg config.ServerConfig, logger *zap.Logger) *auditremote.Deliverer {
+	client, err := auditremote.New(cfg.AuditURL, nil)
+	if err != nil {
+		logger.Fatal("invalid audit url", zap.Error(err))
+	}
+	opts := cfg.AuditRemoteOptions
+	d, err := auditremote.NewDeliverer(client,
+		auditremote.WithBatchSize(opts.BatchSize),
+		auditremote.WithBatchInterval(opts.BatchInterval),
+		auditremote.WithSpool(opts.SpoolDir, opts.SpoolMaxSize),
+		auditremote.WithErrorHandler(func(err error) {
+			logger.Warn("audit delivery", zap.Error(err))
+		}),
+	)
+	if err != nil {
+		logger.Fatal("audit delivery init failed", zap.Error(err))
+	}
+	return d
+}
+
+func newAuditSyslogWriter(cfg config.ServerConfig, logger *zap.Logger) *auditsyslog.Writer {
+	opts := cfg.AuditSyslogOptions
+	facility, err := auditsyslog.ParseFacility(opts.Facility)
+	if err != nil {
+		logger.Fatal("invalid audit syslog facility", zap.Error(err))
+	}
+	params, err := auditsyslog.ParseStructuredData(opts.SDParams)
+	if err != nil {
+		logger.Fatal("invalid audit syslog structured data", zap.Error(err))
+	}
+	w, err := auditsyslog.New(cfg.AuditSyslog,
+		auditsyslog.WithFacility(facility),
+		auditsyslog.WithAppName(opts.AppName),
+		auditsyslog.WithStructuredData(opts.SDID, params),
+	)
+	if err != nil {
+		logger.Fatal("invalid audit syslog address", zap.Error(err))
+	}
+	return w
+}
+
+// reloadAuditRoutes re-reads the routes file and swaps the rules of every sink.
+// A broken file is logged and the current rules stay in place.
+func reloadAuditRoutes(path string, routers map[string]*audit.Router, logger *zap.Logger) {
+	routes, err := audit.LoadRoutes(path)
+	if err != nil {
+		logger.Warn("audit routes reload failed", zap.Error(err))
+		return
+	}
+	for name, rt := range routers {
+		if err := rt.SetRules(routes[name]); err != nil {
+			logger.Warn("audit routes reload failed", zap.String("sink", name), zap.Error(err))
 		}
-		subject.Attach(client)
 	}
-	return subject
+	warnUnknownRoutes(routes, routers, logger)
+	logger.Info("audit routes reloaded", zap.String("path", path))
+}
+
+func warnUnknownRoutes(routes audit.Routes, routers map[string]*audit.Router, logger *zap.Logger) {
+	for name := range routes {
+		if _, ok := routers[name]; !ok {
+			logger.Warn("audit routes reference an unconfigured sink", zap.String("sink", name))
+		}
+	}
+}
+
+// onSIGHUP runs fn whenever the process receives SIGHUP, e.g. to reopen the audit file
+// after an external logrotate or to reload audit routes.
+func onSIGHUP(fn func()) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range hup {
+			fn()
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(hup)
+		<-done
+	}
 }
 
 func printBuildInfo() {
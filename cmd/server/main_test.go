@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
 )
 
 func TestBuildVariablesExist(t *testing.T) {
@@ -9,3 +17,113 @@ func TestBuildVariablesExist(t *testing.T) {
 	_ = buildDate
 	_ = buildCommit
 }
+
+type blockingPersister struct {
+	release chan struct{}
+	mu      sync.Mutex
+	saves   int
+	aborted bool
+}
+
+func (p *blockingPersister) Save(ctx context.Context, _ domain.Snapshot) error {
+	p.mu.Lock()
+	p.saves++
+	first := p.saves == 1
+	p.mu.Unlock()
+	if first {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.aborted = true
+			p.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *blockingPersister) waitStarted() {
+	for {
+		p.mu.Lock()
+		started := p.saves > 0
+		p.mu.Unlock()
+		if started {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *blockingPersister) Restore(context.Context, ports.MetricsRepo) error { return nil }
+
+func TestPersistOnChange_CoalescesConcurrentSaves(t *testing.T) {
+	p := &blockingPersister{release: make(chan struct{})}
+	obs := persistOnChange(memory.New(), p)
+	ctx := context.Background()
+
+	first := make(chan error, 1)
+	go func() { first <- obs.Notify(ctx, domain.MetricsChanged{}) }()
+	p.waitStarted()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- obs.Notify(ctx, domain.MetricsChanged{})
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(p.release)
+	wg.Wait()
+	close(errs)
+
+	if err := <-first; err != nil {
+		t.Fatalf("first save: %v", err)
+	}
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("coalesced save: %v", err)
+		}
+	}
+	// The burst shares the round queued behind the blocked save; a straggler may need one more.
+	if p.saves < 2 || p.saves > 3 {
+		t.Fatalf("want the burst coalesced into one or two saves, got %d saves in total", p.saves)
+	}
+}
+
+func TestPersistOnChange_CallerCancelDoesNotAbortSave(t *testing.T) {
+	p := &blockingPersister{release: make(chan struct{})}
+	obs := persistOnChange(memory.New(), p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- obs.Notify(ctx, domain.MetricsChanged{}) }()
+	p.waitStarted()
+
+	second := make(chan error, 1)
+	go func() { second <- obs.Notify(context.Background(), domain.MetricsChanged{}) }()
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled caller: want context.Canceled, got %v", err)
+	}
+
+	close(p.release)
+	if err := <-second; err != nil {
+		t.Fatalf("save after the first caller left: %v", err)
+	}
+	if p.aborted {
+		t.Fatal("the shared save was cancelled along with the caller that started it")
+	}
+}
+
+func TestPersistOnChange_SaveTimesOut(t *testing.T) {
+	p := &blockingPersister{release: make(chan struct{})}
+	s := &coalescedSaver{repo: memory.New(), persister: p, timeout: 20 * time.Millisecond}
+
+	if err := s.save(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the save bounded by its own timeout, got %v", err)
+	}
+}
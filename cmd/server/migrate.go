@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	pgrepo "github.com/vshulcz/Golectra/internal/adapters/repository/postgres"
+	"github.com/vshulcz/Golectra/internal/config"
+)
+
+const migrateUsage = "migrate: want one of up, down, status, version"
+
+// runMigrate implements "server migrate up|down|status|version": it applies, rolls back
+// and reports the schema migrations embedded in this build.
+func runMigrate(args []string, out io.Writer) (retErr error) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dsnFlag := fs.String("d", "", "DATABASE_DSN for Postgres")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(migrateUsage)
+	}
+	cmd := fs.Arg(0)
+	// Flags may also follow the command: "server migrate up -d ...".
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("migrate: unexpected arguments %q", fs.Args())
+	}
+	switch cmd {
+	case "up", "down", "status", "version":
+	default:
+		return fmt.Errorf("%s, got %q", migrateUsage, cmd)
+	}
+
+	dsn := config.FromEnvOrFlag("DATABASE_DSN", *dsnFlag, "")
+	if dsn == "" {
+		return errors.New("migrate: DATABASE_DSN is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("migrate: open postgres: %w", err)
+	}
+	defer func() {
+		if cerr := db.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("migrate: close postgres: %w", cerr)
+		}
+	}()
+	m, err := pgrepo.NewMigrator(db)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	ctx := context.Background()
+	switch cmd {
+	case "up":
+		err = migrateUp(ctx, m, out)
+	case "down":
+		err = migrateDown(ctx, m, out)
+	case "status":
+		err = migrateStatus(ctx, m, out)
+	default:
+		err = migrateVersion(ctx, m, out)
+	}
+	if err != nil {
+		return fmt.Errorf("migrate %s: %w", cmd, err)
+	}
+	return nil
+}
+
+func migrateUp(ctx context.Context, m *pgrepo.Migrator, out io.Writer) error {
+	applied, err := m.Up(ctx)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintln(out, "no pending migrations")
+	}
+	for _, v := range applied {
+		fmt.Fprintf(out, "applied %d\n", v)
+	}
+	return migrateVersion(ctx, m, out)
+}
+
+func migrateDown(ctx context.Context, m *pgrepo.Migrator, out io.Writer) error {
+	v, err := m.Down(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "rolled back %d\n", v)
+	return migrateVersion(ctx, m, out)
+}
+
+func migrateStatus(ctx context.Context, m *pgrepo.Migrator, out io.Writer) error {
+	if err := migrateVersion(ctx, m, out); err != nil {
+		return err
+	}
+	list, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED AT\tNAME")
+	for _, s := range list {
+		state, at := "pending", "-"
+		if s.Applied {
+			state, at = "applied", s.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, state, at, s.Name)
+	}
+	return tw.Flush()
+}
+
+func migrateVersion(ctx context.Context, m *pgrepo.Migrator, out io.Writer) error {
+	current, latest, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version %d, this build knows up to %d", current, latest)
+	switch {
+	case current > latest:
+		fmt.Fprint(out, " (newer than this build, the server will refuse to start)")
+	case current < latest:
+		fmt.Fprint(out, " (migrations pending)")
+	}
+	fmt.Fprintln(out)
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/persistence/file"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/embedded"
+	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	pgrepo "github.com/vshulcz/Golectra/internal/adapters/repository/postgres"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/internal/services/migrate"
+)
+
+// snapshotFetchTimeout bounds the request to a running server's snapshot API.
+const snapshotFetchTimeout = 30 * time.Second
+
+// runMigrateData implements "server migrate-data": it copies every metric from one storage
+// backend to another, then reads the target back and checks it against the source.
+func runMigrateData(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate-data", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fromFlag := fs.String("from", "", "source: snapshot file (PATH or file:PATH), embedded:DIR, postgres:// or postgres:key=value DSN, or http(s):// server URL")
+	toFlag := fs.String("to", "", "target: snapshot file (PATH or file:PATH), embedded:DIR, or postgres:// or postgres:key=value DSN")
+	countersFlag := fs.String("counters", string(migrate.CountersOverwrite), "how source counters are written: overwrite or add")
+	dryRun := fs.Bool("dry-run", false, "print the changes without writing them")
+	batchSize := fs.Int("batch-size", 1000, "metrics written per batch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fromFlag == "" || *toFlag == "" {
+		return errors.New("migrate-data: -from and -to are required")
+	}
+	mode, err := migrate.ParseCounterMode(*countersFlag)
+	if err != nil {
+		return fmt.Errorf("migrate-data: %w", err)
+	}
+
+	ctx := context.Background()
+	src, err := openEndpoint(ctx, *fromFlag, false, *dryRun)
+	if err != nil {
+		return fmt.Errorf("migrate-data: source: %w", err)
+	}
+	defer src.close()
+	dst, err := openEndpoint(ctx, *toFlag, true, *dryRun)
+	if err != nil {
+		return fmt.Errorf("migrate-data: target: %w", err)
+	}
+	defer dst.close()
+
+	srcSnap, err := src.snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate-data: read source: %w", err)
+	}
+	before, err := dst.snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate-data: read target: %w", err)
+	}
+	plan := migrate.NewPlan(srcSnap, before, mode)
+	fmt.Fprintf(out, "source: %s (%d gauges, %d counters)\n", src.name, len(srcSnap.Gauges), len(srcSnap.Counters))
+	fmt.Fprintf(out, "target: %s (%d gauges, %d counters)\n", dst.name, len(before.Gauges), len(before.Counters))
+	printSummary(out, "gauges", plan.Gauges)
+	printSummary(out, "counters", plan.Counters)
+	fmt.Fprintf(out, "counter mode: %s\n", mode)
+
+	if *dryRun {
+		for _, ch := range plan.Changes {
+			printChange(out, ch)
+		}
+		fmt.Fprintln(out, "dry run: nothing written")
+		return nil
+	}
+
+	batches, err := plan.Apply(ctx, dst.repo, *batchSize)
+	if err != nil {
+		return fmt.Errorf("migrate-data: %w", err)
+	}
+	if err := dst.commit(ctx); err != nil {
+		return fmt.Errorf("migrate-data: %w", err)
+	}
+	fmt.Fprintf(out, "wrote %d metrics in %d batches\n", len(plan.Items), batches)
+
+	after, err := dst.snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate-data: read target back: %w", err)
+	}
+	if err := plan.Verify(after); err != nil {
+		return fmt.Errorf("migrate-data: verify: %w", err)
+	}
+	fmt.Fprintln(out, "OK: target matches source")
+	return nil
+}
+
+func printSummary(out io.Writer, kind string, s migrate.Summary) {
+	fmt.Fprintf(out, "%s: %d new, %d changed, %d unchanged\n", kind, s.New, s.Changed, s.Unchanged)
+}
+
+func printChange(out io.Writer, ch migrate.Change) {
+	if ch.Old == nil {
+		fmt.Fprintf(out, "  + %s %s %s\n", ch.New.MType, ch.New.ID, metricValue(ch.New))
+		return
+	}
+	fmt.Fprintf(out, "  ~ %s %s %s -> %s\n", ch.New.MType, ch.New.ID, metricValue(*ch.Old), metricValue(ch.New))
+}
+
+func metricValue(m domain.Metrics) string {
+	if m.Value != nil {
+		return fmt.Sprint(*m.Value)
+	}
+	if m.Delta != nil {
+		return fmt.Sprint(*m.Delta)
+	}
+	return "-"
+}
+
+// endpoint is one side of a data migration.
+type endpoint struct {
+	// repo receives the writes; it is nil for read-only sources.
+	repo ports.MetricsRepo
+	// snapshot reads the stored state; for snapshot files it rereads the file.
+	snapshot func(context.Context) (domain.Snapshot, error)
+	// commit persists the writes made to repo.
+	commit func(context.Context) error
+	close  func()
+	name   string
+}
+
+// openEndpoint opens a source or target. A dry run writes nothing: Postgres is not migrated
+// and a target that does not exist yet reads as empty instead of being created. Embedded
+// stores are only opened for writing as a real target; otherwise they are read in place.
+func openEndpoint(ctx context.Context, spec string, target, dryRun bool) (endpoint, error) {
+	noop := func(context.Context) error { return nil }
+	if dsn, ok := postgresDSN(spec); ok {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return endpoint{}, fmt.Errorf("open postgres: %w", err)
+		}
+		if target && !dryRun {
+			if err := pgrepo.Migrate(db); err != nil {
+				_ = db.Close()
+				return endpoint{}, fmt.Errorf("migrate postgres: %w", err)
+			}
+		}
+		repo := pgrepo.New(db)
+		return endpoint{
+			repo:     repo,
+			snapshot: repo.Snapshot,
+			commit:   noop,
+			close:    func() { _ = db.Close() },
+			name:     redactDSN(dsn),
+		}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		if target {
+			return endpoint{}, errors.New("a server URL can only be a source")
+		}
+		return endpoint{
+			snapshot: func(ctx context.Context) (domain.Snapshot, error) { return fetchSnapshot(ctx, spec) },
+			commit:   noop,
+			close:    func() {},
+			name:     spec,
+		}, nil
+
+	case strings.HasPrefix(spec, "embedded:"):
+		dir := strings.TrimPrefix(spec, "embedded:")
+		if _, err := os.Stat(dir); err != nil {
+			if !errors.Is(err, os.ErrNotExist) || !target {
+				return endpoint{}, fmt.Errorf("embedded storage: %w", err)
+			}
+			if dryRun {
+				return emptyEndpoint(spec), nil
+			}
+		}
+		if !target || dryRun {
+			snap, err := embedded.ReadSnapshot(ctx, dir)
+			if err != nil {
+				return endpoint{}, err
+			}
+			return snapshotEndpoint(spec, snap)
+		}
+		repo, err := embedded.Open(ctx, dir)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return endpoint{
+			repo:     repo,
+			snapshot: repo.Snapshot,
+			commit:   noop,
+			close:    func() { _ = repo.Close() },
+			name:     spec,
+		}, nil
+	}
+
+	path := strings.TrimPrefix(spec, "file:")
+	if !target {
+		if _, err := os.Stat(path); err != nil {
+			return endpoint{}, fmt.Errorf("snapshot file: %w", err)
+		}
+	}
+	p := file.New(path)
+	read := func(ctx context.Context) (domain.Snapshot, error) {
+		repo := memrepo.New()
+		if err := p.Restore(ctx, repo); err != nil {
+			return domain.Snapshot{}, err
+		}
+		return repo.Snapshot(ctx)
+	}
+	snap, err := read(ctx)
+	if err != nil {
+		return endpoint{}, err
+	}
+	repo := memrepo.New()
+	if _, err := repo.UpdateMany(ctx, snap.Items()); err != nil {
+		return endpoint{}, err
+	}
+	return endpoint{
+		repo:     repo,
+		snapshot: read,
+		commit: func(ctx context.Context) error {
+			s, err := repo.Snapshot(ctx)
+			if err != nil {
+				return err
+			}
+			return p.Save(ctx, s)
+		},
+		close: func() {},
+		name:  "file:" + path,
+	}, nil
+}
+
+// snapshotEndpoint serves snap from memory; writes to it are discarded.
+func snapshotEndpoint(name string, snap domain.Snapshot) (endpoint, error) {
+	repo := memrepo.New()
+	if _, err := repo.UpdateMany(context.Background(), snap.Items()); err != nil {
+		return endpoint{}, err
+	}
+	return endpoint{
+		repo:     repo,
+		snapshot: func(context.Context) (domain.Snapshot, error) { return snap, nil },
+		commit:   func(context.Context) error { return nil },
+		close:    func() {},
+		name:     name,
+	}, nil
+}
+
+func emptyEndpoint(name string) endpoint {
+	repo := memrepo.New()
+	return endpoint{
+		repo:     repo,
+		snapshot: repo.Snapshot,
+		commit:   func(context.Context) error { return nil },
+		close:    func() {},
+		name:     name + " (new)",
+	}
+}
+
+// fetchSnapshot reads `GET /api/v1/snapshot` from a running server; a bare server URL
+// gets the API path appended.
+func fetchSnapshot(ctx context.Context, rawURL string) (domain.Snapshot, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return domain.Snapshot{}, fmt.Errorf("parse url: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/v1/snapshot"
+	}
+	ctx, cancel := context.WithTimeout(ctx, snapshotFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return domain.Snapshot{}, fmt.Errorf("fetch snapshot: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return domain.Snapshot{}, fmt.Errorf("fetch snapshot: %s", resp.Status)
+	}
+	var body struct {
+		Gauges   map[string]float64 `json:"gauges"`
+		Counters map[string]int64   `json:"counters"`
+		Revision int64              `json:"revision"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return domain.Snapshot{}, fmt.Errorf("decode snapshot: %w", err)
+	}
+	return domain.Snapshot{Gauges: body.Gauges, Counters: body.Counters, Revision: body.Revision}, nil
+}
+
+// postgresDSN recognizes a Postgres spec: a postgres:// or postgresql:// URL, or any DSN
+// after a "postgres:" prefix, including the key=value form.
+func postgresDSN(spec string) (string, bool) {
+	if strings.HasPrefix(spec, "postgres://") || strings.HasPrefix(spec, "postgresql://") {
+		return spec, true
+	}
+	if dsn, ok := strings.CutPrefix(spec, "postgres:"); ok && dsn != "" {
+		return dsn, true
+	}
+	return "", false
+}
+
+// redactDSN hides the password of a URL or key=value DSN.
+func redactDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		fields := strings.Fields(dsn)
+		for i, f := range fields {
+			if k, _, ok := strings.Cut(f, "="); ok && k == "password" {
+				fields[i] = "password=xxxxx"
+			}
+		}
+		return "postgres:" + strings.Join(fields, " ")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "postgres"
+	}
+	return u.Redacted()
+}
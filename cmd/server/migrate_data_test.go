@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vshulcz/Golectra/internal/adapters/persistence/file"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/embedded"
+	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+func writeSnapshotFile(t *testing.T, path string, items ...domain.Metrics) {
+	t.Helper()
+	ctx := context.Background()
+	repo := memrepo.New()
+	if _, err := repo.UpdateMany(ctx, items); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	snap, _ := repo.Snapshot(ctx)
+	if err := file.New(path).Save(ctx, snap); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+}
+
+func TestMigrateData_ServerToEmbedded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/snapshot" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"revision":7,"gauges":{"Alloc":1.5,"Heap":2},"counters":{"PollCount":42}}`))
+	}))
+	defer srv.Close()
+	dir := filepath.Join(t.TempDir(), "data")
+	args := []string{"-from", srv.URL, "-to", "embedded:" + dir}
+
+	var out bytes.Buffer
+	if err := runMigrateData(append(args, "-dry-run"), &out); err != nil {
+		t.Fatalf("dry run: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"gauges: 2 new", "counters: 1 new", "+ gauge Alloc 1.5", "+ counter PollCount 42", "dry run: nothing written"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("dry run output misses %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runMigrateData(append(args, "-batch-size", "2"), &out); err != nil {
+		t.Fatalf("migrate: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "wrote 3 metrics in 2 batches") || !strings.Contains(out.String(), "OK: target matches source") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+
+	// A second run finds nothing to do.
+	out.Reset()
+	if err := runMigrateData(args, &out); err != nil {
+		t.Fatalf("rerun: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "gauges: 0 new, 0 changed, 2 unchanged") || !strings.Contains(out.String(), "wrote 0 metrics") {
+		t.Fatalf("unexpected rerun output:\n%s", out.String())
+	}
+
+	repo, err := embedded.Open(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("open target: %v", err)
+	}
+	defer func() { _ = repo.Close() }()
+	repotest.ExpectState(t, repo, map[string]float64{"Alloc": 1.5, "Heap": 2}, map[string]int64{"PollCount": 42})
+}
+
+func TestMigrateData_FileCounterModes(t *testing.T) {
+	tests := []struct {
+		mode      string
+		wantCount int64
+	}{
+		{"overwrite", 10},
+		{"add", 13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src.json"), filepath.Join(dir, "dst.json")
+			writeSnapshotFile(t, src, repotest.Gauge("Alloc", 1), repotest.Counter("PollCount", 10))
+			writeSnapshotFile(t, dst, repotest.Gauge("Alloc", 5), repotest.Counter("PollCount", 3), repotest.Gauge("Other", 9))
+
+			var out bytes.Buffer
+			if err := runMigrateData([]string{"-from", src, "-to", "file:" + dst, "-counters", tt.mode}, &out); err != nil {
+				t.Fatalf("migrate: %v\n%s", err, out.String())
+			}
+			got := memrepo.New()
+			if err := file.New(dst).Restore(context.Background(), got); err != nil {
+				t.Fatalf("restore target: %v", err)
+			}
+			repotest.ExpectState(t, got, map[string]float64{"Alloc": 1, "Other": 9}, map[string]int64{"PollCount": tt.wantCount})
+		})
+	}
+}
+
+func TestMigrateData_Errors(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.json")
+	writeSnapshotFile(t, src, repotest.Gauge("Alloc", 1))
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"missing target", []string{"-from", src}, "-from and -to are required"},
+		{"bad counter mode", []string{"-from", src, "-to", filepath.Join(dir, "dst.json"), "-counters", "merge"}, "unknown counter mode"},
+		{"missing source file", []string{"-from", filepath.Join(dir, "nope.json"), "-to", filepath.Join(dir, "dst.json")}, "source"},
+		{"missing embedded source", []string{"-from", "embedded:" + filepath.Join(dir, "nope"), "-to", filepath.Join(dir, "dst.json")}, "source"},
+		{"server target", []string{"-from", src, "-to", "http://localhost:1"}, "only be a source"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runMigrateData(tt.args, &out)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("want error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestMigrateData_EmbeddedSourceIsReadOnly(t *testing.T) {
+	ctx := context.Background()
+	src := filepath.Join(t.TempDir(), "src")
+	repo, err := embedded.Open(ctx, src)
+	if err != nil {
+		t.Fatalf("open source: %v", err)
+	}
+	if _, err := repo.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("Alloc", 1), repotest.Counter("PollCount", 5)}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if _, err := repo.AddCounter(ctx, "PollCount", 2); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("close source: %v", err)
+	}
+	// Tear the last record, as a crash of the server that owns the store would.
+	logs, _ := filepath.Glob(filepath.Join(src, "wal-*.log"))
+	info, err := os.Stat(logs[len(logs)-1])
+	if err != nil {
+		t.Fatalf("stat log: %v", err)
+	}
+	if err := os.Truncate(logs[len(logs)-1], info.Size()-5); err != nil {
+		t.Fatalf("truncate log: %v", err)
+	}
+	listing := func(dir string) string {
+		entries, _ := os.ReadDir(dir)
+		var b strings.Builder
+		for _, e := range entries {
+			info, _ := e.Info()
+			fmt.Fprintf(&b, "%s:%d ", e.Name(), info.Size())
+		}
+		return b.String()
+	}
+	before := listing(src)
+
+	dst := filepath.Join(t.TempDir(), "dst.json")
+	var out bytes.Buffer
+	if err := runMigrateData([]string{"-from", "embedded:" + src, "-to", dst}, &out); err != nil {
+		t.Fatalf("migrate: %v\n%s", err, out.String())
+	}
+	got := memrepo.New()
+	if err := file.New(dst).Restore(ctx, got); err != nil {
+		t.Fatalf("restore target: %v", err)
+	}
+	repotest.ExpectState(t, got, map[string]float64{"Alloc": 1}, map[string]int64{"PollCount": 5})
+
+	// An existing embedded target is only read under -dry-run as well.
+	if err := runMigrateData([]string{"-from", dst, "-to", "embedded:" + src, "-dry-run"}, &out); err != nil {
+		t.Fatalf("dry run: %v\n%s", err, out.String())
+	}
+	if after := listing(src); after != before {
+		t.Fatalf("embedded store changed: %s -> %s", before, after)
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	tests := []struct {
+		spec, dsn, name string
+		ok              bool
+	}{
+		{"postgres://u:secret@db:5432/m", "postgres://u:secret@db:5432/m", "postgres://u:xxxxx@db:5432/m", true},
+		{"postgresql://db/m", "postgresql://db/m", "postgresql://db/m", true},
+		{"postgres:host=db dbname=m password=secret", "host=db dbname=m password=secret", "postgres:host=db dbname=m password=xxxxx", true},
+		{"postgres:", "", "", false},
+		{"metrics.json", "", "", false},
+	}
+	for _, tt := range tests {
+		dsn, ok := postgresDSN(tt.spec)
+		if dsn != tt.dsn || ok != tt.ok {
+			t.Fatalf("%q: got %q, %v", tt.spec, dsn, ok)
+		}
+		if ok && redactDSN(dsn) != tt.name {
+			t.Fatalf("%q: redacted to %q, want %q", tt.spec, redactDSN(dsn), tt.name)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMigrate_Usage(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no command", nil, "want one of up, down, status, version"},
+		{"unknown command", []string{"sideways"}, `got "sideways"`},
+		{"extra arguments", []string{"up", "now"}, "unexpected arguments"},
+		{"no dsn", []string{"status"}, "DATABASE_DSN is required"},
+		{"no dsn after flags", []string{"version", "-d", ""}, "DATABASE_DSN is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runMigrate(tt.args, &out)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("want error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
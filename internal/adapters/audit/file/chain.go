@@ -0,0 +1,279 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+// genesisMAC is the prev link of the very first record in a chain.
+var genesisMAC = strings.Repeat("0", sha256.Size*2)
+
+// macSuffixPrefix starts the MAC field that closes every chained record.
+var macSuffixPrefix = []byte(`,"mac":"`)
+
+// chainedRecord is an audit event with its position in the hash chain.
+// The MAC is appended as the last field over the exact bytes of this JSON object.
+type chainedRecord struct {
+	audit.Event
+	Prev string `json:"prev"`
+	Seq  uint64 `json:"seq"`
+}
+
+// Checkpoint is a signed statement that the chain reached Seq with head MAC at time TS.
+// Prev is the signature of the previous checkpoint, so checkpoints form a chain of their own
+// and Verify can tell when checkpoint lines were removed together with the records they cover.
+type Checkpoint struct {
+	MAC  string `json:"mac"`
+	Prev string `json:"prev"`
+	Sig  string `json:"sig"`
+	TS   int64  `json:"ts"`
+	Seq  uint64 `json:"seq"`
+}
+
+// chain holds the HMAC key and the head of the chain for a Writer.
+type chain struct {
+	lastCheckpoint time.Time
+	key            []byte
+	prev           string
+	prevCheckpoint string
+	seq            uint64
+	checkpointSeq  uint64
+	recovered      bool
+}
+
+// seal assigns the next sequence number, links evt to the previous record and returns the line to write.
+func (c *chain) seal(evt audit.Event) ([]byte, error) {
+	rec := chainedRecord{Event: evt, Prev: c.prev, Seq: c.seq + 1}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("marshal audit event: %w", err)
+	}
+	mac := recordMAC(c.key, body)
+	line := make([]byte, 0, len(body)+len(macSuffixPrefix)+len(mac)+3)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, macSuffixPrefix...)
+	line = append(line, mac...)
+	line = append(line, '"', '}', '\n')
+	c.seq = rec.Seq
+	c.prev = mac
+	return line, nil
+}
+
+func (c *chain) checkpoint(now time.Time) Checkpoint {
+	cp := Checkpoint{MAC: c.prev, Prev: c.prevCheckpoint, TS: now.Unix(), Seq: c.seq}
+	cp.Sig = checkpointSig(c.key, cp)
+	c.prevCheckpoint = cp.Sig
+	c.checkpointSeq = c.seq
+	c.lastCheckpoint = now
+	return cp
+}
+
+func recordMAC(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func checkpointSig(key []byte, cp Checkpoint) string {
+	msg := "checkpoint|" + strconv.FormatUint(cp.Seq, 10) + "|" + strconv.FormatInt(cp.TS, 10) + "|" + cp.MAC + "|" + cp.Prev
+	return recordMAC(key, []byte(msg))
+}
+
+// splitRecord separates a chained line into the signed body and its MAC.
+func splitRecord(line []byte) (body []byte, mac string, ok bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	i := bytes.LastIndex(line, macSuffixPrefix)
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+	mac = string(line[i+len(macSuffixPrefix) : len(line)-2])
+	if len(mac) != sha256.Size*2 {
+		return nil, "", false
+	}
+	body = make([]byte, 0, i+1)
+	body = append(body, line[:i]...)
+	body = append(body, '}')
+	return body, mac, true
+}
+
+// checkpointPath is the sidecar file that collects signed checkpoints for path.
+// A rotated segment keeps its sidecar under the uncompressed backup name.
+func checkpointPath(path string) string {
+	return strings.TrimSuffix(path, ".gz") + ".chk"
+}
+
+func appendCheckpoint(path string, cp Checkpoint, sync bool) (retErr error) {
+	payload, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("marshal audit checkpoint: %w", err)
+	}
+	f, err := os.OpenFile(checkpointPath(path), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit checkpoints: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit checkpoints: %w", cerr)
+		}
+	}()
+	if _, err := f.Write(append(payload, '\n')); err != nil {
+		return fmt.Errorf("write audit checkpoint: %w", err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("sync audit checkpoints: %w", err)
+		}
+	}
+	return nil
+}
+
+// recoverChain restores the chain head from the newest record on disk so a restarted
+// writer keeps extending the same chain.
+func (c *chain) recover(path string) error {
+	c.recovered = true
+	c.prev = genesisMAC
+	c.prevCheckpoint = genesisMAC
+	names, err := segmentNames(path)
+	if err != nil {
+		return err
+	}
+	// The active sidecar is the newest one; it may even outlive its log when a crash hit
+	// between the two renames of a rotation.
+	sidecars := []string{checkpointPath(path)}
+	for i := len(names) - 1; i >= 0; i-- {
+		sidecars = append(sidecars, checkpointPath(names[i]))
+	}
+	for _, name := range sidecars {
+		sig, found, err := lastCheckpointSig(name)
+		if err != nil {
+			return err
+		}
+		if found {
+			c.prevCheckpoint = sig
+			break
+		}
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		seq, mac, found, err := lastLink(names[i])
+		if err != nil {
+			return err
+		}
+		if found {
+			c.seq, c.prev, c.checkpointSeq = seq, mac, seq
+			return nil
+		}
+	}
+	return nil
+}
+
+// lastCheckpointSig returns the signature of the newest checkpoint in a sidecar file.
+func lastCheckpointSig(name string) (sig string, found bool, retErr error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("open audit checkpoints: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit checkpoints: %w", cerr)
+		}
+	}()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var cp Checkpoint
+		if json.Unmarshal(sc.Bytes(), &cp) == nil && cp.Sig != "" {
+			sig, found = cp.Sig, true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", false, fmt.Errorf("read audit checkpoints: %w", err)
+	}
+	return sig, found, nil
+}
+
+// truncateTornTail cuts a last line that lacks its newline, which is what a crash in the
+// middle of a write leaves behind, so the next record does not get glued onto it.
+func truncateTornTail(path string) (retErr error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit file: %w", cerr)
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat audit file: %w", err)
+	}
+
+	size := info.Size()
+	buf := make([]byte, 64<<10)
+	keep := int64(0)
+	for end := size; end > 0; {
+		n := min(int64(len(buf)), end)
+		off := end - n
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return fmt.Errorf("read audit file: %w", err)
+		}
+		if end == size && buf[n-1] == '\n' {
+			return nil
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			keep = off + int64(i) + 1
+			break
+		}
+		end = off
+	}
+	if err := f.Truncate(keep); err != nil {
+		return fmt.Errorf("truncate torn audit record: %w", err)
+	}
+	return nil
+}
+
+func lastLink(name string) (seq uint64, mac string, found bool, retErr error) {
+	rd, closeFn, err := openSegment(name, 0)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer func() {
+		if cerr := closeFn(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit file: %w", cerr)
+		}
+	}()
+	lr := &lineReader{br: bufio.NewReaderSize(rd, 64<<10)}
+	for {
+		line, _, err := lr.next()
+		if err != nil {
+			return seq, mac, found, nil
+		}
+		body, m, ok := splitRecord(line)
+		if !ok {
+			continue
+		}
+		var head struct {
+			Seq uint64 `json:"seq"`
+		}
+		if json.Unmarshal(body, &head) == nil {
+			seq, mac, found = head.Seq, m, true
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package file
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("audit-secret")
+
+func writeChained(t *testing.T, path string, from, to int64, opts ...Option) {
+	t.Helper()
+	w := New(path, append([]Option{WithHMACKey(testKey), WithFlushInterval(0)}, opts...)...)
+	writeEvents(t, w, from, to)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestVerify_IntactAcrossRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	writeChained(t, path, 1, 500, WithMaxSize(8<<10))
+
+	report, err := Verify(path, testKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break != nil {
+		t.Fatalf("unexpected break: %s", report.Break)
+	}
+	if report.Records != 500 || report.FirstSeq != 1 || report.LastSeq != 500 || len(report.Files) < 3 || report.Checkpoints == 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	report, err = Verify(path, []byte("other-key"))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break == nil {
+		t.Fatal("expected a break with the wrong key")
+	}
+
+	backups, _ := filepath.Glob(path + ".*.gz")
+	sort.Strings(backups)
+	for _, b := range backups {
+		if _, err := os.Stat(checkpointPath(b)); err != nil {
+			t.Fatalf("backup %s has no checkpoint sidecar: %v", b, err)
+		}
+	}
+	if err := os.Remove(backups[0]); err != nil {
+		t.Fatalf("remove backup: %v", err)
+	}
+	report, err = Verify(path, testKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break != nil || report.FirstSeq <= 1 || report.LastSeq != 500 {
+		t.Fatalf("pruned backup should anchor the chain, got %+v (break %v)", report, report.Break)
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(lines [][]byte) [][]byte
+		reason  string
+		wantSeq uint64
+	}{
+		{
+			name: "altered record",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[4] = bytes.Replace(lines[4], []byte("10.0.0.1"), []byte("10.0.0.9"), 1)
+				return lines
+			},
+			reason:  "MAC mismatch",
+			wantSeq: 5,
+		},
+		{
+			name: "deleted record",
+			mutate: func(lines [][]byte) [][]byte {
+				return append(lines[:6], lines[7:]...)
+			},
+			reason:  "sequence gap",
+			wantSeq: 8,
+		},
+		{
+			name: "reordered records",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[9], lines[10] = lines[10], lines[9]
+				return lines
+			},
+			reason:  "sequence gap",
+			wantSeq: 11,
+		},
+		{
+			name: "unchained record",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[2] = []byte(`{"v":1,"ts":3,"metrics":["Alloc"],"ip_address":"10.0.0.1"}`)
+				return lines
+			},
+			reason:  "not chained",
+			wantSeq: 3,
+		},
+		{
+			name: "truncated tail",
+			mutate: func(lines [][]byte) [][]byte {
+				return lines[:17]
+			},
+			reason: "removed from the end",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.ndjson")
+			writeChained(t, path, 1, 20)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+			lines = tt.mutate(lines)
+			if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			report, err := Verify(path, testKey)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if report.Break == nil {
+				t.Fatalf("expected break, got %+v", report)
+			}
+			if !strings.Contains(report.Break.Reason, tt.reason) || report.Break.Seq != tt.wantSeq {
+				t.Fatalf("want %q at seq %d, got %s", tt.reason, tt.wantSeq, report.Break)
+			}
+		})
+	}
+}
+
+func TestWriter_ChainSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	writeChained(t, path, 1, 5)
+	writeChained(t, path, 6, 10)
+
+	report, err := Verify(path, testKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break != nil || report.Records != 10 || report.LastSeq != 10 {
+		t.Fatalf("chain not continued after restart: %+v (break %v)", report, report.Break)
+	}
+}
+
+func TestVerify_DetectsCheckpointTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(lines [][]byte) [][]byte
+		reason string
+	}{
+		{
+			name:   "first checkpoint removed",
+			mutate: func(lines [][]byte) [][]byte { return lines[1:] },
+			reason: "checkpoints were removed",
+		},
+		{
+			name:   "middle checkpoint removed",
+			mutate: func(lines [][]byte) [][]byte { return append(lines[:1], lines[2:]...) },
+			reason: "does not link to the previous one",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.ndjson")
+			writeChained(t, path, 1, 5)
+			writeChained(t, path, 6, 10)
+			writeChained(t, path, 11, 15)
+
+			data, err := os.ReadFile(checkpointPath(path))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+			if len(lines) < 3 {
+				t.Fatalf("expected at least 3 checkpoints, got %d", len(lines))
+			}
+			lines = tt.mutate(lines)
+			if err := os.WriteFile(checkpointPath(path), append(bytes.Join(lines, []byte("\n")), '\n'), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			report, err := Verify(path, testKey)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if report.Break == nil || !strings.Contains(report.Break.Reason, tt.reason) {
+				t.Fatalf("want %q, got %+v (break %v)", tt.reason, report, report.Break)
+			}
+		})
+	}
+}
+
+func TestWriter_PrunesCheckpointSidecars(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	writeChained(t, path, 1, 300, WithMaxSize(4<<10), WithMaxBackups(2))
+
+	backups, _ := filepath.Glob(path + ".*.gz")
+	sidecars, _ := filepath.Glob(path + ".*.chk")
+	if len(backups) != 2 || len(sidecars) != 2 {
+		t.Fatalf("want 2 backups with 2 sidecars, got %v and %v", backups, sidecars)
+	}
+	report, err := Verify(path, testKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break != nil || report.LastSeq != 300 {
+		t.Fatalf("pruned log should verify, got %+v (break %v)", report, report.Break)
+	}
+}
+
+func TestWriter_TruncatesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	writeChained(t, path, 1, 5)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := f.WriteString(`{"v":3,"ts":6,"metr`); err != nil {
+		t.Fatalf("write torn record: %v", err)
+	}
+	_ = f.Close()
+
+	writeChained(t, path, 6, 10)
+	report, err := Verify(path, testKey)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Break != nil || report.Records != 10 || report.LastSeq != 10 {
+		t.Fatalf("torn tail not cut on open: %+v (break %v)", report, report.Break)
+	}
+}
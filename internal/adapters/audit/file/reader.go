@@ -0,0 +1,381 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+// indexBlockLines is how many events share one entry of the time index.
+const indexBlockLines = 256
+
+var _ audit.Reader = (*Reader)(nil)
+
+// block is a run of consecutive lines with the time range they cover.
+type block struct {
+	offset int64
+	end    int64
+	minTS  int64
+	maxTS  int64
+}
+
+// segmentIndex is the time index of one audit file (the live file or a rotated backup).
+// Segments are identified by a fingerprint of their first line, which survives rotation
+// and compression, so cursors stay valid after the live file becomes a backup.
+type segmentIndex struct {
+	modTime time.Time
+	key     string
+	blocks  []block
+	size    int64
+}
+
+func (s *segmentIndex) overlaps(q audit.Query) bool {
+	if len(s.blocks) == 0 {
+		return false
+	}
+	minTS, maxTS := s.blocks[0].minTS, s.blocks[0].maxTS
+	for _, b := range s.blocks[1:] {
+		minTS = min(minTS, b.minTS)
+		maxTS = max(maxTS, b.maxTS)
+	}
+	return blockOverlaps(minTS, maxTS, q)
+}
+
+func blockOverlaps(minTS, maxTS int64, q audit.Query) bool {
+	if q.From > 0 && maxTS < q.From {
+		return false
+	}
+	return q.To <= 0 || minTS <= q.To
+}
+
+// Reader queries events recorded by a Writer, including rotated and gzipped backups.
+// It keeps a sparse per-file time index so time-bounded queries skip unrelated blocks.
+type Reader struct {
+	flush    func() error
+	segments map[string]*segmentIndex
+	path     string
+	mu       sync.Mutex
+}
+
+// NewReader returns a Reader for the audit file at path and its backups.
+func NewReader(path string) *Reader {
+	return &Reader{path: path, segments: make(map[string]*segmentIndex)}
+}
+
+// Reader returns a Reader over this writer's file that flushes buffered events before each query.
+func (w *Writer) Reader() *Reader {
+	r := NewReader(w.path)
+	r.flush = w.Flush
+	return r
+}
+
+// Query returns matching events in recording order, oldest first.
+func (r *Reader) Query(ctx context.Context, q audit.Query) (audit.Page, error) {
+	q = q.Normalized()
+	pos, err := audit.DecodeCursor(q.Cursor)
+	if err != nil {
+		return audit.Page{}, err
+	}
+	if r.flush != nil {
+		if err := r.flush(); err != nil {
+			return audit.Page{}, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names, err := segmentNames(r.path)
+	if err != nil {
+		return audit.Page{}, err
+	}
+	indexes := make([]*segmentIndex, 0, len(names))
+	for _, name := range names {
+		idx, err := r.index(name)
+		if err != nil {
+			return audit.Page{}, err
+		}
+		indexes = append(indexes, idx)
+	}
+	for name := range r.segments {
+		if !slices.Contains(names, name) {
+			delete(r.segments, name)
+		}
+	}
+
+	// Resume inside the cursor's segment; if it was pruned, everything left is newer.
+	startSeg, startOff := 0, int64(0)
+	if pos.Segment != "" {
+		for i, idx := range indexes {
+			if idx.key == pos.Segment {
+				startSeg, startOff = i, pos.Offset
+				break
+			}
+		}
+	}
+
+	page := audit.Page{Events: make([]audit.Event, 0, min(q.Limit, 64))}
+	for i := startSeg; i < len(names); i++ {
+		if err := ctx.Err(); err != nil {
+			return audit.Page{}, err
+		}
+		idx := indexes[i]
+		from := int64(0)
+		if i == startSeg {
+			from = startOff
+		}
+		if !idx.overlaps(q) {
+			continue
+		}
+		next, err := scanSegment(names[i], idx, from, q, &page)
+		if err != nil {
+			return audit.Page{}, err
+		}
+		if len(page.Events) >= q.Limit {
+			page.NextCursor = audit.EncodeCursor(audit.Position{Segment: idx.key, Offset: next})
+			break
+		}
+	}
+	return page, nil
+}
+
+// segmentNames lists backups oldest first followed by the live file.
+// While a backup is being compressed both forms exist; the plain one wins.
+func segmentNames(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("list audit backups: %w", err)
+	}
+	byStamp := make(map[string]string, len(matches))
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		if cur, ok := byStamp[stamp]; !ok || strings.HasSuffix(cur, ".gz") {
+			byStamp[stamp] = m
+		}
+	}
+	stamps := make([]string, 0, len(byStamp))
+	for s := range byStamp {
+		stamps = append(stamps, s)
+	}
+	slices.Sort(stamps)
+
+	names := make([]string, 0, len(stamps)+1)
+	for _, s := range stamps {
+		names = append(names, byStamp[s])
+	}
+	if _, err := os.Stat(path); err == nil {
+		names = append(names, path)
+	}
+	return names, nil
+}
+
+// index returns the cached time index for name, extending it when the file only grew.
+func (r *Reader) index(name string) (*segmentIndex, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("stat audit file: %w", err)
+	}
+	cached := r.segments[name]
+	if cached != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+
+	idx := &segmentIndex{size: info.Size(), modTime: info.ModTime()}
+	start := int64(0)
+	if cached != nil && !isCompressed(name) && info.Size() > cached.size && len(cached.blocks) > 0 {
+		// Appended data only: keep full blocks and re-read the trailing partial one.
+		key, err := firstLineKey(name)
+		if err == nil && key == cached.key {
+			idx.key = cached.key
+			idx.blocks = slices.Clone(cached.blocks[:len(cached.blocks)-1])
+			start = cached.blocks[len(cached.blocks)-1].offset
+		}
+	}
+	if err := buildIndex(name, start, idx); err != nil {
+		return nil, err
+	}
+	r.segments[name] = idx
+	return idx, nil
+}
+
+func isCompressed(name string) bool {
+	return strings.HasSuffix(name, ".gz")
+}
+
+// openSegment opens name for reading from offset in its decompressed content.
+func openSegment(name string, offset int64) (io.Reader, func() error, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open audit file: %w", err)
+	}
+	if !isCompressed(name) {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, nil, fmt.Errorf("seek audit file: %w", err)
+		}
+		return f, f.Close, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("open audit backup: %w", err)
+	}
+	if _, err := io.CopyN(io.Discard, zr, offset); err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("seek audit backup: %w", err)
+	}
+	return zr, f.Close, nil
+}
+
+// lineReader yields complete newline-terminated lines with their starting offsets.
+type lineReader struct {
+	br  *bufio.Reader
+	off int64
+}
+
+func (lr *lineReader) next() ([]byte, int64, error) {
+	start := lr.off
+	line, err := lr.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		buf := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			line, err = lr.br.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		line = buf
+	}
+	if err != nil {
+		// A trailing line without newline is still being written; ignore it.
+		return nil, start, err
+	}
+	lr.off += int64(len(line))
+	return line, start, nil
+}
+
+func buildIndex(name string, start int64, idx *segmentIndex) (retErr error) {
+	rd, closeFn, err := openSegment(name, start)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeFn(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit file: %w", cerr)
+		}
+	}()
+
+	lr := &lineReader{br: bufio.NewReaderSize(rd, 64<<10), off: start}
+	var cur *block
+	lines := 0
+	for {
+		line, off, err := lr.next()
+		if err != nil {
+			break
+		}
+		if idx.key == "" {
+			idx.key = lineKey(line)
+		}
+		var head struct {
+			Timestamp int64 `json:"ts"`
+		}
+		if json.Unmarshal(line, &head) != nil {
+			continue
+		}
+		if cur == nil || lines == indexBlockLines {
+			idx.blocks = append(idx.blocks, block{offset: off, minTS: head.Timestamp, maxTS: head.Timestamp})
+			cur = &idx.blocks[len(idx.blocks)-1]
+			lines = 0
+		}
+		cur.minTS = min(cur.minTS, head.Timestamp)
+		cur.maxTS = max(cur.maxTS, head.Timestamp)
+		cur.end = lr.off
+		lines++
+	}
+	return nil
+}
+
+// scanSegment appends matching events at or after from until the page is full
+// and returns the offset right after the last consumed line. The file is opened once
+// at the first relevant block; blocks outside the time range are skipped undecoded.
+func scanSegment(name string, idx *segmentIndex, from int64, q audit.Query, page *audit.Page) (next int64, retErr error) {
+	blocks := make([]block, 0, len(idx.blocks))
+	for _, b := range idx.blocks {
+		if b.end > from && blockOverlaps(b.minTS, b.maxTS, q) {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) == 0 {
+		return from, nil
+	}
+
+	start := max(from, blocks[0].offset)
+	rd, closeFn, err := openSegment(name, start)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := closeFn(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit file: %w", cerr)
+		}
+	}()
+
+	lr := &lineReader{br: bufio.NewReaderSize(rd, 64<<10), off: start}
+	for _, b := range blocks {
+		if skip := max(from, b.offset) - lr.off; skip > 0 {
+			n, err := lr.br.Discard(int(skip))
+			lr.off += int64(n)
+			if err != nil {
+				return lr.off, nil
+			}
+		}
+		for lr.off < b.end {
+			line, _, err := lr.next()
+			if err != nil {
+				return lr.off, nil
+			}
+			var evt audit.Event
+			if json.Unmarshal(line, &evt) != nil || !q.Matches(evt) {
+				continue
+			}
+			page.Events = append(page.Events, evt)
+			if len(page.Events) >= q.Limit {
+				return lr.off, nil
+			}
+		}
+	}
+	return lr.off, nil
+}
+
+func firstLineKey(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return "", err
+	}
+	return lineKey(line), nil
+}
+
+func lineKey(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,118 @@
+package file
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+func writeEvents(t *testing.T, w *Writer, from, to int64) {
+	t.Helper()
+	for ts := from; ts <= to; ts++ {
+		metric := "Alloc"
+		if ts%2 == 0 {
+			metric = "PollCount"
+		}
+		evt := audit.Event{Timestamp: ts, Metrics: []string{metric}, IPAddress: "10.0.0.1"}
+		if ts%3 == 0 {
+			evt.IPAddress = "10.0.0.2"
+		}
+		if err := w.Notify(context.Background(), evt); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+}
+
+func queryAll(t *testing.T, r *Reader, q audit.Query) ([]int64, int) {
+	t.Helper()
+	var got []int64
+	pages := 0
+	for {
+		page, err := r.Query(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		pages++
+		for _, e := range page.Events {
+			got = append(got, e.Timestamp)
+		}
+		if page.NextCursor == "" {
+			return got, pages
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestReader_QueryAcrossRotatedBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := New(path, WithMaxSize(16<<10), WithFlushInterval(0))
+	w.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	writeEvents(t, w, 1, 1000)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if backups, _ := filepath.Glob(path + ".*.gz"); len(backups) < 2 {
+		t.Fatalf("expected several gzipped backups, got %v", backups)
+	}
+
+	r := NewReader(path)
+	got, pages := queryAll(t, r, audit.Query{Limit: 300})
+	if len(got) != 1000 || pages != 4 {
+		t.Fatalf("want 1000 events in 4 pages, got %d in %d", len(got), pages)
+	}
+	for i, ts := range got {
+		if ts != int64(i+1) {
+			t.Fatalf("events out of order at %d: %d", i, ts)
+		}
+	}
+
+	got, _ = queryAll(t, r, audit.Query{From: 500, To: 520, Metric: "PollCount", IP: "10.0.0.2", Limit: 2})
+	want := []int64{504, 510, 516}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestReader_SeesBufferedEventsAndCursorSurvivesRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	w := New(path, WithFlushInterval(time.Hour))
+	t.Cleanup(func() { _ = w.Close() })
+	r := w.Reader()
+
+	writeEvents(t, w, 1, 3)
+	page, err := r.Query(context.Background(), audit.Query{Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(page.Events) != 2 || page.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	w.mu.Lock()
+	if err := w.rotateLocked(); err != nil {
+		w.mu.Unlock()
+		t.Fatalf("rotate: %v", err)
+	}
+	w.mu.Unlock()
+	writeEvents(t, w, 4, 5)
+
+	page, err = r.Query(context.Background(), audit.Query{Limit: 10, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(page.Events) != 3 || page.Events[0].Timestamp != 3 || page.Events[2].Timestamp != 5 {
+		t.Fatalf("cursor did not resume after rotation: %+v", page.Events)
+	}
+}
@@ -0,0 +1,227 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ChainBreak locates the first inconsistency found by Verify.
+type ChainBreak struct {
+	File   string
+	Reason string
+	Line   int
+	Seq    uint64
+}
+
+// String formats the break as file:line (seq N): reason.
+func (b *ChainBreak) String() string {
+	if b.Line == 0 {
+		return fmt.Sprintf("%s: %s", b.File, b.Reason)
+	}
+	return fmt.Sprintf("%s:%d (seq %d): %s", b.File, b.Line, b.Seq, b.Reason)
+}
+
+// VerifyReport summarizes a verification run. Break is nil when the chain is intact.
+// LastCheckpoint is when the newest checkpoint was signed; a writer that is still running
+// refreshes it every checkpoint interval, so a stale value means the tail was cut.
+type VerifyReport struct {
+	LastCheckpoint time.Time
+	Break          *ChainBreak
+	Files          []string
+	Records        uint64
+	FirstSeq       uint64
+	LastSeq        uint64
+	Checkpoints    int
+}
+
+type verifier struct {
+	checkpoints map[uint64]Checkpoint
+	report      *VerifyReport
+	key         []byte
+	prev        string
+	nextSeq     uint64
+	// anchored is set when the oldest checkpoint left does not start the checkpoint chain.
+	anchored bool
+}
+
+// Verify walks the audit log at path, oldest rotated backup first, checking every record's
+// HMAC, its link to the previous record, the sequence numbers and the signed checkpoints,
+// which are chained to each other across the per-segment checkpoint files.
+// It stops at the first broken or missing link. When old backups were pruned, the chain
+// is anchored at the first remaining record and checkpoint.
+func Verify(path string, key []byte) (VerifyReport, error) {
+	var report VerifyReport
+	if len(key) == 0 {
+		return report, errors.New("audit hmac key is empty")
+	}
+	names, err := segmentNames(path)
+	if err != nil {
+		return report, err
+	}
+	if len(names) == 0 {
+		return report, fmt.Errorf("no audit log found at %s", path)
+	}
+	report.Files = names
+
+	v := &verifier{key: key, report: &report, checkpoints: make(map[uint64]Checkpoint)}
+	sidecars := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		sidecars = append(sidecars, checkpointPath(name))
+	}
+	if names[len(names)-1] != path {
+		sidecars = append(sidecars, checkpointPath(path))
+	}
+	if err := v.loadCheckpoints(sidecars); err != nil || report.Break != nil {
+		return report, err
+	}
+	for _, name := range names {
+		if err := v.verifyFile(name); err != nil || report.Break != nil {
+			return report, err
+		}
+	}
+	if v.anchored && report.FirstSeq == 1 {
+		report.Break = &ChainBreak{
+			File:   sidecars[0],
+			Reason: "the log starts the chain but its first checkpoint does not: checkpoints were removed",
+		}
+		return report, nil
+	}
+	for _, cp := range v.checkpoints {
+		if cp.Seq > report.LastSeq {
+			report.Break = &ChainBreak{
+				File:   checkpointPath(path),
+				Reason: fmt.Sprintf("log ends at seq %d but a checkpoint covers seq %d: records were removed from the end", report.LastSeq, cp.Seq),
+			}
+			break
+		}
+	}
+	return report, nil
+}
+
+func (v *verifier) verifyFile(name string) (retErr error) {
+	rd, closeFn, err := openSegment(name, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeFn(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close audit file: %w", cerr)
+		}
+	}()
+
+	lr := &lineReader{br: bufio.NewReaderSize(rd, 64<<10)}
+	for lineNo := 1; ; lineNo++ {
+		line, _, err := lr.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read audit file %s: %w", name, err)
+		}
+		if brk := v.checkLine(line); brk != nil {
+			brk.File, brk.Line = name, lineNo
+			v.report.Break = brk
+			return nil
+		}
+	}
+}
+
+func (v *verifier) checkLine(line []byte) *ChainBreak {
+	body, mac, ok := splitRecord(line)
+	if !ok {
+		return &ChainBreak{Seq: v.nextSeq, Reason: "record is malformed or not chained"}
+	}
+	var rec struct {
+		Prev string `json:"prev"`
+		Seq  uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(body, &rec); err != nil || rec.Prev == "" || rec.Seq == 0 {
+		return &ChainBreak{Seq: v.nextSeq, Reason: "record is malformed or not chained"}
+	}
+	if recordMAC(v.key, body) != mac {
+		return &ChainBreak{Seq: rec.Seq, Reason: "record MAC mismatch: the record was altered or the key is wrong"}
+	}
+
+	r := v.report
+	if r.Records == 0 {
+		if rec.Seq == 1 && rec.Prev != genesisMAC {
+			return &ChainBreak{Seq: rec.Seq, Reason: "first record does not start the chain"}
+		}
+		r.FirstSeq = rec.Seq
+	} else {
+		if rec.Seq != v.nextSeq {
+			return &ChainBreak{Seq: rec.Seq, Reason: fmt.Sprintf("sequence gap: expected seq %d", v.nextSeq)}
+		}
+		if rec.Prev != v.prev {
+			return &ChainBreak{Seq: rec.Seq, Reason: "link to the previous record is broken: a record was removed, inserted or reordered"}
+		}
+	}
+	if cp, ok := v.checkpoints[rec.Seq]; ok && cp.MAC != mac {
+		return &ChainBreak{Seq: rec.Seq, Reason: "record does not match its signed checkpoint: the chain was rewritten"}
+	}
+
+	r.Records++
+	r.LastSeq = rec.Seq
+	v.prev = mac
+	v.nextSeq = rec.Seq + 1
+	return nil
+}
+
+// loadCheckpoints reads the sidecars oldest first, checking every signature and the link
+// from each checkpoint to the one before it.
+func (v *verifier) loadCheckpoints(sidecars []string) error {
+	prev := ""
+	var prevSeq uint64
+	for _, name := range sidecars {
+		brk, err := v.loadCheckpointFile(name, &prev, &prevSeq)
+		if err != nil {
+			return err
+		}
+		if brk != nil {
+			brk.File = name
+			v.report.Break = brk
+			return nil
+		}
+	}
+	return nil
+}
+
+func (v *verifier) loadCheckpointFile(name string, prev *string, prevSeq *uint64) (*ChainBreak, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open audit checkpoints: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		var cp Checkpoint
+		if err := json.Unmarshal(sc.Bytes(), &cp); err != nil || checkpointSig(v.key, cp) != cp.Sig {
+			return &ChainBreak{Line: lineNo, Seq: cp.Seq, Reason: "checkpoint signature is invalid"}, nil
+		}
+		switch {
+		case *prev == "":
+			v.anchored = cp.Prev != genesisMAC
+		case cp.Prev != *prev:
+			return &ChainBreak{Line: lineNo, Seq: cp.Seq, Reason: "checkpoint does not link to the previous one: checkpoints were removed or reordered"}, nil
+		case cp.Seq < *prevSeq:
+			return &ChainBreak{Line: lineNo, Seq: cp.Seq, Reason: "checkpoint goes back in the sequence"}, nil
+		}
+		*prev, *prevSeq = cp.Sig, cp.Seq
+		v.checkpoints[cp.Seq] = cp
+		v.report.Checkpoints++
+		v.report.LastCheckpoint = time.Unix(cp.TS, 0)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read audit checkpoints: %w", err)
+	}
+	return nil, nil
+}
@@ -1,52 +1,474 @@
 package file
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/vshulcz/Golectra/internal/services/audit"
 )
 
+// SyncPolicy controls when buffered audit data is fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncOnFlush fsyncs after every periodic flush.
+	SyncOnFlush SyncPolicy = iota
+	// SyncAlways flushes and fsyncs after every event.
+	SyncAlways
+	// SyncNever leaves fsync to the operating system.
+	SyncNever
+)
+
+const (
+	defaultBufferSize         = 64 << 10
+	defaultFlushInterval      = time.Second
+	defaultCheckpointInterval = time.Minute
+	backupTimeFormat          = "20060102T150405.000000000"
+)
+
+// Option customizes a Writer built by New.
+type Option func(*Writer)
+
+// WithBufferSize sets the size of the in-memory write buffer.
+func WithBufferSize(n int) Option {
+	return func(w *Writer) {
+		if n > 0 {
+			w.bufSize = n
+		}
+	}
+}
+
+// WithFlushInterval sets how often buffered events are flushed; 0 flushes after every event.
+func WithFlushInterval(d time.Duration) Option {
+	return func(w *Writer) {
+		if d >= 0 {
+			w.flushEvery = d
+		}
+	}
+}
+
+// WithSyncPolicy selects when flushed data is fsynced.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(w *Writer) {
+		w.sync = p
+	}
+}
+
+// WithMaxSize rotates the file once it would grow beyond n bytes; 0 disables size rotation.
+func WithMaxSize(n int64) Option {
+	return func(w *Writer) {
+		w.maxSize = n
+	}
+}
+
+// WithRotateInterval rotates the file once it has been open for d; 0 disables time rotation.
+func WithRotateInterval(d time.Duration) Option {
+	return func(w *Writer) {
+		w.rotateEvery = d
+	}
+}
+
+// WithMaxBackups keeps at most n gzipped backups; 0 keeps all of them.
+func WithMaxBackups(n int) Option {
+	return func(w *Writer) {
+		w.maxBackups = n
+	}
+}
+
+// WithMaxAge removes gzipped backups older than d; 0 keeps them regardless of age.
+func WithMaxAge(d time.Duration) Option {
+	return func(w *Writer) {
+		w.maxAge = d
+	}
+}
+
+// WithHMACKey chains every record to the previous one with HMAC-SHA256 under key
+// and writes signed checkpoints next to the log. An empty key leaves records unchained.
+func WithHMACKey(key []byte) Option {
+	return func(w *Writer) {
+		if len(key) > 0 {
+			w.chain = &chain{key: slices.Clone(key)}
+		}
+	}
+}
+
+// WithCheckpointInterval sets how often a signed checkpoint is written for a chained log.
+// Checkpoints keep coming at this pace while the log is idle, so a checkpoint file whose
+// newest entry is older than the interval means its tail was cut.
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(w *Writer) {
+		if d > 0 {
+			w.checkpointEvery = d
+		}
+	}
+}
+
+// ParseSyncPolicy maps "flush", "always" or "never" to a SyncPolicy.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "flush":
+		return SyncOnFlush, nil
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncOnFlush, fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
 // Writer appends audit events to a local newline-delimited JSON file.
+// The file stays open between events, writes are buffered, and the file is rotated
+// by size or age into gzipped backups.
 type Writer struct {
-	path string
-	mu   sync.Mutex
+	now func() time.Time
+
+	f        *os.File
+	buf      *bufio.Writer
+	openedAt time.Time
+	size     int64
+	dirty    bool
+
+	path        string
+	bufSize     int
+	flushEvery  time.Duration
+	sync        SyncPolicy
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	maxAge      time.Duration
+
+	chain           *chain
+	checkpointEvery time.Duration
+
+	stop     chan struct{}
+	bgWG     sync.WaitGroup
+	mu       sync.Mutex
+	closed   bool
+	stopOnce sync.Once
 }
 
-// New creates a Writer that writes every event to the provided filesystem path.
-func New(path string) *Writer {
-	return &Writer{path: path}
+// New creates a Writer that appends every event to the provided filesystem path.
+func New(path string, opts ...Option) *Writer {
+	w := &Writer{
+		path:       path,
+		bufSize:    defaultBufferSize,
+		flushEvery: defaultFlushInterval,
+		now:        time.Now,
+		stop:       make(chan struct{}),
+
+		checkpointEvery: defaultCheckpointInterval,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.path != "" && w.flushEvery > 0 {
+		w.bgWG.Add(1)
+		go w.flushLoop()
+	}
+	return w
 }
 
-// Notify marshals the audit event and atomically appends it to the writer's file.
-func (w *Writer) Notify(_ context.Context, evt audit.Event) (retErr error) {
+// Notify marshals the versioned audit event and appends it to the writer's file.
+func (w *Writer) Notify(_ context.Context, evt audit.Event) error {
 	if w == nil || w.path == "" {
 		return nil
 	}
 
+	evt = evt.Versioned()
 	payload, err := json.Marshal(evt)
 	if err != nil {
 		return fmt.Errorf("marshal audit event: %w", err)
 	}
+	payload = append(payload, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("audit file writer closed")
+	}
+
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	if w.shouldRotateLocked(int64(len(payload))) {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if w.chain != nil {
+		// Sealing happens under the lock so records are chained in file order.
+		if payload, err = w.chain.seal(evt); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.buf.Write(payload)
+	w.size += int64(n)
+	w.dirty = true
+	if err != nil {
+		return fmt.Errorf("write audit file: %w", err)
+	}
+	if w.flushEvery == 0 || w.sync == SyncAlways {
+		return w.flushLocked()
+	}
+	return nil
+}
 
+// Flush writes buffered events to the file and applies the sync policy.
+func (w *Writer) Flush() error {
+	if w == nil {
+		return nil
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// Reopen flushes and closes the current file and opens the path again.
+// It is meant for SIGHUP handling after an external tool such as logrotate moved the file.
+func (w *Writer) Reopen() error {
+	if w == nil || w.path == "" {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	if err := w.closeFileLocked(); err != nil {
+		return err
+	}
+	return w.openLocked()
+}
+
+// Close flushes pending events, closes the file and waits for background compression.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.stopOnce.Do(func() { close(w.stop) })
+
+	w.mu.Lock()
+	w.closed = true
+	err := w.closeFileLocked()
+	if err == nil {
+		err = w.checkpointLocked(true)
+	}
+	w.mu.Unlock()
+
+	w.bgWG.Wait()
+	return err
+}
 
+func (w *Writer) flushLoop() {
+	defer w.bgWG.Done()
+	ticker := time.NewTicker(w.flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			_ = w.Flush()
+		}
+	}
+}
+
+func (w *Writer) openLocked() error {
+	if w.f != nil {
+		return nil
+	}
+	if err := truncateTornTail(w.path); err != nil {
+		return err
+	}
+	if w.chain != nil && !w.chain.recovered {
+		if err := w.chain.recover(w.path); err != nil {
+			return fmt.Errorf("recover audit chain: %w", err)
+		}
+	}
+	if dir := filepath.Dir(w.path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("mkdir audit dir: %w", err)
+		}
+	}
 	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
 	if err != nil {
 		return fmt.Errorf("open audit file: %w", err)
 	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat audit file: %w", err)
+	}
+	w.f = f
+	w.size = info.Size()
+	w.openedAt = w.now()
+	if w.buf == nil {
+		w.buf = bufio.NewWriterSize(f, w.bufSize)
+	} else {
+		w.buf.Reset(f)
+	}
+	return nil
+}
+
+func (w *Writer) flushLocked() error {
+	if w.f != nil && w.dirty {
+		if err := w.buf.Flush(); err != nil {
+			return fmt.Errorf("flush audit file: %w", err)
+		}
+		if w.sync != SyncNever {
+			if err := w.f.Sync(); err != nil {
+				return fmt.Errorf("sync audit file: %w", err)
+			}
+		}
+		w.dirty = false
+	}
+	return w.checkpointLocked(false)
+}
+
+// checkpointLocked records a signed checkpoint for a chained log once the interval has
+// passed since the previous one, or immediately when force is set. It also fires when no
+// record arrived since the last checkpoint, as a heartbeat that dates the log's tail.
+func (w *Writer) checkpointLocked(force bool) error {
+	c := w.chain
+	if c == nil || c.seq == 0 || (w.closed && !force) {
+		return nil
+	}
+	now := w.now()
+	if !force && now.Sub(c.lastCheckpoint) < w.checkpointEvery {
+		return nil
+	}
+	return appendCheckpoint(w.path, c.checkpoint(now), w.sync != SyncNever)
+}
+
+func (w *Writer) closeFileLocked() error {
+	if w.f == nil {
+		return nil
+	}
+	ferr := w.flushLocked()
+	cerr := w.f.Close()
+	w.f = nil
+	if ferr != nil {
+		return ferr
+	}
+	if cerr != nil {
+		return fmt.Errorf("close audit file: %w", cerr)
+	}
+	return nil
+}
+
+func (w *Writer) shouldRotateLocked(next int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+next > w.maxSize {
+		return true
+	}
+	return w.rotateEvery > 0 && w.now().Sub(w.openedAt) >= w.rotateEvery
+}
+
+func (w *Writer) rotateLocked() error {
+	if err := w.closeFileLocked(); err != nil {
+		return err
+	}
+	// Close the segment's checkpoints at its last record so the sidecar leaves with it.
+	if err := w.checkpointLocked(true); err != nil {
+		return err
+	}
+	now := w.now()
+	backup := w.path + "." + now.UTC().Format(backupTimeFormat)
+	if err := os.Rename(w.path, backup); err != nil {
+		return fmt.Errorf("rotate audit file: %w", err)
+	}
+	if err := os.Rename(checkpointPath(w.path), checkpointPath(backup)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("rotate audit checkpoints: %w", err)
+	}
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	w.bgWG.Add(1)
+	go func() {
+		defer w.bgWG.Done()
+		if err := compressFile(backup); err == nil {
+			w.pruneBackups(now)
+		}
+	}()
+	return nil
+}
+
+func compressFile(src string) (retErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
 	defer func() {
-		if cerr := f.Close(); cerr != nil && retErr == nil {
-			retErr = fmt.Errorf("close audit file: %w", cerr)
+		if cerr := in.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close backup: %w", cerr)
 		}
 	}()
 
-	if _, err := f.Write(append(payload, '\n')); err != nil {
-		return fmt.Errorf("write audit file: %w", err)
+	dst := src + ".gz"
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create gzip backup: %w", err)
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = zw.Close()
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return fmt.Errorf("compress backup: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return fmt.Errorf("compress backup: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close gzip backup: %w", err)
+	}
+	return os.Remove(src)
+}
+
+// pruneBackups removes gzipped backups beyond maxBackups or older than maxAge,
+// together with their checkpoint sidecars.
+func (w *Writer) pruneBackups(now time.Time) {
+	if w.maxBackups <= 0 && w.maxAge <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(w.path + ".*.gz")
+	if err != nil {
+		return
+	}
+	// Backup names embed a sortable UTC timestamp, so newest sort last.
+	slices.Sort(backups)
+	slices.Reverse(backups)
+
+	cutoff := now.Add(-w.maxAge)
+	for i, name := range backups {
+		expired := w.maxBackups > 0 && i >= w.maxBackups
+		if !expired && w.maxAge > 0 {
+			ts := strings.TrimSuffix(strings.TrimPrefix(name, w.path+"."), ".gz")
+			if t, err := time.Parse(backupTimeFormat, ts); err == nil && t.Before(cutoff) {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(name); err == nil {
+				_ = os.Remove(checkpointPath(name))
+			}
+		}
 	}
-	return nil
 }
@@ -1,10 +1,14 @@
 package file
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/vshulcz/Golectra/internal/services/audit"
 )
@@ -17,6 +21,9 @@ func TestWriter_Notify_AppendsJSONLine(t *testing.T) {
 	if err := w.Notify(context.Background(), evt); err != nil {
 		t.Fatalf("Notify error: %v", err)
 	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -27,7 +34,106 @@ func TestWriter_Notify_AppendsJSONLine(t *testing.T) {
 	if err := json.Unmarshal(data[:len(data)-1], &decoded); err != nil {
 		t.Fatalf("unmarshal: %v", err)
 	}
-	if decoded.IPAddress != evt.IPAddress || decoded.Timestamp != evt.Timestamp {
+	if decoded.IPAddress != evt.IPAddress || decoded.Timestamp != evt.Timestamp || decoded.Version != audit.SchemaVersion {
 		t.Fatalf("decoded mismatch: %+v", decoded)
 	}
 }
+
+func TestWriter_BuffersUntilFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w := New(path, WithFlushInterval(time.Hour))
+	t.Cleanup(func() { _ = w.Close() })
+
+	if err := w.Notify(context.Background(), audit.Event{Timestamp: 1}); err != nil {
+		t.Fatalf("Notify error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Fatalf("expected buffered write, file has %d bytes", len(data))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) == 0 {
+		t.Fatal("expected data after Flush")
+	}
+}
+
+func TestWriter_RotatesBySizeAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := New(path, WithFlushInterval(0), WithMaxSize(64), WithMaxBackups(2))
+	w.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for i := range 6 {
+		evt := audit.Event{Timestamp: int64(i), Metrics: []string{"Alloc"}, IPAddress: "127.0.0.1"}
+		if err := w.Notify(context.Background(), evt); err != nil {
+			t.Fatalf("Notify error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	backups, err := filepath.Glob(path + ".*.gz")
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups after pruning, got %v", backups)
+	}
+	if raw, _ := filepath.Glob(path + ".*[0-9]"); len(raw) != 0 {
+		t.Fatalf("uncompressed backups left behind: %v", raw)
+	}
+
+	f, err := os.Open(backups[len(backups)-1])
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	sc := bufio.NewScanner(zr)
+	if !sc.Scan() {
+		t.Fatal("backup is empty")
+	}
+	var decoded audit.Event
+	if err := json.Unmarshal(sc.Bytes(), &decoded); err != nil {
+		t.Fatalf("unmarshal backup line: %v", err)
+	}
+}
+
+func TestWriter_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	w := New(path, WithFlushInterval(0))
+	t.Cleanup(func() { _ = w.Close() })
+
+	if err := w.Notify(context.Background(), audit.Event{Timestamp: 1}); err != nil {
+		t.Fatalf("Notify error: %v", err)
+	}
+	moved := filepath.Join(dir, "audit.log.1")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("Reopen error: %v", err)
+	}
+	if err := w.Notify(context.Background(), audit.Event{Timestamp: 2}); err != nil {
+		t.Fatalf("Notify error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read reopened file: %v", err)
+	}
+	var decoded audit.Event
+	if err := json.Unmarshal(data[:len(data)-1], &decoded); err != nil || decoded.Timestamp != 2 {
+		t.Fatalf("reopened file content %q (err=%v)", data, err)
+	}
+}
@@ -0,0 +1,119 @@
+// Package postgres stores audit events in a Postgres table and queries them back.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	pgrepo "github.com/vshulcz/Golectra/internal/adapters/repository/postgres"
+	"github.com/vshulcz/Golectra/internal/misc"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+// Store records audit events in the audit_events table created by the repository migrations.
+type Store struct {
+	db *sql.DB
+}
+
+var (
+	_ audit.Observer = (*Store)(nil)
+	_ audit.Reader   = (*Store)(nil)
+)
+
+// New returns a Store backed by db.
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Notify inserts the versioned event.
+func (s *Store) Notify(ctx context.Context, evt audit.Event) error {
+	evt = evt.Versioned()
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("marshal audit event: %w", err)
+	}
+	metrics := evt.Metrics
+	if metrics == nil {
+		metrics = []string{}
+	}
+	const q = `INSERT INTO audit_events (ts, ip_address, metrics, event) VALUES ($1, $2, $3, $4)`
+	op := func() error {
+		_, err := s.db.ExecContext(ctx, q, evt.Timestamp, evt.IPAddress, pq.Array(metrics), payload)
+		return err
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, pgrepo.IsRetryable, op); err != nil {
+		return fmt.Errorf("insert audit event: %w", err)
+	}
+	return nil
+}
+
+// Query returns matching events in insertion order; the cursor carries the last row ID.
+func (s *Store) Query(ctx context.Context, q audit.Query) (audit.Page, error) {
+	q = q.Normalized()
+	pos, err := audit.DecodeCursor(q.Cursor)
+	if err != nil {
+		return audit.Page{}, err
+	}
+	query, args := buildQuery(q, pos.Offset)
+
+	var page audit.Page
+	var lastID int64
+	op := func() error {
+		page = audit.Page{Events: make([]audit.Event, 0, min(q.Limit, 64))}
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var raw []byte
+			if err := rows.Scan(&lastID, &raw); err != nil {
+				return err
+			}
+			var evt audit.Event
+			if err := json.Unmarshal(raw, &evt); err != nil {
+				return fmt.Errorf("decode audit event %d: %w", lastID, err)
+			}
+			page.Events = append(page.Events, evt)
+		}
+		return rows.Err()
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, pgrepo.IsRetryable, op); err != nil {
+		return audit.Page{}, fmt.Errorf("query audit events: %w", err)
+	}
+	if len(page.Events) >= q.Limit {
+		page.NextCursor = audit.EncodeCursor(audit.Position{Offset: lastID})
+	}
+	return page, nil
+}
+
+func buildQuery(q audit.Query, afterID int64) (string, []any) {
+	var sb strings.Builder
+	sb.WriteString(`SELECT id, event FROM audit_events WHERE id > $1`)
+	args := []any{afterID}
+	add := func(cond string, v any) {
+		args = append(args, v)
+		sb.WriteString(" AND ")
+		sb.WriteString(strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+	if q.From > 0 {
+		add("ts >= ?", q.From)
+	}
+	if q.To > 0 {
+		add("ts <= ?", q.To)
+	}
+	if q.IP != "" {
+		add("ip_address = ?", q.IP)
+	}
+	if q.Metric != "" {
+		add("metrics @> ARRAY[?]::text[]", q.Metric)
+	}
+	args = append(args, q.Limit)
+	sb.WriteString(" ORDER BY id LIMIT $" + strconv.Itoa(len(args)))
+	return sb.String(), args
+}
@@ -0,0 +1,87 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+func newMockStore(t *testing.T) (sqlmock.Sqlmock, *Store) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectClose()
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Fatalf("db.Close: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+	return mock, New(db)
+}
+
+func TestStore_Notify(t *testing.T) {
+	mock, st := newMockStore(t)
+	evt := audit.Event{Timestamp: 10, Metrics: []string{"Alloc"}, IPAddress: "10.0.0.1"}
+	payload, _ := json.Marshal(evt.Versioned())
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO audit_events (ts, ip_address, metrics, event) VALUES ($1, $2, $3, $4)`)).
+		WithArgs(int64(10), "10.0.0.1", sqlmock.AnyArg(), payload).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := st.Notify(context.Background(), evt); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+}
+
+func TestStore_Query(t *testing.T) {
+	mock, st := newMockStore(t)
+	row := func(id int64, ts int64) (int64, []byte) {
+		b, _ := json.Marshal(audit.Event{Version: audit.SchemaVersion, Timestamp: ts, Metrics: []string{"Alloc"}})
+		return id, b
+	}
+
+	const filtered = `SELECT id, event FROM audit_events WHERE id > $1 AND ts >= $2 AND ts <= $3 AND ip_address = $4 AND metrics @> ARRAY[$5]::text[] ORDER BY id LIMIT $6`
+	id1, ev1 := row(7, 100)
+	id2, ev2 := row(9, 101)
+	mock.ExpectQuery(regexp.QuoteMeta(filtered)).
+		WithArgs(int64(0), int64(100), int64(200), "10.0.0.1", "Alloc", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event"}).AddRow(id1, ev1).AddRow(id2, ev2))
+
+	page, err := st.Query(context.Background(), audit.Query{Metric: "Alloc", IP: "10.0.0.1", From: 100, To: 200, Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(page.Events) != 2 || page.Events[1].Timestamp != 101 || page.NextCursor == "" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	const next = `SELECT id, event FROM audit_events WHERE id > $1 ORDER BY id LIMIT $2`
+	mock.ExpectQuery(regexp.QuoteMeta(next)).
+		WithArgs(int64(9), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event"}))
+
+	page, err = st.Query(context.Background(), audit.Query{Cursor: page.NextCursor, Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(page.Events) != 0 || page.NextCursor != "" {
+		t.Fatalf("expected last empty page, got %+v", page)
+	}
+}
+
+func TestStore_Query_InvalidCursor(t *testing.T) {
+	_, st := newMockStore(t)
+	if _, err := st.Query(context.Background(), audit.Query{Cursor: "%%%"}); err == nil {
+		t.Fatal("expected invalid cursor error")
+	}
+}
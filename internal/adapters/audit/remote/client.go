@@ -8,12 +8,19 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/vshulcz/Golectra/internal/services/audit"
 )
 
+// SchemaVersionHeader announces the audit event schema version of the request body.
+const SchemaVersionHeader = "X-Audit-Schema-Version"
+
+// BatchSizeHeader carries the number of events in a batched request body.
+const BatchSizeHeader = "X-Audit-Batch-Size"
+
 // Client sends audit events to a remote HTTP endpoint.
 type Client struct {
 	endpoint string
@@ -34,21 +41,59 @@ func New(rawURL string, hc *http.Client) (*Client, error) {
 	return &Client{endpoint: rawURL, hc: hc}, nil
 }
 
-// Notify serializes the audit event and issues an HTTP POST to the configured endpoint.
-func (c *Client) Notify(ctx context.Context, evt audit.Event) (retErr error) {
+// StatusError reports a non-2xx response from the audit endpoint.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("audit post status %d", e.Code)
+}
+
+// Temporary reports whether the endpoint may accept the same request later.
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+// Notify serializes the versioned audit event and issues an HTTP POST to the configured endpoint.
+func (c *Client) Notify(ctx context.Context, evt audit.Event) error {
 	if c == nil {
 		return nil
 	}
+	evt = evt.Versioned()
 	payload, err := json.Marshal(evt)
 	if err != nil {
 		return fmt.Errorf("marshal audit event: %w", err)
 	}
+	return c.post(ctx, payload, nil)
+}
 
+// SendBatch POSTs several versioned events as one JSON array.
+func (c *Client) SendBatch(ctx context.Context, events []audit.Event) error {
+	if c == nil || len(events) == 0 {
+		return nil
+	}
+	versioned := make([]audit.Event, len(events))
+	for i := range events {
+		versioned[i] = events[i].Versioned()
+	}
+	payload, err := json.Marshal(versioned)
+	if err != nil {
+		return fmt.Errorf("marshal audit batch: %w", err)
+	}
+	return c.post(ctx, payload, map[string]string{BatchSizeHeader: strconv.Itoa(len(events))})
+}
+
+func (c *Client) post(ctx context.Context, payload []byte, headers map[string]string) (retErr error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("new request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SchemaVersionHeader, strconv.Itoa(audit.SchemaVersion))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	resp, err := c.hc.Do(req)
 	if err != nil {
@@ -64,7 +109,7 @@ func (c *Client) Notify(ctx context.Context, evt audit.Event) (retErr error) {
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("audit post status %d", resp.StatusCode)
+		return &StatusError{Code: resp.StatusCode}
 	}
 	return nil
 }
@@ -12,7 +12,9 @@ import (
 
 func TestClient_Notify_OK(t *testing.T) {
 	var received audit.Event
+	var version string
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version = r.Header.Get(SchemaVersionHeader)
 		defer func() {
 			if err := r.Body.Close(); err != nil {
 				t.Fatalf("body close: %v", err)
@@ -43,6 +45,9 @@ func TestClient_Notify_OK(t *testing.T) {
 	if received.IPAddress != evt.IPAddress {
 		t.Fatalf("event not forwarded: %+v", received)
 	}
+	if received.Version != audit.SchemaVersion || version != "4" {
+		t.Fatalf("schema version not set: body=%d header=%q", received.Version, version)
+	}
 }
 
 func TestClient_Notify_StatusError(t *testing.T) {
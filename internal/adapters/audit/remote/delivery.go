@@ -0,0 +1,394 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/misc"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+const (
+	defaultBatchSize        = 100
+	defaultBatchInterval    = time.Second
+	defaultRequestTimeout   = 5 * time.Second
+	defaultDrainTimeout     = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	// batchQueueLen bounds the batches waiting for the sender before the collector blocks.
+	batchQueueLen = 4
+)
+
+var errDelivererClosed = errors.New("audit deliverer closed")
+
+// DeliveryOption customizes a Deliverer built by NewDeliverer.
+type DeliveryOption func(*Deliverer)
+
+// WithBatchSize sends a batch as soon as it holds n events.
+func WithBatchSize(n int) DeliveryOption {
+	return func(d *Deliverer) {
+		if n > 0 {
+			d.batchSize = n
+		}
+	}
+}
+
+// WithBatchInterval sends a partial batch once it has waited for interval.
+func WithBatchInterval(interval time.Duration) DeliveryOption {
+	return func(d *Deliverer) {
+		if interval > 0 {
+			d.interval = interval
+		}
+	}
+}
+
+// WithErrorHandler receives spool write failures; the batch is then sent directly once and
+// counted as dropped if that fails too.
+func WithErrorHandler(fn func(error)) DeliveryOption {
+	return func(d *Deliverer) {
+		if fn != nil {
+			d.onError = fn
+		}
+	}
+}
+
+// WithSpool keeps undelivered batches in dir, bounded by maxBytes (0 - unbounded).
+// An empty dir keeps them in memory only.
+func WithSpool(dir string, maxBytes int64) DeliveryOption {
+	return func(d *Deliverer) {
+		d.spoolDir = dir
+		d.spoolMax = maxBytes
+	}
+}
+
+// WithBackoff sets the retry delays applied to a batch before it is left in the spool.
+func WithBackoff(delays []time.Duration) DeliveryOption {
+	return func(d *Deliverer) {
+		d.backoff = delays
+	}
+}
+
+// WithBreaker opens the circuit after threshold failed batches and probes again after cooldown.
+func WithBreaker(threshold int, cooldown time.Duration) DeliveryOption {
+	return func(d *Deliverer) {
+		d.breaker = misc.NewBreaker(threshold, cooldown)
+	}
+}
+
+// DeliveryStats is a point-in-time view of remote audit delivery.
+type DeliveryStats struct {
+	Breaker      string  `json:"breaker"`
+	Delivered    int64   `json:"delivered"`
+	Rejected     int64   `json:"rejected"`
+	Failed       int64   `json:"failed"`
+	Dropped      int64   `json:"dropped"`
+	SpoolBatches int     `json:"spool_batches"`
+	SpoolBytes   int64   `json:"spool_bytes"`
+	LagSeconds   float64 `json:"lag_seconds"`
+}
+
+// Deliverer batches audit events and sends them to a Client in order.
+// Batches are sent directly while the endpoint is healthy. One that fails, or arrives
+// while the breaker is open or older batches are still spooled, goes to the spool, so
+// batches that cannot be sent survive outages (and restarts, when the spool has a
+// directory) and are replayed in order.
+type Deliverer struct {
+	now     func() time.Time
+	onError func(error)
+	client  *Client
+	spool   *Spool
+	breaker *misc.Breaker
+
+	spoolDir  string
+	spoolMax  int64
+	backoff   []time.Duration
+	batchSize int
+	interval  time.Duration
+	timeout   time.Duration
+	drain     time.Duration
+
+	in       chan audit.Event
+	batches  chan []audit.Event
+	stop     chan struct{}
+	drained  chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	delivered atomic.Int64
+	rejected  atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// NewDeliverer opens the spool and starts the batching and sending goroutines.
+func NewDeliverer(client *Client, opts ...DeliveryOption) (*Deliverer, error) {
+	if client == nil {
+		return nil, errors.New("audit client is nil")
+	}
+	d := &Deliverer{
+		now:       time.Now,
+		onError:   func(error) {},
+		client:    client,
+		backoff:   misc.DefaultBackoff,
+		batchSize: defaultBatchSize,
+		interval:  defaultBatchInterval,
+		timeout:   defaultRequestTimeout,
+		drain:     defaultDrainTimeout,
+		stop:      make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.breaker == nil {
+		d.breaker = misc.NewBreaker(defaultBreakerThreshold, defaultBreakerCooldown)
+	}
+	spool, err := OpenSpool(d.spoolDir, d.spoolMax)
+	if err != nil {
+		return nil, fmt.Errorf("open audit spool: %w", err)
+	}
+	d.spool = spool
+	d.in = make(chan audit.Event, 4*d.batchSize)
+	d.batches = make(chan []audit.Event, batchQueueLen)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	d.wg.Add(2)
+	go d.collect()
+	go d.send()
+	return d, nil
+}
+
+// Notify queues the event for batched delivery. It does not wait for the network;
+// the caller's context only bounds the wait for queue space.
+func (d *Deliverer) Notify(ctx context.Context, evt audit.Event) error {
+	if d == nil {
+		return nil
+	}
+	select {
+	case <-d.stop:
+		return errDelivererClosed
+	default:
+	}
+	select {
+	case d.in <- evt:
+		return nil
+	case <-d.stop:
+		return errDelivererClosed
+	case <-ctx.Done():
+		return fmt.Errorf("queue audit event: %w", ctx.Err())
+	}
+}
+
+// Close flushes the pending batch and gives the sender a short window to deliver it.
+// Whatever is left is spooled and, with a spool directory, kept for the next start.
+func (d *Deliverer) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.stopOnce.Do(func() { close(d.stop) })
+	timer := time.NewTimer(d.drain)
+	defer timer.Stop()
+	select {
+	case <-d.drained:
+	case <-timer.C:
+	}
+	d.cancel()
+	d.wg.Wait()
+	return nil
+}
+
+// Stats reports delivery counters, spool usage and the age of the oldest undelivered batch.
+func (d *Deliverer) Stats() DeliveryStats {
+	st := DeliveryStats{
+		Breaker:      d.breaker.State().String(),
+		Delivered:    d.delivered.Load(),
+		Rejected:     d.rejected.Load(),
+		Failed:       d.failed.Load(),
+		Dropped:      d.spool.Dropped() + d.dropped.Load(),
+		SpoolBatches: d.spool.Len(),
+		SpoolBytes:   d.spool.Bytes(),
+	}
+	if oldest := d.spool.Oldest(); !oldest.IsZero() {
+		st.LagSeconds = d.now().Sub(oldest).Seconds()
+	}
+	return st
+}
+
+// collect groups incoming events into batches of batchSize or whatever arrived within interval.
+func (d *Deliverer) collect() {
+	defer d.wg.Done()
+	defer close(d.batches)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	batch := make([]audit.Event, 0, d.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		d.batches <- batch
+		batch = make([]audit.Event, 0, d.batchSize)
+	}
+	for {
+		select {
+		case evt := <-d.in:
+			batch = append(batch, evt)
+			if len(batch) >= d.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-d.stop:
+			for {
+				select {
+				case evt := <-d.in:
+					batch = append(batch, evt)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send replays the spool head first and sends new batches directly only while the spool
+// is empty, so order is kept across failures. Before it returns, every batch still queued
+// is spooled.
+func (d *Deliverer) send() {
+	defer d.wg.Done()
+	defer close(d.drained)
+	defer d.spoolQueued()
+	for {
+		if d.spool.Len() > 0 {
+			if !d.replay() && !d.pause() {
+				return
+			}
+			continue
+		}
+		select {
+		case batch, ok := <-d.batches:
+			if !ok {
+				return
+			}
+			if d.deliver(batch) {
+				continue
+			}
+			d.store(batch)
+			if !d.pause() {
+				return
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// replay sends the spool head and reports whether it left the spool.
+func (d *Deliverer) replay() bool {
+	events, seq, err := d.spool.Peek()
+	switch {
+	case errors.Is(err, errSpoolEmpty):
+		return true
+	case err != nil:
+		// An unreadable batch can never be sent; skip it rather than block the queue.
+		d.spool.Remove(seq)
+		d.failed.Add(1)
+		return true
+	}
+	if d.deliver(events) {
+		d.spool.Remove(seq)
+		return true
+	}
+	return false
+}
+
+// store spools a batch that could not be sent. If the spool cannot take it, the batch is
+// sent directly once more, out of order if older batches are spooled, and dropped if that
+// fails too.
+func (d *Deliverer) store(batch []audit.Event) {
+	err := d.spool.Append(batch)
+	if err == nil {
+		return
+	}
+	d.onError(fmt.Errorf("spool audit batch of %d events: %w", len(batch), err))
+	if d.deliver(batch) {
+		return
+	}
+	d.dropped.Add(int64(len(batch)))
+	d.onError(fmt.Errorf("dropped audit batch of %d events", len(batch)))
+}
+
+// spoolQueued moves the batches still queued for the sender into the spool.
+func (d *Deliverer) spoolQueued() {
+	for batch := range d.batches {
+		if err := d.spool.Append(batch); err != nil {
+			d.dropped.Add(int64(len(batch)))
+			d.onError(fmt.Errorf("spool audit batch of %d events: %w", len(batch), err))
+		}
+	}
+}
+
+// deliver sends one batch and reports whether it left the spool, either accepted or permanently rejected.
+func (d *Deliverer) deliver(events []audit.Event) bool {
+	if !d.breaker.Allow() {
+		return false
+	}
+	err := misc.Retry(d.ctx, d.backoff, isTemporary, func() error {
+		ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+		defer cancel()
+		return d.client.SendBatch(ctx, events)
+	})
+	if err == nil {
+		d.breaker.Success()
+		d.delivered.Add(int64(len(events)))
+		return true
+	}
+	var se *StatusError
+	if errors.As(err, &se) && !se.Temporary() {
+		// The collector is reachable but refuses the payload; retrying cannot help.
+		d.breaker.Success()
+		d.rejected.Add(int64(len(events)))
+		return true
+	}
+	d.breaker.Failure()
+	d.failed.Add(1)
+	return false
+}
+
+// pause waits one batch interval before the next attempt, spooling batches that arrive
+// meanwhile; it gives up once shutdown has begun.
+func (d *Deliverer) pause() bool {
+	timer := time.NewTimer(d.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case batch, ok := <-d.batches:
+			if !ok {
+				return false
+			}
+			d.store(batch)
+		case <-d.stop:
+			return false
+		case <-d.ctx.Done():
+			return false
+		}
+	}
+}
+
+// isTemporary treats everything except explicit 4xx rejections and cancellation as worth retrying.
+func isTemporary(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	return !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,273 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+type collector struct {
+	batches [][]audit.Event
+	mu      sync.Mutex
+	down    atomic.Bool
+	status  atomic.Int32
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.down.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if code := c.status.Load(); code != 0 {
+		w.WriteHeader(int(code))
+		return
+	}
+	var batch []audit.Event
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(BatchSizeHeader) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.batches = append(c.batches, batch)
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *collector) timestamps() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []int64
+	for _, b := range c.batches {
+		for _, e := range b {
+			out = append(out, e.Timestamp)
+		}
+	}
+	return out
+}
+
+func (c *collector) batchCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.batches)
+}
+
+func newTestDeliverer(t *testing.T, srv *httptest.Server, opts ...DeliveryOption) *Deliverer {
+	t.Helper()
+	cli, err := New(srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	opts = append([]DeliveryOption{
+		WithBackoff([]time.Duration{time.Millisecond}),
+		WithBatchInterval(10 * time.Millisecond),
+	}, opts...)
+	d, err := NewDeliverer(cli, opts...)
+	if err != nil {
+		t.Fatalf("NewDeliverer: %v", err)
+	}
+	return d
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func notifyRange(t *testing.T, d *Deliverer, from, to int64) {
+	t.Helper()
+	for ts := from; ts <= to; ts++ {
+		if err := d.Notify(context.Background(), audit.Event{Timestamp: ts}); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+}
+
+func assertOrdered(t *testing.T, got []int64, n int) {
+	t.Helper()
+	if len(got) != n {
+		t.Fatalf("want %d events, got %d: %v", n, len(got), got)
+	}
+	for i, ts := range got {
+		if ts != int64(i+1) {
+			t.Fatalf("events out of order: %v", got)
+		}
+	}
+}
+
+func TestDeliverer_BatchesBySize(t *testing.T) {
+	col := &collector{}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	d := newTestDeliverer(t, srv, WithBatchSize(5), WithBatchInterval(time.Hour))
+	notifyRange(t, d, 1, 10)
+	waitFor(t, func() bool { return len(col.timestamps()) == 10 })
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := col.batchCount(); got != 2 {
+		t.Fatalf("want 2 batches of 5, got %d", got)
+	}
+	assertOrdered(t, col.timestamps(), 10)
+	if st := d.Stats(); st.Delivered != 10 || st.SpoolBatches != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestDeliverer_SpoolsDuringOutageAndReplaysInOrder(t *testing.T) {
+	col := &collector{}
+	col.down.Store(true)
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d := newTestDeliverer(t, srv, WithBatchSize(3), WithSpool(dir, 0), WithBreaker(2, 20*time.Millisecond))
+	notifyRange(t, d, 1, 9)
+	waitFor(t, func() bool {
+		st := d.Stats()
+		return st.SpoolBatches == 3 && st.Failed > 0
+	})
+
+	st := d.Stats()
+	if st.Failed == 0 || st.Delivered != 0 || st.SpoolBytes == 0 || st.LagSeconds <= 0 {
+		t.Fatalf("unexpected stats during outage: %+v", st)
+	}
+
+	col.down.Store(false)
+	waitFor(t, func() bool { return len(col.timestamps()) == 9 })
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	assertOrdered(t, col.timestamps(), 9)
+	if st := d.Stats(); st.SpoolBatches != 0 || st.Breaker != "closed" {
+		t.Fatalf("spool not drained: %+v", st)
+	}
+}
+
+func TestDeliverer_SpoolSurvivesRestart(t *testing.T) {
+	col := &collector{}
+	col.down.Store(true)
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d := newTestDeliverer(t, srv, WithBatchSize(2), WithSpool(dir, 0))
+	d.drain = 10 * time.Millisecond
+	notifyRange(t, d, 1, 4)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if len(col.timestamps()) != 0 {
+		t.Fatal("nothing should be delivered while down")
+	}
+
+	col.down.Store(false)
+	d = newTestDeliverer(t, srv, WithBatchSize(2), WithSpool(dir, 0))
+	notifyRange(t, d, 5, 6)
+	waitFor(t, func() bool { return len(col.timestamps()) == 6 })
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	assertOrdered(t, col.timestamps(), 6)
+}
+
+func TestDeliverer_DropsRejectedBatches(t *testing.T) {
+	col := &collector{}
+	col.status.Store(http.StatusBadRequest)
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	d := newTestDeliverer(t, srv, WithBatchSize(2))
+	notifyRange(t, d, 1, 2)
+	waitFor(t, func() bool { return d.Stats().Rejected == 2 })
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if st := d.Stats(); st.SpoolBatches != 0 || st.Breaker != "closed" {
+		t.Fatalf("rejected batch must not stay spooled: %+v", st)
+	}
+}
+
+func TestDeliverer_SpoolsOnlyAfterFailure(t *testing.T) {
+	col := &collector{}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	d := newTestDeliverer(t, srv, WithBatchSize(2), WithSpool(dir, 0), WithErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}))
+	// Without its directory the spool cannot take a batch: only failed sends notice.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove spool dir: %v", err)
+	}
+
+	notifyRange(t, d, 1, 4)
+	waitFor(t, func() bool { return len(col.timestamps()) == 4 })
+	mu.Lock()
+	n := len(errs)
+	mu.Unlock()
+	if n != 0 {
+		t.Fatalf("healthy delivery must not touch the spool, got errors %v", errs)
+	}
+
+	col.down.Store(true)
+	notifyRange(t, d, 5, 6)
+	waitFor(t, func() bool { return d.Stats().Dropped == 2 })
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) == 0 {
+		t.Fatal("spool failure must be reported")
+	}
+}
+
+func TestSpool_EvictsOldestOverLimit(t *testing.T) {
+	s, err := OpenSpool("", 0)
+	if err != nil {
+		t.Fatalf("OpenSpool: %v", err)
+	}
+	if err := s.Append([]audit.Event{{Timestamp: 1}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	s.maxBytes = s.Bytes() + 1
+	if err := s.Append([]audit.Event{{Timestamp: 2}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if s.Len() != 1 || s.Dropped() != 1 {
+		t.Fatalf("want oldest evicted, len=%d dropped=%d", s.Len(), s.Dropped())
+	}
+	events, _, err := s.Peek()
+	if err != nil || len(events) != 1 || events[0].Timestamp != 2 {
+		t.Fatalf("unexpected head: %+v err=%v", events, err)
+	}
+}
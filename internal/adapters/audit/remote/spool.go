@@ -0,0 +1,236 @@
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+const spoolExt = ".json"
+
+// errSpoolEmpty is returned by Peek when nothing is waiting for delivery.
+var errSpoolEmpty = errors.New("audit spool is empty")
+
+type spoolEntry struct {
+	created time.Time
+	name    string
+	data    []byte
+	size    int64
+	seq     uint64
+	count   int
+}
+
+// Spool holds undelivered audit batches in FIFO order, bounded by total size.
+// With a directory each batch is one file named "<seq>-<count>.json", so order
+// survives restarts; without one batches are kept in memory.
+type Spool struct {
+	now      func() time.Time
+	dir      string
+	entries  []spoolEntry
+	maxBytes int64
+	bytes    int64
+	dropped  int64
+	seq      uint64
+	mu       sync.Mutex
+}
+
+// OpenSpool loads previously spooled batches from dir (if set) and returns the spool.
+// maxBytes bounds the total payload size; 0 means unbounded.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	s := &Spool{dir: dir, maxBytes: maxBytes, now: time.Now}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("mkdir audit spool: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, fmt.Errorf("list audit spool: %w", err)
+	}
+	for _, name := range files {
+		e, ok := parseSpoolName(name)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		e.size = info.Size()
+		e.created = info.ModTime()
+		s.entries = append(s.entries, e)
+		s.bytes += e.size
+		s.seq = max(s.seq, e.seq)
+	}
+	slices.SortFunc(s.entries, func(a, b spoolEntry) int {
+		switch {
+		case a.seq < b.seq:
+			return -1
+		case a.seq > b.seq:
+			return 1
+		default:
+			return 0
+		}
+	})
+	return s, nil
+}
+
+func parseSpoolName(path string) (spoolEntry, bool) {
+	base := strings.TrimSuffix(filepath.Base(path), spoolExt)
+	seqPart, countPart, ok := strings.Cut(base, "-")
+	if !ok {
+		return spoolEntry{}, false
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return spoolEntry{}, false
+	}
+	count, err := strconv.Atoi(countPart)
+	if err != nil {
+		return spoolEntry{}, false
+	}
+	return spoolEntry{name: path, seq: seq, count: count}, true
+}
+
+// Append stores a batch at the tail, evicting the oldest batches when the size bound is exceeded.
+func (s *Spool) Append(events []audit.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("marshal audit spool batch: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	e := spoolEntry{seq: s.seq, count: len(events), size: int64(len(data)), created: s.now()}
+	if s.dir == "" {
+		e.data = data
+	} else {
+		e.name = filepath.Join(s.dir, fmt.Sprintf("%020d-%d%s", e.seq, e.count, spoolExt))
+		if err := writeFileAtomic(e.name, data); err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, e)
+	s.bytes += e.size
+
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && len(s.entries) > 1 {
+		s.dropped += int64(s.entries[0].count)
+		s.removeHeadLocked()
+	}
+	return nil
+}
+
+// Peek returns the oldest batch without removing it.
+func (s *Spool) Peek() ([]audit.Event, uint64, error) {
+	s.mu.Lock()
+	if len(s.entries) == 0 {
+		s.mu.Unlock()
+		return nil, 0, errSpoolEmpty
+	}
+	head := s.entries[0]
+	s.mu.Unlock()
+
+	data := head.data
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(head.name); err != nil {
+			return nil, head.seq, fmt.Errorf("read audit spool: %w", err)
+		}
+	}
+	var events []audit.Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, head.seq, fmt.Errorf("decode audit spool: %w", err)
+	}
+	return events, head.seq, nil
+}
+
+// Remove deletes the batch with the given sequence number if it is still the head.
+func (s *Spool) Remove(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) > 0 && s.entries[0].seq == seq {
+		s.removeHeadLocked()
+	}
+}
+
+func (s *Spool) removeHeadLocked() {
+	head := s.entries[0]
+	if head.name != "" {
+		_ = os.Remove(head.name)
+	}
+	s.bytes -= head.size
+	s.entries = s.entries[1:]
+}
+
+// Len reports how many batches are waiting.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Bytes reports the total payload size of waiting batches.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Dropped reports how many events were evicted to honor the size bound.
+func (s *Spool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Oldest returns when the oldest waiting batch was spooled, or the zero time when empty.
+func (s *Spool) Oldest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) == 0 {
+		return time.Time{}
+	}
+	return s.entries[0].created
+}
+
+func writeFileAtomic(path string, data []byte) (retErr error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".spool-*")
+	if err != nil {
+		return fmt.Errorf("create audit spool file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		if retErr != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write audit spool file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("sync audit spool file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close audit spool file: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("rename audit spool file: %w", err)
+	}
+	return nil
+}
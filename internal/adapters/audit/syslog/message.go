@@ -0,0 +1,219 @@
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+// Facility is the syslog facility code of emitted messages.
+type Facility int
+
+// Facilities defined by RFC 5424.
+const (
+	FacilityKern Facility = iota
+	FacilityUser
+	FacilityMail
+	FacilityDaemon
+	FacilityAuth
+	FacilitySyslog
+	FacilityLPR
+	FacilityNews
+	FacilityUUCP
+	FacilityCron
+	FacilityAuthPriv
+	FacilityFTP
+	FacilityNTP
+	FacilityAudit
+	FacilityAlert
+	FacilityClock
+	FacilityLocal0
+	FacilityLocal1
+	FacilityLocal2
+	FacilityLocal3
+	FacilityLocal4
+	FacilityLocal5
+	FacilityLocal6
+	FacilityLocal7
+)
+
+const (
+	severityWarning = 4
+	severityInfo    = 6
+
+	nilValue       = "-"
+	maxHostnameLen = 255
+	maxAppNameLen  = 48
+	maxProcIDLen   = 128
+	maxMsgIDLen    = 32
+	maxSDNameLen   = 32
+)
+
+var facilityNames = map[string]Facility{
+	"kern": FacilityKern, "user": FacilityUser, "mail": FacilityMail, "daemon": FacilityDaemon,
+	"auth": FacilityAuth, "syslog": FacilitySyslog, "lpr": FacilityLPR, "news": FacilityNews,
+	"uucp": FacilityUUCP, "cron": FacilityCron, "authpriv": FacilityAuthPriv, "ftp": FacilityFTP,
+	"ntp": FacilityNTP, "audit": FacilityAudit, "alert": FacilityAlert, "clock": FacilityClock,
+	"local0": FacilityLocal0, "local1": FacilityLocal1, "local2": FacilityLocal2, "local3": FacilityLocal3,
+	"local4": FacilityLocal4, "local5": FacilityLocal5, "local6": FacilityLocal6, "local7": FacilityLocal7,
+}
+
+// ParseFacility maps a facility name such as "local0" or "authpriv", or its numeric code, to a Facility.
+func ParseFacility(s string) (Facility, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if f, ok := facilityNames[s]; ok {
+		return f, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= int(FacilityKern) && n <= int(FacilityLocal7) {
+		return Facility(n), nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility: %q", s)
+}
+
+// ParseStructuredData parses static structured-data params written as "key=value,key=value".
+func ParseStructuredData(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validSDName(name) {
+			return nil, fmt.Errorf("invalid syslog structured-data param: %q", pair)
+		}
+		params[name] = strings.TrimSpace(value)
+	}
+	return params, nil
+}
+
+// header holds the fixed parts of every message a Writer emits.
+type header struct {
+	params   map[string]string
+	hostname string
+	appName  string
+	procID   string
+	sdID     string
+	facility Facility
+}
+
+// format renders evt as an RFC 5424 message: the audit fields go into one SD-ELEMENT
+// and the versioned JSON event becomes the MSG part.
+func (h *header) format(evt audit.Event) ([]byte, error) {
+	evt = evt.Versioned()
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return nil, fmt.Errorf("marshal audit event: %w", err)
+	}
+
+	severity := severityInfo
+	if evt.Outcome == audit.OutcomeFailure {
+		severity = severityWarning
+	}
+	ts := nilValue
+	if evt.Timestamp > 0 {
+		ts = time.Unix(evt.Timestamp, 0).UTC().Format(time.RFC3339)
+	}
+
+	var b strings.Builder
+	b.Grow(len(payload) + 256)
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		int(h.facility)*8+severity, ts,
+		headerField(h.hostname, maxHostnameLen),
+		headerField(h.appName, maxAppNameLen),
+		headerField(h.procID, maxProcIDLen),
+		headerField(string(evt.Operation), maxMsgIDLen),
+	)
+
+	b.WriteByte('[')
+	b.WriteString(h.sdID)
+	writeParam(&b, "version", strconv.Itoa(evt.Version))
+	writeParam(&b, "operation", string(evt.Operation))
+	writeParam(&b, "outcome", string(evt.Outcome))
+	writeParam(&b, "metrics", strings.Join(evt.Metrics, ","))
+	writeParam(&b, "ip", evt.IPAddress)
+	writeParam(&b, "request_id", evt.RequestID)
+	writeParam(&b, "trace_id", evt.TraceID)
+	writeParam(&b, "actor", evt.Actor)
+	writeParam(&b, "error", evt.Error)
+	names := make([]string, 0, len(h.params))
+	for name := range h.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeParam(&b, name, h.params[name])
+	}
+	b.WriteString("] ")
+	b.Write(payload)
+	return []byte(b.String()), nil
+}
+
+func writeParam(b *strings.Builder, name, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteByte(' ')
+	b.WriteString(name)
+	b.WriteString(`="`)
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+}
+
+// headerField keeps a header field within RFC 5424 limits: printable US-ASCII, no spaces, bounded length.
+func headerField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	if s == "" {
+		return nilValue
+	}
+	return s
+}
+
+// validSDName reports whether s is a valid SD-NAME: 1-32 printable ASCII characters except '=', ' ', ']' and '"'.
+func validSDName(s string) bool {
+	if s == "" || len(s) > maxSDNameLen {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// validSDID reports whether s is a valid SD-ID; private IDs take the form name@enterprise-number.
+func validSDID(s string) bool {
+	name, pen, private := strings.Cut(s, "@")
+	if !private {
+		return validSDName(s)
+	}
+	if !validSDName(name) || pen == "" || strings.Contains(pen, "@") {
+		return false
+	}
+	for _, part := range strings.Split(pen, ".") {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return false
+		}
+	}
+	return validSDName(s)
+}
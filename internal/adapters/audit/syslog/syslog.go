@@ -0,0 +1,2 @@
+// Package syslog provides an RFC 5424 syslog audit sink.
+package syslog
@@ -0,0 +1,269 @@
+package syslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+const (
+	defaultAppName      = "golectra"
+	defaultSDID         = "audit@32473"
+	defaultUDPPort      = "514"
+	defaultTCPPort      = "601"
+	defaultWriteTimeout = 5 * time.Second
+)
+
+// Option customizes a Writer built by New.
+type Option func(*Writer)
+
+// WithFacility sets the facility of emitted messages; the default is local0.
+func WithFacility(f Facility) Option {
+	return func(w *Writer) {
+		w.hdr.facility = f
+	}
+}
+
+// WithAppName sets the APP-NAME header field; the default is "golectra".
+func WithAppName(name string) Option {
+	return func(w *Writer) {
+		if name != "" {
+			w.hdr.appName = name
+		}
+	}
+}
+
+// WithHostname overrides the HOSTNAME header field, which defaults to os.Hostname.
+func WithHostname(name string) Option {
+	return func(w *Writer) {
+		if name != "" {
+			w.hdr.hostname = name
+		}
+	}
+}
+
+// WithStructuredData sets the SD-ID of the audit element and static params added to every message.
+// An empty id keeps the default "audit@32473".
+func WithStructuredData(id string, params map[string]string) Option {
+	return func(w *Writer) {
+		if id != "" {
+			w.hdr.sdID = id
+		}
+		w.hdr.params = maps.Clone(params)
+	}
+}
+
+// WithWriteTimeout bounds dialing and writing a single message.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(w *Writer) {
+		if d > 0 {
+			w.timeout = d
+		}
+	}
+}
+
+// Writer sends audit events as RFC 5424 syslog messages over UDP, TCP or a local unix socket.
+// Stream transports use octet-counting framing (RFC 6587). The connection is dialed lazily
+// and redialed once when a write fails.
+type Writer struct {
+	conn    net.Conn
+	network string
+	addr    string
+	hdr     header
+	timeout time.Duration
+	mu      sync.Mutex
+	// gone is closed once the collector closes a stream connection.
+	gone <-chan struct{}
+	// stream is set when conn needs octet-counting framing.
+	stream bool
+}
+
+// New parses addr and returns a Writer for it. Supported forms are udp://host[:port],
+// tcp://host[:port] and unix:///path; the unix form uses a datagram socket when the
+// listener accepts one (as /dev/log and journald's syslog socket do) and a stream otherwise.
+func New(addr string, opts ...Option) (*Writer, error) {
+	network, address, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	w := &Writer{
+		network: network,
+		addr:    address,
+		timeout: defaultWriteTimeout,
+		hdr: header{
+			hostname: hostname,
+			appName:  defaultAppName,
+			procID:   strconv.Itoa(os.Getpid()),
+			sdID:     defaultSDID,
+			facility: FacilityLocal0,
+		},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.hdr.facility < FacilityKern || w.hdr.facility > FacilityLocal7 {
+		return nil, fmt.Errorf("invalid syslog facility: %d", w.hdr.facility)
+	}
+	if !validSDID(w.hdr.sdID) {
+		return nil, fmt.Errorf("invalid syslog structured-data id: %q", w.hdr.sdID)
+	}
+	for name := range w.hdr.params {
+		if !validSDName(name) {
+			return nil, fmt.Errorf("invalid syslog structured-data param: %q", name)
+		}
+	}
+	return w, nil
+}
+
+func parseAddr(addr string) (network, address string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid audit syslog address: %w", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Hostname() == "" {
+			return "", "", fmt.Errorf("audit syslog address %q has no host", addr)
+		}
+		port := u.Port()
+		if port == "" {
+			port = defaultUDPPort
+			if u.Scheme == "tcp" {
+				port = defaultTCPPort
+			}
+		}
+		return u.Scheme, net.JoinHostPort(u.Hostname(), port), nil
+	case "unix":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return "", "", fmt.Errorf("audit syslog address %q has no socket path", addr)
+		}
+		return "unix", path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported audit syslog scheme %q (want udp, tcp or unix)", u.Scheme)
+	}
+}
+
+// Notify formats evt and sends it as one syslog message.
+func (w *Writer) Notify(ctx context.Context, evt audit.Event) error {
+	if w == nil {
+		return nil
+	}
+	msg, err := w.hdr.format(evt)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.writeLocked(ctx, msg)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	// The collector may have restarted: drop the connection and try once more.
+	w.closeLocked()
+	if err2 := w.writeLocked(ctx, msg); err2 != nil {
+		return errors.Join(err, err2)
+	}
+	return nil
+}
+
+func (w *Writer) writeLocked(ctx context.Context, msg []byte) error {
+	if w.conn != nil && w.peerClosed() {
+		// A write into a half-closed stream would succeed and be lost; redial up front.
+		w.closeLocked()
+	}
+	if w.conn == nil {
+		conn, stream, err := w.dial(ctx)
+		if err != nil {
+			return err
+		}
+		w.conn, w.stream, w.gone = conn, stream, nil
+		if stream {
+			w.gone = watchPeer(conn)
+		}
+	}
+	if w.stream {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if _, err := w.conn.Write(msg); err != nil {
+		return fmt.Errorf("write syslog message: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) dial(ctx context.Context) (conn net.Conn, stream bool, err error) {
+	d := net.Dialer{Timeout: w.timeout}
+	if w.network != "unix" {
+		conn, err = d.DialContext(ctx, w.network, w.addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("dial syslog %s://%s: %w", w.network, w.addr, err)
+		}
+		return conn, w.network == "tcp", nil
+	}
+	conn, err = d.DialContext(ctx, "unixgram", w.addr)
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, err2 := d.DialContext(ctx, "unix", w.addr)
+	if err2 != nil {
+		return nil, false, fmt.Errorf("dial syslog socket %s: %w", w.addr, errors.Join(err, err2))
+	}
+	return conn, true, nil
+}
+
+// watchPeer drains conn in the background and closes the returned channel when the
+// collector hangs up. Collectors never write back, so the read only ends at EOF or error.
+func watchPeer(conn net.Conn) <-chan struct{} {
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	return gone
+}
+
+func (w *Writer) peerClosed() bool {
+	if w.gone == nil {
+		return false
+	}
+	select {
+	case <-w.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *Writer) closeLocked() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// Close releases the connection to the collector.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeLocked()
+	return nil
+}
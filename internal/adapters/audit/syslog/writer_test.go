@@ -0,0 +1,207 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+var testEvent = audit.Event{
+	Timestamp: 1735689600,
+	Operation: audit.OpUpsert,
+	Outcome:   audit.OutcomeSuccess,
+	Metrics:   []string{"Alloc", "PollCount"},
+	IPAddress: "10.0.0.1",
+	RequestID: "req-1",
+	TraceID:   "4bf92f3577b34da6a3ce929d0e0e4736",
+}
+
+func newTestWriter(t *testing.T, addr string, opts ...Option) *Writer {
+	t.Helper()
+	w, err := New(addr, append([]Option{WithHostname("host1")}, opts...)...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+func TestFormat(t *testing.T) {
+	h := header{hostname: "host 1", appName: "golectra", procID: "42", sdID: "audit@32473", facility: FacilityLocal4, params: map[string]string{"env": `pr"od]`}}
+
+	msg, err := h.format(testEvent)
+	if err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	want := `<166>1 2025-01-01T00:00:00Z host1 golectra 42 upsert [audit@32473 version="4" operation="upsert" outcome="success" metrics="Alloc,PollCount" ip="10.0.0.1" request_id="req-1" trace_id="4bf92f3577b34da6a3ce929d0e0e4736" env="pr\"od\]"] {"version":4,`
+	if !strings.HasPrefix(string(msg), want) {
+		t.Fatalf("unexpected message:\n%s\nwant prefix:\n%s", msg, want)
+	}
+
+	failed := testEvent
+	failed.Outcome, failed.Error, failed.Operation, failed.Timestamp = audit.OutcomeFailure, "boom", "", 0
+	msg, _ = h.format(failed)
+	if !strings.HasPrefix(string(msg), "<164>1 - host1 golectra 42 - [") || !strings.Contains(string(msg), `error="boom"`) {
+		t.Fatalf("unexpected failure message: %s", msg)
+	}
+}
+
+func TestParseFacilityAndStructuredData(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Facility
+		wantErr bool
+	}{
+		{in: "local0", want: FacilityLocal0},
+		{in: " AuthPriv ", want: FacilityAuthPriv},
+		{in: "13", want: FacilityAudit},
+		{in: "24", wantErr: true},
+		{in: "bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFacility(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("ParseFacility(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+
+	params, err := ParseStructuredData("env=prod, dc = eu1,")
+	if err != nil || len(params) != 2 || params["env"] != "prod" || params["dc"] != "eu1" {
+		t.Fatalf("ParseStructuredData = %v, %v", params, err)
+	}
+	if _, err := ParseStructuredData("bad key=1"); err == nil {
+		t.Fatal("expected error for invalid param name")
+	}
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		opts []Option
+	}{
+		{addr: "http://collector:514"},
+		{addr: "udp://:514"},
+		{addr: "unix://"},
+		{addr: "udp://collector", opts: []Option{WithStructuredData("bad id", nil)}},
+		{addr: "udp://collector", opts: []Option{WithStructuredData("audit@x", nil)}},
+		{addr: "udp://collector", opts: []Option{WithFacility(Facility(30))}},
+	} {
+		if _, err := New(tc.addr, tc.opts...); err == nil {
+			t.Fatalf("New(%q): expected error", tc.addr)
+		}
+	}
+}
+
+func TestWriter_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	w := newTestWriter(t, "udp://"+pc.LocalAddr().String(), WithFacility(FacilityAudit), WithAppName("metrics"))
+	if err := w.Notify(context.Background(), testEvent); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "<110>1 2025-01-01T00:00:00Z host1 metrics ") {
+		t.Fatalf("unexpected datagram: %s", got)
+	}
+}
+
+func readFrame(br *bufio.Reader) string {
+	size, err := br.ReadString(' ')
+	if err != nil {
+		return "read frame length: " + err.Error()
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		return "bad frame length " + size
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		return "read frame: " + err.Error()
+	}
+	return string(msg)
+}
+
+func TestWriter_TCPFramingAndReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	frames := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			frame := readFrame(bufio.NewReader(conn))
+			// Drop the connection after every message to force a redial.
+			_ = conn.Close()
+			frames <- frame
+		}
+	}()
+
+	w := newTestWriter(t, "tcp://"+ln.Addr().String())
+	for i := range 3 {
+		evt := testEvent
+		evt.RequestID = "req-" + strconv.Itoa(i)
+		if err := w.Notify(context.Background(), evt); err != nil {
+			t.Fatalf("Notify %d: %v", i, err)
+		}
+		select {
+		case got := <-frames:
+			if !strings.Contains(got, `request_id="req-`+strconv.Itoa(i)+`"`) {
+				t.Fatalf("frame %d: %s", i, got)
+			}
+			// Wait until the writer has seen the hang-up so the next event redials.
+			w.mu.Lock()
+			gone := w.gone
+			w.mu.Unlock()
+			<-gone
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not received", i)
+		}
+	}
+}
+
+func TestWriter_UnixDatagram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	w := newTestWriter(t, "unix://"+path)
+	if err := w.Notify(context.Background(), testEvent); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "<134>1 ") {
+		t.Fatalf("unexpected datagram: %s", got)
+	}
+}
@@ -0,0 +1,96 @@
+package ginserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+)
+
+// AuditLog handles `GET /api/v1/audit` and returns recorded audit events page by page.
+// Events carry client IPs and request details, so the endpoint answers 404 unless both a
+// reader and a token are configured, and 401 to requests without the bearer token.
+// Supported filters are `metric`, `ip`, `from` and `to` (Unix seconds or RFC 3339),
+// plus `limit` and the opaque `cursor` returned as `next_cursor` by the previous page.
+func (h *Handler) AuditLog(c *gin.Context) {
+	if h.auditReader == nil || h.auditToken == "" {
+		respondError(c, http.StatusNotFound, "audit query not configured")
+		return
+	}
+	if !bearerAuthorized(c, h.auditToken) {
+		c.Header("WWW-Authenticate", `Bearer realm="audit"`)
+		respondError(c, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "bad request: %v", err)
+		return
+	}
+	page, err := h.auditReader.Query(c.Request.Context(), q)
+	if err != nil {
+		if errors.Is(err, audit.ErrInvalidCursor) {
+			respondError(c, http.StatusBadRequest, "bad request: %v", err)
+			return
+		}
+		httpError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// bearerAuthorized reports whether the request carries `Authorization: Bearer <want>`.
+func bearerAuthorized(c *gin.Context, want string) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(want)) == 1
+}
+
+func parseAuditQuery(c *gin.Context) (audit.Query, error) {
+	q := audit.Query{
+		Metric: strings.TrimSpace(c.Query("metric")),
+		IP:     strings.TrimSpace(c.Query("ip")),
+		Cursor: c.Query("cursor"),
+	}
+	var err error
+	if q.From, err = parseAuditTime(c.Query("from")); err != nil {
+		return audit.Query{}, errors.New("invalid from")
+	}
+	if q.To, err = parseAuditTime(c.Query("to")); err != nil {
+		return audit.Query{}, errors.New("invalid to")
+	}
+	if q.From > 0 && q.To > 0 && q.From > q.To {
+		return audit.Query{}, errors.New("from is after to")
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return audit.Query{}, errors.New("invalid limit")
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// parseAuditTime accepts Unix seconds or an RFC 3339 timestamp; empty means unbounded.
+func parseAuditTime(raw string) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
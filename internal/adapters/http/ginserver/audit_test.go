@@ -0,0 +1,97 @@
+package ginserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+
+	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+	"github.com/vshulcz/Golectra/internal/services/metrics"
+)
+
+type fakeAuditReader struct {
+	got   audit.Query
+	page  audit.Page
+	err   error
+	calls int
+}
+
+func (f *fakeAuditReader) Query(_ context.Context, q audit.Query) (audit.Page, error) {
+	f.calls++
+	f.got = q
+	return f.page, f.err
+}
+
+func TestAuditLog(t *testing.T) {
+	reader := &fakeAuditReader{page: audit.Page{
+		Events:     []audit.Event{{Timestamp: 5, Metrics: []string{"Alloc"}}},
+		NextCursor: "abc",
+	}}
+	h := NewHandler(metrics.New(memrepo.New(), nil), WithAuditReader(reader), WithAuditToken("s3cret"))
+	srv := httptest.NewServer(NewRouter(h, zap.NewNop()))
+	defer srv.Close()
+	auth := map[string]string{"Authorization": "Bearer s3cret"}
+
+	for _, hdr := range []map[string]string{nil, {"Authorization": "Bearer wrong"}, {"Authorization": "s3cret"}} {
+		resp, _ := doReq(t, http.MethodGet, srv.URL+"/api/v1/audit", nil, hdr)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%v: want 401, got %d", hdr, resp.StatusCode)
+		}
+	}
+	if reader.calls != 0 {
+		t.Fatal("unauthorized requests must not reach the reader")
+	}
+
+	resp, body := doReq(t, http.MethodGet, srv.URL+"/api/v1/audit?metric=Alloc&ip=10.0.0.1&from=1970-01-01T00:01:40Z&to=200&limit=5&cursor=xyz", nil, auth)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	want := audit.Query{Metric: "Alloc", IP: "10.0.0.1", Cursor: "xyz", From: 100, To: 200, Limit: 5}
+	if reader.got != want {
+		t.Fatalf("want query %+v, got %+v", want, reader.got)
+	}
+	var page audit.Page
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(page.Events) != 1 || page.NextCursor != "abc" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	for _, q := range []string{"from=yesterday", "limit=0", "from=300&to=200"} {
+		resp, _ := doReq(t, http.MethodGet, srv.URL+"/api/v1/audit?"+q, nil, auth)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: want 400, got %d", q, resp.StatusCode)
+		}
+	}
+
+	reader.err = audit.ErrInvalidCursor
+	resp, _ = doReq(t, http.MethodGet, srv.URL+"/api/v1/audit?cursor=bad", nil, auth)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid cursor: want 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuditLog_NotConfigured(t *testing.T) {
+	srv := newServer(t, memrepo.New())
+	defer srv.Close()
+
+	resp, _ := doReq(t, http.MethodGet, srv.URL+"/api/v1/audit", nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", resp.StatusCode)
+	}
+
+	// A reader alone does not open the endpoint: it needs a token as well.
+	h := NewHandler(metrics.New(memrepo.New(), nil), WithAuditReader(&fakeAuditReader{}))
+	tokenless := httptest.NewServer(NewRouter(h, zap.NewNop()))
+	defer tokenless.Close()
+	resp, _ = doReq(t, http.MethodGet, tokenless.URL+"/api/v1/audit", nil, map[string]string{"Authorization": "Bearer "})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("without a token want 404, got %d", resp.StatusCode)
+	}
+}
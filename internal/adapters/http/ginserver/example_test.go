@@ -20,7 +20,7 @@ import (
 func newExampleRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	repo := memory.New()
-	svc := metrics.New(repo, nil, nil)
+	svc := metrics.New(repo, nil)
 	handler := ginserver.NewHandler(svc)
 	return ginserver.NewRouter(handler, zap.NewNop())
 }
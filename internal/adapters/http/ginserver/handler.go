@@ -1,6 +1,9 @@
 package ginserver
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,19 +14,55 @@ import (
 	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/vshulcz/Golectra/internal/adapters/http/ginserver/middlewares"
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/services/audit"
 	"github.com/vshulcz/Golectra/internal/services/metrics"
+	"github.com/vshulcz/Golectra/pkg/trace"
 )
 
 // Handler exposes HTTP endpoints for metric collection and inspection.
 type Handler struct {
-	svc *metrics.Service
+	svc         *metrics.Service
+	auditReader audit.Reader
+	auditToken  string
+	varsToken   string
+}
+
+// HandlerOption customizes a Handler built by NewHandler.
+type HandlerOption func(*Handler)
+
+// WithAuditReader backs `GET /api/v1/audit` with the given reader. The endpoint stays off
+// until WithAuditToken sets the token that callers must present.
+func WithAuditReader(r audit.Reader) HandlerOption {
+	return func(h *Handler) {
+		h.auditReader = r
+	}
+}
+
+// WithAuditToken requires `Authorization: Bearer <token>` on `GET /api/v1/audit`;
+// an empty token keeps the endpoint off.
+func WithAuditToken(token string) HandlerOption {
+	return func(h *Handler) {
+		h.auditToken = token
+	}
+}
+
+// WithDebugVarsToken requires `Authorization: Bearer <token>` on `GET /debug/vars`;
+// an empty token keeps the endpoint off.
+func WithDebugVarsToken(token string) HandlerOption {
+	return func(h *Handler) {
+		h.varsToken = token
+	}
 }
 
 // NewHandler wires a metrics service into a gin-compatible HTTP handler.
-func NewHandler(svc *metrics.Service) *Handler {
-	return &Handler{svc: svc}
+func NewHandler(svc *metrics.Service, opts ...HandlerOption) *Handler {
+	h := &Handler{svc: svc}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 var metricsBatchPool = sync.Pool{
@@ -52,6 +91,44 @@ func decodeMetricsBatch(r io.Reader) ([]domain.Metrics, func(), error) {
 	return items, cleanup, nil
 }
 
+// AgentIDHeader identifies the agent instance that sent a request.
+const AgentIDHeader = "X-Agent-ID"
+
+// APIKeyHeader carries an optional API key; only its fingerprint is recorded in audit events.
+const APIKeyHeader = "X-API-Key"
+
+// Caps for client-supplied values recorded in audit events.
+const (
+	maxUserAgentLen = 256
+	maxAgentIDLen   = 64
+)
+
+// auditContext attaches caller details from the request to the context passed to the service.
+// Everything but the IP comes from headers the client chose, so it is capped and the actor
+// is labelled unverified.
+func auditContext(c *gin.Context) context.Context {
+	return audit.WithRequestMeta(c.Request.Context(), audit.RequestMeta{
+		IPAddress: c.ClientIP(),
+		RequestID: middlewares.ClientValue(c.GetHeader(middlewares.RequestIDHeader), middlewares.MaxRequestIDLen),
+		UserAgent: middlewares.ClientValue(c.Request.UserAgent(), maxUserAgentLen),
+		Actor:     requestActor(c),
+		TraceID:   trace.TraceIDFromContext(c.Request.Context()),
+	})
+}
+
+// requestActor names the caller from X-Agent-ID or an X-API-Key fingerprint. Neither is
+// checked by the server, hence the "unverified-" prefix.
+func requestActor(c *gin.Context) string {
+	if id := middlewares.ClientValue(c.GetHeader(AgentIDHeader), maxAgentIDLen); id != "" {
+		return "unverified-agent:" + id
+	}
+	if key := strings.TrimSpace(c.GetHeader(APIKeyHeader)); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "unverified-apikey:" + hex.EncodeToString(sum[:])[:12]
+	}
+	return ""
+}
+
 func cloneMetrics(items []domain.Metrics) []domain.Metrics {
 	if len(items) == 0 {
 		return nil
@@ -61,11 +138,12 @@ func cloneMetrics(items []domain.Metrics) []domain.Metrics {
 	return clone
 }
 
-// UpdateMetric handles `POST /update/:type/:name/:value` with plain-text payloads.
+// UpdateMetric handles `POST /update/:type/:name/:value` with plain-text payloads. An `op`
+// query parameter picks the gauge operation, as the `op` field does in JSON.
 func (h *Handler) UpdateMetric(c *gin.Context) {
 	metricType, metricName, metricValue := c.Param("type"), c.Param("name"), c.Param("value")
 	if strings.TrimSpace(metricName) == "" {
-		c.String(http.StatusNotFound, "not found")
+		respondError(c, http.StatusNotFound, "not found")
 		return
 	}
 
@@ -74,7 +152,7 @@ func (h *Handler) UpdateMetric(c *gin.Context) {
 	case string(domain.Gauge):
 		val, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
-			c.String(http.StatusBadRequest, "bad request")
+			respondError(c, http.StatusBadRequest, "bad request")
 			return
 		}
 		m = domain.Metrics{ID: metricName, MType: metricType, Value: &val}
@@ -82,20 +160,27 @@ func (h *Handler) UpdateMetric(c *gin.Context) {
 	case string(domain.Counter):
 		val, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
-			c.String(http.StatusBadRequest, "bad request")
+			respondError(c, http.StatusBadRequest, "bad request")
 			return
 		}
 		m = domain.Metrics{ID: metricName, MType: metricType, Delta: &val}
 
 	default:
-		c.String(http.StatusBadRequest, "bad request")
+		respondError(c, http.StatusBadRequest, "bad request")
 		return
 	}
-	ctx := audit.WithClientIP(c.Request.Context(), c.ClientIP())
-	if _, err := h.svc.Upsert(ctx, m); err != nil {
+	m.Op = domain.GaugeOp(c.Query("op"))
+	if !expectedRevision(c, &m) {
+		respondError(c, http.StatusBadRequest, "bad request")
+		return
+	}
+	ctx := auditContext(c)
+	res, err := h.svc.Upsert(ctx, m)
+	if err != nil {
 		httpError(c, err)
 		return
 	}
+	setRevision(c, res.Revision)
 	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte("ok"))
 }
 
@@ -103,11 +188,12 @@ func (h *Handler) UpdateMetric(c *gin.Context) {
 func (h *Handler) GetMetric(c *gin.Context) {
 	metricType, metricName := c.Param("type"), c.Param("name")
 
-	res, err := h.svc.Get(c.Request.Context(), metricType, metricName)
+	res, err := h.svc.Get(auditContext(c), metricType, metricName)
 	if err != nil {
 		httpError(c, err)
 		return
 	}
+	setRevision(c, res.Revision)
 
 	switch metricType {
 	case string(domain.Gauge):
@@ -115,13 +201,13 @@ func (h *Handler) GetMetric(c *gin.Context) {
 	case string(domain.Counter):
 		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(strconv.FormatInt(*res.Delta, 10)))
 	default:
-		c.String(http.StatusBadRequest, "bad request")
+		respondError(c, http.StatusBadRequest, "bad request")
 	}
 }
 
 // Index renders a basic HTML dashboard with current gauge and counter values.
 func (h *Handler) Index(c *gin.Context) {
-	snap, err := h.svc.Snapshot(c.Request.Context())
+	snap, err := h.svc.Snapshot(auditContext(c))
 	if err != nil {
 		httpError(c, err)
 		return
@@ -159,19 +245,21 @@ func (h *Handler) Index(c *gin.Context) {
 }
 
 // UpdateMetricJSON handles `POST /update` requests with a JSON metric payload.
+// A gauge is written conditionally when the request carries If-Match or expected_revision.
 func (h *Handler) UpdateMetricJSON(c *gin.Context) {
 	var m domain.Metrics
-	if err := c.ShouldBindJSON(&m); err != nil || strings.TrimSpace(m.ID) == "" {
-		c.String(http.StatusBadRequest, "bad request")
+	if err := c.ShouldBindJSON(&m); err != nil || strings.TrimSpace(m.ID) == "" || !expectedRevision(c, &m) {
+		respondError(c, http.StatusBadRequest, "bad request")
 		return
 	}
 
-	ctx := audit.WithClientIP(c.Request.Context(), c.ClientIP())
+	ctx := auditContext(c)
 	res, err := h.svc.Upsert(ctx, m)
 	if err != nil {
 		httpError(c, err)
 		return
 	}
+	setRevision(c, res.Revision)
 	c.JSON(http.StatusOK, res)
 }
 
@@ -179,15 +267,16 @@ func (h *Handler) UpdateMetricJSON(c *gin.Context) {
 func (h *Handler) GetMetricJSON(c *gin.Context) {
 	var q domain.Metrics
 	if err := c.ShouldBindJSON(&q); err != nil || strings.TrimSpace(q.ID) == "" {
-		c.String(http.StatusBadRequest, "bad request")
+		respondError(c, http.StatusBadRequest, "bad request")
 		return
 	}
 
-	res, err := h.svc.Get(c.Request.Context(), q.MType, q.ID)
+	res, err := h.svc.Get(auditContext(c), q.MType, q.ID)
 	if err != nil {
 		httpError(c, err)
 		return
 	}
+	setRevision(c, res.Revision)
 	c.JSON(http.StatusOK, res)
 }
 
@@ -195,12 +284,12 @@ func (h *Handler) GetMetricJSON(c *gin.Context) {
 func (h *Handler) UpdateMetricsBatchJSON(c *gin.Context) {
 	items, release, err := decodeMetricsBatch(c.Request.Body)
 	if err != nil {
-		c.String(http.StatusBadRequest, "bad request")
+		respondError(c, http.StatusBadRequest, "bad request")
 		return
 	}
 	defer release()
 	items = cloneMetrics(items)
-	ctx := audit.WithClientIP(c.Request.Context(), c.ClientIP())
+	ctx := auditContext(c)
 	updated, err := h.svc.UpsertBatch(ctx, items)
 	if err != nil {
 		httpError(c, err)
@@ -212,34 +301,137 @@ func (h *Handler) UpdateMetricsBatchJSON(c *gin.Context) {
 // Ping proxies `GET /ping` to the storage health check.
 func (h *Handler) Ping(c *gin.Context) {
 	if err := h.svc.Ping(c.Request.Context()); err != nil {
-		c.String(http.StatusInternalServerError, "db ping error: %v", err)
+		respondError(c, http.StatusInternalServerError, "db ping error: %v", err)
 		return
 	}
 	c.String(http.StatusOK, "ok")
 }
 
 // SnapshotJSON handles `GET /api/v1/snapshot` and returns the current snapshot as JSON.
+// The response carries the store revision as an ETag and honors If-None-Match;
+// `?since=<rev>` limits the payload to metrics changed after that revision.
 func (h *Handler) SnapshotJSON(c *gin.Context) {
-	snap, err := h.svc.Snapshot(c.Request.Context())
+	ctx := auditContext(c)
+
+	var since int64
+	if raw, ok := c.GetQuery("since"); ok {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			respondError(c, http.StatusBadRequest, "bad request")
+			return
+		}
+		since = n
+	}
+
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		rev, err := h.svc.Revision(ctx)
+		if err != nil {
+			httpError(c, err)
+			return
+		}
+		if etagMatches(inm, revisionETag(rev)) {
+			c.Header("ETag", revisionETag(rev))
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	var (
+		snap domain.Snapshot
+		err  error
+	)
+	if since > 0 {
+		snap, err = h.svc.SnapshotSince(ctx, since)
+	} else {
+		snap, err = h.svc.Snapshot(ctx)
+	}
 	if err != nil {
 		httpError(c, err)
 		return
 	}
+	c.Header("ETag", revisionETag(snap.Revision))
 	c.JSON(http.StatusOK, gin.H{
+		"revision": snap.Revision,
 		"gauges":   snap.Gauges,
 		"counters": snap.Counters,
 	})
 }
 
+func revisionETag(rev int64) string {
+	return `"` + strconv.FormatInt(rev, 10) + `"`
+}
+
+// expectedRevision copies the revision named by an If-Match header into m; `If-Match: *`
+// only requires the gauge to exist. It reports false when the header is not a single quoted
+// revision or contradicts expected_revision. Weak validators (W/"...") are rejected on
+// purpose: If-Match uses strong comparison, and a revision ETag is always strong.
+func expectedRevision(c *gin.Context, m *domain.Metrics) bool {
+	raw := strings.TrimSpace(c.GetHeader("If-Match"))
+	if raw == "" {
+		return true
+	}
+	if raw == "*" {
+		m.MustExist = true
+		return true
+	}
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return false
+	}
+	rev, err := strconv.ParseInt(raw[1:len(raw)-1], 10, 64)
+	if err != nil || rev < 0 {
+		return false
+	}
+	if m.ExpectedRevision != nil && *m.ExpectedRevision != rev {
+		return false
+	}
+	m.ExpectedRevision = &rev
+	return true
+}
+
+// setRevision sends the metric revision as an ETag; counters and gauges served without a
+// revision get none.
+func setRevision(c *gin.Context, rev int64) {
+	if rev > 0 {
+		c.Header("ETag", revisionETag(rev))
+	}
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func httpError(c *gin.Context, err error) {
 	switch {
 	case err == nil:
 		return
 	case errors.Is(err, domain.ErrNotFound):
-		c.String(http.StatusNotFound, "not found")
+		respondError(c, http.StatusNotFound, "not found")
 	case errors.Is(err, domain.ErrInvalidType):
-		c.String(http.StatusBadRequest, "bad request")
+		respondError(c, http.StatusBadRequest, "bad request")
+	case errors.Is(err, domain.ErrRevisionMismatch):
+		respondError(c, http.StatusConflict, "conflict")
+	case errors.Is(err, domain.ErrUnavailable):
+		respondError(c, http.StatusServiceUnavailable, "service unavailable")
 	default:
-		c.String(http.StatusInternalServerError, "internal error")
+		respondError(c, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// respondError writes a plain-text error, suffixed with the trace ID when the request has one
+// so a client can quote it when reporting the failure.
+func respondError(c *gin.Context, code int, format string, values ...any) {
+	msg := fmt.Sprintf(format, values...)
+	if id := trace.TraceIDFromContext(c.Request.Context()); id != "" {
+		msg += " (trace_id=" + id + ")"
 	}
+	c.String(code, "%s", msg)
 }
@@ -39,6 +39,11 @@ func (r *benchRepo) GetGauge(_ context.Context, name string) (float64, error) {
 	return v, nil
 }
 
+func (r *benchRepo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	v, err := r.GetGauge(ctx, name)
+	return v, 0, err
+}
+
 func (r *benchRepo) GetCounter(_ context.Context, name string) (int64, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -56,14 +61,29 @@ func (r *benchRepo) SetGauge(_ context.Context, name string, value float64) erro
 	return nil
 }
 
-func (r *benchRepo) AddCounter(_ context.Context, name string, delta int64) error {
+func (r *benchRepo) CompareAndSetGauge(ctx context.Context, name string, value float64, _ int64) (domain.GaugeWrite, error) {
+	return r.ApplyGauge(ctx, name, domain.GaugeSet, value)
+}
+
+func (r *benchRepo) ApplyGauge(_ context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := domain.GaugeWrite{Value: value}
+	if cur, ok := r.gauges[name]; ok {
+		w.Old, w.Value = &cur, op.Apply(cur, value)
+	}
+	r.gauges[name] = w.Value
+	return w, nil
+}
+
+func (r *benchRepo) AddCounter(_ context.Context, name string, delta int64) (int64, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.counters[name] += delta
-	return nil
+	return r.counters[name], nil
 }
 
-func (r *benchRepo) UpdateMany(ctx context.Context, items []domain.Metrics) error {
+func (r *benchRepo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
 	for _, m := range items {
 		switch m.MType {
 		case string(domain.Gauge):
@@ -71,18 +91,18 @@ func (r *benchRepo) UpdateMany(ctx context.Context, items []domain.Metrics) erro
 				continue
 			}
 			if err := r.SetGauge(ctx, m.ID, *m.Value); err != nil {
-				return err
+				return domain.Snapshot{}, err
 			}
 		case string(domain.Counter):
 			if m.Delta == nil {
 				continue
 			}
-			if err := r.AddCounter(ctx, m.ID, *m.Delta); err != nil {
-				return err
+			if _, err := r.AddCounter(ctx, m.ID, *m.Delta); err != nil {
+				return domain.Snapshot{}, err
 			}
 		}
 	}
-	return nil
+	return domain.Snapshot{}, nil
 }
 
 func (r *benchRepo) Snapshot(_ context.Context) (domain.Snapshot, error) {
@@ -95,13 +115,19 @@ func (r *benchRepo) Snapshot(_ context.Context) (domain.Snapshot, error) {
 	return domain.Snapshot{Gauges: gauges, Counters: counters}, nil
 }
 
+func (r *benchRepo) SnapshotSince(ctx context.Context, _ int64) (domain.Snapshot, error) {
+	return r.Snapshot(ctx)
+}
+
+func (*benchRepo) Revision(context.Context) (int64, error) { return 0, nil }
+
 func (r *benchRepo) Ping(context.Context) error { return nil }
 
 func BenchmarkHandlerUpdateMetricsBatchJSON(b *testing.B) {
 	gin.SetMode(gin.ReleaseMode)
 
 	repo := newBenchRepo()
-	svc := metrics.New(repo, nil, nil)
+	svc := metrics.New(repo, nil)
 	handler := NewHandler(svc)
 
 	engine := gin.New()
@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -15,6 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/internal/services/audit"
 	"github.com/vshulcz/Golectra/internal/services/metrics"
 	"go.uber.org/zap"
 
@@ -22,15 +24,12 @@ import (
 	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
 )
 
-func newServer(t *testing.T, repo ports.MetricsRepo, onChanged ...func(context.Context, domain.Snapshot)) *httptest.Server {
+func newServer(t *testing.T, repo ports.MetricsRepo, subscribers ...metrics.ChangeObserver) *httptest.Server {
 	t.Helper()
 
-	var hook func(context.Context, domain.Snapshot)
-	if len(onChanged) > 0 {
-		hook = onChanged[0]
-	}
-
-	svc := metrics.New(repo, hook, nil)
+	bus := metrics.NewChangeBus()
+	bus.Attach(subscribers...)
+	svc := metrics.New(repo, nil, metrics.WithChangePublisher(bus))
 	h := NewHandler(svc)
 
 	r := NewRouter(
@@ -592,16 +591,17 @@ func TestHTTP_UpdatesBatch(t *testing.T) {
 		}
 	})
 
-	t.Run("onChanged_is_called_once_on_success", func(t *testing.T) {
+	t.Run("metrics_changed_is_published_once_on_success", func(t *testing.T) {
 		repo := memrepo.New()
 
 		called := make(chan struct{}, 1)
-		hook := func(_ context.Context, _ domain.Snapshot) {
+		hook := metrics.ChangeObserverFunc(func(_ context.Context, _ domain.MetricsChanged) error {
 			select {
 			case called <- struct{}{}:
 			default:
 			}
-		}
+			return nil
+		})
 		srv := newServer(t, repo, hook)
 		defer srv.Close()
 
@@ -616,7 +616,7 @@ func TestHTTP_UpdatesBatch(t *testing.T) {
 		select {
 		case <-called:
 		default:
-			t.Fatal("onChanged was not called")
+			t.Fatal("MetricsChanged was not published")
 		}
 	})
 }
@@ -627,19 +627,33 @@ func (*errUpdateManyRepo) GetGauge(context.Context, string) (float64, error) {
 	return 0, domain.ErrNotFound
 }
 
+func (*errUpdateManyRepo) GetGaugeWithRevision(context.Context, string) (float64, int64, error) {
+	return 0, 0, domain.ErrNotFound
+}
+
 func (*errUpdateManyRepo) GetCounter(context.Context, string) (int64, error) {
 	return 0, domain.ErrNotFound
 }
-func (*errUpdateManyRepo) SetGauge(context.Context, string, float64) error { return nil }
-func (*errUpdateManyRepo) AddCounter(context.Context, string, int64) error { return nil }
-func (*errUpdateManyRepo) UpdateMany(context.Context, []domain.Metrics) error {
-	return errors.New("boom")
+func (*errUpdateManyRepo) CompareAndSetGauge(context.Context, string, float64, int64) (domain.GaugeWrite, error) {
+	return domain.GaugeWrite{}, nil
+}
+func (*errUpdateManyRepo) ApplyGauge(context.Context, string, domain.GaugeOp, float64) (domain.GaugeWrite, error) {
+	return domain.GaugeWrite{}, nil
+}
+func (*errUpdateManyRepo) SetGauge(context.Context, string, float64) error          { return nil }
+func (*errUpdateManyRepo) AddCounter(context.Context, string, int64) (int64, error) { return 0, nil }
+func (*errUpdateManyRepo) UpdateMany(context.Context, []domain.Metrics) (domain.Snapshot, error) {
+	return domain.Snapshot{}, errors.New("boom")
 }
 
 func (*errUpdateManyRepo) Snapshot(context.Context) (domain.Snapshot, error) {
 	return domain.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}, nil
 }
-func (*errUpdateManyRepo) Ping(context.Context) error { return errors.New("db not configured") }
+func (r *errUpdateManyRepo) SnapshotSince(ctx context.Context, _ int64) (domain.Snapshot, error) {
+	return r.Snapshot(ctx)
+}
+func (*errUpdateManyRepo) Revision(context.Context) (int64, error) { return 0, nil }
+func (*errUpdateManyRepo) Ping(context.Context) error              { return errors.New("db not configured") }
 
 func TestSnapshotJSON_OK(t *testing.T) {
 	gin.SetMode(gin.TestMode)
@@ -651,11 +665,11 @@ func TestSnapshotJSON_OK(t *testing.T) {
 	if err := repo.SetGauge(context.TODO(), "HeapAlloc", 111); err != nil {
 		t.Fatal(err)
 	}
-	if err := repo.AddCounter(context.TODO(), "PollCount", 7); err != nil {
+	if _, err := repo.AddCounter(context.TODO(), "PollCount", 7); err != nil {
 		t.Fatal(err)
 	}
 
-	h := NewHandler(metrics.New(repo, nil, nil))
+	h := NewHandler(metrics.New(repo, nil))
 	r := gin.New()
 	r.GET("/api/v1/snapshot", h.SnapshotJSON)
 
@@ -682,6 +696,189 @@ func TestSnapshotJSON_OK(t *testing.T) {
 	}
 }
 
+func TestSnapshotJSON_ETagAndSince(t *testing.T) {
+	repo := memrepo.New()
+	srv := newServer(t, repo)
+	defer srv.Close()
+
+	if err := repo.SetGauge(context.TODO(), "Alloc", 1); err != nil {
+		t.Fatal(err)
+	}
+	resp, raw := doReq(t, http.MethodGet, srv.URL+"/api/v1/snapshot", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d body=%q", resp.StatusCode, string(raw))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	var first struct {
+		Gauges   map[string]float64 `json:"gauges"`
+		Revision int64              `json:"revision"`
+	}
+	mustUnmarshal(t, raw, &first)
+
+	resp, raw = doReq(t, http.MethodGet, srv.URL+"/api/v1/snapshot", nil, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified || len(raw) != 0 {
+		t.Fatalf("status=%d body=%q, want 304 without body", resp.StatusCode, string(raw))
+	}
+
+	if _, err := repo.AddCounter(context.TODO(), "PollCount", 5); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = doReq(t, http.MethodGet, srv.URL+"/api/v1/snapshot", nil, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("status=%d etag=%q, want 200 with a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	url := fmt.Sprintf("%s/api/v1/snapshot?since=%d", srv.URL, first.Revision)
+	resp, raw = doReq(t, http.MethodGet, url, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d body=%q", resp.StatusCode, string(raw))
+	}
+	var delta struct {
+		Gauges   map[string]float64 `json:"gauges"`
+		Counters map[string]int64   `json:"counters"`
+	}
+	mustUnmarshal(t, raw, &delta)
+	if len(delta.Gauges) != 0 || delta.Counters["PollCount"] != 5 {
+		t.Fatalf("unexpected delta: %+v", delta)
+	}
+
+	resp, _ = doReq(t, http.MethodGet, srv.URL+"/api/v1/snapshot?since=abc", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status=%d, want 400 for malformed since", resp.StatusCode)
+	}
+}
+
+func TestHTTP_GaugeRevisions(t *testing.T) {
+	srv := newServer(t, memrepo.New())
+	defer srv.Close()
+
+	update := func(body string, hdr map[string]string) (*http.Response, domain.Metrics) {
+		t.Helper()
+		resp, raw := doReq(t, http.MethodPost, srv.URL+"/update", []byte(body), hdr)
+		var got domain.Metrics
+		if resp.StatusCode == http.StatusOK {
+			mustUnmarshal(t, raw, &got)
+		}
+		return resp, got
+	}
+
+	resp, created := update(`{"id":"Temp","type":"gauge","value":1,"expected_revision":0}`, nil)
+	if resp.StatusCode != http.StatusOK || created.Revision <= 0 || resp.Header.Get("ETag") != revisionETag(created.Revision) {
+		t.Fatalf("create: status=%d body=%+v etag=%q", resp.StatusCode, created, resp.Header.Get("ETag"))
+	}
+	etag := resp.Header.Get("ETag")
+
+	resp, raw := doReq(t, http.MethodPost, srv.URL+"/value", []byte(`{"id":"Temp","type":"gauge"}`), nil)
+	var read domain.Metrics
+	mustUnmarshal(t, raw, &read)
+	if resp.StatusCode != http.StatusOK || read.Revision != created.Revision || resp.Header.Get("ETag") != etag {
+		t.Fatalf("read: status=%d body=%+v etag=%q", resp.StatusCode, read, resp.Header.Get("ETag"))
+	}
+	resp, _ = doReq(t, http.MethodGet, srv.URL+"/value/gauge/Temp", nil, nil)
+	if resp.Header.Get("ETag") != etag {
+		t.Fatalf("plain read: etag=%q, want %q", resp.Header.Get("ETag"), etag)
+	}
+
+	resp, updated := update(`{"id":"Temp","type":"gauge","value":2}`, map[string]string{"If-Match": etag})
+	if resp.StatusCode != http.StatusOK || updated.Revision <= created.Revision {
+		t.Fatalf("update: status=%d body=%+v", resp.StatusCode, updated)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		hdr      map[string]string
+		wantCode int
+	}{
+		{"stale If-Match", http.MethodPost, "/update", `{"id":"Temp","type":"gauge","value":3}`, map[string]string{"If-Match": etag}, http.StatusConflict},
+		{"stale expected_revision", http.MethodPost, "/update", fmt.Sprintf(`{"id":"Temp","type":"gauge","value":3,"expected_revision":%d}`, created.Revision), nil, http.StatusConflict},
+		{"create over existing", http.MethodPost, "/update", `{"id":"Temp","type":"gauge","value":3,"expected_revision":0}`, nil, http.StatusConflict},
+		{"stale plain-text update", http.MethodPost, "/update/gauge/Temp/3", "", map[string]string{"If-Match": etag}, http.StatusConflict},
+		{"header contradicts body", http.MethodPost, "/update", fmt.Sprintf(`{"id":"Temp","type":"gauge","value":3,"expected_revision":%d}`, updated.Revision), map[string]string{"If-Match": etag}, http.StatusBadRequest},
+		{"unquoted If-Match", http.MethodPost, "/update", `{"id":"Temp","type":"gauge","value":3}`, map[string]string{"If-Match": "5"}, http.StatusBadRequest},
+		{"weak If-Match", http.MethodPost, "/update", `{"id":"Temp","type":"gauge","value":3}`, map[string]string{"If-Match": "W/" + revisionETag(updated.Revision)}, http.StatusBadRequest},
+		{"If-Match any on a missing gauge", http.MethodPost, "/update", `{"id":"Nope","type":"gauge","value":3}`, map[string]string{"If-Match": "*"}, http.StatusConflict},
+		{"If-Match any on a counter", http.MethodPost, "/update/counter/Poll/1", "", map[string]string{"If-Match": "*"}, http.StatusBadRequest},
+		{"conditional counter", http.MethodPost, "/update", `{"id":"Poll","type":"counter","delta":1,"expected_revision":0}`, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			resp, raw := doReq(t, tt.method, srv.URL+tt.path, body, tt.hdr)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status=%d body=%q, want %d", resp.StatusCode, string(raw), tt.wantCode)
+			}
+		})
+	}
+
+	resp, raw = doReq(t, http.MethodGet, srv.URL+"/value/gauge/Temp", nil, nil)
+	if string(raw) != "2" || resp.Header.Get("ETag") != revisionETag(updated.Revision) {
+		t.Fatalf("rejected writes changed the gauge: %q etag=%q", string(raw), resp.Header.Get("ETag"))
+	}
+	if resp, _ := doReq(t, http.MethodGet, srv.URL+"/value/gauge/Nope", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("If-Match: * created a missing gauge: status=%d", resp.StatusCode)
+	}
+
+	resp, anyMatch := update(`{"id":"Temp","type":"gauge","value":4}`, map[string]string{"If-Match": "*"})
+	if resp.StatusCode != http.StatusOK || anyMatch.Revision <= updated.Revision {
+		t.Fatalf("If-Match: * on an existing gauge: status=%d body=%+v", resp.StatusCode, anyMatch)
+	}
+}
+
+func TestHTTP_GaugeOps(t *testing.T) {
+	srv := newServer(t, memrepo.New())
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		wantCode  int
+		wantValue string
+	}{
+		{"set", "/update/gauge/Load/4", "", http.StatusOK, "4"},
+		{"plain-text add", "/update/gauge/Load/2.5?op=add", "", http.StatusOK, "6.5"},
+		{"plain-text min", "/update/gauge/Load/3?op=min", "", http.StatusOK, "3"},
+		{"json max", "/update", `{"id":"Load","type":"gauge","value":10,"op":"max"}`, http.StatusOK, "10"},
+		{"json add", "/update", `{"id":"Load","type":"gauge","value":-1,"op":"add"}`, http.StatusOK, "9"},
+		{"batch", "/updates", `[{"id":"Load","type":"gauge","value":1,"op":"add"},{"id":"Load","type":"gauge","value":20,"op":"max"}]`, http.StatusOK, "20"},
+		{"unknown op", "/update/gauge/Load/1?op=avg", "", http.StatusBadRequest, "20"},
+		{"counter op", "/update/counter/Poll/1?op=add", "", http.StatusBadRequest, "20"},
+		{"op with revision", "/update", `{"id":"Load","type":"gauge","value":1,"op":"add","expected_revision":1}`, http.StatusBadRequest, "20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			resp, raw := doReq(t, http.MethodPost, srv.URL+tt.path, body, nil)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status=%d body=%q, want %d", resp.StatusCode, string(raw), tt.wantCode)
+			}
+			if tt.path == "/update" && tt.wantCode == http.StatusOK {
+				var got domain.Metrics
+				mustUnmarshal(t, raw, &got)
+				if fmt.Sprint(*got.Value) != tt.wantValue || got.Revision <= 0 {
+					t.Fatalf("want the resulting value %s with a revision, got %+v", tt.wantValue, got)
+				}
+			}
+			_, raw = doReq(t, http.MethodGet, srv.URL+"/value/gauge/Load", nil, nil)
+			if string(raw) != tt.wantValue {
+				t.Fatalf("stored value %q, want %s", string(raw), tt.wantValue)
+			}
+		})
+	}
+}
+
 func TestDecodeMetricsBatch(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -820,3 +1017,63 @@ func ptrFloat(f float64) *float64 {
 func ptrInt64(i int64) *int64 {
 	return &i
 }
+
+func TestAuditContext_CapsClientValues(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/update", nil)
+	c.Request.Header.Set(middlewares.RequestIDHeader, strings.Repeat("r", 500))
+	c.Request.Header.Set("User-Agent", strings.Repeat("u", 500))
+	c.Request.Header.Set(AgentIDHeader, "host-a\x07"+strings.Repeat("a", 100))
+
+	meta := audit.RequestMetaFromContext(auditContext(c))
+	if len(meta.RequestID) != middlewares.MaxRequestIDLen || len(meta.UserAgent) != maxUserAgentLen {
+		t.Fatalf("client values not capped: %d, %d", len(meta.RequestID), len(meta.UserAgent))
+	}
+	if want := "unverified-agent:host-a" + strings.Repeat("a", maxAgentIDLen-len("host-a")); meta.Actor != want {
+		t.Fatalf("actor=%q want %q", meta.Actor, want)
+	}
+
+	c.Request.Header.Del(AgentIDHeader)
+	c.Request.Header.Set(APIKeyHeader, "secret")
+	if got := requestActor(c); !strings.HasPrefix(got, "unverified-apikey:") {
+		t.Fatalf("actor=%q, want an unverified API key fingerprint", got)
+	}
+}
+
+func TestDebugVars_RequiresToken(t *testing.T) {
+	srv := newServer(t, memrepo.New())
+	defer srv.Close()
+	resp, _ := doReq(t, http.MethodGet, srv.URL+"/debug/vars", nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("without a token want 404, got %d", resp.StatusCode)
+	}
+
+	h := NewHandler(metrics.New(memrepo.New(), nil), WithDebugVarsToken("s3cret"))
+	gated := httptest.NewServer(NewRouter(h, zap.NewNop()))
+	defer gated.Close()
+	for _, hdr := range []map[string]string{nil, {"Authorization": "Bearer wrong"}, {"Authorization": "s3cret"}} {
+		resp, _ := doReq(t, http.MethodGet, gated.URL+"/debug/vars", nil, hdr)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%v: want 401, got %d", hdr, resp.StatusCode)
+		}
+	}
+}
+
+func TestDebugVars_HidesCmdline(t *testing.T) {
+	h := NewHandler(metrics.New(memrepo.New(), nil), WithDebugVarsToken("s3cret"))
+	srv := httptest.NewServer(NewRouter(h, zap.NewNop()))
+	defer srv.Close()
+
+	resp, body := doReq(t, http.MethodGet, srv.URL+"/debug/vars", nil, map[string]string{"Authorization": "Bearer s3cret"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status=%d", resp.StatusCode)
+	}
+	var vars map[string]json.RawMessage
+	mustUnmarshal(t, body, &vars)
+	if _, ok := vars["cmdline"]; ok {
+		t.Fatal("cmdline must not be published")
+	}
+	if _, ok := vars["memstats"]; ok {
+		t.Fatal("memstats must not be published")
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/vshulcz/Golectra/internal/misc"
+	"github.com/vshulcz/Golectra/pkg/trace"
 )
 
 type bodyBufferWriter struct {
@@ -43,7 +44,7 @@ func HashSHA256(key string) gin.HandlerFunc {
 		if got := strings.TrimSpace(c.GetHeader("HashSHA256")); got != "" {
 			reqBody, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "read body failed"})
+				c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, "read body failed"))
 			} else {
 				if err := c.Request.Body.Close(); err != nil {
 					_ = c.Error(err)
@@ -52,7 +53,7 @@ func HashSHA256(key string) gin.HandlerFunc {
 				if len(reqBody) > 0 {
 					want := misc.SumSHA256(reqBody, key)
 					if !strings.EqualFold(got, want) {
-						c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid hash"})
+						c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, "invalid hash"))
 					}
 				}
 			}
@@ -79,3 +80,12 @@ func HashSHA256(key string) gin.HandlerFunc {
 		}
 	}
 }
+
+// errorBody builds a JSON error carrying the request's trace ID, when it has one.
+func errorBody(c *gin.Context, msg string) gin.H {
+	body := gin.H{"error": msg}
+	if id := trace.TraceIDFromContext(c.Request.Context()); id != "" {
+		body["trace_id"] = id
+	}
+	return body
+}
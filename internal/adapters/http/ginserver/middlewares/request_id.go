@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the request correlation identifier.
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLen caps a client-supplied request ID.
+const MaxRequestIDLen = 128
+
+// RequestID makes sure every request carries an X-Request-ID, generating one when the client sent none,
+// and echoes it back in the response. A client-supplied ID is capped with ClientValue first.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := ClientValue(c.GetHeader(RequestIDHeader), MaxRequestIDLen)
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Request.Header.Set(RequestIDHeader, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// ClientValue trims a client-supplied header value, drops control characters and cuts it
+// to at most n bytes on a rune boundary, so it is safe to log and store.
+func ClientValue(v string, n int) string {
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(v))
+	if len(v) <= n {
+		return v
+	}
+	cut := n
+	for cut > 0 && !utf8.RuneStart(v[cut]) {
+		cut--
+	}
+	return v[:cut]
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,47 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/vshulcz/Golectra/pkg/trace"
+)
+
+// Traceparent continues the W3C trace named in the traceparent header, or starts a new one
+// when the header is missing or malformed, and stores the request span in the request context.
+// The request span is recorded with tracer, which may be nil, and its traceparent is echoed back.
+func Traceparent(tracer *trace.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if parent, err := trace.Parse(c.GetHeader(trace.Header)); err == nil {
+			ctx = trace.ContextWith(ctx, parent)
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route)
+		c.Request = c.Request.WithContext(ctx)
+		if sc, ok := trace.FromContext(ctx); ok {
+			c.Header(trace.Header, sc.String())
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttr("http.status", strconv.Itoa(status))
+		var err error
+		if status >= http.StatusInternalServerError {
+			err = statusError(status)
+		}
+		span.End(err)
+	}
+}
+
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
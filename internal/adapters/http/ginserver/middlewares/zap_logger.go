@@ -5,9 +5,12 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+
+	"github.com/vshulcz/Golectra/pkg/trace"
 )
 
-// ZapLogger logs structured request metadata for every HTTP call.
+// ZapLogger logs structured request metadata for every HTTP call, including the trace ID
+// set by Traceparent when that middleware runs first.
 func ZapLogger(l *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -20,12 +23,16 @@ func ZapLogger(l *zap.Logger) gin.HandlerFunc {
 		status := c.Writer.Status()
 		size := max(c.Writer.Size(), 0)
 
-		l.Info("http_request",
+		fields := []zap.Field{
 			zap.String("method", method),
 			zap.String("uri", uri),
 			zap.Int("status", status),
 			zap.Int("size", size),
 			zap.Duration("duration", latency),
-		)
+		}
+		if id := trace.TraceIDFromContext(c.Request.Context()); id != "" {
+			fields = append(fields, zap.String("trace_id", id))
+		}
+		l.Info("http_request", fields...)
 	}
 }
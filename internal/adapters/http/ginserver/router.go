@@ -21,14 +21,16 @@ func NewRouter(h *Handler, _ *zap.Logger, middlewares ...gin.HandlerFunc) *gin.E
 
 	r.HandleMethodNotAllowed = true
 	r.NoMethod(func(c *gin.Context) {
-		c.String(http.StatusMethodNotAllowed, "method not allowed")
+		respondError(c, http.StatusMethodNotAllowed, "method not allowed")
 	})
 
 	r.GET("/ping", h.Ping)
+	r.GET("/debug/vars", h.DebugVars)
 
 	r.POST("/update/:type/:name/:value", h.UpdateMetric)
 	r.GET("/value/:type/:name", h.GetMetric)
 	r.GET("/api/v1/snapshot", h.SnapshotJSON)
+	r.GET("/api/v1/audit", h.AuditLog)
 	r.GET("/", h.Index)
 
 	// JSON endpoints
@@ -0,0 +1,130 @@
+package ginserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/vshulcz/Golectra/internal/adapters/http/ginserver/middlewares"
+	memrepo "github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/traced"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/services/audit"
+	"github.com/vshulcz/Golectra/internal/services/metrics"
+	"github.com/vshulcz/Golectra/pkg/trace"
+)
+
+type spanRecorder struct {
+	spans []trace.Span
+	mu    sync.Mutex
+}
+
+func (r *spanRecorder) Export(s trace.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	spans := &spanRecorder{}
+	tracer := trace.NewTracer(spans)
+	var events []audit.Event
+	auditor := audit.NewSubject(audit.ObserverFunc(func(_ context.Context, evt audit.Event) error {
+		events = append(events, evt)
+		return nil
+	}))
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	repo := traced.New(&failingRepo{Repo: memrepo.New()}, tracer)
+	h := NewHandler(metrics.New(repo, auditor))
+	srv := httptest.NewServer(NewRouter(h, zap.NewNop(),
+		middlewares.Traceparent(tracer),
+		middlewares.ZapLogger(zap.New(core)),
+	))
+	defer srv.Close()
+
+	resp, _ := doReq(t, http.MethodPost, srv.URL+"/update/gauge/Alloc/1.5", nil, map[string]string{trace.Header: parent})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	echoed, err := trace.Parse(resp.Header.Get(trace.Header))
+	if err != nil || echoed.TraceID.String() != traceID || echoed.SpanID.String() == "00f067aa0ba902b7" {
+		t.Fatalf("want server span in trace %s, got %q", traceID, resp.Header.Get(trace.Header))
+	}
+	if len(events) != 1 || events[0].TraceID != traceID {
+		t.Fatalf("audit event missing trace id: %+v", events)
+	}
+	entry := logs.FilterMessage("http_request").All()
+	if len(entry) != 1 || entry[0].ContextMap()["trace_id"] != traceID {
+		t.Fatalf("log line missing trace id: %+v", entry)
+	}
+
+	spans.mu.Lock()
+	got := spans.spans
+	spans.mu.Unlock()
+	httpSpan := got[len(got)-1]
+	if httpSpan.Name != "POST /update/:type/:name/:value" || httpSpan.ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected http span: %+v", httpSpan)
+	}
+	repoSpan := findSpan(t, got, "repo.CompareAndSetGauge")
+	if repoSpan.ParentID != httpSpan.SpanID || repoSpan.TraceID != traceID || repoSpan.Attrs["metric"] != "Alloc" {
+		t.Fatalf("repo span not linked to the request: %+v", repoSpan)
+	}
+
+	// Without a usable header the server starts its own trace and names it in errors.
+	resp, body := doReq(t, http.MethodPost, srv.URL+"/update/gauge/Broken/1", nil, map[string]string{trace.Header: "garbage"})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("want 500, got %d", resp.StatusCode)
+	}
+	generated, err := trace.Parse(resp.Header.Get(trace.Header))
+	if err != nil || generated.TraceID.String() == traceID {
+		t.Fatalf("want a fresh trace, got %q", resp.Header.Get(trace.Header))
+	}
+	if !strings.Contains(string(body), "trace_id="+generated.TraceID.String()) {
+		t.Fatalf("error body should carry the trace id: %s", body)
+	}
+	spans.mu.Lock()
+	got = spans.spans
+	spans.mu.Unlock()
+	if failed := findSpan(t, got, "repo.CompareAndSetGauge"); failed.Error != "disk on fire" || failed.TraceID != generated.TraceID.String() {
+		t.Fatalf("failed repo call should be recorded as an error: %+v", failed)
+	}
+	if last := got[len(got)-1]; last.Error == "" || last.Attrs["http.status"] != "500" {
+		t.Fatalf("failed request span: %+v", last)
+	}
+}
+
+// findSpan returns the last span with the given name.
+func findSpan(t *testing.T, spans []trace.Span, name string) trace.Span {
+	t.Helper()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name == name {
+			return spans[i]
+		}
+	}
+	t.Fatalf("no %s span in %+v", name, spans)
+	return trace.Span{}
+}
+
+type failingRepo struct {
+	*memrepo.Repo
+}
+
+func (r *failingRepo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	if name == "Broken" {
+		return domain.GaugeWrite{}, errors.New("disk on fire")
+	}
+	return r.Repo.CompareAndSetGauge(ctx, name, value, expected)
+}
@@ -0,0 +1,52 @@
+package ginserver
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hiddenVars are the expvar built-ins left out of /debug/vars: cmdline carries the
+// server's flags, signing and audit keys and DSN included, and memstats is not a stat
+// this server publishes.
+var hiddenVars = map[string]bool{
+	"cmdline":  true,
+	"memstats": true,
+}
+
+// DebugVars handles `GET /debug/vars`. The stats name sinks, paths and delivery state, so
+// the endpoint answers 404 unless WithDebugVarsToken is set, and 401 without the token.
+func (h *Handler) DebugVars(c *gin.Context) {
+	if h.varsToken == "" {
+		respondError(c, http.StatusNotFound, "debug vars not configured")
+		return
+	}
+	if !bearerAuthorized(c, h.varsToken) {
+		c.Header("WWW-Authenticate", `Bearer realm="debug"`)
+		respondError(c, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	debugVars(c)
+}
+
+// debugVars writes the published expvar stats in expvar's JSON layout, without hiddenVars.
+func debugVars(c *gin.Context) {
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := c.Writer
+	_, _ = w.WriteString("{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenVars[kv.Key] {
+			return
+		}
+		if !first {
+			_, _ = w.WriteString(",\n")
+		}
+		first = false
+		_, _ = w.WriteString(strconv.Quote(kv.Key) + ": " + kv.Value.String())
+	})
+	_, _ = w.WriteString("\n}\n")
+}
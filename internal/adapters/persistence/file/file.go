@@ -1,42 +1,330 @@
 // Package file implements a filesystem-based metrics snapshot persister.
+//
+// A snapshot is a JSON envelope holding a format version, a generation number, the creation
+// time, the item count and a CRC-32 of the items, optionally gzip-compressed. Older
+// generations are kept next to the newest one as path.1, path.2 and so on, and Restore falls
+// back to the newest generation that passes its checks. Files written before the envelope
+// existed, a bare JSON array of metrics, are still restored.
 package file
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/ports"
 )
 
-// Persister flushes and restores metric snapshots using a JSON file.
+const (
+	formatVersion      = 1
+	defaultGenerations = 3
+)
+
+var errCorrupt = errors.New("snapshot corrupt")
+
+// envelope is the on-disk snapshot format.
+type envelope struct {
+	Version    int       `json:"version"`
+	Generation uint64    `json:"generation"`
+	CreatedAt  time.Time `json:"created_at"`
+	Count      int       `json:"count"`
+	CRC32      uint32    `json:"crc32"`
+	// Revision is the store revision the snapshot was taken at.
+	Revision int64 `json:"revision,omitempty"`
+	// Items is kept raw so the checksum covers exactly what was written.
+	Items json.RawMessage `json:"items"`
+}
+
+// Option customizes a Persister built by New.
+type Option func(*Persister)
+
+// WithGenerations keeps the n newest snapshots: path and path.1 up to path.(n-1).
+func WithGenerations(n int) Option {
+	return func(p *Persister) {
+		if n > 0 {
+			p.generations = n
+		}
+	}
+}
+
+// WithCompression gzips the snapshots written by Save. Restore detects compression
+// by itself, so the setting can change between runs.
+func WithCompression(on bool) Option {
+	return func(p *Persister) {
+		p.compress = on
+	}
+}
+
+// WithRestoreGeneration makes Restore load path.n instead of the newest valid snapshot,
+// without falling back to other generations. Zero restores the newest.
+func WithRestoreGeneration(n int) Option {
+	return func(p *Persister) {
+		if n >= 0 {
+			p.restoreGen = n
+		}
+	}
+}
+
+// WithErrorHandler receives the reason every generation skipped by Restore was rejected.
+func WithErrorHandler(fn func(error)) Option {
+	return func(p *Persister) {
+		if fn != nil {
+			p.onError = fn
+		}
+	}
+}
+
+// Persister flushes and restores metric snapshots using JSON files.
 type Persister struct {
-	path string
+	onError     func(error)
+	path        string
+	generations int
+	restoreGen  int
+	gen         uint64
+	mu          sync.Mutex
+	compress    bool
+	genLoaded   bool
 }
 
+var _ ports.Persister = (*Persister)(nil)
+
 // New returns a Persister bound to the provided filesystem path.
-func New(path string) *Persister {
-	return &Persister{path: path}
+func New(path string, opts ...Option) *Persister {
+	p := &Persister{
+		path:        path,
+		generations: defaultGenerations,
+		onError:     func(error) {},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-// Save writes the snapshot to disk atomically.
+// Save writes the snapshot as a new generation: it is written to a temporary file first,
+// then the older generations are shifted and the new file is renamed into place.
 func (p *Persister) Save(_ context.Context, s domain.Snapshot) error {
-	items := flattenSnapshot(s)
-	return writeJSONAtomic(p.path, items)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.genLoaded {
+		p.gen = p.lastGeneration()
+		p.genLoaded = true
+	}
+
+	data, err := p.encode(s, p.gen+1)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p.path)
+	if dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+	}
+	tmpName, err := writeTemp(dir, data)
+	if err != nil {
+		return err
+	}
+	if err := p.shift(); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, p.path); err != nil {
+		_ = os.Remove(tmpName)
+		return fmt.Errorf("rename: %w", err)
+	}
+	p.gen++
+	return nil
+}
+
+func (p *Persister) encode(s domain.Snapshot, gen uint64) ([]byte, error) {
+	items := s.Items()
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	data, err := json.Marshal(envelope{
+		Version:    formatVersion,
+		Generation: gen,
+		CreatedAt:  time.Now().UTC(),
+		Count:      len(items),
+		CRC32:      crc32.ChecksumIEEE(raw),
+		Revision:   s.Revision,
+		Items:      raw,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	if !p.compress {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// shift moves path to path.1, path.1 to path.2 and so on, dropping the generations
+// beyond the configured count.
+func (p *Persister) shift() error {
+	gens, err := p.list()
+	if err != nil {
+		return err
+	}
+	for _, g := range slices.Backward(gens) {
+		if g.index == 0 && p.generations == 1 {
+			// The rename in Save replaces it atomically.
+			continue
+		}
+		if g.index+1 >= p.generations {
+			if err := os.Remove(g.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remove old generation: %w", err)
+			}
+			continue
+		}
+		if err := os.Rename(g.path, p.genPath(g.index+1)); err != nil {
+			return fmt.Errorf("rotate generation: %w", err)
+		}
+	}
+	return nil
+}
+
+// revisionAdvancer is implemented by repositories that can carry a restored revision on.
+type revisionAdvancer interface {
+	AdvanceRevision(rev int64)
 }
 
-// Restore loads metrics from disk and replays them into the provided repository.
-func (p *Persister) Restore(ctx context.Context, repo ports.MetricsRepo) (retErr error) {
-	f, err := os.Open(p.path)
+// Restore loads the newest snapshot that passes its checks and replays it into the
+// provided repository; a missing file restores nothing. Nothing is applied unless a
+// whole generation was read and verified. Repositories that implement AdvanceRevision
+// are moved past the revision the snapshot was saved at.
+func (p *Persister) Restore(ctx context.Context, repo ports.MetricsRepo) error {
+	if p.restoreGen > 0 {
+		path := p.genPath(p.restoreGen)
+		items, env, err := readSnapshot(path)
+		if err != nil {
+			return fmt.Errorf("generation %d: %w", p.restoreGen, err)
+		}
+		return apply(ctx, repo, items, env)
+	}
+
+	gens, err := p.list()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, g := range gens {
+		items, env, err := readSnapshot(g.path)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", g.path, err)
+			p.onError(err)
+			errs = append(errs, err)
+			continue
+		}
+		return apply(ctx, repo, items, env)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("no valid snapshot: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func apply(ctx context.Context, repo ports.MetricsRepo, items []domain.Metrics, env envelope) error {
+	if _, err := repo.UpdateMany(ctx, items); err != nil {
+		return err
+	}
+	if ra, ok := repo.(revisionAdvancer); ok {
+		ra.AdvanceRevision(env.Revision)
+	}
+	return nil
+}
+
+// lastGeneration finds the highest generation number on disk so numbering continues
+// across restarts.
+func (p *Persister) lastGeneration() uint64 {
+	gens, err := p.list()
+	if err != nil {
+		return 0
+	}
+	var last uint64
+	for _, g := range gens {
+		if _, env, err := readSnapshot(g.path); err == nil {
+			last = max(last, env.Generation)
+		}
+	}
+	return last
+}
+
+type generation struct {
+	path  string
+	index int
+}
+
+// list returns the snapshot files on disk, newest first.
+func (p *Persister) list() ([]generation, error) {
+	dir, base := filepath.Split(p.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return nil
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list generations: %w", err)
+	}
+	var gens []generation
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if name == base {
+			gens = append(gens, generation{path: p.path})
+			continue
+		}
+		suffix, ok := strings.CutPrefix(name, base+".")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(suffix); err == nil && n > 0 {
+			gens = append(gens, generation{path: p.genPath(n), index: n})
 		}
-		return fmt.Errorf("open: %w", err)
+	}
+	slices.SortFunc(gens, func(a, b generation) int { return a.index - b.index })
+	return gens, nil
+}
+
+func (p *Persister) genPath(n int) string {
+	if n == 0 {
+		return p.path
+	}
+	return p.path + "." + strconv.Itoa(n)
+}
+
+func readSnapshot(path string) (items []domain.Metrics, env envelope, retErr error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, envelope{}, fmt.Errorf("open: %w", err)
 	}
 	defer func() {
 		if cerr := f.Close(); cerr != nil && retErr == nil {
@@ -44,65 +332,75 @@ func (p *Persister) Restore(ctx context.Context, repo ports.MetricsRepo) (retErr
 		}
 	}()
 
-	var items []domain.Metrics
-	if err := json.NewDecoder(f).Decode(&items); err != nil {
-		return fmt.Errorf("decode: %w", err)
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, envelope{}, fmt.Errorf("decompress: %w", err)
+		}
+		defer func() { _ = zr.Close() }()
+		r = zr
 	}
-
-	return repo.UpdateMany(ctx, items)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, envelope{}, fmt.Errorf("read: %w", err)
+	}
+	return decodeSnapshot(data)
 }
 
-func flattenSnapshot(s domain.Snapshot) []domain.Metrics {
-	total := len(s.Gauges) + len(s.Counters)
-	items := make([]domain.Metrics, 0, total)
-	for k, v := range s.Gauges {
-		vv := v
-		items = append(items, domain.Metrics{ID: k, MType: string(domain.Gauge), Value: &vv})
+func decodeSnapshot(data []byte) ([]domain.Metrics, envelope, error) {
+	var items []domain.Metrics
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// Written before the envelope existed: no checks to run.
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, envelope{}, fmt.Errorf("decode: %w", err)
+		}
+		return items, envelope{}, nil
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, envelope{}, fmt.Errorf("decode: %w", err)
+	}
+	if env.Version != formatVersion {
+		return nil, envelope{}, fmt.Errorf("unsupported snapshot version %d", env.Version)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, env.Items); err != nil {
+		return nil, envelope{}, fmt.Errorf("decode: %w", err)
+	}
+	if crc32.ChecksumIEEE(compact.Bytes()) != env.CRC32 {
+		return nil, envelope{}, fmt.Errorf("%w: checksum mismatch", errCorrupt)
 	}
-	for k, d := range s.Counters {
-		dd := d
-		items = append(items, domain.Metrics{ID: k, MType: string(domain.Counter), Delta: &dd})
+	if err := json.Unmarshal(env.Items, &items); err != nil {
+		return nil, envelope{}, fmt.Errorf("decode: %w", err)
 	}
-	return items
+	if len(items) != env.Count {
+		return nil, envelope{}, fmt.Errorf("%w: %d items, header says %d", errCorrupt, len(items), env.Count)
+	}
+	return items, env, nil
 }
 
-func writeJSONAtomic(path string, items []domain.Metrics) (retErr error) {
-	dir := filepath.Dir(path)
-	if dir != "" && dir != "." {
-		if err := os.MkdirAll(dir, 0o750); err != nil {
-			return fmt.Errorf("mkdir: %w", err)
-		}
-	}
+// writeTemp writes data to a new temporary file in dir and syncs it.
+func writeTemp(dir string, data []byte) (name string, retErr error) {
 	tmp, err := os.CreateTemp(dir, ".metrics-*")
 	if err != nil {
-		return fmt.Errorf("create tmp: %w", err)
+		return "", fmt.Errorf("create tmp: %w", err)
 	}
-	tmpName := tmp.Name()
-	cleanup := true
 	defer func() {
-		if tmp != nil {
-			if cerr := tmp.Close(); cerr != nil && retErr == nil {
-				retErr = fmt.Errorf("close tmp: %w", cerr)
-			}
+		if cerr := tmp.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close tmp: %w", cerr)
 		}
-		if cleanup {
-			if err := os.Remove(tmpName); err != nil && retErr == nil {
-				retErr = fmt.Errorf("remove tmp: %w", err)
-			}
+		if retErr != nil {
+			_ = os.Remove(tmp.Name())
 		}
 	}()
-	enc := json.NewEncoder(tmp)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(items); err != nil {
-		return fmt.Errorf("encode: %w", err)
+	if _, err := tmp.Write(data); err != nil {
+		return "", fmt.Errorf("write tmp: %w", err)
 	}
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("close tmp: %w", err)
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("sync tmp: %w", err)
 	}
-	tmp = nil
-	if err := os.Rename(tmpName, path); err != nil {
-		return fmt.Errorf("rename: %w", err)
-	}
-	cleanup = false
-	return nil
+	return tmp.Name(), nil
 }
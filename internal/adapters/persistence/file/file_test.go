@@ -1,12 +1,14 @@
 package file
 
 import (
+	"bytes"
 	"context"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
 )
 
 func mustSetGauge(t *testing.T, repo *memory.Repo, name string, value float64) {
@@ -18,7 +20,7 @@ func mustSetGauge(t *testing.T, repo *memory.Repo, name string, value float64) {
 
 func mustAddCounter(t *testing.T, repo *memory.Repo, name string, delta int64) {
 	t.Helper()
-	if err := repo.AddCounter(context.TODO(), name, delta); err != nil {
+	if _, err := repo.AddCounter(context.TODO(), name, delta); err != nil {
 		t.Fatalf("AddCounter %s: %v", name, err)
 	}
 }
@@ -100,6 +102,24 @@ func TestRestore(t *testing.T) {
 	}
 }
 
+func TestRestore_Revision(t *testing.T) {
+	p := New(filepath.Join(t.TempDir(), "metrics.json"))
+	if err := p.Save(context.TODO(), domain.Snapshot{
+		Gauges:   map[string]float64{"Alloc": 1},
+		Revision: 1 << 40,
+	}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	s := memory.New(memory.WithRevisionBase(100))
+	if err := p.Restore(context.TODO(), s); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if rev, _ := s.Revision(context.TODO()); rev != 1<<40 {
+		t.Fatalf("revision=%d, want the saved %d", rev, int64(1<<40))
+	}
+}
+
 func TestSave_CreateError(t *testing.T) {
 	dir := t.TempDir()
 	p := New(dir)
@@ -111,3 +131,167 @@ func TestSave_CreateError(t *testing.T) {
 		t.Fatal("expected error when saving to directory path, got nil")
 	}
 }
+
+func saveGauge(t *testing.T, p *Persister, value float64) {
+	t.Helper()
+	s := memory.New()
+	mustSetGauge(t, s, "Alloc", value)
+	snap, err := s.Snapshot(context.TODO())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := p.Save(context.TODO(), snap); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+}
+
+func restoredGauge(t *testing.T, p *Persister) float64 {
+	t.Helper()
+	s := memory.New()
+	if err := p.Restore(context.TODO(), s); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	v, err := s.GetGauge(context.TODO(), "Alloc")
+	if err != nil {
+		t.Fatalf("GetGauge: %v", err)
+	}
+	return v
+}
+
+func TestSave_Envelope(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	p := New(file)
+	saveGauge(t, p, 1)
+	saveGauge(t, p, 2)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	items, env, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Version != formatVersion || env.Generation != 2 || env.Count != 1 || len(items) != 1 || env.CreatedAt.IsZero() {
+		t.Fatalf("unexpected envelope: %+v", env)
+	}
+
+	// Numbering continues in a new process.
+	saveGauge(t, New(file), 3)
+	if _, env, err := readSnapshot(file); err != nil || env.Generation != 3 {
+		t.Fatalf("want generation 3, got %+v, %v", env, err)
+	}
+}
+
+func TestSave_Generations(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "metrics.json")
+	p := New(file, WithGenerations(2))
+	for i := range 4 {
+		saveGauge(t, p, float64(i))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "metrics.json" || names[1] != "metrics.json.1" {
+		t.Fatalf("want the two newest generations, got %v", names)
+	}
+	if v := restoredGauge(t, New(file, WithRestoreGeneration(1))); v != 2 {
+		t.Fatalf("generation 1 = %v, want 2", v)
+	}
+}
+
+func TestRestore_Fallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, path string)
+	}{
+		{"checksum", func(t *testing.T, path string) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			data = bytes.Replace(data, []byte(`"value":3`), []byte(`"value":9`), 1)
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}},
+		{"truncated", func(t *testing.T, path string) {
+			if err := os.Truncate(path, 10); err != nil {
+				t.Fatalf("truncate: %v", err)
+			}
+		}},
+		{"missing", func(t *testing.T, path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "metrics.json")
+			p := New(file)
+			for _, v := range []float64{1, 2, 3} {
+				saveGauge(t, p, v)
+			}
+			tt.corrupt(t, file)
+
+			var skipped []error
+			p = New(file, WithErrorHandler(func(err error) { skipped = append(skipped, err) }))
+			if v := restoredGauge(t, p); v != 2 {
+				t.Fatalf("want the previous generation, got %v", v)
+			}
+			if tt.name != "missing" && len(skipped) != 1 {
+				t.Fatalf("want one skipped generation, got %v", skipped)
+			}
+		})
+	}
+}
+
+func TestRestore_Generation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	p := New(file)
+	for _, v := range []float64{1, 2, 3} {
+		saveGauge(t, p, v)
+	}
+	if v := restoredGauge(t, New(file, WithRestoreGeneration(2))); v != 1 {
+		t.Fatalf("generation 2 = %v, want 1", v)
+	}
+	if err := New(file, WithRestoreGeneration(5)).Restore(context.TODO(), memory.New()); err == nil {
+		t.Fatal("want an error for a missing generation")
+	}
+}
+
+func TestSave_Compression(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	saveGauge(t, New(file, WithCompression(true)), 4.5)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("want a gzip file, got %q", data)
+	}
+	if v := restoredGauge(t, New(file)); v != 4.5 {
+		t.Fatalf("restored %v, want 4.5", v)
+	}
+}
+
+func TestRestore_Legacy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `[
+  {"id": "Alloc", "type": "gauge", "value": 7.5},
+  {"id": "PollCount", "type": "counter", "delta": 3}
+]`
+	if err := os.WriteFile(file, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if v := restoredGauge(t, New(file)); v != 7.5 {
+		t.Fatalf("restored %v, want 7.5", v)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,13 +20,18 @@ import (
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/misc"
 	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/trace"
 )
 
+// agentIDHeader lets the server attribute requests to this agent in audit events.
+const agentIDHeader = "X-Agent-ID"
+
 // Client publishes metrics to the server using gzipped JSON requests.
 type Client struct {
-	key  string
-	base *url.URL
-	hc   *http.Client
+	key     string
+	agentID string
+	base    *url.URL
+	hc      *http.Client
 }
 
 var _ ports.Publisher = (*Client)(nil)
@@ -52,7 +58,8 @@ func New(serverAddr string, hc *http.Client, key string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{base: u, hc: hc, key: strings.TrimSpace(key)}, nil
+	agentID, _ := os.Hostname()
+	return &Client{base: u, hc: hc, key: strings.TrimSpace(key), agentID: agentID}, nil
 }
 
 func normalizeBase(s string) string {
@@ -81,7 +88,16 @@ func (c *Client) SendBatch(ctx context.Context, metrics []domain.Metrics) error
 	return c.doGzJSON(ctx, "/updates", metrics)
 }
 
+// doGzJSON sends payload as one traced request: every attempt carries the same traceparent,
+// and a failure names the trace so the agent's log line can be matched with the server's.
 func (c *Client) doGzJSON(ctx context.Context, path string, payload any) (retErr error) {
+	ctx = trace.Derive(ctx)
+	defer func() {
+		if retErr != nil {
+			retErr = fmt.Errorf("trace_id=%s: %w", trace.TraceIDFromContext(ctx), retErr)
+		}
+	}()
+
 	plain, err := marshalJSON(payload)
 	if err != nil {
 		return err
@@ -224,6 +240,12 @@ func (c *Client) newGzJSONRequest(ctx context.Context, path string, body []byte,
 	if hashHeader != "" {
 		req.Header.Set("HashSHA256", hashHeader)
 	}
+	if c.agentID != "" {
+		req.Header.Set(agentIDHeader, c.agentID)
+	}
+	if sc, ok := trace.FromContext(ctx); ok {
+		req.Header.Set(trace.Header, sc.String())
+	}
 
 	return req, nil
 }
@@ -20,6 +20,7 @@ import (
 
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/misc"
+	"github.com/vshulcz/Golectra/pkg/trace"
 )
 
 const (
@@ -695,6 +696,60 @@ func TestSendBatch_Retry(t *testing.T) {
 	}
 }
 
+func TestSendBatch_Traceparent(t *testing.T) {
+	orig := misc.DefaultBackoff
+	misc.DefaultBackoff = []time.Duration{1 * time.Millisecond}
+	defer func() { misc.DefaultBackoff = orig }()
+
+	var seen []string
+	record := func(r *http.Request) {
+		seen = append(seen, r.Header.Get(trace.Header))
+	}
+	rt := &scriptedRT{
+		steps: []func(*http.Request) (*http.Response, error){
+			func(r *http.Request) (*http.Response, error) {
+				record(r)
+				return nil, &net.OpError{Op: "write", Err: syscall.EPIPE}
+			},
+			func(r *http.Request) (*http.Response, error) {
+				record(r)
+				return mkResp(http.StatusInternalServerError, "internal error", nil), nil
+			},
+		},
+	}
+	c, _ := New("http://example", &http.Client{Transport: rt}, "")
+
+	val := 1.23
+	err := c.SendBatch(context.Background(), []domain.Metrics{{ID: "Alloc", MType: "gauge", Value: &val}})
+	if len(seen) != 2 || seen[0] != seen[1] {
+		t.Fatalf("retries must reuse one traceparent, got %q", seen)
+	}
+	sc, perr := trace.Parse(seen[0])
+	if perr != nil || !sc.Sampled() {
+		t.Fatalf("bad traceparent %q: %v", seen[0], perr)
+	}
+	if err == nil || !strings.Contains(err.Error(), "trace_id="+sc.TraceID.String()) {
+		t.Fatalf("error should name the trace, got %v", err)
+	}
+
+	// A trace already in the context is continued rather than replaced.
+	parent := trace.NewRoot()
+	seen = nil
+	rt.steps = []func(*http.Request) (*http.Response, error){
+		func(r *http.Request) (*http.Response, error) {
+			record(r)
+			return mkResp(http.StatusOK, "ok", nil), nil
+		},
+	}
+	if err := c.SendOne(trace.ContextWith(context.Background(), parent), domain.Metrics{ID: "Alloc", MType: "gauge", Value: &val}); err != nil {
+		t.Fatalf("SendOne: %v", err)
+	}
+	sc, _ = trace.Parse(seen[0])
+	if sc.TraceID != parent.TraceID || sc.SpanID == parent.SpanID {
+		t.Fatalf("want child of %s, got %s", parent, seen[0])
+	}
+}
+
 func TestSendOne_ContextCancel(t *testing.T) {
 	orig := misc.DefaultBackoff
 	misc.DefaultBackoff = []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
@@ -0,0 +1,123 @@
+// Package repository_test checks that every metrics repository backend behaves the same.
+package repository_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	filepersist "github.com/vshulcz/Golectra/internal/adapters/persistence/file"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/embedded"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/adapters/repository/postgres"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+// testDSNEnv names a disposable database for the Postgres backend; it is skipped when unset.
+const testDSNEnv = "GOLECTRA_TEST_DSN"
+
+// backend opens an empty repository and reopens it as a restarted server would see it.
+type backend struct {
+	name   string
+	open   repotest.Factory
+	reopen repotest.Reopener
+}
+
+func backends() []backend {
+	return []backend{
+		{
+			name:   "memory",
+			open:   func(*testing.T) ports.MetricsRepo { return memory.New() },
+			reopen: func(_ *testing.T, repo ports.MetricsRepo) ports.MetricsRepo { return repo },
+		},
+		{
+			name: "memory+file",
+			open: func(*testing.T) ports.MetricsRepo { return memory.New() },
+			reopen: func(t *testing.T, repo ports.MetricsRepo) ports.MetricsRepo {
+				t.Helper()
+				ctx := context.Background()
+				p := filepersist.New(filepath.Join(t.TempDir(), "metrics.json"))
+				snap, err := repo.Snapshot(ctx)
+				if err != nil {
+					t.Fatalf("snapshot: %v", err)
+				}
+				if err := p.Save(ctx, snap); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+				restored := memory.New()
+				if err := p.Restore(ctx, restored); err != nil {
+					t.Fatalf("restore: %v", err)
+				}
+				return restored
+			},
+		},
+		{
+			name: "embedded",
+			open: func(t *testing.T) ports.MetricsRepo {
+				t.Helper()
+				return openEmbedded(t, t.TempDir())
+			},
+			reopen: func(t *testing.T, repo ports.MetricsRepo) ports.MetricsRepo {
+				t.Helper()
+				r := repo.(*embedded.Repo)
+				if err := r.Close(); err != nil {
+					t.Fatalf("close: %v", err)
+				}
+				return openEmbedded(t, r.Dir())
+			},
+		},
+		{
+			name: "postgres",
+			open: func(t *testing.T) ports.MetricsRepo {
+				t.Helper()
+				db := openTestDB(t)
+				if _, err := db.ExecContext(context.Background(), `TRUNCATE metrics`); err != nil {
+					t.Fatalf("truncate: %v", err)
+				}
+				return postgres.New(db)
+			},
+			reopen: func(t *testing.T, _ ports.MetricsRepo) ports.MetricsRepo {
+				t.Helper()
+				return postgres.New(openTestDB(t))
+			},
+		},
+	}
+}
+
+func openEmbedded(t *testing.T, dir string) *embedded.Repo {
+	t.Helper()
+	r, err := embedded.Open(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("open embedded: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDSNEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := postgres.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			repotest.Run(t, b.open, repotest.WithReopen(b.reopen))
+		})
+	}
+}
@@ -0,0 +1,749 @@
+// Package embedded implements a metrics repository that keeps its data in local files.
+//
+// Every write batch is appended to a write-ahead log as a checksummed record and fsynced
+// before the write returns; batches written at the same time share one fsync. Once the log
+// grows past the compaction threshold, writes switch to a new log file while the whole
+// dataset is written to a snapshot segment, and the logs it covers are deleted. Open loads
+// the snapshot, replays the logs written after it and cuts off a torn record left at the
+// end of the last log by a crash. Reads are served from memory.
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+const (
+	snapshotName       = "snapshot.seg"
+	logPrefix          = "wal-"
+	logSuffix          = ".log"
+	defaultCompactSize = 8 << 20
+	compactTimeout     = time.Minute
+)
+
+var errClosed = errors.New("embedded repository closed")
+
+// Option customizes a Repo built by Open.
+type Option func(*Repo)
+
+// WithCompactSize compacts the log once it grows past n bytes.
+func WithCompactSize(n int64) Option {
+	return func(r *Repo) {
+		if n > 0 {
+			r.compactSize = n
+		}
+	}
+}
+
+// WithErrorHandler receives background compaction failures; the logs are kept and the
+// next compaction covers them.
+func WithErrorHandler(fn func(error)) Option {
+	return func(r *Repo) {
+		if fn != nil {
+			r.onError = fn
+		}
+	}
+}
+
+// Stats is a point-in-time view of the storage files.
+type Stats struct {
+	LogBytes    int64  `json:"log_bytes"`
+	LogSegment  uint64 `json:"log_segment"`
+	Appends     int64  `json:"appends"`
+	Syncs       int64  `json:"syncs"`
+	Compactions int64  `json:"compactions"`
+	Recovered   int64  `json:"recovered"`
+}
+
+// Repo is a ports.MetricsRepo stored in a directory of log files and a snapshot segment.
+//
+// Revisions are persisted with every record and offset at Open by the larger of the last
+// stored revision and the current time in microseconds, so they keep growing across restarts.
+type Repo struct {
+	mem     *memory.Repo
+	wal     *os.File
+	onError func(error)
+	// err is set once a failed append could not be cut off; later writes fail with it.
+	err         error
+	kick        chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	dir         string
+	base        int64
+	compactSize int64
+	logSeq      uint64
+	logSize     int64
+	// written counts appended records and synced the ones known to be on disk.
+	written uint64
+	synced  uint64
+	// mu orders log appends with memory updates so replay rebuilds the same state.
+	mu sync.Mutex
+	// syncMu is held across fsyncs and log switches; it is taken before mu.
+	syncMu      sync.Mutex
+	compactMu   sync.Mutex
+	appends     atomic.Int64
+	syncs       atomic.Int64
+	compactions atomic.Int64
+	recovered   int64
+	closed      bool
+	closeOnce   sync.Once
+}
+
+var _ ports.MetricsRepo = (*Repo)(nil)
+
+// Open recovers the repository stored in dir, creating the directory if needed, and starts
+// the compaction loop.
+func Open(ctx context.Context, dir string, opts ...Option) (*Repo, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("mkdir storage: %w", err)
+	}
+	r := &Repo{
+		mem:         memory.New(),
+		onError:     func(error) {},
+		dir:         dir,
+		compactSize: defaultCompactSize,
+		kick:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.recover(ctx); err != nil {
+		if r.wal != nil {
+			_ = r.wal.Close()
+		}
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// ReadSnapshot returns the data stored in dir without changing anything on disk: no log is
+// created, nothing is compacted, and a torn record at the end of the last log is skipped
+// rather than cut off. Stop the server that owns dir first, or read a copy of it.
+func ReadSnapshot(ctx context.Context, dir string) (domain.Snapshot, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return domain.Snapshot{}, fmt.Errorf("open storage: %w", err)
+	}
+	r := &Repo{mem: memory.New(), dir: dir}
+	first, _, err := r.loadSnapshot(ctx)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	seqs, err := r.logs()
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	seqs = slices.DeleteFunc(seqs, func(seq uint64) bool { return seq < first })
+	for i, seq := range seqs {
+		if err := r.readLog(ctx, seq, i == len(seqs)-1); err != nil {
+			return domain.Snapshot{}, err
+		}
+	}
+	return r.mem.Snapshot(ctx)
+}
+
+// readLog applies one log read-only; like replay, a bad record is only tolerated at the
+// end of the last log.
+func (r *Repo) readLog(ctx context.Context, seq uint64, last bool) (retErr error) {
+	f, err := os.Open(r.logPath(seq))
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close log: %w", cerr)
+		}
+	}()
+	good, err := readRecords(f, func(rec record) error {
+		_, err := r.mem.UpdateMany(ctx, rec.Items)
+		return err
+	})
+	if err != nil && !(errors.Is(err, errCorrupt) && last) {
+		return fmt.Errorf("read log %d at offset %d: %w", seq, good, err)
+	}
+	return nil
+}
+
+// recover loads the snapshot segment, replays the logs after it and opens the last log
+// for appending.
+func (r *Repo) recover(ctx context.Context) error {
+	first, lastRev, err := r.loadSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	seqs, err := r.logs()
+	if err != nil {
+		return err
+	}
+	var replay []uint64
+	for _, seq := range seqs {
+		if seq >= first {
+			replay = append(replay, seq)
+			continue
+		}
+		// Left behind by a crash between writing the snapshot and deleting the logs.
+		if err := os.Remove(r.logPath(seq)); err != nil {
+			return fmt.Errorf("remove compacted log: %w", err)
+		}
+	}
+	for i, seq := range replay {
+		rev, err := r.replay(ctx, seq, i == len(replay)-1)
+		if err != nil {
+			return err
+		}
+		lastRev = max(lastRev, rev)
+	}
+
+	r.logSeq = max(first, 1)
+	if len(replay) > 0 {
+		r.logSeq = replay[len(replay)-1]
+	}
+	if r.wal, err = r.openLog(r.logSeq); err != nil {
+		return err
+	}
+	info, err := r.wal.Stat()
+	if err != nil {
+		return fmt.Errorf("stat log: %w", err)
+	}
+	r.logSize = info.Size()
+	r.base = max(lastRev, time.Now().UnixMicro())
+	return nil
+}
+
+func (r *Repo) loadSnapshot(ctx context.Context) (first uint64, rev int64, retErr error) {
+	f, err := os.Open(filepath.Join(r.dir, snapshotName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("open snapshot: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close snapshot: %w", cerr)
+		}
+	}()
+	// The segment is renamed into place complete, so unlike a log it is never torn.
+	if _, err := readRecords(f, func(rec record) error {
+		first, rev = rec.WAL, rec.Rev
+		_, err := r.mem.UpdateMany(ctx, rec.Items)
+		return err
+	}); err != nil {
+		return 0, 0, fmt.Errorf("read snapshot: %w", err)
+	}
+	return first, rev, nil
+}
+
+// replay applies the records of one log. A bad record ends the last log, where it is a
+// write torn by a crash and is cut off; anywhere else it is corruption.
+func (r *Repo) replay(ctx context.Context, seq uint64, last bool) (rev int64, retErr error) {
+	f, err := os.OpenFile(r.logPath(seq), os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open log: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close log: %w", cerr)
+		}
+	}()
+	good, err := readRecords(f, func(rec record) error {
+		rev = max(rev, rec.Rev)
+		r.recovered++
+		_, err := r.mem.UpdateMany(ctx, rec.Items)
+		return err
+	})
+	switch {
+	case errors.Is(err, errCorrupt) && last:
+		if err := f.Truncate(good); err != nil {
+			return 0, fmt.Errorf("truncate torn log: %w", err)
+		}
+		if err := f.Sync(); err != nil {
+			return 0, fmt.Errorf("sync log: %w", err)
+		}
+	case err != nil:
+		return 0, fmt.Errorf("replay log %d at offset %d: %w", seq, good, err)
+	}
+	return rev, nil
+}
+
+// GetGauge returns the current gauge value or domain.ErrNotFound.
+func (r *Repo) GetGauge(ctx context.Context, name string) (float64, error) {
+	return r.mem.GetGauge(ctx, name)
+}
+
+// GetGaugeWithRevision returns the gauge value with the revision of the write that stored it.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	v, rev, err := r.mem.GetGaugeWithRevision(ctx, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return v, rev + r.base, nil
+}
+
+// GetCounter returns the current counter delta or domain.ErrNotFound.
+func (r *Repo) GetCounter(ctx context.Context, name string) (int64, error) {
+	return r.mem.GetCounter(ctx, name)
+}
+
+// SetGauge logs and stores the provided gauge value.
+func (r *Repo) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.UpdateMany(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}})
+	return err
+}
+
+// CompareAndSetGauge logs and stores the gauge if it is still at revision expected and
+// reports the write. The revision is compared under the same lock that orders the log, so
+// nothing is logged for a stale write.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	var check func() error
+	if expected != ports.AnyRevision {
+		check = func() error {
+			if r.gaugeRevision(name) != expected {
+				return domain.ErrRevisionMismatch
+			}
+			return nil
+		}
+	}
+	var rev int64
+	read := func() {
+		rev = r.gaugeRevision(name)
+	}
+	prior, err := r.write(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}}, check, read)
+	if err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(prior, name, value, rev), nil
+}
+
+// ApplyGauge logs the gauge write with its operation and reports it. The log keeps the
+// operation, and replaying it in order gives the same values.
+func (r *Repo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	if !op.Valid() {
+		return domain.GaugeWrite{}, domain.ErrInvalidType
+	}
+	var (
+		res float64
+		rev int64
+	)
+	read := func() {
+		res, rev, _ = r.mem.GetGaugeWithRevision(context.Background(), name)
+		rev += r.base
+	}
+	prior, err := r.write(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value, Op: op}}, nil, read)
+	if err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(prior, name, res, rev), nil
+}
+
+// gaugeWrite reports a write of the named gauge from the values its batch replaced.
+func gaugeWrite(prior domain.Snapshot, name string, value float64, rev int64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value, Revision: rev}
+	if old, ok := prior.Gauges[name]; ok {
+		w.Old = &old
+	}
+	return w
+}
+
+// gaugeRevision returns the revision of the gauge in memory, or zero if it does not exist.
+func (r *Repo) gaugeRevision(name string) int64 {
+	_, rev, err := r.mem.GetGaugeWithRevision(context.Background(), name)
+	if err != nil {
+		return 0
+	}
+	return rev + r.base
+}
+
+// AddCounter logs and accumulates the counter delta and returns the total it produced.
+func (r *Repo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	var total int64
+	read := func() {
+		total, _ = r.mem.GetCounter(context.Background(), name)
+	}
+	if _, err := r.write(ctx, []domain.Metrics{{ID: name, MType: string(domain.Counter), Delta: &delta}}, nil, read); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// UpdateMany appends the folded batch to the log as one record and returns once it is on
+// disk. The batch is visible to readers as soon as it is logged; if the fsync fails the
+// error is returned although a restart may still replay it.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	return r.write(ctx, items, nil, nil)
+}
+
+// write implements UpdateMany. check, when set, runs before the batch is logged and its
+// error cancels the write; applied runs right after the batch reached memory. No other
+// write can run between the two.
+func (r *Repo) write(ctx context.Context, items []domain.Metrics, check func() error, applied func()) (domain.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Snapshot{}, err
+	}
+	items = domain.Fold(items)
+	if len(items) == 0 {
+		return domain.Snapshot{}, nil
+	}
+	seq, prior, compact, err := r.append(items, check, applied)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	if err := r.sync(seq); err != nil {
+		return domain.Snapshot{}, err
+	}
+	if compact {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+	return prior, nil
+}
+
+func (r *Repo) append(items []domain.Metrics, check func() error, applied func()) (seq uint64, prior domain.Snapshot, compact bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, domain.Snapshot{}, false, errClosed
+	}
+	if r.err != nil {
+		return 0, domain.Snapshot{}, false, r.err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, domain.Snapshot{}, false, err
+		}
+	}
+	// Memory is only written under mu, so the batch gets the next revision.
+	rev, err := r.mem.Revision(context.Background())
+	if err != nil {
+		return 0, domain.Snapshot{}, false, err
+	}
+	buf, err := encodeRecord(record{Items: items, Rev: r.base + rev + 1})
+	if err != nil {
+		return 0, domain.Snapshot{}, false, err
+	}
+	if _, err := r.wal.Write(buf); err != nil {
+		// A partial record would hide every later one from recovery, so cut it off.
+		if terr := r.wal.Truncate(r.logSize); terr != nil {
+			r.err = fmt.Errorf("log unusable after a failed append: %w", terr)
+		}
+		return 0, domain.Snapshot{}, false, fmt.Errorf("append log: %w", err)
+	}
+	r.logSize += int64(len(buf))
+	r.written++
+	r.appends.Add(1)
+	prior, err = r.mem.UpdateMany(context.Background(), items)
+	if err != nil {
+		return 0, domain.Snapshot{}, false, err
+	}
+	if applied != nil {
+		applied()
+	}
+	return r.written, prior, r.logSize >= r.compactSize, nil
+}
+
+// sync makes every record up to seq durable. Writers that arrive while another fsync is
+// running queue on syncMu and are covered together by the next one.
+func (r *Repo) sync(seq uint64) error {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	if r.synced >= seq {
+		return nil
+	}
+	r.mu.Lock()
+	f, target := r.wal, r.written
+	r.mu.Unlock()
+	if f == nil {
+		return errClosed
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync log: %w", err)
+	}
+	r.synced = target
+	r.syncs.Add(1)
+	return nil
+}
+
+// Snapshot copies the current metrics.
+func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	snap, err := r.mem.Snapshot(ctx)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	snap.Revision += r.base
+	return snap, nil
+}
+
+// SnapshotSince returns the metrics written after since; revisions from before Open
+// return everything.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	snap, err := r.mem.SnapshotSince(ctx, max(since-r.base, 0))
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	snap.Revision += r.base
+	return snap, nil
+}
+
+// Revision reports the revision of the most recent write.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	rev, err := r.mem.Revision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return rev + r.base, nil
+}
+
+// Ping reports whether the log still accepts writes.
+func (r *Repo) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errClosed
+	}
+	return r.err
+}
+
+// Compact switches writes to a new log file, writes the dataset into the snapshot segment
+// and deletes the older logs. Writers only wait for the switch, not for the segment write.
+func (r *Repo) Compact(ctx context.Context) error {
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+	snap, next, err := r.rotate(ctx)
+	if err != nil {
+		return err
+	}
+	seg := record{Items: snap.Items(), Rev: snap.Revision, WAL: next}
+	if err := writeSegment(r.dir, seg); err != nil {
+		return err
+	}
+	seqs, err := r.logs()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq >= next {
+			break
+		}
+		if err := os.Remove(r.logPath(seq)); err != nil {
+			return fmt.Errorf("remove compacted log: %w", err)
+		}
+	}
+	r.compactions.Add(1)
+	return nil
+}
+
+// rotate syncs and closes the current log, opens the next one and returns the state the
+// closed logs add up to.
+func (r *Repo) rotate(ctx context.Context) (domain.Snapshot, uint64, error) {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return domain.Snapshot{}, 0, errClosed
+	}
+	snap, err := r.Snapshot(ctx)
+	if err != nil {
+		return domain.Snapshot{}, 0, err
+	}
+	next, err := r.openLog(r.logSeq + 1)
+	if err != nil {
+		return domain.Snapshot{}, 0, err
+	}
+	if err := r.wal.Sync(); err != nil {
+		_ = next.Close()
+		return domain.Snapshot{}, 0, fmt.Errorf("sync log: %w", err)
+	}
+	r.synced = r.written
+	if err := r.wal.Close(); err != nil {
+		_ = next.Close()
+		return domain.Snapshot{}, 0, fmt.Errorf("close log: %w", err)
+	}
+	r.wal = next
+	r.logSeq++
+	r.logSize = 0
+	return snap, r.logSeq, nil
+}
+
+// Dir returns the directory the repository is stored in.
+func (r *Repo) Dir() string {
+	return r.dir
+}
+
+// Stats reports the log size and write counters.
+func (r *Repo) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Stats{
+		LogBytes:    r.logSize,
+		LogSegment:  r.logSeq,
+		Appends:     r.appends.Load(),
+		Syncs:       r.syncs.Load(),
+		Compactions: r.compactions.Load(),
+		Recovered:   r.recovered,
+	}
+}
+
+// Close stops the compaction loop and closes the log; later writes fail.
+func (r *Repo) Close() error {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+		close(r.stop)
+	})
+	<-r.done
+	r.compactMu.Lock()
+	defer r.compactMu.Unlock()
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.wal == nil {
+		return nil
+	}
+	f := r.wal
+	r.wal = nil
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("sync log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close log: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) run() {
+	defer close(r.done)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.kick:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), compactTimeout)
+		if err := r.Compact(ctx); err != nil && !errors.Is(err, errClosed) {
+			r.onError(fmt.Errorf("compact: %w", err))
+		}
+		cancel()
+	}
+}
+
+func (r *Repo) logPath(seq uint64) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%s%016d%s", logPrefix, seq, logSuffix))
+}
+
+// logs lists the sequence numbers of the log files in ascending order.
+func (r *Repo) logs() ([]uint64, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("list logs: %w", err)
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), logPrefix)
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, logSuffix)
+		if !ok {
+			continue
+		}
+		if seq, err := strconv.ParseUint(name, 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+func (r *Repo) openLog(seq uint64) (*os.File, error) {
+	f, err := os.OpenFile(r.logPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open log: %w", err)
+	}
+	// Make the new name durable, or a crash could lose the whole file with its records.
+	if err := syncDir(r.dir); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeSegment replaces the snapshot segment atomically.
+func writeSegment(dir string, seg record) (retErr error) {
+	buf, err := encodeRecord(seg)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("create tmp: %w", err)
+	}
+	tmpName := tmp.Name()
+	cleanup := true
+	defer func() {
+		if tmp != nil {
+			if cerr := tmp.Close(); cerr != nil && retErr == nil {
+				retErr = fmt.Errorf("close tmp: %w", cerr)
+			}
+		}
+		if cleanup {
+			if err := os.Remove(tmpName); err != nil && retErr == nil {
+				retErr = fmt.Errorf("remove tmp: %w", err)
+			}
+		}
+	}()
+	if _, err := tmp.Write(buf); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close tmp: %w", err)
+	}
+	tmp = nil
+	if err := os.Rename(tmpName, filepath.Join(dir, snapshotName)); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	cleanup = false
+	return syncDir(dir)
+}
+
+func syncDir(dir string) (retErr error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer func() {
+		if cerr := d.Close(); cerr != nil && retErr == nil {
+			retErr = fmt.Errorf("close dir: %w", cerr)
+		}
+	}()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
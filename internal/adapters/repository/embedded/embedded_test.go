@@ -0,0 +1,300 @@
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+func openTest(t *testing.T, dir string, opts ...Option) *Repo {
+	t.Helper()
+	r, err := Open(context.Background(), dir, opts...)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+// reopen closes r and recovers a new repository from its directory.
+func reopen(opts ...Option) repotest.Reopener {
+	return func(t *testing.T, repo ports.MetricsRepo) ports.MetricsRepo {
+		t.Helper()
+		r := repo.(*Repo)
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return openTest(t, r.dir, opts...)
+	}
+}
+
+func TestRepo_Conformance(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"log-only", nil},
+		// A tiny threshold compacts after almost every write.
+		{"compacting", []Option{WithCompactSize(256)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repotest.Run(t, func(t *testing.T) ports.MetricsRepo {
+				return openTest(t, t.TempDir(), tt.opts...)
+			}, repotest.WithReopen(reopen(tt.opts...)))
+		})
+	}
+}
+
+func TestRepo_TornTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := openTest(t, dir)
+	if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 1), repotest.Counter("C", 2)}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	if _, err := r.AddCounter(ctx, "C", 3); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	path := r.logPath(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	// Cut the last record in half, as a crash in the middle of the append would.
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	r = openTest(t, dir)
+	repotest.ExpectState(t, r, map[string]float64{"A": 1}, map[string]int64{"C": 2})
+	if _, err := r.AddCounter(ctx, "C", 10); err != nil {
+		t.Fatalf("AddCounter after recovery: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	r = openTest(t, dir)
+	repotest.ExpectState(t, r, map[string]float64{"A": 1}, map[string]int64{"C": 12})
+}
+
+func TestReadSnapshot_LeavesFilesAlone(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := openTest(t, dir)
+	if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 1), repotest.Counter("C", 2)}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	if _, err := r.AddCounter(ctx, "C", 3); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	path := r.logPath(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	before, _ := os.ReadDir(dir)
+
+	snap, err := ReadSnapshot(ctx, dir)
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err)
+	}
+	if snap.Gauges["A"] != 1 || snap.Counters["C"] != 2 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	after, _ := os.ReadDir(dir)
+	if len(after) != len(before) {
+		t.Fatalf("ReadSnapshot changed the directory: %v -> %v", before, after)
+	}
+	if got, _ := os.Stat(path); got.Size() != info.Size()-5 {
+		t.Fatalf("ReadSnapshot cut the torn tail: size %d", got.Size())
+	}
+
+	if _, err := ReadSnapshot(ctx, filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+}
+
+func TestRepo_Corruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, r *Repo)
+	}{
+		{"older log", func(t *testing.T, r *Repo) {
+			flipByte(t, r.logPath(1), headerSize+2)
+		}},
+		{"snapshot segment", func(t *testing.T, r *Repo) {
+			flipByte(t, filepath.Join(r.dir, snapshotName), headerSize+2)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			r := openTest(t, dir)
+			if err := r.SetGauge(ctx, "A", 1); err != nil {
+				t.Fatalf("SetGauge: %v", err)
+			}
+			// Keep log 1 around by switching logs without deleting it.
+			if _, _, err := r.rotate(ctx); err != nil {
+				t.Fatalf("rotate: %v", err)
+			}
+			if err := writeSegment(dir, record{Items: []domain.Metrics{repotest.Gauge("A", 1)}, WAL: 1}); err != nil {
+				t.Fatalf("writeSegment: %v", err)
+			}
+			if err := r.SetGauge(ctx, "B", 2); err != nil {
+				t.Fatalf("SetGauge: %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			tt.corrupt(t, r)
+			if _, err := Open(ctx, dir); !errors.Is(err, errCorrupt) {
+				t.Fatalf("want errCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func flipByte(t *testing.T, path string, off int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	data[off] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestRepo_Compaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := openTest(t, dir)
+	for i := range 10 {
+		if _, err := r.AddCounter(ctx, "C", 1); err != nil {
+			t.Fatalf("AddCounter: %v", err)
+		}
+		if err := r.SetGauge(ctx, "G", float64(i)); err != nil {
+			t.Fatalf("SetGauge: %v", err)
+		}
+		if i == 4 {
+			if err := r.Compact(ctx); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+		}
+	}
+	if seqs, err := r.logs(); err != nil || len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("want only log 2 after compaction, got %v, %v", seqs, err)
+	}
+	rev, _ := r.Revision(ctx)
+
+	next := reopen()(t, r).(*Repo)
+	repotest.ExpectState(t, next, map[string]float64{"G": 9}, map[string]int64{"C": 10})
+	if st := next.Stats(); st.Recovered != 10 || st.LogSegment != 2 {
+		t.Fatalf("want the 10 writes after the snapshot replayed into log 2: %+v", st)
+	}
+	if got, _ := next.Revision(ctx); got <= rev {
+		t.Fatalf("revision went backwards across reopen: %d -> %d", rev, got)
+	}
+}
+
+func TestRepo_CompactsInBackground(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	r := openTest(t, t.TempDir(), WithCompactSize(512), WithErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}))
+	for i := range 50 {
+		if err := r.SetGauge(ctx, fmt.Sprintf("G%d", i%5), float64(i)); err != nil {
+			t.Fatalf("SetGauge: %v", err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Stats().Compactions == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want background compactions: %+v", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) > 0 {
+		t.Fatalf("compaction failed: %v", errs)
+	}
+}
+
+func TestRepo_GroupCommit(t *testing.T) {
+	ctx := context.Background()
+	r := openTest(t, t.TempDir())
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if _, err := r.AddCounter(ctx, fmt.Sprintf("C%d", w), 1); err != nil {
+					t.Errorf("AddCounter: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	st := r.Stats()
+	if st.Appends != 200 || st.Syncs == 0 || st.Syncs > st.Appends {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	next := reopen()(t, r)
+	snap, err := next.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	for w := range 8 {
+		if got := snap.Counters[fmt.Sprintf("C%d", w)]; got != 25 {
+			t.Fatalf("C%d = %d after recovery, want 25", w, got)
+		}
+	}
+}
+
+func TestRepo_WritesAfterClose(t *testing.T) {
+	r := openTest(t, t.TempDir())
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := r.SetGauge(context.Background(), "A", 1); !errors.Is(err, errClosed) {
+		t.Fatalf("want errClosed, got %v", err)
+	}
+	if err := r.Ping(context.Background()); err == nil {
+		t.Fatal("Ping should fail after Close")
+	}
+}
@@ -0,0 +1,88 @@
+package embedded
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+)
+
+const (
+	// headerSize covers the payload length and its CRC-32C, both big-endian uint32.
+	headerSize = 8
+	// maxRecordSize rejects lengths that can only come from a damaged header.
+	maxRecordSize = 256 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorrupt = errors.New("corrupt record")
+)
+
+// record is one framed entry: a write batch in a log file, or the whole dataset in the
+// snapshot segment.
+type record struct {
+	Items []domain.Metrics `json:"items"`
+	// Rev is the revision of the repository once the record is applied.
+	Rev int64 `json:"rev"`
+	// WAL is set in the snapshot segment: the first log file it does not cover.
+	WAL uint64 `json:"wal,omitempty"`
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encode record: %w", err)
+	}
+	buf := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	return append(buf, payload...), nil
+}
+
+// readRecords calls fn for every record in r and returns the offset just past the last
+// valid one. A short, oversized or mismatching record stops the scan with errCorrupt.
+func readRecords(r io.Reader, fn func(record) error) (int64, error) {
+	var (
+		good   int64
+		header [headerSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return good, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return good, errCorrupt
+			}
+			return good, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return good, errCorrupt
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return good, errCorrupt
+			}
+			return good, err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return good, errCorrupt
+		}
+		var rec record
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return good, errCorrupt
+		}
+		if err := fn(rec); err != nil {
+			return good, err
+		}
+		good += headerSize + int64(size)
+	}
+}
@@ -4,100 +4,439 @@ package memory
 import (
 	"context"
 	"errors"
-	"maps"
+	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/ports"
 )
 
-// Repo keeps metrics in memory with coarse-grained RW locking.
+// maxShards caps the default shard count on hosts with many CPUs.
+const maxShards = 64
+
+// Option customizes a Repo built by New.
+type Option func(*Repo)
+
+// WithShards sets the number of shards; the default scales with GOMAXPROCS.
+func WithShards(n int) Option {
+	return func(r *Repo) {
+		if n > 0 {
+			r.shards = make([]*shard, n)
+		}
+	}
+}
+
+// WithRevisionBase starts revisions at base instead of zero. A server that outlives its
+// process passes max(restored revision, time.Now().UnixMicro()) so revisions handed out
+// before a restart never match different data afterwards.
+func WithRevisionBase(base int64) Option {
+	return func(r *Repo) {
+		if base > 0 {
+			r.rev.Store(base)
+		}
+	}
+}
+
+// Repo keeps metrics in memory, split into shards by metric name. Writes to metrics that
+// already exist update them atomically under the shard's read lock, so writers to the same
+// shard do not queue behind each other; only new names and conditional gauge writes take
+// the shard's write lock.
+//
+// A batch locks every shard it touches. A snapshot copies one shard at a time under its
+// read lock, so single writes carry on while it runs; batches spanning several shards
+// wait for the snapshot to finish, so snapshots never show part of a batch. Calls made
+// with an already canceled context fail with the context error and change nothing.
 type Repo struct {
-	gauges   map[string]float64
-	counters map[string]int64
+	shards []*shard
+	rev    atomic.Int64
+	// batches is held shared by batches spanning several shards and exclusively by
+	// snapshots, which copy shards one by one and must not see such a batch half applied.
+	batches sync.RWMutex
+}
+
+type shard struct {
+	gauges   map[string]*gaugeEntry
+	counters map[string]*counterEntry
 	mu       sync.RWMutex
 }
 
+// gaugeEntry swaps value and revision as one immutable pair, so a reader never sees the
+// value of one write with the revision of another.
+type gaugeEntry struct {
+	cur atomic.Pointer[gaugeState]
+}
+
+type gaugeState struct {
+	value float64
+	rev   int64
+}
+
+type counterEntry struct {
+	delta atomic.Int64
+	rev   atomic.Int64
+}
+
 var _ ports.MetricsRepo = (*Repo)(nil)
 
 // New returns an empty in-memory repository.
-func New() *Repo {
-	return &Repo{
-		gauges:   make(map[string]float64),
-		counters: make(map[string]int64),
+func New(opts ...Option) *Repo {
+	r := &Repo{shards: make([]*shard, min(runtime.GOMAXPROCS(0)*4, maxShards))}
+	for _, opt := range opts {
+		opt(r)
 	}
+	for i := range r.shards {
+		r.shards[i] = &shard{
+			gauges:   make(map[string]*gaugeEntry),
+			counters: make(map[string]*counterEntry),
+		}
+	}
+	return r
 }
 
 // GetGauge returns the current gauge value or domain.ErrNotFound.
-func (r *Repo) GetGauge(_ context.Context, name string) (float64, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	v, ok := r.gauges[name]
+func (r *Repo) GetGauge(ctx context.Context, name string) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s := r.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.gauges[name]
 	if !ok {
 		return 0, domain.ErrNotFound
 	}
-	return v, nil
+	return e.load().value, nil
+}
+
+// GetGaugeWithRevision returns the gauge value with the revision of the write that stored it.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	s := r.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.gauges[name]
+	if !ok {
+		return 0, 0, domain.ErrNotFound
+	}
+	st := e.load()
+	return st.value, st.rev, nil
 }
 
 // GetCounter returns the current counter delta or domain.ErrNotFound.
-func (r *Repo) GetCounter(_ context.Context, name string) (int64, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	v, ok := r.counters[name]
+func (r *Repo) GetCounter(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s := r.shardFor(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.counters[name]
 	if !ok {
 		return 0, domain.ErrNotFound
 	}
-	return v, nil
+	return e.delta.Load(), nil
 }
 
 // SetGauge stores the provided gauge value.
-func (r *Repo) SetGauge(_ context.Context, name string, value float64) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.gauges[name] = value
-	return nil
+func (r *Repo) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.CompareAndSetGauge(ctx, name, value, ports.AnyRevision)
+	return err
 }
 
-// AddCounter accumulates the counter delta.
-func (r *Repo) AddCounter(_ context.Context, name string, delta int64) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.counters[name] += delta
-	return nil
+// CompareAndSetGauge stores the gauge if it is still at revision expected and reports the
+// write. Conditional writes take the shard's write lock, which keeps every other writer of
+// the shard out between the comparison and the write.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	s := r.shardFor(name)
+	if expected == ports.AnyRevision {
+		s.mu.RLock()
+		e, ok := s.gauges[name]
+		if ok {
+			old, rev := r.swapGauge(e, value)
+			s.mu.RUnlock()
+			return gaugeWrite(old, value, rev), nil
+		}
+		s.mu.RUnlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expected != ports.AnyRevision {
+		var cur int64
+		if e, ok := s.gauges[name]; ok {
+			cur = e.load().rev
+		}
+		if cur != expected {
+			return domain.GaugeWrite{}, domain.ErrRevisionMismatch
+		}
+	}
+	old, rev := r.swapGauge(s.gauge(name), value)
+	return gaugeWrite(old, value, rev), nil
+}
+
+// ApplyGauge writes the gauge with op and reports the write. Operations other than set
+// take the shard's write lock, so they always combine with the latest value.
+func (r *Repo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	if !op.Valid() {
+		return domain.GaugeWrite{}, domain.ErrInvalidType
+	}
+	if op.Effective() == domain.GaugeSet {
+		return r.CompareAndSetGauge(ctx, name, value, ports.AnyRevision)
+	}
+	if err := ctx.Err(); err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	s := r.shardFor(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rev := r.rev.Add(1)
+	old, res := applyGauge(s.gauge(name), op, value, rev)
+	return gaugeWrite(old, res, rev), nil
+}
+
+// AddCounter accumulates the counter delta and returns the total it produced, which
+// concurrent writers cannot change in between.
+func (r *Repo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s := r.shardFor(name)
+	s.mu.RLock()
+	e, ok := s.counters[name]
+	if ok {
+		total := addCounter(e, delta, r.rev.Add(1))
+		s.mu.RUnlock()
+		return total, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return addCounter(s.counter(name), delta, r.rev.Add(1)), nil
 }
 
-// UpdateMany applies a batch of gauge/counter updates in-place.
-func (r *Repo) UpdateMany(_ context.Context, items []domain.Metrics) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// UpdateMany applies a batch of gauge/counter updates under a single revision. Every shard
+// the batch touches is locked for the whole batch, so readers see all of it or none, and
+// gauge operations combine with the values the items before them left. The values the
+// batch replaced are read under the same locks.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Snapshot{}, err
+	}
+	idx := make([]int, 0, len(items))
 	for _, it := range items {
-		switch it.MType {
-		case string(domain.Gauge):
-			if it.Value != nil {
-				r.gauges[it.ID] = *it.Value
+		switch {
+		case it.MType == string(domain.Gauge) && it.Value != nil && it.Op.Valid():
+		case it.MType == string(domain.Counter) && it.Delta != nil:
+		default:
+			continue
+		}
+		idx = append(idx, r.shardIndex(it.ID))
+	}
+	if len(idx) == 0 {
+		return domain.Snapshot{}, nil
+	}
+	// Lock in ascending order so concurrent batches cannot deadlock.
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+	if len(idx) > 1 {
+		r.batches.RLock()
+		defer r.batches.RUnlock()
+	}
+	for _, i := range idx {
+		r.shards[i].mu.Lock()
+	}
+	defer func() {
+		for _, i := range idx {
+			r.shards[i].mu.Unlock()
+		}
+	}()
+
+	prior := domain.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}
+	for _, it := range items {
+		s := r.shardFor(it.ID)
+		switch {
+		case it.MType == string(domain.Gauge) && it.Value != nil && it.Op.Valid():
+			if e, ok := s.gauges[it.ID]; ok {
+				prior.Gauges[it.ID] = e.load().value
 			}
-		case string(domain.Counter):
-			if it.Delta != nil {
-				r.counters[it.ID] += *it.Delta
+		case it.MType == string(domain.Counter) && it.Delta != nil:
+			if e, ok := s.counters[it.ID]; ok {
+				prior.Counters[it.ID] = e.delta.Load()
 			}
 		default:
 		}
 	}
-	return nil
+
+	rev := r.rev.Add(1)
+	for _, it := range items {
+		s := r.shardFor(it.ID)
+		switch {
+		case it.MType == string(domain.Gauge) && it.Value != nil && it.Op.Valid():
+			applyGauge(s.gauge(it.ID), it.Op, *it.Value, rev)
+		case it.MType == string(domain.Counter) && it.Delta != nil:
+			addCounter(s.counter(it.ID), *it.Delta, rev)
+		default:
+		}
+	}
+	return prior, nil
 }
 
 // Snapshot copies the current metrics maps to avoid exposing internal state.
-func (r *Repo) Snapshot(_ context.Context) (domain.Snapshot, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	g := make(map[string]float64, len(r.gauges))
-	maps.Copy(g, r.gauges)
-	c := make(map[string]int64, len(r.counters))
-	maps.Copy(c, r.counters)
-	return domain.Snapshot{Gauges: g, Counters: c}, nil
+func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	return r.SnapshotSince(ctx, 0)
+}
+
+// SnapshotSince returns only the metrics written after the given revision.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Snapshot{}, err
+	}
+	r.batches.Lock()
+	defer r.batches.Unlock()
+	// Every write takes its revision while holding its shard's lock. Taking each lock once
+	// after reading the revision waits out the writes that took a revision up to it, so the
+	// copy holds all of them; later writes may show up as well and are sent again by the
+	// next SnapshotSince from this revision.
+	snap := domain.Snapshot{
+		Gauges:   make(map[string]float64),
+		Counters: make(map[string]int64),
+		Revision: r.rev.Load(),
+	}
+	for _, s := range r.shards {
+		s.mu.Lock()
+		s.mu.Unlock()
+		s.mu.RLock()
+		for name, e := range s.gauges {
+			if st := e.load(); st.rev > since {
+				snap.Gauges[name] = st.value
+			}
+		}
+		for name, e := range s.counters {
+			if e.rev.Load() > since {
+				snap.Counters[name] = e.delta.Load()
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return snap, nil
+}
+
+// Revision reports the revision of the most recent write.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rev.Load(), nil
+}
+
+// AdvanceRevision raises the store revision to at least rev, e.g. to the revision recorded
+// with a restored snapshot.
+func (r *Repo) AdvanceRevision(rev int64) {
+	raiseRev(&r.rev, rev)
 }
 
 // Ping reports that the in-memory store is not backed by a real database.
 func (*Repo) Ping(context.Context) error {
 	return errors.New("db not configured")
 }
+
+// swapGauge stores value under a fresh revision and returns the state it replaced, nil for a
+// new entry. Writers of an existing gauge only hold the shard's read lock, so the revision
+// is taken inside the retry loop: the state a swap replaces always has a lower revision.
+func (r *Repo) swapGauge(e *gaugeEntry, value float64) (*gaugeState, int64) {
+	for {
+		cur := e.cur.Load()
+		next := &gaugeState{value: value, rev: r.rev.Add(1)}
+		if e.cur.CompareAndSwap(cur, next) {
+			return cur, next.rev
+		}
+	}
+}
+
+// applyGauge combines v with the stored value using op, stores the result and returns the
+// state it replaced with the result. The caller holds the shard's write lock, so the stored
+// value cannot change in between.
+func applyGauge(e *gaugeEntry, op domain.GaugeOp, v float64, rev int64) (*gaugeState, float64) {
+	cur := e.cur.Load()
+	if cur != nil {
+		v = op.Apply(cur.value, v)
+	}
+	e.cur.Store(&gaugeState{value: v, rev: rev})
+	return cur, v
+}
+
+// gaugeWrite reports a write that replaced old, nil for a new gauge.
+func gaugeWrite(old *gaugeState, value float64, rev int64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value, Revision: rev}
+	if old != nil {
+		v := old.value
+		w.Old = &v
+	}
+	return w
+}
+
+// load returns the current state; entries are only published after their first write.
+func (e *gaugeEntry) load() gaugeState {
+	if st := e.cur.Load(); st != nil {
+		return *st
+	}
+	return gaugeState{}
+}
+
+func addCounter(e *counterEntry, delta, rev int64) int64 {
+	total := e.delta.Add(delta)
+	raiseRev(&e.rev, rev)
+	return total
+}
+
+// raiseRev stores rev unless a concurrent write already recorded a later one.
+func raiseRev(v *atomic.Int64, rev int64) {
+	for {
+		cur := v.Load()
+		if cur >= rev || v.CompareAndSwap(cur, rev) {
+			return
+		}
+	}
+}
+
+func (r *Repo) shardFor(name string) *shard {
+	return r.shards[r.shardIndex(name)]
+}
+
+// shardIndex hashes name with FNV-1a.
+func (r *Repo) shardIndex(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(r.shards)))
+}
+
+// gauge returns the entry for name, creating it; the caller holds the write lock.
+func (s *shard) gauge(name string) *gaugeEntry {
+	e, ok := s.gauges[name]
+	if !ok {
+		e = &gaugeEntry{}
+		s.gauges[name] = e
+	}
+	return e
+}
+
+// counter returns the entry for name, creating it; the caller holds the write lock.
+func (s *shard) counter(name string) *counterEntry {
+	e, ok := s.counters[name]
+	if !ok {
+		e = &counterEntry{}
+		s.counters[name] = e
+	}
+	return e
+}
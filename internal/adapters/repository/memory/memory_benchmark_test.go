@@ -0,0 +1,326 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+// lockedRepo is the previous Repo: both maps behind one RWMutex. Kept as the baseline.
+type lockedRepo struct {
+	gauges     map[string]float64
+	counters   map[string]int64
+	gaugeRev   map[string]int64
+	counterRev map[string]int64
+	rev        int64
+	mu         sync.RWMutex
+}
+
+func newLocked() *lockedRepo {
+	return &lockedRepo{
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		gaugeRev:   make(map[string]int64),
+		counterRev: make(map[string]int64),
+	}
+}
+
+func (r *lockedRepo) GetGauge(_ context.Context, name string) (float64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.gauges[name]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	return v, nil
+}
+
+func (r *lockedRepo) GetGaugeWithRevision(_ context.Context, name string) (float64, int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.gauges[name]
+	if !ok {
+		return 0, 0, domain.ErrNotFound
+	}
+	return v, r.gaugeRev[name], nil
+}
+
+func (r *lockedRepo) GetCounter(_ context.Context, name string) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.counters[name]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	return v, nil
+}
+
+func (r *lockedRepo) SetGauge(_ context.Context, name string, value float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rev++
+	r.gauges[name] = value
+	r.gaugeRev[name] = r.rev
+	return nil
+}
+
+func (r *lockedRepo) CompareAndSetGauge(_ context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if expected != ports.AnyRevision && r.gaugeRev[name] != expected {
+		return domain.GaugeWrite{}, domain.ErrRevisionMismatch
+	}
+	return r.writeGaugeLocked(name, value), nil
+}
+
+func (r *lockedRepo) ApplyGauge(_ context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, ok := r.gauges[name]; ok {
+		value = op.Apply(cur, value)
+	}
+	return r.writeGaugeLocked(name, value), nil
+}
+
+func (r *lockedRepo) writeGaugeLocked(name string, value float64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value}
+	if old, ok := r.gauges[name]; ok {
+		w.Old = &old
+	}
+	r.rev++
+	r.gauges[name] = value
+	r.gaugeRev[name] = r.rev
+	w.Revision = r.rev
+	return w
+}
+
+func (r *lockedRepo) AddCounter(_ context.Context, name string, delta int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rev++
+	r.counters[name] += delta
+	r.counterRev[name] = r.rev
+	return r.counters[name], nil
+}
+
+func (r *lockedRepo) UpdateMany(_ context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prior := domain.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}
+	for _, it := range items {
+		if v, ok := r.gauges[it.ID]; ok && it.MType == string(domain.Gauge) {
+			prior.Gauges[it.ID] = v
+		}
+		if d, ok := r.counters[it.ID]; ok && it.MType == string(domain.Counter) {
+			prior.Counters[it.ID] = d
+		}
+	}
+	r.rev++
+	for _, it := range items {
+		switch {
+		case it.MType == string(domain.Gauge) && it.Value != nil:
+			r.gauges[it.ID] = *it.Value
+			r.gaugeRev[it.ID] = r.rev
+		case it.MType == string(domain.Counter) && it.Delta != nil:
+			r.counters[it.ID] += *it.Delta
+			r.counterRev[it.ID] = r.rev
+		default:
+		}
+	}
+	return prior, nil
+}
+
+func (r *lockedRepo) Snapshot(context.Context) (domain.Snapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return domain.Snapshot{Gauges: maps.Clone(r.gauges), Counters: maps.Clone(r.counters), Revision: r.rev}, nil
+}
+
+func (r *lockedRepo) SnapshotSince(ctx context.Context, _ int64) (domain.Snapshot, error) {
+	return r.Snapshot(ctx)
+}
+
+func (r *lockedRepo) Revision(context.Context) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rev, nil
+}
+
+func (*lockedRepo) Ping(context.Context) error {
+	return errors.New("db not configured")
+}
+
+var benchRepos = []struct {
+	newRepo func() ports.MetricsRepo
+	name    string
+}{
+	{func() ports.MetricsRepo { return newLocked() }, "locked"},
+	{func() ports.MetricsRepo { return New() }, "sharded"},
+}
+
+// agentBatch mimics one agent report: the runtime gauges plus a poll counter.
+func agentBatch(n int) []domain.Metrics {
+	items := make([]domain.Metrics, 0, n+1)
+	for i := range n {
+		items = append(items, domain.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: string(domain.Gauge), Value: ptrFloat64(float64(i))})
+	}
+	return append(items, domain.Metrics{ID: "PollCount", MType: string(domain.Counter), Delta: ptrInt64(1)})
+}
+
+func BenchmarkAddCounter_Parallel(b *testing.B) {
+	for _, br := range benchRepos {
+		b.Run(br.name, func(b *testing.B) {
+			repo := br.newRepo()
+			ctx := context.Background()
+			var worker atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				name := fmt.Sprintf("Counter%d", worker.Add(1)%16)
+				for pb.Next() {
+					if _, err := repo.AddCounter(ctx, name, 1); err != nil {
+						b.Errorf("AddCounter: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetGauge_Parallel(b *testing.B) {
+	for _, br := range benchRepos {
+		b.Run(br.name, func(b *testing.B) {
+			repo := br.newRepo()
+			ctx := context.Background()
+			if _, err := repo.UpdateMany(ctx, agentBatch(30)); err != nil {
+				b.Fatalf("seed: %v", err)
+			}
+			var worker atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				w := worker.Add(1)
+				i := 0
+				for pb.Next() {
+					i++
+					if i%8 == 0 {
+						_ = repo.SetGauge(ctx, fmt.Sprintf("Gauge%d", w%30), float64(i))
+						continue
+					}
+					if _, err := repo.GetGauge(ctx, fmt.Sprintf("Gauge%d", i%30)); err != nil {
+						b.Errorf("GetGauge: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkUpdateMany_WithSnapshots measures agent batches while a reader keeps taking
+// snapshots, the pattern of many agents reporting to a polled server.
+func BenchmarkUpdateMany_WithSnapshots(b *testing.B) {
+	for _, br := range benchRepos {
+		b.Run(br.name, func(b *testing.B) {
+			repo := br.newRepo()
+			ctx := context.Background()
+			items := agentBatch(30)
+			for i := range 2000 {
+				_ = repo.SetGauge(ctx, fmt.Sprintf("Host%d", i), float64(i))
+			}
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := repo.Snapshot(ctx); err != nil {
+						b.Errorf("Snapshot: %v", err)
+						return
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := repo.UpdateMany(ctx, items); err != nil {
+						b.Errorf("UpdateMany: %v", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkSnapshot_WithWriters measures snapshots of a populated store while single
+// writes and agent batches keep landing, and reports how many writes got through per
+// snapshot.
+func BenchmarkSnapshot_WithWriters(b *testing.B) {
+	for _, br := range benchRepos {
+		b.Run(br.name, func(b *testing.B) {
+			repo := br.newRepo()
+			ctx := context.Background()
+			for i := range 2000 {
+				_ = repo.SetGauge(ctx, fmt.Sprintf("Host%d", i), float64(i))
+			}
+			items := agentBatch(30)
+
+			stop := make(chan struct{})
+			var writes atomic.Int64
+			var wg sync.WaitGroup
+			for w := range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						var err error
+						if w == 0 {
+							_, err = repo.UpdateMany(ctx, items)
+						} else {
+							err = repo.SetGauge(ctx, fmt.Sprintf("Host%d", (i*4+w)%2000), float64(i))
+						}
+						if err != nil {
+							b.Errorf("write: %v", err)
+							return
+						}
+						writes.Add(1)
+					}
+				}()
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := repo.Snapshot(ctx); err != nil {
+					b.Fatalf("Snapshot: %v", err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -3,11 +3,14 @@ package memory
 import (
 	"context"
 	"errors"
+	"fmt"
 	"slices"
 	"sync"
 	"testing"
 
 	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
 )
 
 func TestMemStorage(t *testing.T) {
@@ -54,7 +57,7 @@ func TestMemStorage(t *testing.T) {
 		for _, tc := range cases {
 			t.Run(tc.name, func(t *testing.T) {
 				for _, d := range tc.deltas {
-					if err := ms.AddCounter(context.TODO(), tc.key, d); err != nil {
+					if _, err := ms.AddCounter(context.TODO(), tc.key, d); err != nil {
 						t.Fatalf("unexpected error: %v", err)
 					}
 				}
@@ -123,11 +126,11 @@ func TestMemStorage(t *testing.T) {
 				if err := ms.SetGauge(context.TODO(), "pre_g", 10); err != nil {
 					t.Fatalf("seed gauge: %v", err)
 				}
-				if err := ms.AddCounter(context.TODO(), "pre_c", 5); err != nil {
+				if _, err := ms.AddCounter(context.TODO(), "pre_c", 5); err != nil {
 					t.Fatalf("seed counter: %v", err)
 				}
 
-				if err := ms.UpdateMany(context.TODO(), tc.items); err != nil {
+				if _, err := ms.UpdateMany(context.TODO(), tc.items); err != nil {
 					t.Fatalf("UpdateMany error: %v", err)
 				}
 
@@ -166,7 +169,7 @@ func TestMemStorage(t *testing.T) {
 		if err := ms.SetGauge(context.TODO(), "g", 1.0); err != nil {
 			t.Fatalf("seed gauge: %v", err)
 		}
-		if err := ms.AddCounter(context.TODO(), "c", 1); err != nil {
+		if _, err := ms.AddCounter(context.TODO(), "c", 1); err != nil {
 			t.Fatalf("seed counter: %v", err)
 		}
 
@@ -182,6 +185,63 @@ func TestMemStorage(t *testing.T) {
 		}
 	})
 
+	t.Run("RevisionAndSince", func(t *testing.T) {
+		ms := New()
+		if rev, _ := ms.Revision(context.TODO()); rev != 0 {
+			t.Fatalf("empty repo revision=%d, want 0", rev)
+		}
+		if err := ms.SetGauge(context.TODO(), "g", 1.0); err != nil {
+			t.Fatalf("seed gauge: %v", err)
+		}
+		base, _ := ms.Revision(context.TODO())
+
+		items := []domain.Metrics{
+			{ID: "c", MType: string(domain.Counter), Delta: ptrInt64(2)},
+			{ID: "g2", MType: string(domain.Gauge), Value: ptrFloat64(3)},
+		}
+		if _, err := ms.UpdateMany(context.TODO(), items); err != nil {
+			t.Fatalf("UpdateMany: %v", err)
+		}
+
+		delta, err := ms.SnapshotSince(context.TODO(), base)
+		if err != nil {
+			t.Fatalf("SnapshotSince: %v", err)
+		}
+		if _, ok := delta.Gauges["g"]; ok {
+			t.Fatal("unchanged gauge must not be part of the delta")
+		}
+		if delta.Gauges["g2"] != 3 || delta.Counters["c"] != 2 {
+			t.Fatalf("unexpected delta: %+v", delta)
+		}
+		if delta.Revision <= base {
+			t.Fatalf("revision %d must be greater than %d", delta.Revision, base)
+		}
+
+		full, _ := ms.Snapshot(context.TODO())
+		if full.Revision != delta.Revision || len(full.Gauges) != 2 {
+			t.Fatalf("unexpected snapshot: %+v", full)
+		}
+	})
+
+	t.Run("RevisionBase", func(t *testing.T) {
+		ms := New(WithRevisionBase(1000))
+		if rev, _ := ms.Revision(context.TODO()); rev != 1000 {
+			t.Fatalf("revision=%d, want 1000", rev)
+		}
+		if err := ms.SetGauge(context.TODO(), "g", 1.0); err != nil {
+			t.Fatalf("SetGauge: %v", err)
+		}
+		if delta, _ := ms.SnapshotSince(context.TODO(), 1000); delta.Gauges["g"] != 1 || delta.Revision != 1001 {
+			t.Fatalf("unexpected delta: %+v", delta)
+		}
+
+		ms.AdvanceRevision(5000)
+		ms.AdvanceRevision(10)
+		if rev, _ := ms.Revision(context.TODO()); rev != 5000 {
+			t.Fatalf("revision=%d, want 5000", rev)
+		}
+	})
+
 	t.Run("PingNotConfigured", func(t *testing.T) {
 		ms := New()
 		if err := ms.Ping(context.TODO()); err == nil {
@@ -200,7 +260,7 @@ func TestMemStorage(t *testing.T) {
 					if err := ms.SetGauge(context.TODO(), "g", float64(i)); err != nil {
 						panic(err)
 					}
-					if err := ms.AddCounter(context.TODO(), "c", int64(i)); err != nil {
+					if _, err := ms.AddCounter(context.TODO(), "c", int64(i)); err != nil {
 						panic(err)
 					}
 				}(i)
@@ -233,7 +293,7 @@ func TestMemStorage(t *testing.T) {
 						d := int64(1)
 						items = append(items, domain.Metrics{ID: "c", MType: string(domain.Counter), Delta: &d})
 					}
-					if err := ms.UpdateMany(context.TODO(), items); err != nil {
+					if _, err := ms.UpdateMany(context.TODO(), items); err != nil {
 						panic(err)
 					}
 				}()
@@ -261,7 +321,7 @@ func TestMemStorage(t *testing.T) {
 				go func(i int) {
 					defer wg.Done()
 					items := []domain.Metrics{{ID: "g", MType: string(domain.Gauge), Value: ptrFloat64(values[i])}}
-					if err := ms.UpdateMany(context.TODO(), items); err != nil {
+					if _, err := ms.UpdateMany(context.TODO(), items); err != nil {
 						panic(err)
 					}
 				}(i)
@@ -282,3 +342,11 @@ func TestMemStorage(t *testing.T) {
 
 func ptrFloat64(v float64) *float64 { return &v }
 func ptrInt64(v int64) *int64       { return &v }
+
+func TestRepo_Conformance(t *testing.T) {
+	for _, shards := range []int{1, 3, 64} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			repotest.Run(t, func(*testing.T) ports.MetricsRepo { return New(WithShards(shards)) })
+		})
+	}
+}
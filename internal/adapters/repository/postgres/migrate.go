@@ -1,8 +1,14 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
 
 	"github.com/pressly/goose/v3"
 )
@@ -10,11 +16,116 @@ import (
 //go:embed migrations/*.sql
 var embedMigrations embed.FS
 
-// Migrate applies the embedded Goose migrations to the provided database.
+var (
+	// ErrSchemaTooNew means the database was migrated by a build newer than this one.
+	ErrSchemaTooNew = errors.New("database schema is newer than this build")
+	// ErrNothingToRollBack means no migration is applied.
+	ErrNothingToRollBack = errors.New("no migration to roll back")
+)
+
+// MigrationStatus describes one embedded migration.
+type MigrationStatus struct {
+	AppliedAt time.Time
+	Name      string
+	Version   int64
+	Applied   bool
+}
+
+// Migrator applies, rolls back and reports the embedded Goose migrations.
+type Migrator struct {
+	provider *goose.Provider
+}
+
+// NewMigrator binds the embedded migrations to db. It does not touch the database.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	fsys, err := fs.Sub(embedMigrations, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("migrations: %w", err)
+	}
+	p, err := goose.NewProvider(goose.DialectPostgres, db, fsys)
+	if err != nil {
+		return nil, fmt.Errorf("migrations: %w", err)
+	}
+	return &Migrator{provider: p}, nil
+}
+
+// Version returns the schema version of the database and the newest version this build knows.
+func (m *Migrator) Version(ctx context.Context) (current, latest int64, err error) {
+	current, latest, err = m.provider.GetVersions(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("schema version: %w", err)
+	}
+	return current, latest, nil
+}
+
+// Check returns ErrSchemaTooNew when the database holds a migration this build does not know.
+func (m *Migrator) Check(ctx context.Context) error {
+	current, latest, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, this build knows up to %d", ErrSchemaTooNew, current, latest)
+	}
+	return nil
+}
+
+// Up applies every pending migration and returns the versions it applied.
+func (m *Migrator) Up(ctx context.Context) ([]int64, error) {
+	if err := m.Check(ctx); err != nil {
+		return nil, err
+	}
+	results, err := m.provider.Up(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate up: %w", err)
+	}
+	applied := make([]int64, 0, len(results))
+	for _, r := range results {
+		applied = append(applied, r.Source.Version)
+	}
+	return applied, nil
+}
+
+// Down rolls back the most recently applied migration and returns its version.
+func (m *Migrator) Down(ctx context.Context) (int64, error) {
+	if err := m.Check(ctx); err != nil {
+		return 0, err
+	}
+	res, err := m.provider.Down(ctx)
+	if errors.Is(err, goose.ErrNoNextVersion) {
+		return 0, ErrNothingToRollBack
+	}
+	if err != nil {
+		return 0, fmt.Errorf("migrate down: %w", err)
+	}
+	return res.Source.Version, nil
+}
+
+// Status lists the embedded migrations in version order and whether each one is applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	list, err := m.provider.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migration status: %w", err)
+	}
+	out := make([]MigrationStatus, 0, len(list))
+	for _, s := range list {
+		out = append(out, MigrationStatus{
+			Version:   s.Source.Version,
+			Name:      path.Base(s.Source.Path),
+			Applied:   s.State == goose.StateApplied,
+			AppliedAt: s.AppliedAt,
+		})
+	}
+	return out, nil
+}
+
+// Migrate applies the embedded Goose migrations to the provided database. It refuses
+// a database migrated by a newer build.
 func Migrate(db *sql.DB) error {
-	goose.SetBaseFS(embedMigrations)
-	if err := goose.SetDialect("postgres"); err != nil {
+	m, err := NewMigrator(db)
+	if err != nil {
 		return err
 	}
-	return goose.Up(db, "migrations")
+	_, err = m.Up(context.Background())
+	return err
 }
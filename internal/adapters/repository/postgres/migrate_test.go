@@ -1,8 +1,15 @@
 package postgres
 
 import (
+	"context"
+	"errors"
 	"io/fs"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
 )
 
 func TestEmbeddedMigrations_Present(t *testing.T) {
@@ -25,3 +32,118 @@ func TestEmbeddedMigrations_Present(t *testing.T) {
 		t.Logf("warning: 0001_init.sql not found among: %v", entries)
 	}
 }
+
+// latestEmbedded returns the highest version among the embedded migrations.
+func latestEmbedded(t *testing.T) int64 {
+	t.Helper()
+	entries, err := fs.ReadDir(embedMigrations, "migrations")
+	if err != nil {
+		t.Fatalf("cannot read embedded migrations: %v", err)
+	}
+	var latest int64
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		v, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			t.Fatalf("bad migration name %q", e.Name())
+		}
+		latest = max(latest, v)
+	}
+	return latest
+}
+
+func newMockMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	m, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	mock.ExpectQuery(`SELECT EXISTS \( SELECT 1 FROM pg_tables`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	return m, mock
+}
+
+func expectDBVersion(mock sqlmock.Sqlmock, v int64) {
+	mock.ExpectQuery(`SELECT max\(version_id\) FROM goose_db_version`).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(v))
+}
+
+func TestMigrator_Check(t *testing.T) {
+	latest := latestEmbedded(t)
+	tests := []struct {
+		name    string
+		db      int64
+		wantErr error
+	}{
+		{"fresh", 0, nil},
+		{"behind", latest - 1, nil},
+		{"current", latest, nil},
+		{"newer", latest + 1, ErrSchemaTooNew},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mock := newMockMigrator(t)
+			expectDBVersion(mock, tt.db)
+			if err := m.Check(context.Background()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want %v, got %v", tt.wantErr, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMigrator_RefusesNewerSchema(t *testing.T) {
+	latest := latestEmbedded(t)
+	ops := map[string]func(*Migrator) error{
+		"up":   func(m *Migrator) error { _, err := m.Up(context.Background()); return err },
+		"down": func(m *Migrator) error { _, err := m.Down(context.Background()); return err },
+	}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			m, mock := newMockMigrator(t)
+			expectDBVersion(mock, latest+1)
+			if err := op(m); !errors.Is(err, ErrSchemaTooNew) {
+				t.Fatalf("want ErrSchemaTooNew, got %v", err)
+			}
+			// Nothing past the version check may run.
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMigrator_Status(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	appliedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	latest := latestEmbedded(t)
+	for v := int64(1); v <= latest; v++ {
+		rows := sqlmock.NewRows([]string{"tstamp", "is_applied"})
+		if v < latest {
+			rows.AddRow(appliedAt, true)
+		}
+		mock.ExpectQuery(`SELECT tstamp, is_applied FROM goose_db_version WHERE version_id=\$1`).
+			WithArgs(v).WillReturnRows(rows)
+	}
+
+	list, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if int64(len(list)) != latest {
+		t.Fatalf("want %d migrations, got %d", latest, len(list))
+	}
+	if list[0].Name != "0001_init.sql" || !list[0].Applied || !list[0].AppliedAt.Equal(appliedAt) {
+		t.Fatalf("unexpected first migration: %+v", list[0])
+	}
+	if last := list[len(list)-1]; last.Version != latest || last.Applied {
+		t.Fatalf("the newest migration should be pending: %+v", last)
+	}
+}
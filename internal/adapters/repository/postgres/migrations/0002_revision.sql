@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE SEQUENCE IF NOT EXISTS metrics_rev_seq;
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS rev BIGINT NOT NULL DEFAULT nextval('metrics_rev_seq');
+CREATE INDEX IF NOT EXISTS metrics_rev_idx ON metrics(rev);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION metrics_bump_rev() RETURNS trigger AS $$
+BEGIN
+  NEW.rev := nextval('metrics_rev_seq');
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER metrics_bump_rev_trg
+  BEFORE UPDATE ON metrics
+  FOR EACH ROW EXECUTE FUNCTION metrics_bump_rev();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS metrics_bump_rev_trg ON metrics;
+DROP FUNCTION IF EXISTS metrics_bump_rev();
+DROP INDEX IF EXISTS metrics_rev_idx;
+ALTER TABLE metrics DROP COLUMN IF EXISTS rev;
+DROP SEQUENCE IF EXISTS metrics_rev_seq;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS audit_events (
+  id         BIGSERIAL PRIMARY KEY,
+  ts         BIGINT NOT NULL,
+  ip_address TEXT NOT NULL DEFAULT '',
+  metrics    TEXT[] NOT NULL DEFAULT '{}',
+  event      JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_ts_idx ON audit_events(ts);
+CREATE INDEX IF NOT EXISTS audit_events_ip_idx ON audit_events(ip_address);
+CREATE INDEX IF NOT EXISTS audit_events_metrics_idx ON audit_events USING GIN (metrics);
+
+-- +goose Down
+DROP TABLE IF EXISTS audit_events;
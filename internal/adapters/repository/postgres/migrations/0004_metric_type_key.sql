@@ -0,0 +1,10 @@
+-- +goose Up
+-- A gauge and a counter may share a name; existing rows keep their (id, mtype) as is.
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (id, mtype);
+
+-- +goose Down
+-- Only one metric per name fits the old key: keep the most recently written one.
+DELETE FROM metrics m USING metrics o WHERE m.id = o.id AND m.rev < o.rev;
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (id);
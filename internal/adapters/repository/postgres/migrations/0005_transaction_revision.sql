@@ -0,0 +1,48 @@
+-- +goose Up
+-- Revisions follow the writing transaction's ID, offset to stay above the revisions the
+-- sequence handed out. Transactions below pg_snapshot_xmin have all finished, so
+-- metrics_safe_rev() is a revision no write still in flight can commit at or below.
+-- +goose StatementBegin
+DO $$
+DECLARE
+  base bigint;
+BEGIN
+  SELECT GREATEST(COALESCE(MAX(rev), 0) - pg_current_xact_id()::text::bigint, 0) + 1 INTO base FROM metrics;
+  EXECUTE format('CREATE OR REPLACE FUNCTION metrics_rev_base() RETURNS bigint IMMUTABLE LANGUAGE sql AS %L',
+    'SELECT ' || base || '::bigint');
+END;
+$$;
+-- +goose StatementEnd
+
+CREATE OR REPLACE FUNCTION metrics_xact_rev() RETURNS bigint VOLATILE LANGUAGE sql
+  AS 'SELECT pg_current_xact_id()::text::bigint + metrics_rev_base()';
+
+CREATE OR REPLACE FUNCTION metrics_safe_rev() RETURNS bigint STABLE LANGUAGE sql
+  AS 'SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint + metrics_rev_base() - 1';
+
+ALTER TABLE metrics ALTER COLUMN rev SET DEFAULT metrics_xact_rev();
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION metrics_bump_rev() RETURNS trigger AS $$
+BEGIN
+  NEW.rev := metrics_xact_rev();
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION metrics_bump_rev() RETURNS trigger AS $$
+BEGIN
+  NEW.rev := nextval('metrics_rev_seq');
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+ALTER TABLE metrics ALTER COLUMN rev SET DEFAULT nextval('metrics_rev_seq');
+SELECT setval('metrics_rev_seq', GREATEST((SELECT COALESCE(MAX(rev), 0) FROM metrics), 1));
+DROP FUNCTION IF EXISTS metrics_safe_rev();
+DROP FUNCTION IF EXISTS metrics_xact_rev();
+DROP FUNCTION IF EXISTS metrics_rev_base();
@@ -0,0 +1,7 @@
+-- +goose Up
+-- The value a gauge held before its latest single write. That write sets it from the row it
+-- replaces, so its RETURNING clause can report the old value; nothing else reads it.
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS prev_value DOUBLE PRECISION;
+
+-- +goose Down
+ALTER TABLE metrics DROP COLUMN IF EXISTS prev_value;
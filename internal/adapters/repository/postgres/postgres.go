@@ -17,7 +17,8 @@ import (
 	"github.com/vshulcz/Golectra/internal/ports"
 )
 
-// Repo persists metrics in Postgres with retryable operations.
+// Repo persists metrics in Postgres with retryable operations. Rows are keyed by (id, mtype),
+// so a gauge and a counter with the same name are stored independently.
 type Repo struct {
 	db *sql.DB
 }
@@ -67,6 +68,29 @@ func (r *Repo) GetGauge(ctx context.Context, n string) (float64, error) {
 	return v.Float64, nil
 }
 
+// GetGaugeWithRevision reads a gauge value together with the revision of its row.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, n string) (float64, int64, error) {
+	const q = `SELECT value, rev FROM metrics WHERE id=$1 AND mtype=$2`
+	var (
+		v   sql.NullFloat64
+		rev int64
+	)
+	op := func() error {
+		v = sql.NullFloat64{}
+		return r.db.QueryRowContext(ctx, q, n, string(domain.Gauge)).Scan(&v, &rev)
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, domain.ErrNotFound
+		}
+		return 0, 0, err
+	}
+	if !v.Valid {
+		return 0, 0, domain.ErrNotFound
+	}
+	return v.Float64, rev, nil
+}
+
 // GetCounter reads a single counter value by name.
 func (r *Repo) GetCounter(ctx context.Context, n string) (int64, error) {
 	const q = `SELECT delta FROM metrics WHERE id=$1 AND mtype=$2`
@@ -92,8 +116,8 @@ func (r *Repo) SetGauge(ctx context.Context, n string, v float64) error {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=EXCLUDED.value, updated_at=now();`
 	op := func() error {
 		_, err := r.db.ExecContext(ctx, q, n, string(domain.Gauge), v)
 		return err
@@ -101,37 +125,218 @@ DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
 	return misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op)
 }
 
-// AddCounter increments (or creates) the named counter.
-func (r *Repo) AddCounter(ctx context.Context, n string, d int64) error {
+// Gauge writes used by CompareAndSetGauge; each returns the revision the row got and the
+// value it replaced, NULL for a new row, or no row when the revision did not match.
+const (
+	qSetGaugeAny = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+VALUES ($1, 'gauge', $2, NULL, now())
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=EXCLUDED.value, prev_value=metrics.value, updated_at=now()
+RETURNING rev, prev_value;`
+	qInsertGauge = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+VALUES ($1, 'gauge', $2, NULL, now())
+ON CONFLICT (id, mtype) DO NOTHING
+RETURNING rev, prev_value;`
+	qUpdateGaugeAt = `
+UPDATE metrics SET value=$2, prev_value=value, updated_at=now()
+WHERE id=$1 AND mtype='gauge' AND rev=$3
+RETURNING rev, prev_value;`
+)
+
+// CompareAndSetGauge writes the gauge with a single statement: the row is only inserted when
+// expected is zero and only updated while its rev still equals expected, so the comparison
+// and the write are one atomic step.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, n string, v float64, expected int64) (domain.GaugeWrite, error) {
+	q, args := qSetGaugeAny, []any{n, v}
+	switch {
+	case expected == 0:
+		q = qInsertGauge
+	case expected != ports.AnyRevision:
+		q, args = qUpdateGaugeAt, []any{n, v, expected}
+	}
+	var (
+		rev int64
+		old sql.NullFloat64
+	)
+	op := func() error {
+		return r.db.QueryRowContext(ctx, q, args...).Scan(&rev, &old)
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.GaugeWrite{}, domain.ErrRevisionMismatch
+		}
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(old, v, rev), nil
+}
+
+// Gauge operations as SQL: the value a row gets when EXCLUDED.value is written to it.
+const (
+	qApplyGauge = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+VALUES ($1, 'gauge', $2, NULL, now())
+ON CONFLICT (id, mtype)
+DO UPDATE SET prev_value=metrics.value, value=`
+	qApplyGaugeReturning = `, updated_at=now()
+RETURNING value, rev, prev_value;`
+)
+
+var gaugeOpExprs = map[domain.GaugeOp]string{
+	domain.GaugeSet: "EXCLUDED.value",
+	domain.GaugeAdd: "COALESCE(metrics.value, 0)+EXCLUDED.value",
+	domain.GaugeMax: "GREATEST(metrics.value, EXCLUDED.value)",
+	domain.GaugeMin: "LEAST(metrics.value, EXCLUDED.value)",
+}
+
+// ApplyGauge combines the value with the stored gauge in a single upsert, so concurrent
+// writers never lose an update, and reports the value it replaced and the value and
+// revision the row got.
+func (r *Repo) ApplyGauge(ctx context.Context, n string, gop domain.GaugeOp, v float64) (domain.GaugeWrite, error) {
+	expr, ok := gaugeOpExprs[gop.Effective()]
+	if !ok {
+		return domain.GaugeWrite{}, domain.ErrInvalidType
+	}
+	q := qApplyGauge + expr + qApplyGaugeReturning
+	var (
+		res float64
+		rev int64
+		old sql.NullFloat64
+	)
+	op := func() error {
+		return r.db.QueryRowContext(ctx, q, n, v).Scan(&res, &rev, &old)
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(old, res, rev), nil
+}
+
+// gaugeWrite reports a gauge write from the prev_value it returned, NULL for a new row.
+func gaugeWrite(old sql.NullFloat64, value float64, rev int64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value, Revision: rev}
+	if old.Valid {
+		w.Old = &old.Float64
+	}
+	return w
+}
+
+// AddCounter increments (or creates) the named counter and returns the total written by
+// the same statement.
+func (r *Repo) AddCounter(ctx context.Context, n string, d int64) (int64, error) {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now()
+RETURNING delta;`
+	var total int64
 	op := func() error {
-		_, err := r.db.ExecContext(ctx, q, n, string(domain.Counter), d)
-		return err
+		return r.db.QueryRowContext(ctx, q, n, string(domain.Counter), d).Scan(&total)
 	}
-	return misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op)
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
+		return 0, err
+	}
+	return total, nil
 }
 
-// UpdateMany atomically applies a batch of metrics inside a transaction.
-func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) error {
+// Set-based upserts used by UpdateMany: one statement per metric type, and per gauge
+// operation, whatever the batch size. The arrays must not repeat an ID, since one statement
+// cannot update the same row twice.
+//
+// qLockBatch runs first and takes the row lock of every metric in the batch, creating rows
+// that do not exist yet, in (id, mtype) order. Concurrent batches therefore queue on their
+// first shared row instead of locking each other's rows in opposite orders through the
+// later statements. Rows it creates are left without a value, which the write that follows
+// in the same transaction fills in, and it returns every row as the batch found it, so
+// rows without a value or delta are the ones the batch created.
+const (
+	qLockBatch = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+SELECT id, mtype, NULL::double precision, NULL::bigint, now()
+FROM unnest($1::text[], $2::text[]) AS b(id, mtype)
+ORDER BY id, mtype
+ON CONFLICT (id, mtype)
+DO UPDATE SET updated_at=now()
+RETURNING id, mtype, value, delta;`
+	qUpsertGaugesBy = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+SELECT id, 'gauge', value, NULL::bigint, now()
+FROM unnest($1::text[], $2::double precision[]) AS b(id, value)
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=`
+	qUpsertGauges   = qUpsertGaugesBy + `EXCLUDED.value, updated_at=now();`
+	qUpsertCounters = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+SELECT id, 'counter', NULL::double precision, delta, now()
+FROM unnest($1::text[], $2::bigint[]) AS b(id, delta)
+ON CONFLICT (id, mtype)
+DO UPDATE SET delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+)
+
+// gaugeUpsert is one set-based gauge statement of UpdateMany.
+type gaugeUpsert struct {
+	query  string
+	ids    []string
+	values []float64
+}
+
+// UpdateMany atomically applies a batch of metrics inside a transaction. The batch is first
+// folded per metric (combined gauge writes, summed counter delta); its rows are locked in
+// order with qLockBatch and then written with one statement per gauge operation, then one
+// for counters. Items without a payload or of an unknown type are skipped. A gauge whose
+// operations do not fold into one write takes a further round of gauge statements for each
+// extra write. The values the batch replaced are the ones qLockBatch returned.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
 	if len(items) == 0 {
-		return nil
+		return domain.Snapshot{}, nil
 	}
 
-	const qGauge = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
-	const qCounter = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+	var (
+		rounds          [][]domain.Metrics
+		counterIDs      []string
+		deltas          []int64
+		seen            = map[string]int{}
+		lockIDs, lockTs []string
+	)
+	for _, it := range domain.Fold(items) {
+		if it.MType == string(domain.Gauge) {
+			k := seen[it.ID]
+			seen[it.ID]++
+			if k == 0 {
+				lockIDs, lockTs = append(lockIDs, it.ID), append(lockTs, it.MType)
+			}
+			if k == len(rounds) {
+				rounds = append(rounds, nil)
+			}
+			rounds[k] = append(rounds[k], it)
+			continue
+		}
+		counterIDs = append(counterIDs, it.ID)
+		deltas = append(deltas, *it.Delta)
+		lockIDs, lockTs = append(lockIDs, it.ID), append(lockTs, it.MType)
+	}
+	var gauges []gaugeUpsert
+	for _, round := range rounds {
+		for _, gop := range domain.GaugeOps {
+			u := gaugeUpsert{query: qUpsertGaugesBy + gaugeOpExprs[gop] + ", updated_at=now();"}
+			for _, it := range round {
+				if it.Op.Effective() == gop {
+					u.ids = append(u.ids, it.ID)
+					u.values = append(u.values, *it.Value)
+				}
+			}
+			if len(u.ids) > 0 {
+				gauges = append(gauges, u)
+			}
+		}
+	}
+	if len(gauges)+len(counterIDs) == 0 {
+		return domain.Snapshot{}, nil
+	}
 
+	var prior domain.Snapshot
 	attempt := func() error {
 		tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 		if err != nil {
@@ -141,23 +346,18 @@ DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.del
 			_ = tx.Rollback()
 		}()
 
-		for _, it := range items {
-			switch it.MType {
-			case string(domain.Gauge):
-				if it.Value == nil {
-					continue
-				}
-				if _, err := tx.ExecContext(ctx, qGauge, it.ID, string(domain.Gauge), *it.Value); err != nil {
-					return err
-				}
-			case string(domain.Counter):
-				if it.Delta == nil {
-					continue
-				}
-				if _, err := tx.ExecContext(ctx, qCounter, it.ID, string(domain.Counter), *it.Delta); err != nil {
-					return err
-				}
-			default:
+		prior, err = lockBatch(ctx, tx, lockIDs, lockTs)
+		if err != nil {
+			return err
+		}
+		for _, u := range gauges {
+			if _, err := tx.ExecContext(ctx, u.query, pq.Array(u.ids), pq.Array(u.values)); err != nil {
+				return err
+			}
+		}
+		if len(counterIDs) > 0 {
+			if _, err := tx.ExecContext(ctx, qUpsertCounters, pq.Array(counterIDs), pq.Array(deltas)); err != nil {
+				return err
 			}
 		}
 		if err := tx.Commit(); err != nil {
@@ -165,17 +365,73 @@ DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.del
 		}
 		return nil
 	}
-	return misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, attempt)
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, attempt); err != nil {
+		return domain.Snapshot{}, err
+	}
+	return prior, nil
+}
+
+// lockBatch runs qLockBatch and returns the values the rows held before the batch.
+func lockBatch(ctx context.Context, tx *sql.Tx, ids, mtypes []string) (domain.Snapshot, error) {
+	rows, err := tx.QueryContext(ctx, qLockBatch, pq.Array(ids), pq.Array(mtypes))
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	prior := domain.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}
+	for rows.Next() {
+		var (
+			id, mtype string
+			v         sql.NullFloat64
+			d         sql.NullInt64
+		)
+		if err := rows.Scan(&id, &mtype, &v, &d); err != nil {
+			return domain.Snapshot{}, err
+		}
+		switch {
+		case mtype == string(domain.Gauge) && v.Valid:
+			prior.Gauges[id] = v.Float64
+		case mtype == string(domain.Counter) && d.Valid:
+			prior.Counters[id] = d.Int64
+		default:
+		}
+	}
+	return prior, rows.Err()
 }
 
 // Snapshot loads all stored metrics and returns them grouped by type.
 func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
-	const q = `SELECT id, mtype, value, delta FROM metrics`
+	return r.SnapshotSince(ctx, 0)
+}
+
+// SnapshotSince loads metrics whose revision is greater than since, grouped by type.
+// The revision and the rows are read in one REPEATABLE READ transaction, so they describe
+// the same snapshot. A row's revision is fixed by its transaction before that commits, so
+// the returned revision is capped below the oldest transaction still in flight: a poller
+// that passes it back as since may see a metric twice but never skips one.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	const q = `SELECT id, mtype, value, delta FROM metrics WHERE rev > $1`
 	resultG := map[string]float64{}
 	resultC := map[string]int64{}
+	var resultRev int64
 
 	op := func() error {
-		rows, err := r.db.QueryContext(ctx, q)
+		tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		var maxRev int64
+		if err := tx.QueryRowContext(ctx, qMaxRevision).Scan(&maxRev); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, q, since)
 		if err != nil {
 			return err
 		}
@@ -193,7 +449,7 @@ func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
 		)
 		for rows.Next() {
 			if err := rows.Scan(&id, &mtype, &v, &d); err != nil {
-				continue
+				return err
 			}
 			switch mtype {
 			case string(domain.Gauge):
@@ -207,14 +463,48 @@ func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
 			default:
 			}
 		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
 		resultG = g
 		resultC = c
+		resultRev = maxRev
 		return nil
 	}
 	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
 		return domain.Snapshot{Gauges: resultG, Counters: resultC}, err
 	}
-	return domain.Snapshot{Gauges: resultG, Counters: resultC}, nil
+	return domain.Snapshot{Gauges: resultG, Counters: resultC, Revision: resultRev}, nil
+}
+
+// Revision returns the highest revision of any stored metric, capped below the oldest
+// transaction still in flight like the revision of SnapshotSince.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	var rev int64
+	op := func() error {
+		var err error
+		rev, err = r.queryRevision(ctx)
+		return err
+	}
+	if err := misc.Retry(ctx, misc.DefaultBackoff, isRetryablePG, op); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// qMaxRevision reads the highest visible revision, or metrics_safe_rev when a transaction
+// that may still commit a lower one is in flight.
+const qMaxRevision = `SELECT LEAST(COALESCE(MAX(rev), 0), metrics_safe_rev()) FROM metrics`
+
+func (r *Repo) queryRevision(ctx context.Context) (int64, error) {
+	var rev int64
+	if err := r.db.QueryRowContext(ctx, qMaxRevision).Scan(&rev); err != nil {
+		return 0, err
+	}
+	return rev, nil
 }
 
 // Ping verifies the database connection using a short-lived context.
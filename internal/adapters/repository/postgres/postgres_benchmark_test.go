@@ -0,0 +1,173 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	_ "github.com/lib/pq"
+	"github.com/vshulcz/Golectra/internal/domain"
+)
+
+// benchDSNEnv names a disposable database for the Postgres benchmarks; they are skipped when unset.
+const benchDSNEnv = "GOLECTRA_BENCH_DSN"
+
+// mockRoundTrip stands in for the network and server time of one statement.
+const mockRoundTrip = 50 * time.Microsecond
+
+var benchBatchSizes = []int{10, 100, 1000}
+
+// The statements UpdateMany used to issue once per item; kept as the baseline.
+const (
+	qRowGauge = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+VALUES ($1, $2, $3, NULL, now())
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=EXCLUDED.value, updated_at=now();`
+	qRowCounter = `
+INSERT INTO metrics (id, mtype, value, delta, updated_at)
+VALUES ($1, $2, NULL, $3, now())
+ON CONFLICT (id, mtype)
+DO UPDATE SET delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+)
+
+// updateManyPerRow is the previous UpdateMany: one upsert per item in a transaction.
+func updateManyPerRow(ctx context.Context, db *sql.DB, items []domain.Metrics) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, it := range items {
+		switch it.MType {
+		case string(domain.Gauge):
+			_, err = tx.ExecContext(ctx, qRowGauge, it.ID, it.MType, *it.Value)
+		case string(domain.Counter):
+			_, err = tx.ExecContext(ctx, qRowCounter, it.ID, it.MType, *it.Delta)
+		default:
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// benchBatch returns n items, half gauges and half counters, with every fifth ID repeated.
+func benchBatch(n int) []domain.Metrics {
+	items := make([]domain.Metrics, 0, n)
+	for i := range n {
+		id := i - i%5/4
+		if i%2 == 0 {
+			items = append(items, domain.Metrics{ID: fmt.Sprintf("g-%d", id), MType: string(domain.Gauge), Value: ptrFloat64(float64(i))})
+			continue
+		}
+		items = append(items, domain.Metrics{ID: fmt.Sprintf("c-%d", id), MType: string(domain.Counter), Delta: ptrInt64(int64(i))})
+	}
+	return items
+}
+
+func BenchmarkUpdateMany_Mock(b *testing.B) {
+	for _, n := range benchBatchSizes {
+		items := benchBatch(n)
+		b.Run(fmt.Sprintf("per_row/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				b.StopTimer()
+				db, mock := newBenchMock(b)
+				mock.ExpectBegin()
+				for range items {
+					mock.ExpectExec("INSERT").WillDelayFor(mockRoundTrip).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+				b.StartTimer()
+				if err := updateManyPerRow(context.Background(), db, items); err != nil {
+					b.Fatalf("updateManyPerRow: %v", err)
+				}
+				b.StopTimer()
+				_ = db.Close()
+				b.StartTimer()
+			}
+		})
+		b.Run(fmt.Sprintf("bulk/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				b.StopTimer()
+				db, mock := newBenchMock(b)
+				repo := New(db)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT").WillDelayFor(mockRoundTrip).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT").WillDelayFor(mockRoundTrip).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT").WillDelayFor(mockRoundTrip).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				b.StartTimer()
+				if _, err := repo.UpdateMany(context.Background(), items); err != nil {
+					b.Fatalf("UpdateMany: %v", err)
+				}
+				b.StopTimer()
+				_ = db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// newBenchMock returns a fresh mock per iteration: sqlmock keeps every expectation it
+// has matched, so reusing one would make each lookup slower than the last.
+func newBenchMock(b *testing.B) (*sql.DB, sqlmock.Sqlmock) {
+	b.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("sqlmock.New: %v", err)
+	}
+	return db, mock
+}
+
+func BenchmarkUpdateMany_Postgres(b *testing.B) {
+	dsn := os.Getenv(benchDSNEnv)
+	if dsn == "" {
+		b.Skipf("%s not set", benchDSNEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatalf("open: %v", err)
+	}
+	b.Cleanup(func() { _ = db.Close() })
+	if err := Migrate(db); err != nil {
+		b.Fatalf("migrate: %v", err)
+	}
+	ctx := context.Background()
+	repo := New(db)
+
+	for _, n := range benchBatchSizes {
+		items := benchBatch(n)
+		for _, tc := range []struct {
+			name string
+			fn   func() error
+		}{
+			{"per_row", func() error { return updateManyPerRow(ctx, db, items) }},
+			{"bulk", func() error {
+				_, err := repo.UpdateMany(ctx, items)
+				return err
+			}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", tc.name, n), func(b *testing.B) {
+				if _, err := db.ExecContext(ctx, `TRUNCATE metrics`); err != nil {
+					b.Fatalf("truncate: %v", err)
+				}
+				b.ReportAllocs()
+				for b.Loop() {
+					if err := tc.fn(); err != nil {
+						b.Fatalf("%s: %v", tc.name, err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"database/sql/driver"
 	"errors"
 	"net"
+	"os"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/lib/pq"
 	"github.com/vshulcz/Golectra/internal/domain"
 	"github.com/vshulcz/Golectra/internal/misc"
+	"github.com/vshulcz/Golectra/internal/ports"
 )
 
 func TestRepo_GetGauge(t *testing.T) {
@@ -139,8 +142,8 @@ func TestRepo_SetGauge(t *testing.T) {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=EXCLUDED.value, updated_at=now();`
 
 	t.Run("ok", func(t *testing.T) {
 		mock.ExpectExec(qm(q)).WithArgs("Alloc", "gauge", 1.23).
@@ -166,58 +169,247 @@ func TestRepo_AddCounter(t *testing.T) {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now()
+RETURNING delta;`
 
 	t.Run("ok", func(t *testing.T) {
-		mock.ExpectExec(qm(q)).WithArgs("Poll", "counter", int64(5)).
-			WillReturnResult(sqlmock.NewResult(0, 1))
-		if err := st.AddCounter(context.TODO(), "Poll", 5); err != nil {
+		mock.ExpectQuery(qm(q)).WithArgs("Poll", "counter", int64(5)).
+			WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(12)))
+		total, err := st.AddCounter(context.TODO(), "Poll", 5)
+		if err != nil {
 			t.Fatalf("AddCounter err: %v", err)
 		}
+		if total != 12 {
+			t.Fatalf("want the total returned by the upsert, got %d", total)
+		}
 	})
 
 	t.Run("error", func(t *testing.T) {
-		mock.ExpectExec(qm(q)).WithArgs("Err", "counter", int64(2)).
+		mock.ExpectQuery(qm(q)).WithArgs("Err", "counter", int64(2)).
 			WillReturnError(errors.New("exec"))
-		if err := st.AddCounter(context.TODO(), "Err", 2); err == nil {
+		if _, err := st.AddCounter(context.TODO(), "Err", 2); err == nil {
 			t.Fatal("expected error")
 		}
 	})
 }
 
+func TestRepo_GetGaugeWithRevision(t *testing.T) {
+	_, mock, st, done := newMock(t)
+	defer done()
+
+	pat := regexp.QuoteMeta(`SELECT value, rev FROM metrics WHERE id=$1 AND mtype=$2`)
+
+	mock.ExpectQuery(pat).WithArgs("Alloc", "gauge").
+		WillReturnRows(sqlmock.NewRows([]string{"value", "rev"}).AddRow(1.5, int64(7)))
+	v, rev, err := st.GetGaugeWithRevision(context.TODO(), "Alloc")
+	if err != nil || v != 1.5 || rev != 7 {
+		t.Fatalf("want 1.5 at rev 7, got %v at %d (%v)", v, rev, err)
+	}
+
+	mock.ExpectQuery(pat).WithArgs("Missing", "gauge").WillReturnError(sql.ErrNoRows)
+	if _, _, err := st.GetGaugeWithRevision(context.TODO(), "Missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestRepo_CompareAndSetGauge(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int64
+		query    string
+		args     []driver.Value
+		rows     *sqlmock.Rows
+		wantRev  int64
+		wantOld  *float64
+		wantErr  error
+	}{
+		{
+			name:     "any revision upserts",
+			expected: ports.AnyRevision,
+			query:    qSetGaugeAny,
+			args:     []driver.Value{"Alloc", 1.5},
+			rows:     sqlmock.NewRows([]string{"rev", "prev_value"}).AddRow(int64(9), 0.5),
+			wantRev:  9,
+			wantOld:  ptrFloat64(0.5),
+		},
+		{
+			name:     "zero creates",
+			expected: 0,
+			query:    qInsertGauge,
+			args:     []driver.Value{"Alloc", 1.5},
+			rows:     sqlmock.NewRows([]string{"rev", "prev_value"}).AddRow(int64(3), nil),
+			wantRev:  3,
+		},
+		{
+			name:     "zero on an existing gauge",
+			expected: 0,
+			query:    qInsertGauge,
+			args:     []driver.Value{"Alloc", 1.5},
+			rows:     sqlmock.NewRows([]string{"rev", "prev_value"}),
+			wantErr:  domain.ErrRevisionMismatch,
+		},
+		{
+			name:     "matching revision",
+			expected: 4,
+			query:    qUpdateGaugeAt,
+			args:     []driver.Value{"Alloc", 1.5, int64(4)},
+			rows:     sqlmock.NewRows([]string{"rev", "prev_value"}).AddRow(int64(10), 1.0),
+			wantRev:  10,
+			wantOld:  ptrFloat64(1),
+		},
+		{
+			name:     "stale revision",
+			expected: 4,
+			query:    qUpdateGaugeAt,
+			args:     []driver.Value{"Alloc", 1.5, int64(4)},
+			rows:     sqlmock.NewRows([]string{"rev", "prev_value"}),
+			wantErr:  domain.ErrRevisionMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, st, done := newMock(t)
+			defer done()
+
+			mock.ExpectQuery(qm(tt.query)).WithArgs(tt.args...).WillReturnRows(tt.rows)
+			w, err := st.CompareAndSetGauge(context.TODO(), "Alloc", 1.5, tt.expected)
+			if !errors.Is(err, tt.wantErr) || w.Revision != tt.wantRev {
+				t.Fatalf("want rev %d (%v), got %d (%v)", tt.wantRev, tt.wantErr, w.Revision, err)
+			}
+			if (w.Old == nil) != (tt.wantOld == nil) || (w.Old != nil && *w.Old != *tt.wantOld) {
+				t.Fatalf("want old value %v, got %v", tt.wantOld, w.Old)
+			}
+		})
+	}
+}
+
+func TestRepo_ApplyGauge(t *testing.T) {
+	tests := []struct {
+		op   domain.GaugeOp
+		expr string
+	}{
+		{"", "EXCLUDED.value"},
+		{domain.GaugeAdd, "COALESCE(metrics.value, 0)+EXCLUDED.value"},
+		{domain.GaugeMax, "GREATEST(metrics.value, EXCLUDED.value)"},
+		{domain.GaugeMin, "LEAST(metrics.value, EXCLUDED.value)"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.op.Effective()), func(t *testing.T) {
+			_, mock, st, done := newMock(t)
+			defer done()
+
+			mock.ExpectQuery(qm("DO UPDATE SET prev_value=metrics.value, value="+tt.expr+", updated_at=now()\nRETURNING value, rev, prev_value;")).
+				WithArgs("Load", 2.5).
+				WillReturnRows(sqlmock.NewRows([]string{"value", "rev", "prev_value"}).AddRow(4.0, int64(11), 1.5))
+			w, err := st.ApplyGauge(context.TODO(), "Load", tt.op, 2.5)
+			if err != nil || w.Value != 4 || w.Revision != 11 || w.Old == nil || *w.Old != 1.5 {
+				t.Fatalf("want 1.5 -> 4 at rev 11, got %+v (%v)", w, err)
+			}
+		})
+	}
+
+	t.Run("unknown operation", func(t *testing.T) {
+		_, _, st, done := newMock(t)
+		defer done()
+
+		if _, err := st.ApplyGauge(context.TODO(), "Load", "avg", 1); !errors.Is(err, domain.ErrInvalidType) {
+			t.Fatalf("want ErrInvalidType, got %v", err)
+		}
+	})
+}
+
 func TestRepo_Snapshot(t *testing.T) {
 	_, mock, st, done := newMock(t)
 	defer done()
 
-	const pat = `SELECT id, mtype, value, delta FROM metrics`
+	const pat = `SELECT id, mtype, value, delta FROM metrics WHERE rev > \$1`
+	const revPat = `SELECT LEAST\(COALESCE\(MAX\(rev\), 0\), metrics_safe_rev\(\)\) FROM metrics`
 
-	rows := sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
+	mock.ExpectBegin()
+	mock.ExpectQuery(revPat).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(42)))
+	mock.ExpectQuery(pat).WithArgs(int64(0)).WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
 		AddRow("Alloc", "gauge", 12.5, nil).
-		AddRow("PollCount", "counter", nil, int64(9)).
-		AddRow("BadRow", "gauge", "oops", nil)
-	rows.RowError(2, errors.New("scan err"))
-
-	mock.ExpectQuery(pat).WillReturnRows(rows)
+		AddRow("PollCount", "counter", nil, int64(9)))
+	mock.ExpectCommit()
 
-	s, _ := st.Snapshot(context.TODO())
+	s, err := st.Snapshot(context.TODO())
+	if err != nil {
+		t.Fatalf("Snapshot err: %v", err)
+	}
 	if s.Gauges["Alloc"] != 12.5 {
 		t.Fatalf("gauge Alloc=%v want 12.5", s.Gauges["Alloc"])
 	}
 	if s.Counters["PollCount"] != 9 {
 		t.Fatalf("counter PollCount=%v want 9", s.Counters["PollCount"])
 	}
-	if _, ok := s.Gauges["BadRow"]; ok {
-		t.Fatal("BadRow should be skipped on scan error")
+	if s.Revision != 42 {
+		t.Fatalf("revision=%d want 42", s.Revision)
 	}
 
-	mock.ExpectQuery(pat).WillReturnError(errors.New("db"))
+	rows := sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
+		AddRow("Alloc", "gauge", 12.5, nil).
+		AddRow("BadRow", "gauge", "oops", nil)
+	rows.RowError(1, errors.New("row err"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(revPat).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(42)))
+	mock.ExpectQuery(pat).WithArgs(int64(0)).WillReturnRows(rows)
+	mock.ExpectRollback()
+	s, err = st.Snapshot(context.TODO())
+	if err == nil {
+		t.Fatal("expected error on a broken row, not a partial snapshot")
+	}
+	if len(s.Gauges) != 0 || len(s.Counters) != 0 {
+		t.Fatalf("on error want empty maps, got %v %v", s.Gauges, s.Counters)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(revPat).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(42)))
+	mock.ExpectQuery(pat).WithArgs(int64(0)).WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
+		AddRow("BadRow", "gauge", "oops", nil))
+	mock.ExpectRollback()
+	if _, err := st.Snapshot(context.TODO()); err == nil {
+		t.Fatal("expected scan error")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(revPat).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(42)))
+	mock.ExpectQuery(pat).WithArgs(int64(0)).WillReturnError(errors.New("db"))
+	mock.ExpectRollback()
 	s, _ = st.Snapshot(context.TODO())
 	if len(s.Gauges) != 0 || len(s.Counters) != 0 {
 		t.Fatalf("on error want empty maps, got %v %v", s.Gauges, s.Counters)
 	}
 }
 
+func TestRepo_SnapshotSince(t *testing.T) {
+	_, mock, st, done := newMock(t)
+	defer done()
+
+	const pat = `SELECT id, mtype, value, delta FROM metrics WHERE rev > \$1`
+	const revPat = `SELECT LEAST\(COALESCE\(MAX\(rev\), 0\), metrics_safe_rev\(\)\) FROM metrics`
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(revPat).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(12)))
+	mock.ExpectQuery(pat).WithArgs(int64(10)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
+			AddRow("PollCount", "counter", nil, int64(3)))
+	mock.ExpectCommit()
+
+	s, err := st.SnapshotSince(context.TODO(), 10)
+	if err != nil {
+		t.Fatalf("SnapshotSince err: %v", err)
+	}
+	if len(s.Gauges) != 0 || s.Counters["PollCount"] != 3 || s.Revision != 12 {
+		t.Fatalf("unexpected delta: %+v", s)
+	}
+
+	mock.ExpectQuery(revPat).WillReturnError(errors.New("db"))
+	if _, err := st.Revision(context.TODO()); err == nil {
+		t.Fatal("expected Revision error")
+	}
+}
+
 func TestRepo_Ping(t *testing.T) {
 	snil := &Repo{}
 	if err := snil.Ping(context.TODO()); err == nil {
@@ -285,26 +477,18 @@ func newMockWithPing(t *testing.T) (*sql.DB, sqlmock.Sqlmock, *Repo, func()) {
 }
 
 func TestRepo_UpdateMany(t *testing.T) {
-	t.Run("mixed success commit", func(t *testing.T) {
+	t.Run("batch is folded into one statement per type", func(t *testing.T) {
 		_, mock, st, done := newMock(t)
 		defer done()
 
-		const qGauge = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
-		const qCounter = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
-
 		mock.ExpectBegin()
-		mock.ExpectExec(qm(qGauge)).WithArgs("g1", "gauge", 3.14).WillReturnResult(sqlmock.NewResult(0, 1))
-		mock.ExpectExec(qm(qCounter)).WithArgs("c1", "counter", int64(5)).WillReturnResult(sqlmock.NewResult(0, 1))
-		mock.ExpectExec(qm(qGauge)).WithArgs("g1", "gauge", 2.71).WillReturnResult(sqlmock.NewResult(0, 1))
-		mock.ExpectExec(qm(qCounter)).WithArgs("c1", "counter", int64(7)).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLock(mock, []string{"a", "c1", "g1"}, []string{"gauge", "counter", "gauge"})
+		mock.ExpectExec(qm(qUpsertGauges)).
+			WithArgs(pq.Array([]string{"a", "g1"}), pq.Array([]float64{1, 2.71})).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(qm(qUpsertCounters)).
+			WithArgs(pq.Array([]string{"c1"}), pq.Array([]int64{12})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
 		mock.ExpectCommit()
 
 		items := []domain.Metrics{
@@ -312,24 +496,87 @@ DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.del
 			{ID: "c1", MType: "counter", Delta: ptrInt64(5)},
 			{ID: "g1", MType: "gauge", Value: ptrFloat64(2.71)},
 			{ID: "c1", MType: "counter", Delta: ptrInt64(7)},
+			{ID: "a", MType: "gauge", Value: ptrFloat64(1)},
 		}
-		if err := st.UpdateMany(context.TODO(), items); err != nil {
+		if _, err := st.UpdateMany(context.TODO(), items); err != nil {
 			t.Fatalf("UpdateMany error: %v", err)
 		}
 	})
 
-	t.Run("ignores nil/unknown but still commits", func(t *testing.T) {
+	t.Run("gauge operations get a statement each, in rounds", func(t *testing.T) {
 		_, mock, st, done := newMock(t)
 		defer done()
 
-		const qGauge = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
+		mock.ExpectBegin()
+		expectLock(mock, []string{"a", "b", "c"}, []string{"gauge", "gauge", "gauge"})
+		mock.ExpectExec(qm(qUpsertGauges)).
+			WithArgs(pq.Array([]string{"b"}), pq.Array([]float64{4})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(qm(qUpsertGaugesBy+"COALESCE(metrics.value, 0)+EXCLUDED.value, updated_at=now();")).
+			WithArgs(pq.Array([]string{"a"}), pq.Array([]float64{3})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(qm(qUpsertGaugesBy+"LEAST(metrics.value, EXCLUDED.value), updated_at=now();")).
+			WithArgs(pq.Array([]string{"c"}), pq.Array([]float64{-1})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(qm(qUpsertGaugesBy+"GREATEST(metrics.value, EXCLUDED.value), updated_at=now();")).
+			WithArgs(pq.Array([]string{"a"}), pq.Array([]float64{10})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		items := []domain.Metrics{
+			{ID: "a", MType: "gauge", Value: ptrFloat64(1), Op: domain.GaugeAdd},
+			{ID: "a", MType: "gauge", Value: ptrFloat64(2), Op: domain.GaugeAdd},
+			{ID: "a", MType: "gauge", Value: ptrFloat64(10), Op: domain.GaugeMax},
+			{ID: "b", MType: "gauge", Value: ptrFloat64(3)},
+			{ID: "b", MType: "gauge", Value: ptrFloat64(1), Op: domain.GaugeAdd},
+			{ID: "c", MType: "gauge", Value: ptrFloat64(-1), Op: domain.GaugeMin},
+		}
+		if _, err := st.UpdateMany(context.TODO(), items); err != nil {
+			t.Fatalf("UpdateMany error: %v", err)
+		}
+	})
+
+	t.Run("reports the values the batch replaced", func(t *testing.T) {
+		_, mock, st, done := newMock(t)
+		defer done()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(qm(qLockBatch)).
+			WithArgs(pq.Array([]string{"c1", "g1", "g2"}), pq.Array([]string{"counter", "gauge", "gauge"})).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
+				AddRow("c1", "counter", nil, int64(7)).
+				AddRow("g1", "gauge", 1.5, nil).
+				AddRow("g2", "gauge", nil, nil))
+		mock.ExpectExec(qm(qUpsertGauges)).
+			WithArgs(pq.Array([]string{"g1", "g2"}), pq.Array([]float64{10, 20})).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(qm(qUpsertCounters)).
+			WithArgs(pq.Array([]string{"c1"}), pq.Array([]int64{5})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		prior, err := st.UpdateMany(context.TODO(), []domain.Metrics{
+			{ID: "g1", MType: "gauge", Value: ptrFloat64(10)},
+			{ID: "c1", MType: "counter", Delta: ptrInt64(5)},
+			{ID: "g2", MType: "gauge", Value: ptrFloat64(20)},
+		})
+		if err != nil {
+			t.Fatalf("UpdateMany error: %v", err)
+		}
+		if len(prior.Gauges) != 1 || prior.Gauges["g1"] != 1.5 || len(prior.Counters) != 1 || prior.Counters["c1"] != 7 {
+			t.Fatalf("want g1=1.5 and c1=7 replaced, got %v %v", prior.Gauges, prior.Counters)
+		}
+	})
+
+	t.Run("ignores nil/unknown items", func(t *testing.T) {
+		_, mock, st, done := newMock(t)
+		defer done()
 
 		mock.ExpectBegin()
-		mock.ExpectExec(qm(qGauge)).WithArgs("g2", "gauge", 1.0).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLock(mock, []string{"g2"}, []string{"gauge"})
+		mock.ExpectExec(qm(qUpsertGauges)).
+			WithArgs(pq.Array([]string{"g2"}), pq.Array([]float64{1.0})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
 		mock.ExpectCommit()
 
 		items := []domain.Metrics{
@@ -338,41 +585,38 @@ DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
 			{ID: "nullc", MType: "counter", Delta: nil},
 			{ID: "weird", MType: "unknown", Value: ptrFloat64(123.0)},
 		}
-		if err := st.UpdateMany(context.TODO(), items); err != nil {
+		if _, err := st.UpdateMany(context.TODO(), items); err != nil {
 			t.Fatalf("UpdateMany error: %v", err)
 		}
 	})
 
-	t.Run("empty slice is no-op (no BEGIN)", func(t *testing.T) {
+	t.Run("empty or payload-less batch is no-op (no BEGIN)", func(t *testing.T) {
 		_, _, st, done := newMock(t)
 		defer done()
 
-		if err := st.UpdateMany(context.TODO(), nil); err != nil {
+		if _, err := st.UpdateMany(context.TODO(), nil); err != nil {
 			t.Fatalf("nil slice: %v", err)
 		}
-		if err := st.UpdateMany(context.TODO(), []domain.Metrics{}); err != nil {
+		if _, err := st.UpdateMany(context.TODO(), []domain.Metrics{}); err != nil {
 			t.Fatalf("empty slice: %v", err)
 		}
+		if _, err := st.UpdateMany(context.TODO(), []domain.Metrics{{ID: "nullg", MType: "gauge"}}); err != nil {
+			t.Fatalf("payload-less batch: %v", err)
+		}
 	})
 
 	t.Run("rollback on exec error", func(t *testing.T) {
 		_, mock, st, done := newMock(t)
 		defer done()
 
-		const qGauge = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
-		const qCounter = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
-
 		mock.ExpectBegin()
-		mock.ExpectExec(qm(qGauge)).WithArgs("g1", "gauge", 10.0).WillReturnResult(sqlmock.NewResult(0, 1))
-		mock.ExpectExec(qm(qCounter)).WithArgs("c1", "counter", int64(5)).WillReturnError(errors.New("boom"))
+		expectLock(mock, []string{"c1", "g1", "g2"}, []string{"counter", "gauge", "gauge"})
+		mock.ExpectExec(qm(qUpsertGauges)).
+			WithArgs(pq.Array([]string{"g1", "g2"}), pq.Array([]float64{10, 20})).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(qm(qUpsertCounters)).
+			WithArgs(pq.Array([]string{"c1"}), pq.Array([]int64{5})).
+			WillReturnError(errors.New("boom"))
 		mock.ExpectRollback()
 
 		items := []domain.Metrics{
@@ -380,12 +624,24 @@ DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.del
 			{ID: "c1", MType: "counter", Delta: ptrInt64(5)},
 			{ID: "g2", MType: "gauge", Value: ptrFloat64(20)},
 		}
-		if err := st.UpdateMany(context.TODO(), items); err == nil {
+		if _, err := st.UpdateMany(context.TODO(), items); err == nil {
 			t.Fatal("expected error and rollback")
 		}
 	})
 }
 
+// expectLock expects the statement that locks the rows of a batch in order, reporting every
+// row as created by it.
+func expectLock(mock sqlmock.Sqlmock, ids, mTypes []string) {
+	rows := sqlmock.NewRows([]string{"id", "mtype", "value", "delta"})
+	for i := range ids {
+		rows.AddRow(ids[i], mTypes[i], nil, nil)
+	}
+	mock.ExpectQuery(qm(qLockBatch)).
+		WithArgs(pq.Array(ids), pq.Array(mTypes)).
+		WillReturnRows(rows)
+}
+
 func ptrFloat64(v float64) *float64 { return &v }
 func ptrInt64(v int64) *int64       { return &v }
 
@@ -501,8 +757,8 @@ func TestRepo_SetGauge_Retry(t *testing.T) {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET value=EXCLUDED.value, updated_at=now();`
 
 	mock.ExpectExec(qm(q)).WithArgs("Alloc", "gauge", 1.23).
 		WillReturnError(&pq.Error{Code: pq.ErrorCode(pgerrcode.ConnectionDoesNotExist)})
@@ -527,17 +783,127 @@ func TestRepo_AddCounter_Retr(t *testing.T) {
 	const q = `
 INSERT INTO metrics (id, mtype, value, delta, updated_at)
 VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
+ON CONFLICT (id, mtype)
+DO UPDATE SET delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now()
+RETURNING delta;`
 
-	mock.ExpectExec(qm(q)).WithArgs("C", "counter", int64(5)).WillReturnError(&net.OpError{Op: "write", Err: errors.New("broken pipe")})
-	mock.ExpectExec(qm(q)).WithArgs("C", "counter", int64(5)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(qm(q)).WithArgs("C", "counter", int64(5)).WillReturnError(&net.OpError{Op: "write", Err: errors.New("broken pipe")})
+	mock.ExpectQuery(qm(q)).WithArgs("C", "counter", int64(5)).WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(5)))
 
-	if err := st.AddCounter(context.Background(), "C", 5); err != nil {
+	if _, err := st.AddCounter(context.Background(), "C", 5); err != nil {
 		t.Fatalf("AddCounter error: %v", err)
 	}
 }
 
+// testDSNEnv names a disposable database for tests that need a real Postgres; they are
+// skipped when unset.
+const testDSNEnv = "GOLECTRA_TEST_DSN"
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDSNEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := db.ExecContext(context.Background(), `TRUNCATE metrics`); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	return db
+}
+
+// Two batches that write the same metrics through different statements must not deadlock.
+// Retries are off so that a deadlock Postgres resolves by aborting one batch fails the test.
+func TestRepo_UpdateMany_ConcurrentBatchesPostgres(t *testing.T) {
+	repo := New(openTestDB(t))
+	orig := misc.DefaultBackoff
+	misc.DefaultBackoff = nil
+	defer func() { misc.DefaultBackoff = orig }()
+
+	ctx := context.Background()
+	batches := [][]domain.Metrics{
+		{
+			{ID: "a", MType: "gauge", Value: ptrFloat64(1)},
+			{ID: "b", MType: "gauge", Value: ptrFloat64(1), Op: domain.GaugeAdd},
+			{ID: "c", MType: "counter", Delta: ptrInt64(1)},
+		},
+		{
+			{ID: "a", MType: "gauge", Value: ptrFloat64(1), Op: domain.GaugeAdd},
+			{ID: "b", MType: "gauge", Value: ptrFloat64(1)},
+			{ID: "c", MType: "counter", Delta: ptrInt64(1)},
+		},
+	}
+	const rounds = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, len(batches))
+	for _, items := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if _, err := repo.UpdateMany(ctx, items); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent batch: %v", err)
+	}
+	if got, err := repo.GetCounter(ctx, "c"); err != nil || got != 2*rounds {
+		t.Fatalf("counter c=%d, %v; want %d", got, err, 2*rounds)
+	}
+}
+
+// A write that took its revision before a snapshot but commits after it must still be
+// returned by the next SnapshotSince from the snapshot's revision.
+func TestRepo_SnapshotSince_SlowWriterPostgres(t *testing.T) {
+	db := openTestDB(t)
+	repo := New(db)
+	ctx := context.Background()
+
+	slow, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer func() { _ = slow.Rollback() }()
+	if _, err := slow.ExecContext(ctx, `INSERT INTO metrics (id, mtype, value) VALUES ('slow', 'gauge', 1)`); err != nil {
+		t.Fatalf("slow write: %v", err)
+	}
+	if err := repo.SetGauge(ctx, "fast", 2); err != nil {
+		t.Fatalf("fast write: %v", err)
+	}
+
+	first, err := repo.SnapshotSince(ctx, 0)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if _, ok := first.Gauges["slow"]; ok {
+		t.Fatal("uncommitted write is visible")
+	}
+	if err := slow.Commit(); err != nil {
+		t.Fatalf("commit slow write: %v", err)
+	}
+
+	next, err := repo.SnapshotSince(ctx, first.Revision)
+	if err != nil {
+		t.Fatalf("snapshot since %d: %v", first.Revision, err)
+	}
+	if next.Gauges["slow"] != 1 {
+		t.Fatalf("write committed after the snapshot was skipped: %+v", next)
+	}
+}
+
 func TestRepo_UpdateMany_Retry(t *testing.T) {
 	orig := misc.DefaultBackoff
 	misc.DefaultBackoff = []time.Duration{1 * time.Millisecond, 1 * time.Millisecond}
@@ -546,32 +912,20 @@ func TestRepo_UpdateMany_Retry(t *testing.T) {
 	_, mock, st, done := newMock(t)
 	defer done()
 
-	const qGauge = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, $3, NULL, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=EXCLUDED.value, delta=NULL, updated_at=now();`
-	const qCounter = `
-INSERT INTO metrics (id, mtype, value, delta, updated_at)
-VALUES ($1, $2, NULL, $3, now())
-ON CONFLICT (id)
-DO UPDATE SET mtype=$2, value=NULL, delta=COALESCE(metrics.delta,0)+EXCLUDED.delta, updated_at=now();`
-
-	mock.ExpectBegin()
-	mock.ExpectExec(qm(qGauge)).WithArgs("g", "gauge", 1.0).WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec(qm(qCounter)).WithArgs("c", "counter", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	for range 2 {
+		mock.ExpectBegin()
+		expectLock(mock, []string{"c", "g"}, []string{"counter", "gauge"})
+		mock.ExpectExec(qm(qUpsertGauges)).WithArgs(pq.Array([]string{"g"}), pq.Array([]float64{1.0})).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(qm(qUpsertCounters)).WithArgs(pq.Array([]string{"c"}), pq.Array([]int64{2})).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
 	mock.ExpectCommit().WillReturnError(&pq.Error{Code: pq.ErrorCode(pgerrcode.SerializationFailure)})
-
-	mock.ExpectBegin()
-	mock.ExpectExec(qm(qGauge)).WithArgs("g", "gauge", 1.0).WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec(qm(qCounter)).WithArgs("c", "counter", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
 	items := []domain.Metrics{
 		{ID: "g", MType: "gauge", Value: ptrFloat64(1.0)},
 		{ID: "c", MType: "counter", Delta: ptrInt64(2)},
 	}
-	if err := st.UpdateMany(context.Background(), items); err != nil {
+	if _, err := st.UpdateMany(context.Background(), items); err != nil {
 		t.Fatalf("UpdateMany error: %v", err)
 	}
 }
@@ -584,13 +938,20 @@ func TestRepo_Snapshot_Retry(t *testing.T) {
 	_, mock, st, done := newMock(t)
 	defer done()
 
-	const q = `SELECT id, mtype, value, delta FROM metrics`
+	const q = `SELECT id, mtype, value, delta FROM metrics WHERE rev > \$1`
+	const revQ = `SELECT LEAST\(COALESCE\(MAX\(rev\), 0\), metrics_safe_rev\(\)\) FROM metrics`
 
-	mock.ExpectQuery(q).WillReturnError(&pq.Error{Code: pq.ErrorCode(pgerrcode.ConnectionDoesNotExist)})
+	mock.ExpectBegin()
+	mock.ExpectQuery(revQ).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(2)))
+	mock.ExpectQuery(q).WithArgs(int64(0)).WillReturnError(&pq.Error{Code: pq.ErrorCode(pgerrcode.ConnectionDoesNotExist)})
+	mock.ExpectRollback()
 	rows := sqlmock.NewRows([]string{"id", "mtype", "value", "delta"}).
 		AddRow("Alloc", "gauge", 12.5, nil).
 		AddRow("PollCount", "counter", nil, int64(9))
-	mock.ExpectQuery(q).WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectQuery(revQ).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(2)))
+	mock.ExpectQuery(q).WithArgs(int64(0)).WillReturnRows(rows)
+	mock.ExpectCommit()
 
 	s, err := st.Snapshot(context.Background())
 	if err != nil {
@@ -0,0 +1,223 @@
+package resilient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+)
+
+// Entry is one journaled write batch.
+type Entry struct {
+	Items []domain.Metrics `json:"items,omitempty"`
+	Seq   uint64           `json:"seq,omitempty"`
+	// Ack marks every entry up to this sequence number as replayed.
+	Ack uint64 `json:"ack,omitempty"`
+}
+
+// crcTable is the CRC-32C table that checksums every journal line.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt marks a complete journal line whose checksum or JSON does not hold up.
+var errCorrupt = errors.New("corrupt journal line")
+
+// Journal is an append-only file of write batches that could not reach the database.
+// Each line is either an entry or an ack, prefixed with the hex CRC-32C of its JSON;
+// entries up to the highest ack have been replayed. Every line is fsynced before Append
+// or Ack returns, and the file is truncated once everything in it has been acked.
+type Journal struct {
+	f       *os.File
+	path    string
+	pending []Entry
+	seq     uint64
+	mu      sync.Mutex
+}
+
+// OpenJournal opens or creates the journal at path and loads the entries not yet acked.
+// A last line without its newline, left by a crash in the middle of an append, is cut off.
+// A damaged complete line fails the open instead, since dropping it would lose writes.
+func OpenJournal(path string) (*Journal, error) {
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("mkdir journal: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	j := &Journal{f: f, path: path}
+	if err := j.load(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	var (
+		entries []Entry
+		acked   uint64
+		good    int64
+	)
+	r := bufio.NewReader(j.f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read journal: %w", err)
+		}
+		e, err := decodeLine(line)
+		if err != nil {
+			return fmt.Errorf("load journal line %d: %w", lineNo, err)
+		}
+		good += int64(len(line))
+		if e.Ack > 0 {
+			acked = max(acked, e.Ack)
+			continue
+		}
+		entries = append(entries, e)
+		j.seq = max(j.seq, e.Seq)
+	}
+	if err := j.f.Truncate(good); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	if _, err := j.f.Seek(good, io.SeekStart); err != nil {
+		return fmt.Errorf("seek journal: %w", err)
+	}
+	for _, e := range entries {
+		if e.Seq > acked {
+			j.pending = append(j.pending, e)
+		}
+	}
+	if len(j.pending) == 0 {
+		return j.resetLocked()
+	}
+	return nil
+}
+
+// Append journals a batch and returns its sequence number.
+func (j *Journal) Append(items []domain.Metrics) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := Entry{Seq: j.seq + 1, Items: items}
+	if err := j.writeLocked(e); err != nil {
+		return 0, err
+	}
+	j.seq = e.Seq
+	j.pending = append(j.pending, e)
+	return e.Seq, nil
+}
+
+// Pending returns the entries not yet acked, oldest first.
+func (j *Journal) Pending() []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Entry(nil), j.pending...)
+}
+
+// Ack marks every entry up to seq as replayed, truncating the file when nothing is left.
+func (j *Journal) Ack(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n := 0
+	for n < len(j.pending) && j.pending[n].Seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	j.pending = j.pending[n:]
+	if len(j.pending) == 0 {
+		return j.resetLocked()
+	}
+	return j.writeLocked(Entry{Ack: seq})
+}
+
+// Len reports how many entries wait for replay.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// Close closes the journal file; pending entries stay on disk for the next start.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Close(); err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) writeLocked(e Entry) error {
+	line, err := encodeLine(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(line); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) resetLocked() error {
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek journal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return nil
+}
+
+// encodeLine frames e as "<crc32c hex> <json>\n".
+func encodeLine(e Entry) ([]byte, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("encode journal entry: %w", err)
+	}
+	line := make([]byte, 0, 9+len(payload)+1)
+	line = hex.AppendEncode(line, binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable)))
+	line = append(line, ' ')
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func decodeLine(line []byte) (Entry, error) {
+	var e Entry
+	sum, payload, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok || len(sum) != 8 {
+		return e, errCorrupt
+	}
+	var want [4]byte
+	if _, err := hex.Decode(want[:], sum); err != nil {
+		return e, errCorrupt
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(want[:]) {
+		return e, errCorrupt
+	}
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return e, errCorrupt
+	}
+	return e, nil
+}
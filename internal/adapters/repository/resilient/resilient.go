@@ -0,0 +1,515 @@
+// Package resilient keeps a metrics repository writable while its database is unreachable.
+//
+// Repo wraps a primary repository (Postgres in production) and mirrors every write into an
+// in-memory cache. When a call fails with an outage error the repo turns degraded: writes are
+// appended to a local journal and applied to the cache, reads are served from the cache, and a
+// background loop probes the database. Once the probe succeeds the journal is replayed in order,
+// the cache is reloaded from the database and the repo serves from the primary again.
+package resilient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+const (
+	defaultReconnectInterval = 5 * time.Second
+	defaultProbeTimeout      = 5 * time.Second
+)
+
+// Option customizes a Repo built by Open.
+type Option func(*Repo)
+
+// WithReconnectInterval sets how often a degraded repo probes the database.
+func WithReconnectInterval(d time.Duration) Option {
+	return func(r *Repo) {
+		if d > 0 {
+			r.interval = d
+		}
+	}
+}
+
+// WithProbe replaces the reconnect check, which defaults to the primary's Ping.
+// It runs before the journal is replayed, so it may also apply pending migrations.
+func WithProbe(probe func(ctx context.Context) error) Option {
+	return func(r *Repo) {
+		if probe != nil {
+			r.probe = probe
+		}
+	}
+}
+
+// WithOutageCheck decides which primary errors mean the database is unavailable. By default
+// every error except domain.ErrNotFound, domain.ErrRevisionMismatch and context errors does.
+func WithOutageCheck(isOutage func(error) bool) Option {
+	return func(r *Repo) {
+		if isOutage != nil {
+			r.isOutage = isOutage
+		}
+	}
+}
+
+// WithStateHandler is called whenever the repo turns degraded (with the triggering error)
+// or recovers (with nil), and when a reconnect attempt fails.
+func WithStateHandler(fn func(degraded bool, err error)) Option {
+	return func(r *Repo) {
+		if fn != nil {
+			r.onState = fn
+		}
+	}
+}
+
+// Stats is a point-in-time view of the failover state.
+type Stats struct {
+	Degraded       bool  `json:"degraded"`
+	JournalEntries int   `json:"journal_entries"`
+	Journaled      int64 `json:"journaled"`
+	Replayed       int64 `json:"replayed"`
+	Outages        int64 `json:"outages"`
+}
+
+// Repo is a ports.MetricsRepo that fails over to a journal and an in-memory cache.
+//
+// While degraded, Revision stays at the last revision read from the primary and SnapshotSince
+// returns the whole cache, so pollers may see a metric twice but never miss one. When the repo
+// starts degraded the cache holds only the journaled writes until the database is back.
+type Repo struct {
+	primary  ports.MetricsRepo
+	cache    *memory.Repo
+	journal  *Journal
+	probe    func(ctx context.Context) error
+	isOutage func(error) bool
+	onState  func(degraded bool, err error)
+	stop     chan struct{}
+	done     chan struct{}
+	interval time.Duration
+	lastRev  atomic.Int64
+	// mu is held shared by calls and exclusively while switching state and replaying,
+	// so no write can slip between the journal and the primary.
+	mu        sync.RWMutex
+	journaled atomic.Int64
+	replayed  atomic.Int64
+	outages   atomic.Int64
+	degraded  atomic.Bool
+	// cacheStale is set when a write reached the primary but not the cache.
+	cacheStale atomic.Bool
+	closeOnce  sync.Once
+}
+
+var _ ports.MetricsRepo = (*Repo)(nil)
+
+// Open wraps primary, journaling to journalPath during outages, and starts the reconnect loop.
+// Entries left in the journal by a previous run are replayed before the primary serves again;
+// an unreachable primary does not fail Open but starts the repo degraded.
+func Open(ctx context.Context, primary ports.MetricsRepo, journalPath string, opts ...Option) (*Repo, error) {
+	journal, err := OpenJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{
+		primary:  primary,
+		cache:    memory.New(),
+		journal:  journal,
+		probe:    primary.Ping,
+		isOutage: defaultIsOutage,
+		onState:  func(bool, error) {},
+		interval: defaultReconnectInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.degraded.Store(true)
+	for _, e := range journal.Pending() {
+		if _, err := r.cache.UpdateMany(ctx, e.Items); err != nil {
+			_ = journal.Close()
+			return nil, fmt.Errorf("load journal: %w", err)
+		}
+	}
+	if err := r.reconnect(ctx); err != nil {
+		r.outages.Add(1)
+		r.onState(true, err)
+	}
+	go r.run()
+	return r, nil
+}
+
+// Degraded reports whether the repo is serving from the cache and journal.
+func (r *Repo) Degraded() bool {
+	return r.degraded.Load()
+}
+
+// Stats reports the failover state and journal counters.
+func (r *Repo) Stats() Stats {
+	return Stats{
+		Degraded:       r.degraded.Load(),
+		JournalEntries: r.journal.Len(),
+		Journaled:      r.journaled.Load(),
+		Replayed:       r.replayed.Load(),
+		Outages:        r.outages.Load(),
+	}
+}
+
+// Close stops the reconnect loop and closes the journal. Journaled writes that were not
+// replayed yet stay on disk for the next start.
+func (r *Repo) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+	return r.journal.Close()
+}
+
+// GetGauge reads from the primary, or from the cache while degraded.
+func (r *Repo) GetGauge(ctx context.Context, name string) (float64, error) {
+	return read(ctx, r, func(repo ports.MetricsRepo) (float64, error) {
+		return repo.GetGauge(ctx, name)
+	})
+}
+
+// GetGaugeWithRevision reads from the primary, or from the cache while degraded. Cache
+// revisions mean nothing to the primary, so a gauge read from the cache has revision zero.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	type result struct {
+		value float64
+		rev   int64
+	}
+	res, err := read(ctx, r, func(repo ports.MetricsRepo) (result, error) {
+		v, rev, err := repo.GetGaugeWithRevision(ctx, name)
+		if r.isCache(repo) {
+			rev = 0
+		}
+		return result{v, rev}, err
+	})
+	return res.value, res.rev, err
+}
+
+// GetCounter reads from the primary, or from the cache while degraded.
+func (r *Repo) GetCounter(ctx context.Context, name string) (int64, error) {
+	return read(ctx, r, func(repo ports.MetricsRepo) (int64, error) {
+		return repo.GetCounter(ctx, name)
+	})
+}
+
+// SetGauge writes through to the primary, or to the journal while degraded.
+func (r *Repo) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.UpdateMany(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}})
+	return err
+}
+
+// CompareAndSetGauge writes through to the primary and reports the primary's write. While
+// degraded an unconditional write is journaled and reports the cache's write with revision
+// zero; a conditional one fails with domain.ErrUnavailable, since only the primary can
+// compare revisions.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	set := func(ctx context.Context, repo ports.MetricsRepo) (domain.GaugeWrite, error) {
+		if r.isCache(repo) {
+			w, err := repo.CompareAndSetGauge(ctx, name, value, ports.AnyRevision)
+			w.Revision = 0
+			return w, err
+		}
+		return repo.CompareAndSetGauge(ctx, name, value, expected)
+	}
+	if expected != ports.AnyRevision {
+		return write(ctx, r, nil, set)
+	}
+	return write(ctx, r, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}}, set)
+}
+
+// ApplyGauge writes through to the primary and reports the primary's write; the cache then
+// stores the value it produced. While degraded the operation is journaled and applied to the
+// cache, and the cache's write is reported with revision zero.
+func (r *Repo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	if !op.Valid() {
+		return domain.GaugeWrite{}, domain.ErrInvalidType
+	}
+	var primary *domain.GaugeWrite
+	items := []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value, Op: op}}
+	return write(ctx, r, items, func(ctx context.Context, repo ports.MetricsRepo) (domain.GaugeWrite, error) {
+		if !r.isCache(repo) {
+			w, err := repo.ApplyGauge(ctx, name, op, value)
+			if err != nil {
+				return domain.GaugeWrite{}, err
+			}
+			primary = &w
+			return w, nil
+		}
+		if primary != nil {
+			_, err := repo.CompareAndSetGauge(ctx, name, primary.Value, ports.AnyRevision)
+			return domain.GaugeWrite{}, err
+		}
+		w, err := repo.ApplyGauge(ctx, name, op, value)
+		w.Revision = 0
+		return w, err
+	})
+}
+
+// AddCounter writes through to the primary, or to the journal while degraded. It returns the
+// total the primary reports, or the cache's total while degraded.
+func (r *Repo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	items := []domain.Metrics{{ID: name, MType: string(domain.Counter), Delta: &delta}}
+	return write(ctx, r, items, func(ctx context.Context, repo ports.MetricsRepo) (int64, error) {
+		return repo.AddCounter(ctx, name, delta)
+	})
+}
+
+// UpdateMany writes the batch to the primary and mirrors it into the cache. While degraded,
+// or when the primary fails with an outage error, the batch is journaled instead. The values
+// it replaced come from the primary, or from the cache while degraded.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	items = domain.Fold(items)
+	if len(items) == 0 {
+		return domain.Snapshot{}, ctx.Err()
+	}
+	return write(ctx, r, items, func(ctx context.Context, repo ports.MetricsRepo) (domain.Snapshot, error) {
+		return repo.UpdateMany(ctx, items)
+	})
+}
+
+// Snapshot reads from the primary, or returns the cache while degraded.
+func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	return read(ctx, r, func(repo ports.MetricsRepo) (domain.Snapshot, error) {
+		if r.isCache(repo) {
+			return r.cacheSnapshot(ctx)
+		}
+		return r.trackRevision(repo.Snapshot(ctx))
+	})
+}
+
+// SnapshotSince reads from the primary, or returns the whole cache while degraded.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	return read(ctx, r, func(repo ports.MetricsRepo) (domain.Snapshot, error) {
+		if r.isCache(repo) {
+			return r.cacheSnapshot(ctx)
+		}
+		return r.trackRevision(repo.SnapshotSince(ctx, since))
+	})
+}
+
+// Revision reads from the primary, or reports the last primary revision while degraded.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	return read(ctx, r, func(repo ports.MetricsRepo) (int64, error) {
+		if r.isCache(repo) {
+			return r.lastRev.Load(), nil
+		}
+		rev, err := repo.Revision(ctx)
+		if err == nil {
+			r.lastRev.Store(rev)
+		}
+		return rev, err
+	})
+}
+
+// Ping reports whether the primary is reachable.
+func (r *Repo) Ping(ctx context.Context) error {
+	if r.degraded.Load() {
+		return fmt.Errorf("database unavailable, %d writes journaled", r.journal.Len())
+	}
+	return r.primary.Ping(ctx)
+}
+
+// isCache reports whether a read callback was handed the cache rather than the primary.
+func (r *Repo) isCache(repo ports.MetricsRepo) bool {
+	c, ok := repo.(*memory.Repo)
+	return ok && c == r.cache
+}
+
+func (r *Repo) trackRevision(snap domain.Snapshot, err error) (domain.Snapshot, error) {
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	r.lastRev.Store(snap.Revision)
+	return snap, nil
+}
+
+// cacheSnapshot returns the whole cache stamped with the last primary revision.
+func (r *Repo) cacheSnapshot(ctx context.Context) (domain.Snapshot, error) {
+	snap, err := r.cache.Snapshot(ctx)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	snap.Revision = r.lastRev.Load()
+	return snap, nil
+}
+
+// write applies items with fn to the primary and mirrors them into the cache, returning the
+// primary's result. While degraded, or when the primary fails with an outage error, items are
+// journaled and fn's result against the cache is returned instead. A write without items
+// cannot be journaled and fails with domain.ErrUnavailable instead.
+//
+// Once the primary or the journal holds the write, the cache is updated under a context the
+// caller cannot cancel, and a failing mirror only schedules a cache reload: the write has
+// happened, so the call must not report otherwise.
+func write[T any](ctx context.Context, r *Repo, items []domain.Metrics, fn func(ctx context.Context, repo ports.MetricsRepo) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	for {
+		r.mu.RLock()
+		if r.degraded.Load() {
+			if items == nil {
+				r.mu.RUnlock()
+				return zero, fmt.Errorf("%w: database unreachable", domain.ErrUnavailable)
+			}
+			res, err := journalLocked(ctx, r, items, fn)
+			r.mu.RUnlock()
+			return res, err
+		}
+		res, err := fn(ctx, r.primary)
+		if err == nil {
+			if _, err := fn(context.WithoutCancel(ctx), r.cache); err != nil {
+				r.cacheStale.Store(true)
+			}
+			r.mu.RUnlock()
+			return res, nil
+		}
+		r.mu.RUnlock()
+		if !r.isOutage(err) {
+			return zero, err
+		}
+		r.degrade(err)
+	}
+}
+
+// journalLocked appends items to the journal and applies them to the cache with fn.
+// The caller holds mu for reading.
+func journalLocked[T any](ctx context.Context, r *Repo, items []domain.Metrics, fn func(ctx context.Context, repo ports.MetricsRepo) (T, error)) (T, error) {
+	if _, err := r.journal.Append(items); err != nil {
+		var zero T
+		return zero, fmt.Errorf("journal write: %w", err)
+	}
+	r.journaled.Add(1)
+	return fn(context.WithoutCancel(ctx), r.cache)
+}
+
+// read runs fn against the primary, falling back to the cache while degraded
+// or when the primary fails with an outage error.
+func read[T any](ctx context.Context, r *Repo, fn func(repo ports.MetricsRepo) (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	r.mu.RLock()
+	if r.degraded.Load() {
+		defer r.mu.RUnlock()
+		return fn(r.cache)
+	}
+	v, err := fn(r.primary)
+	r.mu.RUnlock()
+	if err == nil || !r.isOutage(err) {
+		return v, err
+	}
+	r.degrade(err)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.degraded.Load() {
+		return fn(r.primary)
+	}
+	return fn(r.cache)
+}
+
+func (r *Repo) degrade(cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.degraded.Swap(true) {
+		return
+	}
+	r.outages.Add(1)
+	r.onState(true, cause)
+}
+
+func (r *Repo) run() {
+	defer close(r.done)
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultProbeTimeout)
+		switch {
+		case r.degraded.Load():
+			if err := r.reconnect(ctx); err != nil {
+				r.onState(true, err)
+			}
+		case r.cacheStale.Load():
+			r.resyncCache(ctx)
+		}
+		cancel()
+	}
+}
+
+// reconnect probes the primary and, once it answers, replays the journal in order and
+// reloads the cache. Writers wait for it to finish, so nothing overtakes the journal.
+func (r *Repo) reconnect(ctx context.Context) error {
+	if err := r.probe(ctx); err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.degraded.Load() {
+		return nil
+	}
+	for _, e := range r.journal.Pending() {
+		if _, err := r.primary.UpdateMany(ctx, e.Items); err != nil {
+			return fmt.Errorf("replay journal entry %d: %w", e.Seq, err)
+		}
+		r.replayed.Add(1)
+		if err := r.journal.Ack(e.Seq); err != nil {
+			return err
+		}
+	}
+	if err := r.reloadCacheLocked(ctx); err != nil {
+		return err
+	}
+	r.degraded.Store(false)
+	r.onState(false, nil)
+	return nil
+}
+
+// resyncCache reloads a cache that missed a write mirrored from the primary. A failure
+// leaves it stale for the next tick; an outage in between reloads it on recovery anyway.
+func (r *Repo) resyncCache(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.degraded.Load() {
+		return
+	}
+	_ = r.reloadCacheLocked(ctx)
+}
+
+// reloadCacheLocked replaces the cache with the primary's data. The caller holds mu.
+func (r *Repo) reloadCacheLocked(ctx context.Context) error {
+	snap, err := r.primary.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("reload cache: %w", err)
+	}
+	cache := memory.New()
+	if _, err := cache.UpdateMany(ctx, snap.Items()); err != nil {
+		return fmt.Errorf("reload cache: %w", err)
+	}
+	r.cache = cache
+	r.lastRev.Store(snap.Revision)
+	r.cacheStale.Store(false)
+	return nil
+}
+
+func defaultIsOutage(err error) bool {
+	return !errors.Is(err, domain.ErrNotFound) &&
+		!errors.Is(err, domain.ErrRevisionMismatch) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,448 @@
+package resilient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+var errDown = errors.New("connection refused")
+
+// flakyRepo is a memory repo that can be switched off and records the batches it applied.
+type flakyRepo struct {
+	*memory.Repo
+	batches [][]domain.Metrics
+	failAt  int
+	down    atomic.Bool
+	mu      sync.Mutex
+}
+
+func newFlaky() *flakyRepo {
+	return &flakyRepo{Repo: memory.New(), failAt: -1}
+}
+
+func (f *flakyRepo) ping(context.Context) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return nil
+}
+
+func (f *flakyRepo) GetGauge(ctx context.Context, name string) (float64, error) {
+	if f.down.Load() {
+		return 0, errDown
+	}
+	return f.Repo.GetGauge(ctx, name)
+}
+
+func (f *flakyRepo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	if f.down.Load() {
+		return 0, 0, errDown
+	}
+	return f.Repo.GetGaugeWithRevision(ctx, name)
+}
+
+func (f *flakyRepo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	if f.down.Load() {
+		return domain.GaugeWrite{}, errDown
+	}
+	return f.Repo.CompareAndSetGauge(ctx, name, value, expected)
+}
+
+func (f *flakyRepo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	if f.down.Load() {
+		return domain.GaugeWrite{}, errDown
+	}
+	return f.Repo.ApplyGauge(ctx, name, op, value)
+}
+
+func (f *flakyRepo) GetCounter(ctx context.Context, name string) (int64, error) {
+	if f.down.Load() {
+		return 0, errDown
+	}
+	return f.Repo.GetCounter(ctx, name)
+}
+
+func (f *flakyRepo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down.Load() || f.failAt == len(f.batches) {
+		return domain.Snapshot{}, errDown
+	}
+	f.batches = append(f.batches, items)
+	return f.Repo.UpdateMany(ctx, items)
+}
+
+func (f *flakyRepo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	if f.down.Load() {
+		return domain.Snapshot{}, errDown
+	}
+	return f.Repo.Snapshot(ctx)
+}
+
+func (f *flakyRepo) applied() [][]domain.Metrics {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]domain.Metrics(nil), f.batches...)
+}
+
+func openTest(t *testing.T, primary *flakyRepo, journal string) *Repo {
+	t.Helper()
+	r, err := Open(context.Background(), primary, journal,
+		WithProbe(primary.ping),
+		WithReconnectInterval(5*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+func waitRecovered(t *testing.T, r *Repo) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Degraded() {
+		if time.Now().After(deadline) {
+			t.Fatalf("repo did not recover: %+v", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRepo_Conformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) ports.MetricsRepo {
+		return openTest(t, newFlaky(), filepath.Join(t.TempDir(), "journal"))
+	})
+}
+
+func TestRepo_FailoverAndReplay(t *testing.T) {
+	ctx := context.Background()
+	primary := newFlaky()
+	r := openTest(t, primary, filepath.Join(t.TempDir(), "journal"))
+
+	if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("Alloc", 1), repotest.Counter("Polls", 10)}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	rev, _ := r.Revision(ctx)
+
+	primary.down.Store(true)
+	if err := r.SetGauge(ctx, "Alloc", 2); err != nil {
+		t.Fatalf("SetGauge during outage: %v", err)
+	}
+	if _, err := r.AddCounter(ctx, "Polls", 5); err != nil {
+		t.Fatalf("AddCounter during outage: %v", err)
+	}
+	if err := r.SetGauge(ctx, "Alloc", 3); err != nil {
+		t.Fatalf("SetGauge during outage: %v", err)
+	}
+	if !r.Degraded() || r.Stats().JournalEntries != 3 {
+		t.Fatalf("want degraded with 3 journal entries, got %+v", r.Stats())
+	}
+	repotest.ExpectState(t, r, map[string]float64{"Alloc": 3}, map[string]int64{"Polls": 15})
+	if got, _ := r.Revision(ctx); got != rev {
+		t.Fatalf("revision moved while degraded: %d -> %d", rev, got)
+	}
+	if snap, _ := r.SnapshotSince(ctx, rev); len(snap.Gauges) != 1 || len(snap.Counters) != 1 {
+		t.Fatalf("SnapshotSince while degraded should return the whole cache: %+v", snap)
+	}
+	if err := r.Ping(ctx); err == nil {
+		t.Fatal("Ping should fail while degraded")
+	}
+
+	primary.down.Store(false)
+	waitRecovered(t, r)
+
+	batches := primary.applied()
+	if len(batches) != 4 {
+		t.Fatalf("want 1 direct and 3 replayed batches, got %d", len(batches))
+	}
+	if v := *batches[3][0].Value; v != 3 {
+		t.Fatalf("journal replayed out of order: last gauge %v", v)
+	}
+	repotest.ExpectState(t, primary.Repo, map[string]float64{"Alloc": 3}, map[string]int64{"Polls": 15})
+	st := r.Stats()
+	if st.JournalEntries != 0 || st.Replayed != 3 || st.Outages != 1 {
+		t.Fatalf("stats after recovery: %+v", st)
+	}
+}
+
+func TestRepo_CompareAndSetGauge(t *testing.T) {
+	ctx := context.Background()
+	primary := newFlaky()
+	r := openTest(t, primary, filepath.Join(t.TempDir(), "journal"))
+
+	w, err := r.CompareAndSetGauge(ctx, "Temp", 1, 0)
+	rev := w.Revision
+	if err != nil || rev <= 0 {
+		t.Fatalf("create: %d, %v", rev, err)
+	}
+	if _, err := r.CompareAndSetGauge(ctx, "Temp", 2, rev+100); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("want ErrRevisionMismatch, got %v", err)
+	}
+	if r.Degraded() {
+		t.Fatal("a revision mismatch must not degrade the repo")
+	}
+
+	primary.down.Store(true)
+	if _, err := r.CompareAndSetGauge(ctx, "Temp", 3, rev); !errors.Is(err, domain.ErrUnavailable) {
+		t.Fatalf("conditional write during outage: want ErrUnavailable, got %v", err)
+	}
+	if !r.Degraded() || r.Stats().JournalEntries != 0 {
+		t.Fatalf("want degraded without journal entries, got %+v", r.Stats())
+	}
+	if w, err := r.CompareAndSetGauge(ctx, "Temp", 4, ports.AnyRevision); err != nil || w.Revision != 0 || w.Old == nil || *w.Old != 1 {
+		t.Fatalf("unconditional write during outage: %+v, %v; want replacing 1 without a revision", w, err)
+	}
+	if v, got, err := r.GetGaugeWithRevision(ctx, "Temp"); err != nil || v != 4 || got != 0 {
+		t.Fatalf("cached gauge: %v at %d, %v; want 4 without a revision", v, got, err)
+	}
+
+	primary.down.Store(false)
+	waitRecovered(t, r)
+	v, got, err := r.GetGaugeWithRevision(ctx, "Temp")
+	if err != nil || v != 4 || got <= rev {
+		t.Fatalf("after recovery: %v at %d, %v", v, got, err)
+	}
+}
+
+func TestRepo_ApplyGauge(t *testing.T) {
+	ctx := context.Background()
+	primary := newFlaky()
+	r := openTest(t, primary, filepath.Join(t.TempDir(), "journal"))
+
+	if w, err := r.ApplyGauge(ctx, "Load", domain.GaugeAdd, 2); err != nil || w.Value != 2 || w.Revision <= 0 || w.Old != nil {
+		t.Fatalf("add on a new gauge: %+v, %v", w, err)
+	}
+	if w, err := r.ApplyGauge(ctx, "Load", domain.GaugeMax, 5); err != nil || w.Value != 5 || w.Old == nil || *w.Old != 2 {
+		t.Fatalf("max: %+v, %v", w, err)
+	}
+
+	primary.down.Store(true)
+	if w, err := r.ApplyGauge(ctx, "Load", domain.GaugeAdd, 1); err != nil || w.Value != 6 || w.Revision != 0 || w.Old == nil || *w.Old != 5 {
+		t.Fatalf("add during outage: %+v, %v; want 5 -> 6 without a revision", w, err)
+	}
+	if !r.Degraded() || r.Stats().JournalEntries != 1 {
+		t.Fatalf("want the add journaled, got %+v", r.Stats())
+	}
+	if _, err := r.ApplyGauge(ctx, "Load", "avg", 1); !errors.Is(err, domain.ErrInvalidType) {
+		t.Fatalf("unknown operation: want ErrInvalidType, got %v", err)
+	}
+
+	primary.down.Store(false)
+	waitRecovered(t, r)
+	if v, err := primary.Repo.GetGauge(ctx, "Load"); err != nil || v != 6 {
+		t.Fatalf("primary after replay: %v, %v; want 6", v, err)
+	}
+}
+
+func TestRepo_NonOutageErrorsAreReturned(t *testing.T) {
+	primary := newFlaky()
+	r, err := Open(context.Background(), primary, filepath.Join(t.TempDir(), "journal"),
+		WithProbe(primary.ping),
+		WithOutageCheck(func(err error) bool { return !errors.Is(err, errDown) }),
+	)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	primary.down.Store(true)
+	if err := r.SetGauge(context.Background(), "G", 1); !errors.Is(err, errDown) {
+		t.Fatalf("want the primary error, got %v", err)
+	}
+	if r.Degraded() || r.Stats().Journaled != 0 {
+		t.Fatalf("a non-outage error must not journal: %+v", r.Stats())
+	}
+}
+
+func TestRepo_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal")
+	primary := newFlaky()
+	primary.down.Store(true)
+
+	r, err := Open(ctx, primary, path, WithProbe(primary.ping), WithReconnectInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !r.Degraded() {
+		t.Fatal("want degraded start")
+	}
+	if _, err := r.AddCounter(ctx, "Polls", 2); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	if _, err := r.AddCounter(ctx, "Polls", 3); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Restarted while the database is still down: the cache is rebuilt from the journal.
+	r = openTest(t, primary, path)
+	repotest.ExpectState(t, r, map[string]float64{}, map[string]int64{"Polls": 5})
+
+	primary.down.Store(false)
+	waitRecovered(t, r)
+	repotest.ExpectState(t, primary.Repo, map[string]float64{}, map[string]int64{"Polls": 5})
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("journal should be empty after replay: %v, %v", info, err)
+	}
+}
+
+func TestRepo_ReplayStopsAtFailure(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal")
+	primary := newFlaky()
+	primary.down.Store(true)
+	r, err := Open(ctx, primary, path, WithProbe(primary.ping), WithReconnectInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := range 3 {
+		if _, err := r.AddCounter(ctx, "Polls", int64(i+1)); err != nil {
+			t.Fatalf("AddCounter: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	primary.down.Store(false)
+	primary.failAt = 1
+	r, err = Open(ctx, primary, path, WithProbe(primary.ping), WithReconnectInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !r.Degraded() || r.Stats().JournalEntries != 2 {
+		t.Fatalf("want the two unreplayed entries kept, got %+v", r.Stats())
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	primary.failAt = -1
+	r = openTest(t, primary, path)
+	if r.Degraded() {
+		t.Fatalf("want recovery on restart, got %+v", r.Stats())
+	}
+	repotest.ExpectState(t, primary.Repo, map[string]float64{}, map[string]int64{"Polls": 6})
+}
+
+func TestJournal_TornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	if _, err := j.Append([]domain.Metrics{repotest.Gauge("A", 1)}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := f.WriteString(`{"seq":2,"items":[{"id":"B"`); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = f.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := j.Append([]domain.Metrics{repotest.Gauge("C", 3)}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	_ = j.Close()
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer func() { _ = j.Close() }()
+	pending := j.Pending()
+	if len(pending) != 2 || pending[0].Items[0].ID != "A" || pending[1].Items[0].ID != "C" || pending[1].Seq != 2 {
+		t.Fatalf("unexpected entries after torn tail: %+v", pending)
+	}
+}
+
+func TestJournal_CorruptLineFailsOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	for _, id := range []string{"A", "B", "C"} {
+		if _, err := j.Append([]domain.Metrics{repotest.Gauge(id, 1)}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	_ = j.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	// Flip the gauge ID of the middle entry; its line stays complete but fails the checksum.
+	i := bytes.Index(data, []byte(`"B"`))
+	data[i+1] = 'X'
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := OpenJournal(path); !errors.Is(err, errCorrupt) {
+		t.Fatalf("want a corrupt middle line to fail the open, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+		t.Fatal("a failed open must not truncate the journal")
+	}
+}
+
+// cancelingRepo cancels the caller's context right after the primary commits a counter.
+type cancelingRepo struct {
+	*flakyRepo
+	cancel context.CancelFunc
+}
+
+func (c *cancelingRepo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	v, err := c.flakyRepo.AddCounter(ctx, name, delta)
+	c.cancel()
+	return v, err
+}
+
+func TestRepo_MirrorSurvivesCanceledCaller(t *testing.T) {
+	flaky := newFlaky()
+	primary := &cancelingRepo{flakyRepo: flaky}
+	r, err := Open(context.Background(), primary, filepath.Join(t.TempDir(), "journal"), WithProbe(flaky.ping))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	primary.cancel = cancel
+	if got, err := r.AddCounter(ctx, "C", 5); err != nil || got != 5 {
+		t.Fatalf("a committed write must succeed: got %d, %v", got, err)
+	}
+
+	flaky.down.Store(true)
+	if got, err := r.GetCounter(context.Background(), "C"); err != nil || got != 5 {
+		t.Fatalf("cache missed the committed write: got %d, %v", got, err)
+	}
+}
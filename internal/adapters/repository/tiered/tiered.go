@@ -0,0 +1,538 @@
+// Package tiered serves metrics from memory in front of a slower backing repository.
+//
+// Repo loads the whole dataset from the backing repository when it opens and answers every
+// read from memory. Writes are applied to memory at once and, in write-behind mode, folded
+// per metric and flushed to the backing repository in group commits, either on an interval
+// or once enough metrics are pending. Close flushes whatever is left.
+//
+// Repo assumes it is the only writer of the backing store: writes made to the database by
+// anyone else after Open are not seen. The one exception is a backing repository that reports
+// itself degraded at Open, such as the failover repository during a database outage: its
+// snapshot then holds only part of the data, so Repo reloads once the backing recovers.
+package tiered
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+const (
+	defaultFlushInterval  = time.Second
+	defaultFlushSize      = 500
+	defaultFlushTimeout   = 10 * time.Second
+	defaultReloadInterval = time.Second
+)
+
+var errClosed = errors.New("tiered repository closed")
+
+// Option customizes a Repo built by Open.
+type Option func(*Repo)
+
+// WithFlushInterval bounds how long a write may wait in memory before it is flushed.
+// Zero turns write-behind off: every write reaches the backing repository before it returns.
+func WithFlushInterval(d time.Duration) Option {
+	return func(r *Repo) {
+		if d >= 0 {
+			r.interval = d
+		}
+	}
+}
+
+// WithFlushSize flushes early once n distinct metrics are pending.
+func WithFlushSize(n int) Option {
+	return func(r *Repo) {
+		if n > 0 {
+			r.flushSize = n
+		}
+	}
+}
+
+// WithReloadInterval sets how often a cache loaded from a degraded backing repository
+// checks whether the backing has recovered.
+func WithReloadInterval(d time.Duration) Option {
+	return func(r *Repo) {
+		if d > 0 {
+			r.reloadEvery = d
+		}
+	}
+}
+
+// WithErrorHandler receives background flush and reload failures; both are retried.
+func WithErrorHandler(fn func(error)) Option {
+	return func(r *Repo) {
+		if fn != nil {
+			r.onError = fn
+		}
+	}
+}
+
+// Stats is a point-in-time view of the write-behind buffer.
+type Stats struct {
+	Pending     int     `json:"pending"`
+	Flushes     int64   `json:"flushes"`
+	Flushed     int64   `json:"flushed"`
+	Failures    int64   `json:"failures"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	WriteBehind bool    `json:"write_behind"`
+	// Partial is set while the cache holds what a degraded backing served at Open.
+	Partial bool `json:"partial"`
+}
+
+// degradedReporter is implemented by backing repositories that serve a partial dataset
+// during an outage.
+type degradedReporter interface {
+	Degraded() bool
+}
+
+// Repo is a ports.MetricsRepo that keeps the full dataset in memory over a backing repository.
+//
+// Revisions are local to the cache and offset by a base taken at Open: the larger of the backing
+// revision and the current time in microseconds, so they keep growing across restarts.
+type Repo struct {
+	backing ports.MetricsRepo
+	cache   *memory.Repo
+	onError func(error)
+	oldest  time.Time
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	// gauges and counters hold the writes not flushed yet: the latest gauge
+	// values and the summed counter deltas.
+	gauges   map[string]float64
+	counters map[string]int64
+	// base is added to cache revisions so they never go backwards across restarts.
+	base        int64
+	interval    time.Duration
+	reloadEvery time.Duration
+	flushSize   int
+	// mu orders writes so the cache and the pending batch see them in the same order.
+	mu        sync.Mutex
+	flushMu   sync.Mutex
+	flushes   atomic.Int64
+	flushed   atomic.Int64
+	failures  atomic.Int64
+	partial   atomic.Bool
+	reloadWG  sync.WaitGroup
+	closed    bool
+	closeOnce sync.Once
+}
+
+var _ ports.MetricsRepo = (*Repo)(nil)
+
+// Open loads every metric from backing and, in write-behind mode, starts the flush loop.
+// When backing reports itself degraded, Open still succeeds and reloads in the background
+// once the backing recovers.
+func Open(ctx context.Context, backing ports.MetricsRepo, opts ...Option) (*Repo, error) {
+	r := &Repo{
+		backing:     backing,
+		cache:       memory.New(),
+		onError:     func(error) {},
+		interval:    defaultFlushInterval,
+		reloadEvery: defaultReloadInterval,
+		flushSize:   defaultFlushSize,
+		gauges:      make(map[string]float64),
+		counters:    make(map[string]int64),
+		kick:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	dr, canDegrade := backing.(degradedReporter)
+	partial := canDegrade && dr.Degraded()
+	snap, err := backing.Snapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load metrics: %w", err)
+	}
+	if _, err := r.cache.UpdateMany(ctx, snap.Items()); err != nil {
+		return nil, fmt.Errorf("load metrics: %w", err)
+	}
+	r.base = max(snap.Revision, time.Now().UnixMicro())
+
+	if r.interval > 0 {
+		go r.run()
+	} else {
+		close(r.done)
+	}
+	if partial {
+		r.partial.Store(true)
+		r.reloadWG.Add(1)
+		go r.reloadOnRecovery(dr)
+	}
+	return r, nil
+}
+
+// GetGauge reads the gauge from memory.
+func (r *Repo) GetGauge(ctx context.Context, name string) (float64, error) {
+	return r.cache.GetGauge(ctx, name)
+}
+
+// GetGaugeWithRevision reads the gauge and the revision of its last write from memory.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	v, rev, err := r.cache.GetGaugeWithRevision(ctx, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return v, rev + r.base, nil
+}
+
+// GetCounter reads the counter from memory.
+func (r *Repo) GetCounter(ctx context.Context, name string) (int64, error) {
+	return r.cache.GetCounter(ctx, name)
+}
+
+// SetGauge stores the gauge in memory and queues it for the backing repository.
+func (r *Repo) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.UpdateMany(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}})
+	return err
+}
+
+// CompareAndSetGauge stores the gauge if its cached revision is still expected and reports
+// the write. Repo is the only writer of the backing store, so the cache decides.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	var check func() error
+	if expected != ports.AnyRevision {
+		check = func() error {
+			if r.gaugeRevision(name) != expected {
+				return domain.ErrRevisionMismatch
+			}
+			return nil
+		}
+	}
+	var rev int64
+	read := func() {
+		rev = r.gaugeRevision(name)
+	}
+	prior, err := r.update(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value}}, check, read)
+	if err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(prior, name, value, rev), nil
+}
+
+// ApplyGauge combines the value with the cached gauge and queues the result for the backing
+// repository; without write-behind the operation itself is written through. It reports the
+// write as it happened in memory.
+func (r *Repo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	if !op.Valid() {
+		return domain.GaugeWrite{}, domain.ErrInvalidType
+	}
+	var (
+		res float64
+		rev int64
+	)
+	read := func() {
+		res, rev, _ = r.cache.GetGaugeWithRevision(context.Background(), name)
+		rev += r.base
+	}
+	prior, err := r.update(ctx, []domain.Metrics{{ID: name, MType: string(domain.Gauge), Value: &value, Op: op}}, nil, read)
+	if err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	return gaugeWrite(prior, name, res, rev), nil
+}
+
+// gaugeWrite reports a write of the named gauge from the cached values its batch replaced.
+func gaugeWrite(prior domain.Snapshot, name string, value float64, rev int64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value, Revision: rev}
+	if old, ok := prior.Gauges[name]; ok {
+		w.Old = &old
+	}
+	return w
+}
+
+// gaugeRevision returns the revision of the cached gauge, or zero if it does not exist.
+func (r *Repo) gaugeRevision(name string) int64 {
+	_, rev, err := r.cache.GetGaugeWithRevision(context.Background(), name)
+	if err != nil {
+		return 0
+	}
+	return rev + r.base
+}
+
+// AddCounter adds the delta in memory and queues it for the backing repository. It returns
+// the total the delta produced in memory.
+func (r *Repo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	var total int64
+	read := func() {
+		total, _ = r.cache.GetCounter(context.Background(), name)
+	}
+	if _, err := r.update(ctx, []domain.Metrics{{ID: name, MType: string(domain.Counter), Delta: &delta}}, nil, read); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// UpdateMany applies the batch in memory and queues it for the next flush. Without write-behind
+// it is written to the backing repository first and the cache is left untouched if that fails.
+// The values it replaced are read from the cache.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	return r.update(ctx, items, nil, nil)
+}
+
+// update implements UpdateMany. check, when set, runs before the batch is written anywhere
+// and its error cancels the write; applied runs right after the batch reached the cache. No
+// other write can run between the two.
+func (r *Repo) update(ctx context.Context, items []domain.Metrics, check func() error, applied func()) (domain.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.Snapshot{}, err
+	}
+	items = domain.Fold(items)
+	if len(items) == 0 {
+		return domain.Snapshot{}, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return domain.Snapshot{}, errClosed
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return domain.Snapshot{}, err
+		}
+	}
+	if r.interval == 0 {
+		if _, err := r.backing.UpdateMany(ctx, items); err != nil {
+			return domain.Snapshot{}, err
+		}
+		r.flushes.Add(1)
+		r.flushed.Add(int64(len(items)))
+		prior, err := r.cache.UpdateMany(ctx, items)
+		if err != nil {
+			return domain.Snapshot{}, err
+		}
+		if applied != nil {
+			applied()
+		}
+		return prior, nil
+	}
+
+	prior, err := r.cache.UpdateMany(ctx, items)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	if applied != nil {
+		applied()
+	}
+	if r.pendingLocked() == 0 {
+		r.oldest = time.Now()
+	}
+	for _, it := range items {
+		if it.MType == string(domain.Gauge) {
+			// Queue the value the operations left, the flush writes it as a set.
+			r.gauges[it.ID], _ = r.cache.GetGauge(context.Background(), it.ID)
+		} else {
+			r.counters[it.ID] += *it.Delta
+		}
+	}
+	if r.pendingLocked() >= r.flushSize {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+	return prior, nil
+}
+
+// Snapshot copies the in-memory metrics.
+func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	snap, err := r.cache.Snapshot(ctx)
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	snap.Revision += r.base
+	return snap, nil
+}
+
+// SnapshotSince returns the metrics written after since; revisions from before Open
+// return everything.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	snap, err := r.cache.SnapshotSince(ctx, max(since-r.base, 0))
+	if err != nil {
+		return domain.Snapshot{}, err
+	}
+	snap.Revision += r.base
+	return snap, nil
+}
+
+// Revision reports the revision of the latest in-memory write.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	rev, err := r.cache.Revision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return rev + r.base, nil
+}
+
+// Ping checks the backing repository.
+func (r *Repo) Ping(ctx context.Context) error {
+	return r.backing.Ping(ctx)
+}
+
+// Flush writes every pending metric to the backing repository in one batch. On failure the
+// batch is merged back under newer writes and retried by the next flush.
+func (r *Repo) Flush(ctx context.Context) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	batch := domain.Snapshot{Gauges: r.gauges, Counters: r.counters}
+	oldest := r.oldest
+	r.gauges = make(map[string]float64)
+	r.counters = make(map[string]int64)
+	r.mu.Unlock()
+	items := batch.Items()
+	if len(items) == 0 {
+		return nil
+	}
+
+	if _, err := r.backing.UpdateMany(ctx, items); err != nil {
+		r.failures.Add(1)
+		r.mu.Lock()
+		for id, v := range batch.Gauges {
+			if _, ok := r.gauges[id]; !ok {
+				r.gauges[id] = v
+			}
+		}
+		for id, d := range batch.Counters {
+			r.counters[id] += d
+		}
+		r.oldest = oldest
+		r.mu.Unlock()
+		return fmt.Errorf("flush %d metrics: %w", len(items), err)
+	}
+	r.flushes.Add(1)
+	r.flushed.Add(int64(len(items)))
+	return nil
+}
+
+// Stats reports the write-behind buffer state.
+func (r *Repo) Stats() Stats {
+	r.mu.Lock()
+	pending := r.pendingLocked()
+	var lag float64
+	if pending > 0 {
+		lag = time.Since(r.oldest).Seconds()
+	}
+	r.mu.Unlock()
+	return Stats{
+		Pending:     pending,
+		Flushes:     r.flushes.Load(),
+		Flushed:     r.flushed.Load(),
+		Failures:    r.failures.Load(),
+		LagSeconds:  lag,
+		WriteBehind: r.interval > 0,
+		Partial:     r.partial.Load(),
+	}
+}
+
+func (r *Repo) pendingLocked() int {
+	return len(r.gauges) + len(r.counters)
+}
+
+// Close stops the flush loop and flushes the remaining writes; later writes fail.
+func (r *Repo) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+		close(r.stop)
+	})
+	<-r.done
+	r.reloadWG.Wait()
+	return r.Flush(ctx)
+}
+
+func (r *Repo) run() {
+	defer close(r.done)
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		case <-r.kick:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultFlushTimeout)
+		if err := r.Flush(ctx); err != nil {
+			r.onError(err)
+		}
+		cancel()
+	}
+}
+
+// reloadOnRecovery waits for a backing that was degraded at Open to recover and then reloads.
+func (r *Repo) reloadOnRecovery(dr degradedReporter) {
+	defer r.reloadWG.Done()
+	t := time.NewTicker(r.reloadEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		if dr.Degraded() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultFlushTimeout)
+		err := r.reload(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		r.onError(err)
+	}
+}
+
+// reload brings the cache in line with the backing repository, keeping the writes that are
+// still pending. Every flush so far reached the backing, so its value plus the pending
+// counter deltas and gauges is the current state. The cache is updated in place, so revisions
+// keep growing and readers never see it empty.
+func (r *Repo) reload(ctx context.Context) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snap, err := r.backing.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("reload metrics: %w", err)
+	}
+	cached, err := r.cache.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("reload metrics: %w", err)
+	}
+	var items []domain.Metrics
+	for id, v := range snap.Gauges {
+		if _, pending := r.gauges[id]; pending {
+			continue
+		}
+		if cur, ok := cached.Gauges[id]; !ok || cur != v {
+			items = append(items, domain.Metrics{ID: id, MType: string(domain.Gauge), Value: &v})
+		}
+	}
+	for id, v := range snap.Counters {
+		if delta := v + r.counters[id] - cached.Counters[id]; delta != 0 {
+			items = append(items, domain.Metrics{ID: id, MType: string(domain.Counter), Delta: &delta})
+		}
+	}
+	if len(items) > 0 {
+		if _, err := r.cache.UpdateMany(ctx, items); err != nil {
+			return fmt.Errorf("reload metrics: %w", err)
+		}
+	}
+	r.partial.Store(false)
+	return nil
+}
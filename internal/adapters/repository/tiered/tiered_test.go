@@ -0,0 +1,284 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+// backingRepo is a memory repo that counts calls and can fail writes.
+type backingRepo struct {
+	*memory.Repo
+	reads   atomic.Int64
+	writes  atomic.Int64
+	failing atomic.Bool
+}
+
+func newBacking() *backingRepo {
+	return &backingRepo{Repo: memory.New()}
+}
+
+func (b *backingRepo) GetGauge(ctx context.Context, name string) (float64, error) {
+	b.reads.Add(1)
+	return b.Repo.GetGauge(ctx, name)
+}
+
+func (b *backingRepo) GetCounter(ctx context.Context, name string) (int64, error) {
+	b.reads.Add(1)
+	return b.Repo.GetCounter(ctx, name)
+}
+
+func (b *backingRepo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	if b.failing.Load() {
+		return domain.Snapshot{}, errors.New("database is down")
+	}
+	b.writes.Add(1)
+	return b.Repo.UpdateMany(ctx, items)
+}
+
+func openTest(t *testing.T, backing ports.MetricsRepo, opts ...Option) *Repo {
+	t.Helper()
+	r, err := Open(context.Background(), backing, opts...)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close(context.Background()) })
+	return r
+}
+
+// reopen closes r, flushing it, and opens a new cache over the same backing repository.
+func reopen(opts ...Option) repotest.Reopener {
+	return func(t *testing.T, repo ports.MetricsRepo) ports.MetricsRepo {
+		t.Helper()
+		r := repo.(*Repo)
+		if err := r.Close(context.Background()); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return openTest(t, r.backing, opts...)
+	}
+}
+
+func TestRepo_Conformance(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"write-behind", []Option{WithFlushInterval(time.Hour)}},
+		{"write-through", []Option{WithFlushInterval(0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repotest.Run(t, func(t *testing.T) ports.MetricsRepo {
+				return openTest(t, newBacking(), tt.opts...)
+			}, repotest.WithReopen(reopen(tt.opts...)))
+		})
+	}
+}
+
+func TestRepo_ReadsStayLocal(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	if _, err := backing.Repo.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("Alloc", 1), repotest.Counter("Polls", 2)}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	r := openTest(t, backing, WithFlushInterval(time.Hour))
+
+	if err := r.SetGauge(ctx, "Alloc", 5); err != nil {
+		t.Fatalf("SetGauge: %v", err)
+	}
+	repotest.ExpectState(t, r, map[string]float64{"Alloc": 5}, map[string]int64{"Polls": 2})
+	if n := backing.reads.Load(); n != 0 {
+		t.Fatalf("reads reached the backing repository %d times", n)
+	}
+	if n := backing.writes.Load(); n != 0 {
+		t.Fatalf("write-behind wrote through %d times", n)
+	}
+}
+
+func TestRepo_GroupCommit(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	r := openTest(t, backing, WithFlushInterval(20*time.Millisecond))
+	for range 10 {
+		if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Counter("Polls", 1), repotest.Gauge("A", 1)}); err != nil {
+			t.Fatalf("UpdateMany: %v", err)
+		}
+	}
+	waitFlushed(t, r)
+	if got, err := backing.Repo.GetCounter(ctx, "Polls"); err != nil || got != 10 {
+		t.Fatalf("backing counter = %v, %v; want 10", got, err)
+	}
+	if n := backing.writes.Load(); n >= 10 {
+		t.Fatalf("want writes grouped, got %d backing writes", n)
+	}
+}
+
+func TestRepo_FlushSize(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	r := openTest(t, backing, WithFlushInterval(time.Hour), WithFlushSize(3))
+	for _, id := range []string{"A", "B", "A"} {
+		if err := r.SetGauge(ctx, id, 1); err != nil {
+			t.Fatalf("SetGauge: %v", err)
+		}
+	}
+	if st := r.Stats(); st.Pending != 2 || st.Flushes != 0 {
+		t.Fatalf("two distinct metrics should not trigger a flush: %+v", st)
+	}
+	if _, err := r.AddCounter(ctx, "A", 1); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	waitFlushed(t, r)
+	repotest.ExpectState(t, backing.Repo, map[string]float64{"A": 1, "B": 1}, map[string]int64{"A": 1})
+}
+
+func waitFlushed(t *testing.T, r *Repo) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if st := r.Stats(); st.Pending == 0 && st.Flushes > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending writes were not flushed: %+v", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRepo_FlushFailureKeepsWrites(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	r := openTest(t, backing, WithFlushInterval(time.Hour))
+
+	if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 1), repotest.Counter("C", 2)}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	backing.failing.Store(true)
+	if err := r.Flush(ctx); err == nil {
+		t.Fatal("want flush error")
+	}
+	if st := r.Stats(); st.Pending != 2 || st.Failures != 1 || st.LagSeconds <= 0 {
+		t.Fatalf("failed batch should stay pending: %+v", st)
+	}
+	if _, err := r.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 7), repotest.Counter("C", 3)}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+
+	backing.failing.Store(false)
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	repotest.ExpectState(t, backing.Repo, map[string]float64{"A": 7}, map[string]int64{"C": 5})
+	if err := r.SetGauge(ctx, "A", 1); !errors.Is(err, errClosed) {
+		t.Fatalf("write after Close: want errClosed, got %v", err)
+	}
+}
+
+func TestRepo_WriteThroughFailure(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	r := openTest(t, backing, WithFlushInterval(0))
+	backing.failing.Store(true)
+	if err := r.SetGauge(ctx, "A", 1); err == nil {
+		t.Fatal("want the backing error")
+	}
+	if _, err := r.GetGauge(ctx, "A"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("failed write-through must not reach the cache: %v", err)
+	}
+}
+
+func TestRepo_RevisionGrowsAcrossReopen(t *testing.T) {
+	ctx := context.Background()
+	backing := newBacking()
+	r := openTest(t, backing, WithFlushInterval(time.Hour))
+	for i := range 5 {
+		if _, err := r.AddCounter(ctx, "C", int64(i)); err != nil {
+			t.Fatalf("AddCounter: %v", err)
+		}
+	}
+	before, _ := r.Revision(ctx)
+
+	next := reopen(WithFlushInterval(time.Hour))(t, r)
+	after, _ := next.Revision(ctx)
+	if after <= before {
+		t.Fatalf("revision went backwards across reopen: %d -> %d", before, after)
+	}
+	snap, err := next.SnapshotSince(ctx, before)
+	if err != nil || snap.Counters["C"] != 10 {
+		t.Fatalf("SnapshotSince an older revision should return everything: %+v, %v", snap, err)
+	}
+}
+
+// degradedBacking serves only part of the data while degraded, like the failover repo
+// during an outage, and the full data once it recovers.
+type degradedBacking struct {
+	*memory.Repo
+	partial  *memory.Repo
+	degraded atomic.Bool
+}
+
+func (d *degradedBacking) Degraded() bool { return d.degraded.Load() }
+
+func (d *degradedBacking) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	if d.degraded.Load() {
+		return d.partial.Snapshot(ctx)
+	}
+	return d.Repo.Snapshot(ctx)
+}
+
+func TestRepo_ReloadsAfterDegradedOpen(t *testing.T) {
+	ctx := context.Background()
+	backing := &degradedBacking{Repo: memory.New(), partial: memory.New()}
+	if _, err := backing.Repo.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 5), repotest.Gauge("B", 7), repotest.Counter("C", 10)}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if _, err := backing.partial.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 1)}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	backing.degraded.Store(true)
+
+	r := openTest(t, backing, WithFlushInterval(time.Hour), WithReloadInterval(time.Millisecond))
+	if !r.Stats().Partial {
+		t.Fatal("a cache loaded from a degraded backing must report itself partial")
+	}
+	if _, err := r.AddCounter(ctx, "C", 3); err != nil {
+		t.Fatalf("AddCounter: %v", err)
+	}
+	rev, _ := r.Revision(ctx)
+
+	backing.degraded.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Stats().Partial {
+		if time.Now().After(deadline) {
+			t.Fatal("cache was not reloaded after the backing recovered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if v, _ := r.GetGauge(ctx, "A"); v != 5 {
+		t.Fatalf("gauge A: want 5, got %v", v)
+	}
+	if v, _ := r.GetGauge(ctx, "B"); v != 7 {
+		t.Fatalf("gauge B: want 7, got %v", v)
+	}
+	if v, _ := r.GetCounter(ctx, "C"); v != 13 {
+		t.Fatalf("counter C: want the backing total plus the pending delta, got %d", v)
+	}
+	if after, _ := r.Revision(ctx); after <= rev {
+		t.Fatalf("revision went from %d to %d across the reload", rev, after)
+	}
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if v, _ := backing.GetCounter(ctx, "C"); v != 13 {
+		t.Fatalf("backing counter C after flush: want 13, got %d", v)
+	}
+}
@@ -0,0 +1,129 @@
+// Package traced decorates a metrics repository with trace spans.
+package traced
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/trace"
+)
+
+// Repo records a child span of the request span for every call to the wrapped repository.
+type Repo struct {
+	next   ports.MetricsRepo
+	tracer *trace.Tracer
+}
+
+var _ ports.MetricsRepo = (*Repo)(nil)
+
+// New wraps next so its calls are recorded with tracer.
+func New(next ports.MetricsRepo, tracer *trace.Tracer) *Repo {
+	return &Repo{next: next, tracer: tracer}
+}
+
+func (r *Repo) start(ctx context.Context, op, metric string) (context.Context, *trace.ActiveSpan) {
+	ctx, span := r.tracer.Start(ctx, "repo."+op)
+	if metric != "" {
+		span.SetAttr("metric", metric)
+	}
+	return ctx, span
+}
+
+// GetGauge records a span around the wrapped GetGauge.
+func (r *Repo) GetGauge(ctx context.Context, name string) (float64, error) {
+	ctx, span := r.start(ctx, "GetGauge", name)
+	v, err := r.next.GetGauge(ctx, name)
+	span.End(err)
+	return v, err
+}
+
+// GetGaugeWithRevision records a span around the wrapped GetGaugeWithRevision.
+func (r *Repo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	ctx, span := r.start(ctx, "GetGaugeWithRevision", name)
+	v, rev, err := r.next.GetGaugeWithRevision(ctx, name)
+	span.End(err)
+	return v, rev, err
+}
+
+// GetCounter records a span around the wrapped GetCounter.
+func (r *Repo) GetCounter(ctx context.Context, name string) (int64, error) {
+	ctx, span := r.start(ctx, "GetCounter", name)
+	v, err := r.next.GetCounter(ctx, name)
+	span.End(err)
+	return v, err
+}
+
+// SetGauge records a span around the wrapped SetGauge.
+func (r *Repo) SetGauge(ctx context.Context, name string, value float64) error {
+	ctx, span := r.start(ctx, "SetGauge", name)
+	err := r.next.SetGauge(ctx, name, value)
+	span.End(err)
+	return err
+}
+
+// CompareAndSetGauge records a span around the wrapped CompareAndSetGauge.
+func (r *Repo) CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
+	ctx, span := r.start(ctx, "CompareAndSetGauge", name)
+	w, err := r.next.CompareAndSetGauge(ctx, name, value, expected)
+	span.End(err)
+	return w, err
+}
+
+// ApplyGauge records a span around the wrapped ApplyGauge.
+func (r *Repo) ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	ctx, span := r.start(ctx, "ApplyGauge", name)
+	w, err := r.next.ApplyGauge(ctx, name, op, value)
+	span.End(err)
+	return w, err
+}
+
+// AddCounter records a span around the wrapped AddCounter.
+func (r *Repo) AddCounter(ctx context.Context, name string, delta int64) (int64, error) {
+	ctx, span := r.start(ctx, "AddCounter", name)
+	total, err := r.next.AddCounter(ctx, name, delta)
+	span.End(err)
+	return total, err
+}
+
+// UpdateMany records a span around the wrapped UpdateMany, noting the batch size.
+func (r *Repo) UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error) {
+	ctx, span := r.start(ctx, "UpdateMany", "")
+	span.SetAttr("items", strconv.Itoa(len(items)))
+	prior, err := r.next.UpdateMany(ctx, items)
+	span.End(err)
+	return prior, err
+}
+
+// Snapshot records a span around the wrapped Snapshot.
+func (r *Repo) Snapshot(ctx context.Context) (domain.Snapshot, error) {
+	ctx, span := r.start(ctx, "Snapshot", "")
+	s, err := r.next.Snapshot(ctx)
+	span.End(err)
+	return s, err
+}
+
+// SnapshotSince records a span around the wrapped SnapshotSince.
+func (r *Repo) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	ctx, span := r.start(ctx, "SnapshotSince", "")
+	s, err := r.next.SnapshotSince(ctx, since)
+	span.End(err)
+	return s, err
+}
+
+// Revision records a span around the wrapped Revision.
+func (r *Repo) Revision(ctx context.Context) (int64, error) {
+	ctx, span := r.start(ctx, "Revision", "")
+	rev, err := r.next.Revision(ctx)
+	span.End(err)
+	return rev, err
+}
+
+// Ping records a span around the wrapped Ping.
+func (r *Repo) Ping(ctx context.Context) error {
+	ctx, span := r.start(ctx, "Ping", "")
+	err := r.next.Ping(ctx)
+	span.End(err)
+	return err
+}
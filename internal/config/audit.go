@@ -0,0 +1,231 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditFileMaxSizeMB    = 100
+	defaultAuditFileMaxBackups   = 10
+	defaultAuditFileFlushSeconds = 1
+	defaultAuditFileFsync        = "flush"
+	defaultAuditFileCheckpoint   = 60
+
+	defaultAuditRemoteBatchSize    = 100
+	defaultAuditRemoteBatchMillis  = 1000
+	defaultAuditRemoteSpoolMaxSize = 64
+
+	defaultAuditSyslogFacility = "local0"
+	defaultAuditSyslogAppName  = "golectra"
+
+	defaultAuditQueueSize          = 128
+	defaultAuditQueuePolicy        = "drop_newest"
+	defaultAuditQueueTimeoutMillis = 100
+)
+
+// AuditFileConfig tunes buffering, fsync and rotation of the audit log file.
+type AuditFileConfig struct {
+	Fsync          string
+	HMACKey        string
+	MaxSize        int64
+	MaxAge         time.Duration
+	RotateInterval time.Duration
+	FlushInterval  time.Duration
+	// CheckpointInterval spaces signed checkpoints when HMACKey chains the log.
+	CheckpointInterval time.Duration
+	MaxBackups         int
+}
+
+type auditFileFlags struct {
+	fsync       string
+	hmacKeyFile string
+	maxSizeMB   int
+	maxBackups  int
+	maxAge      int
+	rotate      int
+	flush       int
+	checkpoint  int
+}
+
+func registerAuditFileFlags(fs *flag.FlagSet) *auditFileFlags {
+	f := &auditFileFlags{}
+	fs.IntVar(&f.maxSizeMB, "audit-file-max-size", -1, fmt.Sprintf("rotate the audit file after this many MB (0 - never), default: %d", defaultAuditFileMaxSizeMB))
+	fs.IntVar(&f.maxBackups, "audit-file-max-backups", -1, fmt.Sprintf("number of gzipped audit backups to keep (0 - all), default: %d", defaultAuditFileMaxBackups))
+	fs.IntVar(&f.maxAge, "audit-file-max-age", -1, "remove audit backups older than this many seconds (0 - keep), default: 0")
+	fs.IntVar(&f.rotate, "audit-file-rotate-interval", -1, "rotate the audit file every N seconds (0 - never), default: 0")
+	fs.IntVar(&f.flush, "audit-file-flush-interval", -1, fmt.Sprintf("flush buffered audit events every N seconds (0 - every event), default: %d", defaultAuditFileFlushSeconds))
+	fs.StringVar(&f.fsync, "audit-file-fsync", "", fmt.Sprintf("audit file fsync policy: flush, always or never, default: %s", defaultAuditFileFsync))
+	fs.StringVar(&f.hmacKeyFile, "audit-hmac-key-file", "", "file holding the HMAC key that hash-chains audit file records (or AUDIT_HMAC_KEY; plain records if empty)")
+	fs.IntVar(&f.checkpoint, "audit-file-checkpoint-interval", -1, fmt.Sprintf("write a signed audit checkpoint every N seconds, default: %d", defaultAuditFileCheckpoint))
+	return f
+}
+
+func (f *auditFileFlags) resolve() (AuditFileConfig, error) {
+	fsync := strings.ToLower(FromEnvOrFlag("AUDIT_FILE_FSYNC", f.fsync, defaultAuditFileFsync))
+	switch fsync {
+	case "flush", "always", "never":
+	default:
+		return AuditFileConfig{}, fmt.Errorf("invalid audit file fsync policy: %q", fsync)
+	}
+
+	maxSizeMB := fromEnvOrFlagCount("AUDIT_FILE_MAX_SIZE", f.maxSizeMB, defaultAuditFileMaxSizeMB)
+	maxBackups := fromEnvOrFlagCount("AUDIT_FILE_MAX_BACKUPS", f.maxBackups, defaultAuditFileMaxBackups)
+	maxAge, _ := FromEnvOrFlagDuration("AUDIT_FILE_MAX_AGE", f.maxAge, -1, 0)
+	rotate, _ := FromEnvOrFlagDuration("AUDIT_FILE_ROTATE_INTERVAL", f.rotate, -1, 0)
+	flush, _ := FromEnvOrFlagDuration("AUDIT_FILE_FLUSH_INTERVAL", f.flush, -1, defaultAuditFileFlushSeconds)
+	checkpoint, _ := FromEnvOrFlagDuration("AUDIT_FILE_CHECKPOINT_INTERVAL", f.checkpoint, -1, defaultAuditFileCheckpoint)
+	if maxAge < 0 || rotate < 0 || flush < 0 || checkpoint < 0 {
+		return AuditFileConfig{}, fmt.Errorf("audit file intervals must be >= 0")
+	}
+	hmacKey, err := SecretFromEnvOrFile("AUDIT_HMAC_KEY", f.hmacKeyFile)
+	if err != nil {
+		return AuditFileConfig{}, err
+	}
+
+	return AuditFileConfig{
+		Fsync:              fsync,
+		HMACKey:            hmacKey,
+		MaxSize:            int64(maxSizeMB) << 20,
+		MaxAge:             maxAge,
+		RotateInterval:     rotate,
+		FlushInterval:      flush,
+		CheckpointInterval: checkpoint,
+		MaxBackups:         maxBackups,
+	}, nil
+}
+
+// AuditRemoteConfig tunes batching and spooling of remote audit delivery.
+type AuditRemoteConfig struct {
+	SpoolDir      string
+	SpoolMaxSize  int64
+	BatchInterval time.Duration
+	BatchSize     int
+}
+
+type auditRemoteFlags struct {
+	spoolDir     string
+	batchSize    int
+	batchMillis  int
+	spoolMaxSize int
+}
+
+func registerAuditRemoteFlags(fs *flag.FlagSet) *auditRemoteFlags {
+	f := &auditRemoteFlags{}
+	fs.IntVar(&f.batchSize, "audit-batch-size", 0, fmt.Sprintf("send remote audit events in batches of N, default: %d", defaultAuditRemoteBatchSize))
+	fs.IntVar(&f.batchMillis, "audit-batch-interval", 0, fmt.Sprintf("send a partial remote audit batch after N ms, default: %d", defaultAuditRemoteBatchMillis))
+	fs.StringVar(&f.spoolDir, "audit-spool-dir", "", "directory for undelivered remote audit batches (in memory if empty)")
+	fs.IntVar(&f.spoolMaxSize, "audit-spool-max-size", -1, fmt.Sprintf("cap the audit spool at this many MB, dropping the oldest batches (0 - unbounded), default: %d", defaultAuditRemoteSpoolMaxSize))
+	return f
+}
+
+func (f *auditRemoteFlags) resolve() AuditRemoteConfig {
+	batchSize := FromEnvOrFlagInt("AUDIT_BATCH_SIZE", f.batchSize, defaultAuditRemoteBatchSize, 1)
+	batchMillis := FromEnvOrFlagInt("AUDIT_BATCH_INTERVAL", f.batchMillis, defaultAuditRemoteBatchMillis, 1)
+	spoolMaxSize := fromEnvOrFlagCount("AUDIT_SPOOL_MAX_SIZE", f.spoolMaxSize, defaultAuditRemoteSpoolMaxSize)
+
+	return AuditRemoteConfig{
+		SpoolDir:      FromEnvOrFlag("AUDIT_SPOOL_DIR", f.spoolDir, ""),
+		SpoolMaxSize:  int64(spoolMaxSize) << 20,
+		BatchInterval: time.Duration(batchMillis) * time.Millisecond,
+		BatchSize:     batchSize,
+	}
+}
+
+// AuditSyslogConfig sets the header and structured-data fields of syslog audit messages.
+type AuditSyslogConfig struct {
+	Facility string
+	AppName  string
+	// SDID names the structured-data element; empty keeps the sink default.
+	SDID string
+	// SDParams lists static structured-data params as "key=value,key=value".
+	SDParams string
+}
+
+type auditSyslogFlags struct {
+	facility string
+	appName  string
+	sdID     string
+	sdParams string
+}
+
+func registerAuditSyslogFlags(fs *flag.FlagSet) *auditSyslogFlags {
+	f := &auditSyslogFlags{}
+	fs.StringVar(&f.facility, "audit-syslog-facility", "", fmt.Sprintf("syslog facility of audit messages, default: %s", defaultAuditSyslogFacility))
+	fs.StringVar(&f.appName, "audit-syslog-app-name", "", fmt.Sprintf("APP-NAME of audit syslog messages, default: %s", defaultAuditSyslogAppName))
+	fs.StringVar(&f.sdID, "audit-syslog-sd-id", "", "structured-data ID of audit syslog messages, default: audit@32473")
+	fs.StringVar(&f.sdParams, "audit-syslog-sd-params", "", "static structured-data params added to audit syslog messages, as key=value,key=value")
+	return f
+}
+
+func (f *auditSyslogFlags) resolve() AuditSyslogConfig {
+	return AuditSyslogConfig{
+		Facility: strings.ToLower(FromEnvOrFlag("AUDIT_SYSLOG_FACILITY", f.facility, defaultAuditSyslogFacility)),
+		AppName:  FromEnvOrFlag("AUDIT_SYSLOG_APP_NAME", f.appName, defaultAuditSyslogAppName),
+		SDID:     FromEnvOrFlag("AUDIT_SYSLOG_SD_ID", f.sdID, ""),
+		SDParams: FromEnvOrFlag("AUDIT_SYSLOG_SD_PARAMS", f.sdParams, ""),
+	}
+}
+
+// AuditQueueConfig sizes the per-sink audit queues and selects what happens when one is full.
+type AuditQueueConfig struct {
+	Policy   string
+	SpillDir string
+	Timeout  time.Duration
+	Size     int
+}
+
+type auditQueueFlags struct {
+	policy        string
+	spillDir      string
+	size          int
+	timeoutMillis int
+}
+
+func registerAuditQueueFlags(fs *flag.FlagSet) *auditQueueFlags {
+	f := &auditQueueFlags{}
+	fs.IntVar(&f.size, "audit-queue-size", 0, fmt.Sprintf("events buffered per audit sink, default: %d", defaultAuditQueueSize))
+	fs.StringVar(&f.policy, "audit-queue-policy", "", fmt.Sprintf("what to do when an audit queue is full: block, drop_newest, drop_oldest or spill, default: %s", defaultAuditQueuePolicy))
+	fs.IntVar(&f.timeoutMillis, "audit-queue-timeout", 0, fmt.Sprintf("max ms to wait for queue space with the block policy, default: %d", defaultAuditQueueTimeoutMillis))
+	fs.StringVar(&f.spillDir, "audit-queue-spill-dir", "", "directory for overflowing audit events with the spill policy")
+	return f
+}
+
+func (f *auditQueueFlags) resolve() (AuditQueueConfig, error) {
+	policy := strings.ReplaceAll(strings.ToLower(FromEnvOrFlag("AUDIT_QUEUE_POLICY", f.policy, defaultAuditQueuePolicy)), "-", "_")
+	spillDir := FromEnvOrFlag("AUDIT_QUEUE_SPILL_DIR", f.spillDir, "")
+	switch policy {
+	case "block", "drop_newest", "drop_oldest":
+	case "spill":
+		if spillDir == "" {
+			return AuditQueueConfig{}, fmt.Errorf("audit queue policy spill requires a spill directory")
+		}
+	default:
+		return AuditQueueConfig{}, fmt.Errorf("invalid audit queue policy: %q", policy)
+	}
+	timeoutMillis := FromEnvOrFlagInt("AUDIT_QUEUE_TIMEOUT", f.timeoutMillis, defaultAuditQueueTimeoutMillis, 1)
+
+	return AuditQueueConfig{
+		Policy:   policy,
+		SpillDir: spillDir,
+		Timeout:  time.Duration(timeoutMillis) * time.Millisecond,
+		Size:     FromEnvOrFlagInt("AUDIT_QUEUE_SIZE", f.size, defaultAuditQueueSize, 1),
+	}, nil
+}
+
+// fromEnvOrFlagCount resolves a non-negative integer where an unset flag is -1, so 0 stays expressible.
+func fromEnvOrFlagCount(envKey string, flagVal, def int) int {
+	if ev := strings.TrimSpace(os.Getenv(envKey)); ev != "" {
+		if n, err := strconv.Atoi(ev); err == nil && n >= 0 {
+			return n
+		}
+	}
+	if flagVal >= 0 {
+		return flagVal
+	}
+	return def
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultDBJournalPath      = "metrics-db.journal"
+	defaultDBReconnectSeconds = 5
+	defaultDBFlushMillis      = 1000
+	defaultDBFlushSize        = 500
+)
+
+// DBConfig controls how the server rides out Postgres outages.
+type DBConfig struct {
+	// JournalPath holds writes made while Postgres is unreachable until they are replayed.
+	JournalPath       string
+	ReconnectInterval time.Duration
+	// FlushInterval bounds how long a cached write may wait before it reaches Postgres;
+	// zero writes through.
+	FlushInterval time.Duration
+	FlushSize     int
+	// Strict refuses to start without a reachable database instead of starting degraded.
+	Strict bool
+	// Cache serves reads from memory and writes behind to Postgres.
+	Cache bool
+	// SkipMigrate leaves schema migrations to "server migrate up"; the schema version is
+	// still checked at startup.
+	SkipMigrate bool
+}
+
+type dbFlags struct {
+	journal     string
+	reconnect   int
+	flushMillis int
+	flushSize   int
+	strict      bool
+	cache       bool
+	skipMigrate bool
+}
+
+func registerDBFlags(fs *flag.FlagSet) *dbFlags {
+	f := &dbFlags{}
+	fs.StringVar(&f.journal, "db-journal", "", fmt.Sprintf("journal for writes made while Postgres is unreachable, default: %s", defaultDBJournalPath))
+	fs.IntVar(&f.reconnect, "db-reconnect-interval", -1, fmt.Sprintf("seconds between reconnect attempts while Postgres is unreachable, default: %d", defaultDBReconnectSeconds))
+	fs.BoolVar(&f.strict, "db-strict", false, "refuse to start when Postgres is unreachable (true/false), default: false")
+	fs.BoolVar(&f.cache, "db-cache", false, "keep all metrics in memory and write them behind to Postgres (true/false), default: false")
+	fs.BoolVar(&f.skipMigrate, "skip-migrate", false, "do not apply schema migrations at startup (true/false), default: false")
+	fs.IntVar(&f.flushMillis, "db-flush-interval", -1, fmt.Sprintf("max ms a cached write waits before it is flushed to Postgres (0 - write through), default: %d", defaultDBFlushMillis))
+	fs.IntVar(&f.flushSize, "db-flush-size", 0, fmt.Sprintf("flush cached writes early once this many metrics are pending, default: %d", defaultDBFlushSize))
+	return f
+}
+
+func (f *dbFlags) resolve() (DBConfig, error) {
+	reconnect, _ := FromEnvOrFlagDuration("DB_RECONNECT_INTERVAL", f.reconnect, -1, defaultDBReconnectSeconds)
+	if reconnect <= 0 {
+		return DBConfig{}, fmt.Errorf("db reconnect interval must be > 0, got %v", reconnect)
+	}
+	flushMillis := fromEnvOrFlagCount("DB_FLUSH_INTERVAL", f.flushMillis, defaultDBFlushMillis)
+	return DBConfig{
+		JournalPath:       FromEnvOrFlag("DB_JOURNAL", f.journal, defaultDBJournalPath),
+		ReconnectInterval: reconnect,
+		FlushInterval:     time.Duration(flushMillis) * time.Millisecond,
+		FlushSize:         FromEnvOrFlagInt("DB_FLUSH_SIZE", f.flushSize, defaultDBFlushSize, 1),
+		Strict:            FromEnvOrFlagBool("DB_STRICT", f.strict, false),
+		Cache:             FromEnvOrFlagBool("DB_CACHE", f.cache, false),
+		SkipMigrate:       FromEnvOrFlagBool("SKIP_MIGRATE", f.skipMigrate, false),
+	}, nil
+}
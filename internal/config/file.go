@@ -0,0 +1,39 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+)
+
+const defaultFileGenerations = 3
+
+// FileConfig controls the snapshot files of the memory storage.
+type FileConfig struct {
+	// Generations is how many snapshots are kept: FILE_STORAGE_PATH and its .1, .2... backups.
+	Generations int
+	// RestoreGeneration restores FILE_STORAGE_PATH.N instead of the newest valid snapshot.
+	RestoreGeneration int
+	Compress          bool
+}
+
+type fileFlags struct {
+	generations       int
+	restoreGeneration int
+	compress          bool
+}
+
+func registerFileFlags(fs *flag.FlagSet) *fileFlags {
+	f := &fileFlags{}
+	fs.IntVar(&f.generations, "file-generations", 0, fmt.Sprintf("snapshot generations to keep, default: %d", defaultFileGenerations))
+	fs.BoolVar(&f.compress, "file-gzip", false, "gzip snapshot files (true/false), default: false")
+	fs.IntVar(&f.restoreGeneration, "restore-generation", -1, "restore this older snapshot generation instead of the newest valid one (0 - newest), default: 0")
+	return f
+}
+
+func (f *fileFlags) resolve() FileConfig {
+	return FileConfig{
+		Generations:       FromEnvOrFlagInt("FILE_STORAGE_GENERATIONS", f.generations, defaultFileGenerations, 1),
+		RestoreGeneration: fromEnvOrFlagCount("RESTORE_GENERATION", f.restoreGeneration, 0),
+		Compress:          FromEnvOrFlagBool("FILE_STORAGE_GZIP", f.compress, false),
+	}
+}
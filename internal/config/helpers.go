@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -60,3 +61,25 @@ func FromEnvOrFlagDuration(envKey string, flagSeconds, flagSentinel, defSeconds
 	}
 	return time.Duration(defSeconds) * time.Second, false
 }
+
+// SecretFromEnvOrFile reads a secret from the envKey variable or, failing that, from the file
+// named by fileFlag or the envKey+"_FILE" variable. Secrets are never taken from a flag value,
+// which would show up in ps output.
+func SecretFromEnvOrFile(envKey, fileFlag string) (string, error) {
+	if v := strings.TrimSpace(os.Getenv(envKey)); v != "" {
+		return v, nil
+	}
+	path := FromEnvOrFlag(envKey+"_FILE", fileFlag, "")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s file: %w", envKey, err)
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "" {
+		return "", fmt.Errorf("%s file %s is empty", envKey, path)
+	}
+	return v, nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -278,3 +280,35 @@ func TestHelpers_FromEnvOrFlagDuration(t *testing.T) {
 		})
 	}
 }
+
+func TestHelpers_SecretFromEnvOrFile(t *testing.T) {
+	const key = "CFG_SECRET"
+	t.Setenv(key, "")
+	t.Setenv(key+"_FILE", "")
+
+	if got, err := SecretFromEnvOrFile(key, ""); err != nil || got != "" {
+		t.Fatalf("unset: got %q, %v", got, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if got, err := SecretFromEnvOrFile(key, path); err != nil || got != "from-file" {
+		t.Fatalf("file flag: got %q, %v", got, err)
+	}
+	t.Setenv(key+"_FILE", path)
+	if got, err := SecretFromEnvOrFile(key, ""); err != nil || got != "from-file" {
+		t.Fatalf("file env: got %q, %v", got, err)
+	}
+	t.Setenv(key, "from-env")
+	if got, err := SecretFromEnvOrFile(key, path); err != nil || got != "from-env" {
+		t.Fatalf("env: got %q, %v", got, err)
+	}
+
+	t.Setenv(key, "")
+	t.Setenv(key+"_FILE", "")
+	if _, err := SecretFromEnvOrFile(key, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected error for a missing secret file")
+	}
+}
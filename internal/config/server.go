@@ -20,14 +20,31 @@ const (
 
 // ServerConfig describes how the HTTP server listens, stores data, and emits audit logs.
 type ServerConfig struct {
-	Address   string
-	File      string
-	DSN       string
-	Key       string
-	Interval  time.Duration
-	Restore   bool
-	AuditFile string
-	AuditURL  string
+	Address     string
+	File        string
+	DSN         string
+	Key         string
+	Interval    time.Duration
+	Restore     bool
+	AuditFile   string
+	AuditURL    string
+	AuditSyslog string
+	AuditRoutes string
+	AuditReads  bool
+	AuditDB     bool
+	// AuditAPIToken enables GET /api/v1/audit for requests bearing it; empty keeps it off.
+	AuditAPIToken string
+	// DebugVarsToken enables GET /debug/vars for requests bearing it; empty keeps it off.
+	DebugVarsToken string
+	TraceFile      string
+
+	AuditFileOptions   AuditFileConfig
+	AuditRemoteOptions AuditRemoteConfig
+	AuditSyslogOptions AuditSyslogConfig
+	AuditQueueOptions  AuditQueueConfig
+	DBOptions          DBConfig
+	StorageOptions     StorageConfig
+	FileOptions        FileConfig
 }
 
 // LoadServerConfig resolves CLI flags, environment variables, and defaults (ENV > CLI > defaults).
@@ -47,6 +64,13 @@ func LoadServerConfig(args []string, out io.Writer) (ServerConfig, error) {
 	var restoreOpt bool
 	var auditFileOpt string
 	var auditURLOpt string
+	var auditSyslogOpt string
+	var auditRoutesOpt string
+	var auditReadsOpt bool
+	var auditDBOpt bool
+	var auditTokenFileOpt string
+	var varsTokenFileOpt string
+	var traceFileOpt string
 
 	fs.StringVar(&addrOpt, "a", "", fmt.Sprintf("HTTP listen address, default: %s", defaultListenAndServeAddr))
 	fs.StringVar(&fileOpt, "f", "", fmt.Sprintf("FILE_STORAGE_PATH, default: %s", defaultFilePath))
@@ -56,6 +80,20 @@ func LoadServerConfig(args []string, out io.Writer) (ServerConfig, error) {
 	fs.BoolVar(&restoreOpt, "r", false, fmt.Sprintf("RESTORE on start (true/false), default: %t", defaultRestore))
 	fs.StringVar(&auditFileOpt, "audit-file", "", "path to audit log file (disabled if empty)")
 	fs.StringVar(&auditURLOpt, "audit-url", "", "URL for sending audit events via HTTP POST (disabled if empty)")
+	fs.StringVar(&auditSyslogOpt, "audit-syslog", "", "syslog collector for audit events: udp://host:port, tcp://host:port or unix:///path (disabled if empty)")
+	fs.StringVar(&auditRoutesOpt, "audit-routes", "", "JSON file with per-sink audit routing rules, reloaded on SIGHUP (every sink gets every event if empty)")
+	fs.BoolVar(&auditReadsOpt, "audit-reads", false, "also audit metric reads (true/false), default: false")
+	fs.BoolVar(&auditDBOpt, "audit-db", false, "also store audit events in the Postgres audit_events table (requires -d), default: false")
+	fs.StringVar(&auditTokenFileOpt, "audit-api-token-file", "", "file holding the bearer token that enables GET /api/v1/audit (or AUDIT_API_TOKEN; disabled if empty)")
+	fs.StringVar(&varsTokenFileOpt, "debug-vars-token-file", "", "file holding the bearer token that enables GET /debug/vars (or DEBUG_VARS_TOKEN; disabled if empty)")
+	fs.StringVar(&traceFileOpt, "trace-file", "", "append request and repository spans to this file as JSON lines (disabled if empty)")
+	auditFileOpts := registerAuditFileFlags(fs)
+	auditRemoteOpts := registerAuditRemoteFlags(fs)
+	auditSyslogOpts := registerAuditSyslogFlags(fs)
+	auditQueueOpts := registerAuditQueueFlags(fs)
+	dbOpts := registerDBFlags(fs)
+	storageOpts := registerStorageFlags(fs)
+	fileOpts := registerFileFlags(fs)
 
 	if err := fs.Parse(args); err != nil {
 		return ServerConfig{}, err
@@ -72,6 +110,9 @@ func LoadServerConfig(args []string, out io.Writer) (ServerConfig, error) {
 	key := FromEnvOrFlag("KEY", keyOpt, "")
 	auditFile := FromEnvOrFlag("AUDIT_FILE", auditFileOpt, "")
 	auditURL := FromEnvOrFlag("AUDIT_URL", auditURLOpt, "")
+	auditSyslog := FromEnvOrFlag("AUDIT_SYSLOG", auditSyslogOpt, "")
+	auditRoutes := FromEnvOrFlag("AUDIT_ROUTES", auditRoutesOpt, "")
+	traceFile := FromEnvOrFlag("TRACE_FILE", traceFileOpt, "")
 
 	interval, _ := FromEnvOrFlagDuration("STORE_INTERVAL", ivalOpt, -1, defaultStoreInterval)
 	if interval < 0 {
@@ -79,16 +120,58 @@ func LoadServerConfig(args []string, out io.Writer) (ServerConfig, error) {
 	}
 
 	restore := FromEnvOrFlagBool("RESTORE", restoreOpt, defaultRestore)
+	auditReads := FromEnvOrFlagBool("AUDIT_READS", auditReadsOpt, false)
+	auditDB := FromEnvOrFlagBool("AUDIT_DB", auditDBOpt, false)
+	auditToken, err := SecretFromEnvOrFile("AUDIT_API_TOKEN", auditTokenFileOpt)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	varsToken, err := SecretFromEnvOrFile("DEBUG_VARS_TOKEN", varsTokenFileOpt)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	auditFileCfg, err := auditFileOpts.resolve()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	auditQueueCfg, err := auditQueueOpts.resolve()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	dbCfg, err := dbOpts.resolve()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	storageCfg, err := storageOpts.resolve(dsn)
+	if err != nil {
+		return ServerConfig{}, err
+	}
 
 	return ServerConfig{
-		Address:   addr,
-		File:      file,
-		DSN:       dsn,
-		Key:       key,
-		Interval:  interval,
-		Restore:   restore,
-		AuditFile: auditFile,
-		AuditURL:  auditURL,
+		Address:     addr,
+		File:        file,
+		DSN:         dsn,
+		Key:         key,
+		Interval:    interval,
+		Restore:     restore,
+		AuditFile:   auditFile,
+		AuditURL:    auditURL,
+		AuditSyslog: auditSyslog,
+		AuditRoutes: auditRoutes,
+		AuditReads:  auditReads,
+		AuditDB:     auditDB,
+
+		AuditAPIToken:  auditToken,
+		DebugVarsToken: varsToken,
+		TraceFile:      traceFile,
+
+		AuditFileOptions:   auditFileCfg,
+		AuditRemoteOptions: auditRemoteOpts.resolve(),
+		AuditSyslogOptions: auditSyslogOpts.resolve(),
+		AuditQueueOptions:  auditQueueCfg,
+		DBOptions:          dbCfg,
+		StorageOptions:     storageCfg,
+		FileOptions:        fileOpts.resolve(),
 	}, nil
 }
 
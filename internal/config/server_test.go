@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -39,14 +41,20 @@ func TestLoadServerConfig(t *testing.T) {
 				"RESTORE":           "false",
 				"AUDIT_FILE":        "env-audit.log",
 				"AUDIT_URL":         "https://audit.example.com",
+				"AUDIT_SYSLOG":      "udp://siem:514",
+				"AUDIT_ROUTES":      "/etc/golectra/routes.json",
+				"TRACE_FILE":        "/var/log/golectra/spans.jsonl",
 			},
 			want: ServerConfig{
-				Address:   "0.0.0.0:1234",
-				File:      "env.json",
-				Interval:  777 * time.Second,
-				Restore:   false,
-				AuditFile: "env-audit.log",
-				AuditURL:  "https://audit.example.com",
+				Address:     "0.0.0.0:1234",
+				File:        "env.json",
+				Interval:    777 * time.Second,
+				Restore:     false,
+				AuditFile:   "env-audit.log",
+				AuditURL:    "https://audit.example.com",
+				AuditSyslog: "udp://siem:514",
+				AuditRoutes: "/etc/golectra/routes.json",
+				TraceFile:   "/var/log/golectra/spans.jsonl",
 			},
 		},
 		{
@@ -104,6 +112,28 @@ func TestLoadServerConfig(t *testing.T) {
 				AuditURL:  "",
 			},
 		},
+		{
+			name: "audit reads via flag",
+			args: []string{"-audit-reads"},
+			want: ServerConfig{
+				Address:    defaultListenAndServeAddr,
+				File:       defaultFilePath,
+				Interval:   ds(defaultStoreInterval),
+				Restore:    defaultRestore,
+				AuditReads: true,
+			},
+		},
+		{
+			name: "audit db via env",
+			env:  map[string]string{"AUDIT_DB": "true"},
+			want: ServerConfig{
+				Address:  defaultListenAndServeAddr,
+				File:     defaultFilePath,
+				Interval: ds(defaultStoreInterval),
+				Restore:  defaultRestore,
+				AuditDB:  true,
+			},
+		},
 		{
 			name: "address accepts plain port (normalized to :port)",
 			args: []string{"-a", "9090"},
@@ -120,7 +150,7 @@ func TestLoadServerConfig(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			for _, k := range []string{"ADDRESS", "STORE_INTERVAL", "FILE_STORAGE_PATH", "RESTORE", "AUDIT_FILE", "AUDIT_URL"} {
+			for _, k := range []string{"ADDRESS", "STORE_INTERVAL", "FILE_STORAGE_PATH", "RESTORE", "AUDIT_FILE", "AUDIT_URL", "AUDIT_SYSLOG", "AUDIT_ROUTES", "AUDIT_READS", "AUDIT_DB", "TRACE_FILE"} {
 				t.Setenv(k, "")
 			}
 			for k, v := range tt.env {
@@ -159,6 +189,21 @@ func TestLoadServerConfig(t *testing.T) {
 			if got.AuditURL != tt.want.AuditURL {
 				t.Errorf("AuditURL: want %q, got %q", tt.want.AuditURL, got.AuditURL)
 			}
+			if got.AuditSyslog != tt.want.AuditSyslog {
+				t.Errorf("AuditSyslog: want %q, got %q", tt.want.AuditSyslog, got.AuditSyslog)
+			}
+			if got.AuditRoutes != tt.want.AuditRoutes {
+				t.Errorf("AuditRoutes: want %q, got %q", tt.want.AuditRoutes, got.AuditRoutes)
+			}
+			if got.TraceFile != tt.want.TraceFile {
+				t.Errorf("TraceFile: want %q, got %q", tt.want.TraceFile, got.TraceFile)
+			}
+			if got.AuditReads != tt.want.AuditReads {
+				t.Errorf("AuditReads: want %v, got %v", tt.want.AuditReads, got.AuditReads)
+			}
+			if got.AuditDB != tt.want.AuditDB {
+				t.Errorf("AuditDB: want %v, got %v", tt.want.AuditDB, got.AuditDB)
+			}
 		})
 	}
 }
@@ -183,3 +228,314 @@ func TestNormalizeListenAndServeURL(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadServerConfig_AuditFileOptions(t *testing.T) {
+	for _, k := range []string{"AUDIT_FILE_MAX_SIZE", "AUDIT_FILE_MAX_BACKUPS", "AUDIT_FILE_MAX_AGE", "AUDIT_FILE_ROTATE_INTERVAL", "AUDIT_FILE_FLUSH_INTERVAL", "AUDIT_FILE_FSYNC", "AUDIT_FILE_CHECKPOINT_INTERVAL", "AUDIT_HMAC_KEY", "AUDIT_HMAC_KEY_FILE"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := AuditFileConfig{
+		Fsync:              defaultAuditFileFsync,
+		MaxSize:            defaultAuditFileMaxSizeMB << 20,
+		MaxBackups:         defaultAuditFileMaxBackups,
+		FlushInterval:      ds(defaultAuditFileFlushSeconds),
+		CheckpointInterval: ds(defaultAuditFileCheckpoint),
+	}
+	if got.AuditFileOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.AuditFileOptions)
+	}
+
+	t.Setenv("AUDIT_FILE_MAX_AGE", "72h")
+	t.Setenv("AUDIT_FILE_FSYNC", "always")
+	t.Setenv("AUDIT_HMAC_KEY", "secret")
+	got, err = LoadServerConfig([]string{"-audit-file-max-size", "0", "-audit-file-max-backups", "3", "-audit-file-flush-interval", "0", "-audit-file-checkpoint-interval", "5", "-audit-hmac-key-file", "/nonexistent"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = AuditFileConfig{Fsync: "always", HMACKey: "secret", MaxAge: 72 * time.Hour, CheckpointInterval: 5 * time.Second, MaxBackups: 3}
+	if got.AuditFileOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.AuditFileOptions)
+	}
+
+	t.Setenv("AUDIT_FILE_FSYNC", "")
+	if _, err := LoadServerConfig([]string{"-audit-file-fsync", "sometimes"}, nil); err == nil {
+		t.Fatal("expected error for unknown fsync policy")
+	}
+	if _, err := LoadServerConfig([]string{"-audit-hmac-key", "secret"}, nil); err == nil {
+		t.Fatal("expected the hmac key flag to be gone")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "hmac.key")
+	if err := os.WriteFile(keyFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	t.Setenv("AUDIT_HMAC_KEY", "")
+	got, err = LoadServerConfig([]string{"-audit-hmac-key-file", keyFile}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.AuditFileOptions.HMACKey != "from-file" {
+		t.Fatalf("hmac key from file: got %q", got.AuditFileOptions.HMACKey)
+	}
+}
+
+func TestLoadServerConfig_AuditRemoteOptions(t *testing.T) {
+	for _, k := range []string{"AUDIT_BATCH_SIZE", "AUDIT_BATCH_INTERVAL", "AUDIT_SPOOL_DIR", "AUDIT_SPOOL_MAX_SIZE"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := AuditRemoteConfig{
+		SpoolMaxSize:  defaultAuditRemoteSpoolMaxSize << 20,
+		BatchInterval: time.Second,
+		BatchSize:     defaultAuditRemoteBatchSize,
+	}
+	if got.AuditRemoteOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.AuditRemoteOptions)
+	}
+
+	t.Setenv("AUDIT_SPOOL_DIR", "/var/spool/audit")
+	got, err = LoadServerConfig([]string{"-audit-batch-size", "10", "-audit-batch-interval", "250", "-audit-spool-max-size", "0", "-audit-spool-dir", "/tmp/ignored"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = AuditRemoteConfig{SpoolDir: "/var/spool/audit", BatchInterval: 250 * time.Millisecond, BatchSize: 10}
+	if got.AuditRemoteOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.AuditRemoteOptions)
+	}
+}
+
+func TestLoadServerConfig_AuditSyslogOptions(t *testing.T) {
+	for _, k := range []string{"AUDIT_SYSLOG_FACILITY", "AUDIT_SYSLOG_APP_NAME", "AUDIT_SYSLOG_SD_ID", "AUDIT_SYSLOG_SD_PARAMS"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := AuditSyslogConfig{Facility: defaultAuditSyslogFacility, AppName: defaultAuditSyslogAppName}
+	if got.AuditSyslogOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.AuditSyslogOptions)
+	}
+
+	t.Setenv("AUDIT_SYSLOG_FACILITY", "AUTHPRIV")
+	got, err = LoadServerConfig([]string{"-audit-syslog-facility", "local3", "-audit-syslog-app-name", "metrics", "-audit-syslog-sd-id", "golectra@32473", "-audit-syslog-sd-params", "env=prod"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = AuditSyslogConfig{Facility: "authpriv", AppName: "metrics", SDID: "golectra@32473", SDParams: "env=prod"}
+	if got.AuditSyslogOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.AuditSyslogOptions)
+	}
+}
+
+func TestLoadServerConfig_AuditAPIToken(t *testing.T) {
+	t.Setenv("AUDIT_API_TOKEN", "")
+	t.Setenv("AUDIT_API_TOKEN_FILE", "")
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil || got.AuditAPIToken != "" {
+		t.Fatalf("audit API must be off by default, got %q, %v", got.AuditAPIToken, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("tok\n"), 0o600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	got, err = LoadServerConfig([]string{"-audit-api-token-file", path}, nil)
+	if err != nil || got.AuditAPIToken != "tok" {
+		t.Fatalf("token file: got %q, %v", got.AuditAPIToken, err)
+	}
+	if _, err := LoadServerConfig([]string{"-audit-api-token", "tok"}, nil); err == nil {
+		t.Fatal("the token must not be accepted as a flag value")
+	}
+}
+
+func TestLoadServerConfig_DebugVarsToken(t *testing.T) {
+	t.Setenv("DEBUG_VARS_TOKEN", "")
+	t.Setenv("DEBUG_VARS_TOKEN_FILE", "")
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil || got.DebugVarsToken != "" {
+		t.Fatalf("debug vars must be off by default, got %q, %v", got.DebugVarsToken, err)
+	}
+
+	t.Setenv("DEBUG_VARS_TOKEN", "env-tok")
+	got, err = LoadServerConfig(nil, nil)
+	if err != nil || got.DebugVarsToken != "env-tok" {
+		t.Fatalf("env token: got %q, %v", got.DebugVarsToken, err)
+	}
+}
+
+func TestLoadServerConfig_AuditQueueOptions(t *testing.T) {
+	for _, k := range []string{"AUDIT_QUEUE_SIZE", "AUDIT_QUEUE_POLICY", "AUDIT_QUEUE_TIMEOUT", "AUDIT_QUEUE_SPILL_DIR"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := AuditQueueConfig{Policy: defaultAuditQueuePolicy, Timeout: 100 * time.Millisecond, Size: defaultAuditQueueSize}
+	if got.AuditQueueOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.AuditQueueOptions)
+	}
+
+	t.Setenv("AUDIT_QUEUE_POLICY", "block")
+	got, err = LoadServerConfig([]string{"-audit-queue-size", "16", "-audit-queue-timeout", "20", "-audit-queue-policy", "spill"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = AuditQueueConfig{Policy: "block", Timeout: 20 * time.Millisecond, Size: 16}
+	if got.AuditQueueOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.AuditQueueOptions)
+	}
+
+	t.Setenv("AUDIT_QUEUE_POLICY", "spill")
+	if _, err := LoadServerConfig(nil, nil); err == nil {
+		t.Fatal("expected error for spill policy without a directory")
+	}
+	t.Setenv("AUDIT_QUEUE_POLICY", "sometimes")
+	if _, err := LoadServerConfig(nil, nil); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+func TestLoadServerConfig_DBOptions(t *testing.T) {
+	for _, k := range []string{"DB_JOURNAL", "DB_RECONNECT_INTERVAL", "DB_STRICT", "DB_CACHE", "DB_FLUSH_INTERVAL", "DB_FLUSH_SIZE", "SKIP_MIGRATE"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := DBConfig{
+		JournalPath:       defaultDBJournalPath,
+		ReconnectInterval: ds(defaultDBReconnectSeconds),
+		FlushInterval:     defaultDBFlushMillis * time.Millisecond,
+		FlushSize:         defaultDBFlushSize,
+	}
+	if got.DBOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.DBOptions)
+	}
+
+	t.Setenv("DB_RECONNECT_INTERVAL", "500ms")
+	t.Setenv("DB_FLUSH_INTERVAL", "0")
+	got, err = LoadServerConfig([]string{"-db-journal", "/var/lib/golectra/journal", "-db-reconnect-interval", "30", "-db-strict", "-db-cache", "-db-flush-interval", "250", "-db-flush-size", "64", "-skip-migrate"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = DBConfig{
+		JournalPath:       "/var/lib/golectra/journal",
+		ReconnectInterval: 500 * time.Millisecond,
+		FlushSize:         64,
+		Strict:            true,
+		Cache:             true,
+		SkipMigrate:       true,
+	}
+	if got.DBOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.DBOptions)
+	}
+
+	t.Setenv("DB_RECONNECT_INTERVAL", "0")
+	if _, err := LoadServerConfig(nil, nil); err == nil {
+		t.Fatal("expected error for a zero reconnect interval")
+	}
+}
+
+func TestLoadServerConfig_StorageOptions(t *testing.T) {
+	for _, k := range []string{"STORAGE", "STORAGE_DIR", "STORAGE_COMPACT_SIZE", "DATABASE_DSN"} {
+		t.Setenv(k, "")
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		want    StorageConfig
+		wantErr bool
+	}{
+		{
+			name: "memory by default",
+			want: StorageConfig{Engine: StorageMemory, Dir: defaultStorageDir, CompactSize: defaultStorageCompactSizeMB << 20},
+		},
+		{
+			name: "postgres with a dsn",
+			args: []string{"-d", "postgres://localhost/db"},
+			want: StorageConfig{Engine: StoragePostgres, Dir: defaultStorageDir, CompactSize: defaultStorageCompactSizeMB << 20},
+		},
+		{
+			name: "embedded from flags",
+			args: []string{"-storage", "embedded", "-storage-dir", "/var/lib/golectra", "-storage-compact-size", "32"},
+			want: StorageConfig{Engine: StorageEmbedded, Dir: "/var/lib/golectra", CompactSize: 32 << 20},
+		},
+		{
+			name: "env wins over flags",
+			env:  map[string]string{"STORAGE": "embedded", "STORAGE_DIR": "/data"},
+			args: []string{"-storage", "memory", "-storage-dir", "/tmp"},
+			want: StorageConfig{Engine: StorageEmbedded, Dir: "/data", CompactSize: defaultStorageCompactSizeMB << 20},
+		},
+		{
+			name:    "postgres without a dsn",
+			args:    []string{"-storage", "postgres"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown engine",
+			env:     map[string]string{"STORAGE": "sqlite"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got, err := LoadServerConfig(tt.args, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.StorageOptions != tt.want {
+				t.Fatalf("want %+v, got %+v", tt.want, got.StorageOptions)
+			}
+		})
+	}
+}
+
+func TestLoadServerConfig_FileOptions(t *testing.T) {
+	for _, k := range []string{"FILE_STORAGE_GENERATIONS", "FILE_STORAGE_GZIP", "RESTORE_GENERATION"} {
+		t.Setenv(k, "")
+	}
+
+	got, err := LoadServerConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (FileConfig{Generations: defaultFileGenerations}); got.FileOptions != want {
+		t.Fatalf("defaults: want %+v, got %+v", want, got.FileOptions)
+	}
+
+	t.Setenv("RESTORE_GENERATION", "2")
+	got, err = LoadServerConfig([]string{"-file-generations", "5", "-file-gzip", "-restore-generation", "1"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (FileConfig{Generations: 5, RestoreGeneration: 2, Compress: true}); got.FileOptions != want {
+		t.Fatalf("overrides: want %+v, got %+v", want, got.FileOptions)
+	}
+}
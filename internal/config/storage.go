@@ -0,0 +1,65 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Storage engines accepted by STORAGE.
+const (
+	StorageMemory   = "memory"
+	StoragePostgres = "postgres"
+	StorageEmbedded = "embedded"
+)
+
+const (
+	defaultStorageDir           = "metrics-data"
+	defaultStorageCompactSizeMB = 8
+)
+
+// StorageConfig selects the metrics repository backend.
+type StorageConfig struct {
+	// Engine is memory, postgres or embedded; it defaults to postgres when a DSN is set.
+	Engine string
+	// Dir holds the log files and snapshot segment of the embedded engine.
+	Dir string
+	// CompactSize is the log size in bytes that triggers a compaction.
+	CompactSize int64
+}
+
+type storageFlags struct {
+	engine        string
+	dir           string
+	compactSizeMB int
+}
+
+func registerStorageFlags(fs *flag.FlagSet) *storageFlags {
+	f := &storageFlags{}
+	fs.StringVar(&f.engine, "storage", "", "metrics storage: memory, postgres or embedded, default: postgres with -d, memory otherwise")
+	fs.StringVar(&f.dir, "storage-dir", "", fmt.Sprintf("data directory of the embedded storage, default: %s", defaultStorageDir))
+	fs.IntVar(&f.compactSizeMB, "storage-compact-size", 0, fmt.Sprintf("compact the embedded storage log after this many MB, default: %d", defaultStorageCompactSizeMB))
+	return f
+}
+
+func (f *storageFlags) resolve(dsn string) (StorageConfig, error) {
+	def := StorageMemory
+	if dsn != "" {
+		def = StoragePostgres
+	}
+	engine := FromEnvOrFlag("STORAGE", f.engine, def)
+	switch engine {
+	case StorageMemory, StorageEmbedded:
+	case StoragePostgres:
+		if dsn == "" {
+			return StorageConfig{}, fmt.Errorf("storage %s requires DATABASE_DSN", engine)
+		}
+	default:
+		return StorageConfig{}, fmt.Errorf("unknown storage %q: want %s, %s or %s", engine, StorageMemory, StoragePostgres, StorageEmbedded)
+	}
+	compactSizeMB := FromEnvOrFlagInt("STORAGE_COMPACT_SIZE", f.compactSizeMB, defaultStorageCompactSizeMB, 1)
+	return StorageConfig{
+		Engine:      engine,
+		Dir:         FromEnvOrFlag("STORAGE_DIR", f.dir, defaultStorageDir),
+		CompactSize: int64(compactSizeMB) << 20,
+	}, nil
+}
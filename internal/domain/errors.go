@@ -7,4 +7,8 @@ var (
 	ErrNotFound = errors.New("not found")
 	// ErrInvalidType indicates an unsupported metric type was supplied.
 	ErrInvalidType = errors.New("invalid metric type")
+	// ErrRevisionMismatch is returned when a conditional write finds the metric at another revision.
+	ErrRevisionMismatch = errors.New("revision mismatch")
+	// ErrUnavailable is returned when the storage cannot serve the request for the time being.
+	ErrUnavailable = errors.New("storage unavailable")
 )
@@ -0,0 +1,9 @@
+package domain
+
+// MetricsChanged reports a successful write. Items holds the writes folded by Fold: one
+// entry per metric touched, the combined writes to a gauge and the summed delta applied to
+// a counter, sorted by ID and then type. A gauge whose operations do not combine has one
+// entry per run.
+type MetricsChanged struct {
+	Items []Metrics
+}
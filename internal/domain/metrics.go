@@ -1,5 +1,10 @@
 package domain
 
+import (
+	"slices"
+	"strings"
+)
+
 // MetricType enumerates supported metric transports.
 type MetricType string
 
@@ -10,16 +15,192 @@ const (
 	Counter MetricType = "counter"
 )
 
+// GaugeOp says how a gauge write combines with the stored value. A gauge that does not
+// exist yet is set to the written value whatever the operation.
+type GaugeOp string
+
+const (
+	// GaugeSet replaces the stored value; an empty GaugeOp means the same.
+	GaugeSet GaugeOp = "set"
+	// GaugeAdd adds the written value to the stored one.
+	GaugeAdd GaugeOp = "add"
+	// GaugeMax keeps the larger of the stored and the written value.
+	GaugeMax GaugeOp = "max"
+	// GaugeMin keeps the smaller of the stored and the written value.
+	GaugeMin GaugeOp = "min"
+)
+
+// GaugeOps lists every gauge operation in the order batches apply them.
+var GaugeOps = []GaugeOp{GaugeSet, GaugeAdd, GaugeMax, GaugeMin}
+
+// Effective returns the operation op stands for: GaugeSet when it is empty.
+func (op GaugeOp) Effective() GaugeOp {
+	if op == "" {
+		return GaugeSet
+	}
+	return op
+}
+
+// Valid reports whether op is empty or a known operation.
+func (op GaugeOp) Valid() bool {
+	return slices.Contains(GaugeOps, op.Effective())
+}
+
+// Apply returns the value a write of v with op leaves on a gauge that holds cur.
+func (op GaugeOp) Apply(cur, v float64) float64 {
+	switch op.Effective() {
+	case GaugeAdd:
+		return cur + v
+	case GaugeMax:
+		return max(cur, v)
+	case GaugeMin:
+		return min(cur, v)
+	default:
+		return v
+	}
+}
+
 // Metrics describes a single gauge or counter payload.
 type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
+	// ExpectedRevision makes a gauge write conditional: it only applies while the gauge is
+	// still at this revision, zero meaning the gauge does not exist yet.
+	ExpectedRevision *int64 `json:"expected_revision,omitempty"`
+	ID               string `json:"id"`
+	MType            string `json:"type"`
+	// Op is how a gauge value combines with the stored one; empty means GaugeSet.
+	Op GaugeOp `json:"op,omitempty"`
+	// Revision is the store revision of the gauge's last write, set on gauges the server returns.
+	Revision int64 `json:"revision,omitempty"`
+	// MustExist makes a gauge write conditional on the gauge existing at any revision,
+	// as `If-Match: *` asks. It is not part of the JSON payload.
+	MustExist bool `json:"-"`
 }
 
-// Snapshot groups all currently known gauge and counter values.
+// GaugeWrite reports what one gauge write did: the value the gauge held right before it,
+// nil when the write created the gauge, the value it left and the revision it got.
+type GaugeWrite struct {
+	Old      *float64
+	Value    float64
+	Revision int64
+}
+
+// Snapshot groups gauge and counter values together with the store revision they reflect.
 type Snapshot struct {
 	Gauges   map[string]float64
 	Counters map[string]int64
+	Revision int64
+}
+
+// Items lists the snapshot as update items, sorted like Fold, so it can be written to another store.
+func (s Snapshot) Items() []Metrics {
+	items := make([]Metrics, 0, len(s.Gauges)+len(s.Counters))
+	for id, v := range s.Gauges {
+		items = append(items, Metrics{ID: id, MType: string(Gauge), Value: &v})
+	}
+	for id, d := range s.Counters {
+		items = append(items, Metrics{ID: id, MType: string(Counter), Delta: &d})
+	}
+	sortItems(items)
+	return items
+}
+
+// Fold merges a batch into one item per metric: the summed delta applied to a counter and
+// the combined writes to a gauge. A set absorbs the gauge writes before it and turns the
+// later ones into a set of the computed value, and runs of adds, maxes or mins combine into
+// one; a gauge whose operations do not combine, such as an add followed by a max, keeps one
+// item per run in batch order. Items are sorted by ID and then type. Items of an unknown
+// type, without a payload or with an unknown gauge operation are dropped. The input is not
+// modified.
+func Fold(items []Metrics) []Metrics {
+	counters := make(map[string]int)
+	// runs holds the indices of a gauge's items in out; superseded marks runs a set replaced.
+	runs := make(map[string][]int)
+	superseded := make(map[int]bool)
+	out := make([]Metrics, 0, len(items))
+	for _, it := range items {
+		switch {
+		case it.MType == string(Gauge) && it.Value != nil && it.Op.Valid():
+		case it.MType == string(Counter) && it.Delta != nil:
+		default:
+			continue
+		}
+		if it.MType == string(Gauge) {
+			r := runs[it.ID]
+			if n := len(r); n > 0 && combineGauge(&out[r[n-1]], it) {
+				if it.Op.Effective() == GaugeSet {
+					for _, j := range r[:n-1] {
+						superseded[j] = true
+					}
+					runs[it.ID] = r[n-1:]
+				}
+				continue
+			}
+			v := *it.Value
+			runs[it.ID] = append(r, len(out))
+			out = append(out, Metrics{ID: it.ID, MType: it.MType, Value: &v, Op: opOf(it.Op)})
+			continue
+		}
+		i, ok := counters[it.ID]
+		if !ok {
+			i = len(out)
+			counters[it.ID] = i
+			out = append(out, Metrics{ID: it.ID, MType: it.MType})
+		}
+		var d int64
+		if out[i].Delta != nil {
+			d = *out[i].Delta
+		}
+		d += *it.Delta
+		out[i].Delta = &d
+	}
+	if len(superseded) > 0 {
+		kept := out[:0]
+		for i, it := range out {
+			if !superseded[i] {
+				kept = append(kept, it)
+			}
+		}
+		out = kept
+	}
+	sortItems(out)
+	return out
+}
+
+// combineGauge folds next into the folded gauge item prev and reports whether one item can
+// express both writes.
+func combineGauge(prev *Metrics, next Metrics) bool {
+	prevOp, nextOp := prev.Op.Effective(), next.Op.Effective()
+	v := *next.Value
+	switch {
+	case nextOp == GaugeSet:
+	case prevOp == GaugeSet, prevOp == nextOp:
+		v = nextOp.Apply(*prev.Value, v)
+	default:
+		return false
+	}
+	if nextOp == GaugeSet {
+		prev.Op = ""
+	}
+	prev.Value = &v
+	return true
+}
+
+// opOf drops an explicit GaugeSet, so folded sets look like plain gauge writes.
+func opOf(op GaugeOp) GaugeOp {
+	if op.Effective() == GaugeSet {
+		return ""
+	}
+	return op
+}
+
+// sortItems sorts by ID and then type, keeping the runs of a gauge in batch order.
+func sortItems(items []Metrics) {
+	slices.SortStableFunc(items, func(a, b Metrics) int {
+		if c := strings.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.MType, b.MType)
+	})
 }
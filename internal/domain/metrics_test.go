@@ -0,0 +1,109 @@
+package domain
+
+import "testing"
+
+func TestFold(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	d := func(v int64) *int64 { return &v }
+	in := []Metrics{
+		{ID: "b", MType: string(Counter), Delta: d(2)},
+		{ID: "a", MType: string(Gauge), Value: f(1)},
+		{ID: "b", MType: string(Counter), Delta: d(3)},
+		{ID: "a", MType: string(Gauge), Value: f(4)},
+		{ID: "a", MType: string(Counter), Delta: d(1)},
+		{ID: "c", MType: string(Gauge)},
+		{ID: "d", MType: "histogram", Value: f(1)},
+	}
+	got := Fold(in)
+	if len(got) != 3 {
+		t.Fatalf("want 3 items, got %+v", got)
+	}
+	if got[0].ID != "a" || got[0].MType != string(Counter) || *got[0].Delta != 1 {
+		t.Fatalf("item 0: %+v", got[0])
+	}
+	if got[1].ID != "a" || got[1].MType != string(Gauge) || *got[1].Value != 4 {
+		t.Fatalf("item 1: %+v", got[1])
+	}
+	if got[2].ID != "b" || *got[2].Delta != 5 {
+		t.Fatalf("item 2: %+v", got[2])
+	}
+	if *in[0].Delta != 2 {
+		t.Fatal("input must not be modified")
+	}
+}
+
+func TestFold_GaugeOps(t *testing.T) {
+	g := func(v float64, op GaugeOp) Metrics {
+		return Metrics{ID: "g", MType: string(Gauge), Value: &v, Op: op}
+	}
+	type want struct {
+		op GaugeOp
+		v  float64
+	}
+	tests := []struct {
+		name string
+		in   []Metrics
+		want []want
+	}{
+		{"set absorbs earlier writes", []Metrics{g(1, GaugeAdd), g(5, GaugeMax), g(2, GaugeSet)}, []want{{"", 2}}},
+		{"writes after a set are computed", []Metrics{g(1, ""), g(2, GaugeAdd), g(10, GaugeMax), g(4, GaugeMin)}, []want{{"", 4}}},
+		{"adds sum up", []Metrics{g(1, GaugeAdd), g(2.5, GaugeAdd)}, []want{{GaugeAdd, 3.5}}},
+		{"maxes combine", []Metrics{g(3, GaugeMax), g(1, GaugeMax)}, []want{{GaugeMax, 3}}},
+		{"mins combine", []Metrics{g(3, GaugeMin), g(1, GaugeMin)}, []want{{GaugeMin, 1}}},
+		{"mixed operations keep their runs", []Metrics{g(1, GaugeAdd), g(2, GaugeAdd), g(5, GaugeMax), g(1, GaugeAdd)}, []want{{GaugeAdd, 3}, {GaugeMax, 5}, {GaugeAdd, 1}}},
+		{"unknown operations are dropped", []Metrics{g(1, "mul"), g(2, GaugeAdd)}, []want{{GaugeAdd, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Fold(append(tt.in, Metrics{ID: "a", MType: string(Gauge), Value: new(float64)}))
+			if len(got) != len(tt.want)+1 || got[0].ID != "a" {
+				t.Fatalf("want %d runs after gauge a, got %+v", len(tt.want), got)
+			}
+			for i, w := range tt.want {
+				if it := got[i+1]; it.Op != w.op || *it.Value != w.v {
+					t.Fatalf("run %d: want %s %v, got %s %v", i, w.op, w.v, it.Op, *it.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestGaugeOp(t *testing.T) {
+	tests := []struct {
+		op    GaugeOp
+		want  float64
+		valid bool
+	}{
+		{"", 3, true},
+		{GaugeSet, 3, true},
+		{GaugeAdd, 5, true},
+		{GaugeMax, 3, true},
+		{GaugeMin, 2, true},
+		{"mul", 3, false},
+	}
+	for _, tt := range tests {
+		if got := tt.op.Apply(2, 3); got != tt.want || tt.op.Valid() != tt.valid {
+			t.Fatalf("%q: Apply(2, 3) = %v, Valid = %v", tt.op, got, tt.op.Valid())
+		}
+	}
+}
+
+func TestSnapshotItems(t *testing.T) {
+	s := Snapshot{
+		Gauges:   map[string]float64{"b": 2, "a": 1},
+		Counters: map[string]int64{"a": 3},
+	}
+	got := s.Items()
+	if len(got) != 3 {
+		t.Fatalf("want 3 items, got %+v", got)
+	}
+	if got[0].ID != "a" || got[0].MType != string(Counter) || *got[0].Delta != 3 {
+		t.Fatalf("item 0: %+v", got[0])
+	}
+	if got[1].ID != "a" || got[1].MType != string(Gauge) || *got[1].Value != 1 {
+		t.Fatalf("item 1: %+v", got[1])
+	}
+	if got[2].ID != "b" || *got[2].Value != 2 {
+		t.Fatalf("item 2: %+v", got[2])
+	}
+}
@@ -0,0 +1,95 @@
+package misc
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState reports whether a Breaker lets calls through.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects calls until the cooldown elapses.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through.
+	BreakerHalfOpen
+)
+
+// String returns the lowercase state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a minimal circuit breaker: it opens after a run of consecutive failures
+// and allows one probe once the cooldown has passed.
+type Breaker struct {
+	now       func() time.Time
+	openedAt  time.Time
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     BreakerState
+	mu        sync.Mutex
+}
+
+// NewBreaker returns a Breaker that opens after threshold consecutive failures.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a call may proceed, moving an expired open breaker to half-open.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// Success records a successful call and closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = BreakerClosed
+}
+
+// Failure records a failed call, opening the breaker when the threshold is reached
+// or when a half-open probe fails.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// State returns the current breaker state.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,43 @@
+package misc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	clock := time.Unix(0, 0)
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return clock }
+
+	if !b.Allow() {
+		t.Fatal("closed breaker must allow calls")
+	}
+	b.Failure()
+	if b.State() != BreakerClosed {
+		t.Fatalf("state=%v after one failure, want closed", b.State())
+	}
+	b.Failure()
+	if b.State() != BreakerOpen || b.Allow() {
+		t.Fatalf("state=%v, want open and rejecting", b.State())
+	}
+
+	clock = clock.Add(time.Minute)
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatalf("state=%v, want a half-open probe after cooldown", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker must allow a single probe only")
+	}
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Fatalf("failed probe must reopen, state=%v", b.State())
+	}
+
+	clock = clock.Add(time.Minute)
+	b.Allow()
+	b.Success()
+	if b.State() != BreakerClosed || !b.Allow() {
+		t.Fatalf("successful probe must close, state=%v", b.State())
+	}
+}
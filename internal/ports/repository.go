@@ -6,15 +6,38 @@ import (
 	"github.com/vshulcz/Golectra/internal/domain"
 )
 
+// AnyRevision makes CompareAndSetGauge write without comparing revisions.
+const AnyRevision int64 = -1
+
 // MetricsRepo persists gauge and counter values and supports querying snapshots.
+// Every write bumps a monotonically increasing store revision. AddCounter returns the
+// counter total its own delta produced, read atomically with the write.
+//
+// Each gauge carries the store revision of its last write. CompareAndSetGauge stores a gauge
+// only while it is still at the expected revision, zero meaning it does not exist yet, and
+// returns what its own write did; otherwise it fails with domain.ErrRevisionMismatch and
+// changes nothing. The comparison and the write are atomic.
+//
+// ApplyGauge combines a value with the stored gauge using a domain.GaugeOp and returns what
+// the write did; UpdateMany applies the operations of its items. The stored value is read
+// and written in one atomic step, so the value a write reports replacing is the one it
+// combined with. An unknown operation fails with domain.ErrInvalidType.
+//
+// UpdateMany returns the values the batch's metrics held right before it, read atomically
+// with the batch; metrics the batch created are missing from it and its Revision is unset.
 type MetricsRepo interface {
 	GetGauge(ctx context.Context, name string) (float64, error)
+	GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error)
 	GetCounter(ctx context.Context, name string) (int64, error)
 	SetGauge(ctx context.Context, name string, value float64) error
-	AddCounter(ctx context.Context, name string, delta int64) error
-	UpdateMany(ctx context.Context, items []domain.Metrics) error
+	CompareAndSetGauge(ctx context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error)
+	ApplyGauge(ctx context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error)
+	AddCounter(ctx context.Context, name string, delta int64) (int64, error)
+	UpdateMany(ctx context.Context, items []domain.Metrics) (domain.Snapshot, error)
 
 	Snapshot(ctx context.Context) (domain.Snapshot, error)
+	SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error)
+	Revision(ctx context.Context) (int64, error)
 	Ping(ctx context.Context) error
 }
 
@@ -4,18 +4,39 @@ import "context"
 
 type ctxKey string
 
-const clientIPKey ctxKey = "audit_client_ip"
+const requestMetaKey ctxKey = "audit_request_meta"
+
+// RequestMeta identifies the caller behind an audited operation.
+type RequestMeta struct {
+	IPAddress string
+	RequestID string
+	UserAgent string
+	Actor     string
+	TraceID   string
+}
+
+// WithRequestMeta stores caller details inside the context for later audit fan-out.
+func WithRequestMeta(ctx context.Context, meta RequestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey, meta)
+}
+
+// RequestMetaFromContext extracts the stored caller details, returning a zero value when missing.
+func RequestMetaFromContext(ctx context.Context) RequestMeta {
+	if ctx == nil {
+		return RequestMeta{}
+	}
+	v, _ := ctx.Value(requestMetaKey).(RequestMeta)
+	return v
+}
 
 // WithClientIP stores the originating request IP inside the context for later audit fan-out.
 func WithClientIP(ctx context.Context, ip string) context.Context {
-	return context.WithValue(ctx, clientIPKey, ip)
+	meta := RequestMetaFromContext(ctx)
+	meta.IPAddress = ip
+	return WithRequestMeta(ctx, meta)
 }
 
 // ClientIPFromContext extracts the stored client IP, returning an empty string when missing.
 func ClientIPFromContext(ctx context.Context) string {
-	if ctx == nil {
-		return ""
-	}
-	v, _ := ctx.Value(clientIPKey).(string)
-	return v
+	return RequestMetaFromContext(ctx).IPAddress
 }
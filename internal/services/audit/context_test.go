@@ -16,3 +16,13 @@ func TestWithClientIP(t *testing.T) {
 		t.Fatalf("expected empty ip, got %q", got)
 	}
 }
+
+func TestWithRequestMeta(t *testing.T) {
+	ctx := WithRequestMeta(context.Background(), RequestMeta{RequestID: "r1", Actor: "agent:a"})
+	ctx = WithClientIP(ctx, "10.0.0.1")
+
+	got := RequestMetaFromContext(ctx)
+	if got.RequestID != "r1" || got.Actor != "agent:a" || got.IPAddress != "10.0.0.1" {
+		t.Fatalf("RequestMetaFromContext returned %+v", got)
+	}
+}
@@ -1,8 +1,74 @@
 package audit
 
-// Event describes which metrics changed, when, and from which IP address.
+// SchemaVersion identifies the layout of Event emitted to audit sinks.
+const SchemaVersion = 4
+
+// Operation names the kind of action that produced an audit event.
+type Operation string
+
+const (
+	// OpUpsert marks a single-metric write.
+	OpUpsert Operation = "upsert"
+	// OpBatch marks a multi-metric write.
+	OpBatch Operation = "batch"
+	// OpRead marks a read, recorded only when read auditing is enabled.
+	OpRead Operation = "read"
+)
+
+// Outcome reports whether the audited operation succeeded.
+type Outcome string
+
+const (
+	// OutcomeSuccess marks an operation that completed.
+	OutcomeSuccess Outcome = "success"
+	// OutcomeFailure marks an operation that was rejected or failed in storage.
+	OutcomeFailure Outcome = "failure"
+)
+
+// Event describes which metrics changed, how, when, and who requested the change.
+// RequestID, UserAgent and Actor are copied from request headers, capped in length but
+// not authenticated; Actor values carry an "unverified-" prefix to say so.
 type Event struct {
-	Timestamp int64    `json:"ts"`
-	Metrics   []string `json:"metrics"`
-	IPAddress string   `json:"ip_address"`
+	Version   int       `json:"version"`
+	Timestamp int64     `json:"ts"`
+	Operation Operation `json:"operation"`
+	Outcome   Outcome   `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Metrics   []string  `json:"metrics"`
+	Changes   []Change  `json:"changes,omitempty"`
+	IPAddress string    `json:"ip_address"`
+	RequestID string    `json:"request_id,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+}
+
+// Change captures what one write did to a metric, as reported by the write itself.
+// Gauges carry the value before the write in OldValue, absent when the write created the
+// gauge, and the value it left in NewValue; when any of the writes to the gauge combined
+// with the stored value rather than replacing it, Ops lists all of them in order. Counters
+// carry the applied Delta and the totals around it in OldDelta and NewDelta.
+type Change struct {
+	OldValue *float64    `json:"old_value,omitempty"`
+	NewValue *float64    `json:"new_value,omitempty"`
+	Ops      []GaugeStep `json:"ops,omitempty"`
+	OldDelta *int64      `json:"old_delta,omitempty"`
+	Delta    *int64      `json:"delta,omitempty"`
+	NewDelta *int64      `json:"new_delta,omitempty"`
+	ID       string      `json:"id"`
+	MType    string      `json:"type"`
+}
+
+// GaugeStep is one gauge write of a Change: its operation and the value it wrote.
+type GaugeStep struct {
+	Op      string  `json:"op"`
+	Operand float64 `json:"operand"`
+}
+
+// Versioned returns the event with Version populated, defaulting to SchemaVersion.
+func (e Event) Versioned() Event {
+	if e.Version == 0 {
+		e.Version = SchemaVersion
+	}
+	return e
 }
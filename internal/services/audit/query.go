@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultQueryLimit caps a page when Query.Limit is unset.
+	DefaultQueryLimit = 100
+	// MaxQueryLimit is the largest page a Reader returns.
+	MaxQueryLimit = 1000
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded.
+var ErrInvalidCursor = errors.New("invalid audit cursor")
+
+// Query filters recorded audit events. Zero-valued fields match everything;
+// From and To are inclusive Unix seconds.
+type Query struct {
+	Metric string
+	IP     string
+	Cursor string
+	From   int64
+	To     int64
+	Limit  int
+}
+
+// Page is one slice of matching events in recording order.
+type Page struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Reader reads back recorded audit events.
+type Reader interface {
+	Query(ctx context.Context, q Query) (Page, error)
+}
+
+// Normalized clamps Limit into [1, MaxQueryLimit], defaulting to DefaultQueryLimit.
+func (q Query) Normalized() Query {
+	switch {
+	case q.Limit <= 0:
+		q.Limit = DefaultQueryLimit
+	case q.Limit > MaxQueryLimit:
+		q.Limit = MaxQueryLimit
+	}
+	return q
+}
+
+// Matches reports whether evt satisfies the metric, IP and time filters.
+func (q Query) Matches(evt Event) bool {
+	if q.From > 0 && evt.Timestamp < q.From {
+		return false
+	}
+	if q.To > 0 && evt.Timestamp > q.To {
+		return false
+	}
+	if q.IP != "" && evt.IPAddress != q.IP {
+		return false
+	}
+	return q.Metric == "" || slices.Contains(evt.Metrics, q.Metric)
+}
+
+// Position is where a page ended inside a Reader: an optional segment key
+// (for example, which log file) and an offset or row ID within it.
+type Position struct {
+	Segment string
+	Offset  int64
+}
+
+// EncodeCursor turns a position into an opaque cursor string.
+func EncodeCursor(p Position) string {
+	raw := p.Segment + ":" + strconv.FormatInt(p.Offset, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a cursor produced by EncodeCursor; an empty cursor is the zero position.
+func DecodeCursor(s string) (Position, error) {
+	if s == "" {
+		return Position{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Position{}, ErrInvalidCursor
+	}
+	i := strings.LastIndexByte(string(raw), ':')
+	if i < 0 {
+		return Position{}, ErrInvalidCursor
+	}
+	off, err := strconv.ParseInt(string(raw[i+1:]), 10, 64)
+	if err != nil || off < 0 {
+		return Position{}, fmt.Errorf("%w: %q", ErrInvalidCursor, s)
+	}
+	return Position{Segment: string(raw[:i]), Offset: off}, nil
+}
@@ -0,0 +1,398 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what a Queue does with an event when it is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits up to QueueConfig.BlockTimeout for space, then drops the event.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest discards the incoming event.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest queued event to make room.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowSpill appends events to a file in QueueConfig.SpillDir and replays them once the queue drains.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// DefaultQueueSize is the number of events buffered per observer when QueueConfig.Size is unset.
+const DefaultQueueSize = 128
+
+// dropReportInterval spaces out drop reports: drops come in bursts exactly when the
+// system is overloaded, and one log line per event would only add to the load.
+const dropReportInterval = 10 * time.Second
+
+// ErrQueueFull is passed to the error handler, at most once per dropReportInterval, when
+// events were dropped by the overflow policy.
+var ErrQueueFull = errors.New("audit queue full")
+
+var errQueueClosed = errors.New("audit queue closed")
+
+// ParseOverflowPolicy maps "block", "drop_newest", "drop_oldest" or "spill" to an OverflowPolicy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	p := OverflowPolicy(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), "-", "_"))
+	switch p {
+	case "":
+		return OverflowDropNewest, nil
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowSpill:
+		return p, nil
+	default:
+		return OverflowDropNewest, fmt.Errorf("unknown audit overflow policy %q", s)
+	}
+}
+
+// QueueConfig sizes a Queue and selects its overflow behavior.
+type QueueConfig struct {
+	Policy       OverflowPolicy
+	SpillDir     string
+	Size         int
+	BlockTimeout time.Duration
+}
+
+// QueueStats is a point-in-time view of one observer queue.
+type QueueStats struct {
+	Queued    int   `json:"queued"`
+	Spilled   int   `json:"spilled"`
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+type queuedEvent struct {
+	ctx context.Context
+	evt Event
+}
+
+// Queue decouples one observer from publishers: Notify only enqueues and a dedicated
+// worker delivers events to the wrapped observer, so a slow sink never stalls the others.
+type Queue struct {
+	obs       Observer
+	onError   atomic.Pointer[func(error)]
+	now       func() time.Time
+	ch        chan queuedEvent
+	stop      chan struct{}
+	done      chan struct{}
+	spillPath string
+	cfg       QueueConfig
+
+	mu      sync.Mutex
+	closed  bool
+	pending int // events waiting in the spill file
+
+	delivered atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+	// reported is the dropped count at the last drop report, made at lastReport (UnixNano).
+	reported   atomic.Int64
+	lastReport atomic.Int64
+}
+
+// NewQueue starts a worker that forwards queued events to obs.
+// With OverflowSpill, events left in the spill file by a previous run are replayed first.
+func NewQueue(name string, obs Observer, cfg QueueConfig) (*Queue, error) {
+	if obs == nil {
+		return nil, errors.New("audit queue observer is nil")
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultQueueSize
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = OverflowDropNewest
+	}
+	q := &Queue{
+		obs:  obs,
+		now:  time.Now,
+		cfg:  cfg,
+		ch:   make(chan queuedEvent, cfg.Size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if cfg.Policy == OverflowSpill {
+		if cfg.SpillDir == "" {
+			return nil, errors.New("audit spill policy requires a spill directory")
+		}
+		if err := os.MkdirAll(cfg.SpillDir, 0o750); err != nil {
+			return nil, fmt.Errorf("mkdir audit spill dir: %w", err)
+		}
+		q.spillPath = filepath.Join(cfg.SpillDir, name+".spill.ndjson")
+		if err := recoverReplay(q.spillPath); err != nil {
+			return nil, err
+		}
+		if n, err := countLines(q.spillPath); err == nil {
+			q.pending = n
+		}
+	}
+	go q.run()
+	return q, nil
+}
+
+// SetErrorHandler configures a callback for delivery failures of the wrapped observer and
+// for rate-limited reports of dropped events.
+func (q *Queue) SetErrorHandler(fn func(error)) {
+	q.onError.Store(&fn)
+}
+
+// Notify enqueues the event according to the overflow policy. Dropped events are not
+// returned as errors: they are counted in Stats and reported to the error handler at
+// most once per dropReportInterval, so sustained overflow does not flood the logs.
+// The caller's context is detached from cancellation so request-scoped contexts stay usable by the worker.
+func (q *Queue) Notify(ctx context.Context, evt Event) error {
+	if q == nil {
+		return nil
+	}
+	item := queuedEvent{ctx: context.WithoutCancel(ctx), evt: evt}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errQueueClosed
+	}
+	if q.pending > 0 {
+		// Keep order: once events spill, later ones follow them to disk.
+		err := q.spillLocked(evt)
+		q.mu.Unlock()
+		q.dropOnError(err)
+		return nil
+	}
+	select {
+	case q.ch <- item:
+		q.mu.Unlock()
+		return nil
+	default:
+	}
+
+	switch q.cfg.Policy {
+	case OverflowSpill:
+		err := q.spillLocked(evt)
+		q.mu.Unlock()
+		q.dropOnError(err)
+		return nil
+	case OverflowDropOldest:
+		defer q.mu.Unlock()
+		for {
+			select {
+			case q.ch <- item:
+				return nil
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.drop(errors.New("dropped oldest event"))
+			default:
+			}
+		}
+	case OverflowBlock:
+		q.mu.Unlock()
+		return q.enqueueWait(item)
+	default:
+		q.mu.Unlock()
+		q.drop(errors.New("dropped newest event"))
+		return nil
+	}
+}
+
+func (q *Queue) enqueueWait(item queuedEvent) error {
+	timer := time.NewTimer(q.cfg.BlockTimeout)
+	defer timer.Stop()
+	select {
+	case q.ch <- item:
+		return nil
+	case <-timer.C:
+		q.drop(fmt.Errorf("timed out after %v", q.cfg.BlockTimeout))
+		return nil
+	case <-q.stop:
+		return errQueueClosed
+	}
+}
+
+// Close stops accepting events and waits until queued events were handed to the observer.
+// Spilled events that were not replayed yet stay on disk for the next start.
+func (q *Queue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		<-q.done
+		return nil
+	}
+	q.closed = true
+	close(q.stop)
+	q.mu.Unlock()
+	<-q.done
+	return nil
+}
+
+// Stats reports queue depth and delivery counters.
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	spilled := q.pending
+	q.mu.Unlock()
+	return QueueStats{
+		Queued:    len(q.ch),
+		Spilled:   spilled,
+		Delivered: q.delivered.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case item := <-q.ch:
+			q.deliver(item.ctx, item.evt)
+			continue
+		default:
+		}
+		if q.replaySpill() {
+			continue
+		}
+		select {
+		case item := <-q.ch:
+			q.deliver(item.ctx, item.evt)
+		case <-q.stop:
+			for {
+				select {
+				case item := <-q.ch:
+					q.deliver(item.ctx, item.evt)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *Queue) deliver(ctx context.Context, evt Event) {
+	if err := q.obs.Notify(ctx, evt); err != nil {
+		q.failed.Add(1)
+		q.report(err)
+		return
+	}
+	q.delivered.Add(1)
+}
+
+func (q *Queue) report(err error) {
+	if fn := q.onError.Load(); fn != nil && *fn != nil {
+		(*fn)(err)
+	}
+}
+
+// drop counts a dropped event and reports the drops since the last report, unless one was
+// made within dropReportInterval.
+func (q *Queue) drop(reason error) {
+	total := q.dropped.Add(1)
+	now := q.now().UnixNano()
+	last := q.lastReport.Load()
+	if last != 0 && now-last < int64(dropReportInterval) {
+		return
+	}
+	if !q.lastReport.CompareAndSwap(last, now) {
+		return
+	}
+	n := total - q.reported.Swap(total)
+	q.report(fmt.Errorf("%w: %d events dropped since the last report, latest: %w", ErrQueueFull, n, reason))
+}
+
+func (q *Queue) dropOnError(err error) {
+	if err != nil {
+		q.drop(err)
+	}
+}
+
+func (q *Queue) spillLocked(evt Event) error {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("marshal audit spill: %w", err)
+	}
+	f, err := os.OpenFile(q.spillPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit spill: %w", err)
+	}
+	_, werr := f.Write(append(payload, '\n'))
+	cerr := f.Close()
+	if werr != nil || cerr != nil {
+		return fmt.Errorf("write audit spill: %w", errors.Join(werr, cerr))
+	}
+	q.pending++
+	return nil
+}
+
+// replaySpill moves the spill file aside and delivers its events in order.
+// It reports whether anything was replayed. Replay is skipped once the queue is closing.
+func (q *Queue) replaySpill() bool {
+	q.mu.Lock()
+	if q.pending == 0 || q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	replay := q.spillPath + ".replay"
+	if err := os.Rename(q.spillPath, replay); err != nil {
+		q.mu.Unlock()
+		return false
+	}
+	q.pending = 0
+	q.mu.Unlock()
+
+	f, err := os.Open(replay)
+	if err != nil {
+		return false
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for sc.Scan() {
+		var evt Event
+		if err := json.Unmarshal(sc.Bytes(), &evt); err != nil {
+			q.drop(fmt.Errorf("decode audit spill: %w", err))
+			continue
+		}
+		q.deliver(context.Background(), evt)
+	}
+	_ = f.Close()
+	_ = os.Remove(replay)
+	return true
+}
+
+// recoverReplay puts events from an interrupted replay back in front of the spill file.
+func recoverReplay(spillPath string) error {
+	replay := spillPath + ".replay"
+	head, err := os.ReadFile(replay)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read audit replay: %w", err)
+	}
+	tail, err := os.ReadFile(spillPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read audit spill: %w", err)
+	}
+	if err := os.WriteFile(spillPath, append(head, tail...), 0o600); err != nil {
+		return fmt.Errorf("restore audit spill: %w", err)
+	}
+	return os.Remove(replay)
+}
+
+func countLines(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strings.Count(string(data), "\n"), nil
+}
@@ -0,0 +1,264 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedObserver blocks every Notify until release is closed and records timestamps in order.
+type gatedObserver struct {
+	release chan struct{}
+	mu      sync.Mutex
+	got     []int64
+}
+
+func newGatedObserver() *gatedObserver {
+	return &gatedObserver{release: make(chan struct{})}
+}
+
+func (o *gatedObserver) Notify(_ context.Context, evt Event) error {
+	<-o.release
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.got = append(o.got, evt.Timestamp)
+	return nil
+}
+
+func (o *gatedObserver) Got() []int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]int64(nil), o.got...)
+}
+
+// fill pushes events 1..n; the first one is taken by the blocked worker, the rest fill the buffer.
+func fill(t *testing.T, q *Queue, n int) []error {
+	t.Helper()
+	errs := make([]error, 0, n)
+	for ts := 1; ts <= n; ts++ {
+		errs = append(errs, q.Notify(context.Background(), Event{Timestamp: int64(ts)}))
+		if ts == 1 {
+			waitQueued(t, q, 0)
+		}
+	}
+	return errs
+}
+
+func waitQueued(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for q.Stats().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth did not reach %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueue_OverflowPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         QueueConfig
+		want        []int64
+		wantDropped int64
+	}{
+		{
+			name:        "drop newest",
+			cfg:         QueueConfig{Size: 2, Policy: OverflowDropNewest},
+			want:        []int64{1, 2, 3},
+			wantDropped: 2,
+		},
+		{
+			name:        "drop oldest",
+			cfg:         QueueConfig{Size: 2, Policy: OverflowDropOldest},
+			want:        []int64{1, 4, 5},
+			wantDropped: 2,
+		},
+		{
+			name:        "block with timeout",
+			cfg:         QueueConfig{Size: 2, Policy: OverflowBlock, BlockTimeout: 5 * time.Millisecond},
+			want:        []int64{1, 2, 3},
+			wantDropped: 2,
+		},
+		{
+			name: "spill",
+			cfg:  QueueConfig{Size: 2, Policy: OverflowSpill},
+			want: []int64{1, 2, 3, 4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cfg.Policy == OverflowSpill {
+				tt.cfg.SpillDir = t.TempDir()
+			}
+			obs := newGatedObserver()
+			q, err := NewQueue("sink", obs, tt.cfg)
+			if err != nil {
+				t.Fatalf("NewQueue: %v", err)
+			}
+			var reports []error
+			q.SetErrorHandler(func(err error) { reports = append(reports, err) })
+
+			for _, err := range fill(t, q, 5) {
+				if err != nil {
+					t.Fatalf("Notify must not return drops, got %v", err)
+				}
+			}
+			wantReports := 0
+			if tt.wantDropped > 0 {
+				wantReports = 1
+			}
+			if len(reports) != wantReports || (wantReports > 0 && !errors.Is(reports[0], ErrQueueFull)) {
+				t.Fatalf("want %d rate-limited ErrQueueFull report, got %v", wantReports, reports)
+			}
+			if st := q.Stats(); st.Dropped != tt.wantDropped {
+				t.Fatalf("want %d dropped, got %+v", tt.wantDropped, st)
+			}
+
+			close(obs.release)
+			deadline := time.Now().Add(time.Second)
+			for len(obs.Got()) < len(tt.want) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if err := q.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			got := obs.Got()
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("want %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQueue_SpillSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	obs := newGatedObserver()
+	q, err := NewQueue("sink", obs, QueueConfig{Size: 1, Policy: OverflowSpill, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	fill(t, q, 4)
+	if st := q.Stats(); st.Spilled != 2 {
+		t.Fatalf("want 2 spilled events, got %+v", st)
+	}
+	closed := make(chan struct{})
+	go func() {
+		_ = q.Close()
+		close(closed)
+	}()
+	for {
+		q.mu.Lock()
+		stopping := q.closed
+		q.mu.Unlock()
+		if stopping {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(obs.release)
+	<-closed
+
+	next := newGatedObserver()
+	close(next.release)
+	q, err = NewQueue("sink", next, QueueConfig{Size: 1, Policy: OverflowSpill, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(next.Got()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := next.Got(); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Fatalf("want spilled events 3,4 replayed, got %v", got)
+	}
+}
+
+func TestQueue_SlowObserverDoesNotStallOthers(t *testing.T) {
+	slow := newGatedObserver()
+	defer close(slow.release)
+	fast := newGatedObserver()
+	close(fast.release)
+
+	slowQ, err := NewQueue("slow", slow, QueueConfig{Size: 1})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	fastQ, err := NewQueue("fast", fast, QueueConfig{Size: 1})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	s := NewSubject(slowQ, fastQ)
+
+	for ts := int64(1); ts <= 10; ts++ {
+		s.Publish(context.Background(), Event{Timestamp: ts})
+		time.Sleep(time.Millisecond)
+	}
+	if err := fastQ.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := fast.Got(); len(got) != 10 {
+		t.Fatalf("fast sink must receive every event, got %v", got)
+	}
+	if slowQ.Stats().Dropped == 0 {
+		t.Fatal("slow sink should have dropped events")
+	}
+}
+
+func TestQueue_DropReportsAreRateLimited(t *testing.T) {
+	obs := newGatedObserver()
+	defer close(obs.release)
+	q, err := NewQueue("sink", obs, QueueConfig{Size: 1})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	q.now = func() time.Time { return now }
+	var reports []error
+	q.SetErrorHandler(func(err error) { reports = append(reports, err) })
+
+	fill(t, q, 2)
+	for ts := int64(3); ts <= 10; ts++ {
+		_ = q.Notify(context.Background(), Event{Timestamp: ts})
+	}
+	if len(reports) != 1 {
+		t.Fatalf("want a single report for a burst of drops, got %v", reports)
+	}
+	now = now.Add(dropReportInterval)
+	_ = q.Notify(context.Background(), Event{Timestamp: 11})
+	if len(reports) != 2 || !strings.Contains(reports[1].Error(), "8 events dropped") {
+		t.Fatalf("want the drops since the first report summed up, got %v", reports)
+	}
+	if st := q.Stats(); st.Dropped != 9 {
+		t.Fatalf("want every drop counted, got %+v", st)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for in, want := range map[string]OverflowPolicy{
+		"":            OverflowDropNewest,
+		"block":       OverflowBlock,
+		"drop-oldest": OverflowDropOldest,
+		"DROP_NEWEST": OverflowDropNewest,
+		"spill":       OverflowSpill,
+	} {
+		got, err := ParseOverflowPolicy(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseOverflowPolicy(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseOverflowPolicy("sometimes"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,266 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+)
+
+// Rule selects the audit events a sink receives. Every criterion that is set must match;
+// an empty Rule matches everything. Metrics and Types narrow an event to the matching
+// metrics, so a batch touching several metrics reaches the sink with only the matching ones.
+type Rule struct {
+	// Metrics lists path.Match patterns for metric names, e.g. "billing.*".
+	Metrics []string `json:"metrics,omitempty"`
+	// Types lists metric types ("gauge", "counter") as recorded in Event.Changes.
+	Types []string `json:"types,omitempty"`
+	// IPs lists client addresses or CIDR prefixes.
+	IPs []string `json:"ips,omitempty"`
+	// Operations lists the operations to keep.
+	Operations []Operation `json:"operations,omitempty"`
+	// Sample keeps this fraction of the matching events; 0 means 1.
+	Sample float64 `json:"sample,omitempty"`
+
+	prefixes []netip.Prefix
+}
+
+// Routes maps a sink name to its rules. A sink without an entry receives every event;
+// a sink with an empty list receives none. An event goes to a sink when any of its rules match.
+type Routes map[string][]Rule
+
+// ParseRoutes decodes and validates routes written as JSON, for example
+// {"remote": [{"metrics": ["billing.*"], "types": ["counter"]}]}.
+func ParseRoutes(data []byte) (Routes, error) {
+	var routes Routes
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("decode audit routes: %w", err)
+	}
+	for sink, rules := range routes {
+		for i := range rules {
+			if err := rules[i].compile(); err != nil {
+				return nil, fmt.Errorf("audit route %s[%d]: %w", sink, i, err)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// LoadRoutes reads routes from a JSON file.
+func LoadRoutes(name string) (Routes, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read audit routes: %w", err)
+	}
+	return ParseRoutes(data)
+}
+
+func (r *Rule) compile() error {
+	for _, p := range r.Metrics {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad metric pattern %q: %w", p, err)
+		}
+	}
+	for _, t := range r.Types {
+		if t != "gauge" && t != "counter" {
+			return fmt.Errorf("unknown metric type %q", t)
+		}
+	}
+	for _, op := range r.Operations {
+		switch op {
+		case OpUpsert, OpBatch, OpRead:
+		default:
+			return fmt.Errorf("unknown operation %q", op)
+		}
+	}
+	if r.Sample < 0 || r.Sample > 1 {
+		return fmt.Errorf("sample must be within [0, 1], got %v", r.Sample)
+	}
+	for _, s := range r.IPs {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			r.prefixes = append(r.prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return fmt.Errorf("bad ip or cidr %q", s)
+		}
+		r.prefixes = append(r.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return nil
+}
+
+// matchEvent checks the event-level criteria: operation and client address.
+func (r *Rule) matchEvent(evt Event) bool {
+	if len(r.Operations) > 0 && !slices.Contains(r.Operations, evt.Operation) {
+		return false
+	}
+	if len(r.prefixes) > 0 {
+		addr, err := netip.ParseAddr(evt.IPAddress)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(r.prefixes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// metricKey identifies a metric by name and type: a gauge and a counter may share a name.
+type metricKey struct {
+	id, mType string
+}
+
+// matchMetric checks one metric against the name patterns and the type. Metrics named
+// without a change have no known type and never match a type filter.
+func (r *Rule) matchMetric(k metricKey) bool {
+	if len(r.Metrics) > 0 && !slices.ContainsFunc(r.Metrics, func(p string) bool {
+		ok, _ := path.Match(p, k.id)
+		return ok
+	}) {
+		return false
+	}
+	return len(r.Types) == 0 || slices.Contains(r.Types, k.mType)
+}
+
+// eventMetrics lists the metrics of evt by name and type: one per change, plus the
+// names in evt.Metrics that no change describes.
+func eventMetrics(evt Event) []metricKey {
+	keys := make([]metricKey, 0, len(evt.Metrics))
+	described := make(map[string]bool, len(evt.Changes))
+	for _, c := range evt.Changes {
+		keys = append(keys, metricKey{c.ID, c.MType})
+		described[c.ID] = true
+	}
+	for _, m := range evt.Metrics {
+		if !described[m] {
+			keys = append(keys, metricKey{id: m})
+		}
+	}
+	return keys
+}
+
+func (r *Rule) sampled(roll func() float64) bool {
+	return r.Sample == 0 || r.Sample == 1 || roll() < r.Sample
+}
+
+// route applies rules to evt. It returns the event to deliver, narrowed to the matching
+// metrics when rules filter by metric, and false when no rule lets it through.
+func route(rules []Rule, evt Event, roll func() float64) (Event, bool) {
+	var metrics []metricKey
+	keep := make(map[metricKey]bool)
+	whole := false
+	for i := range rules {
+		r := &rules[i]
+		if !r.matchEvent(evt) {
+			continue
+		}
+		if len(r.Metrics) == 0 && len(r.Types) == 0 {
+			if r.sampled(roll) {
+				whole = true
+			}
+			continue
+		}
+		if metrics == nil {
+			metrics = eventMetrics(evt)
+		}
+		var matched []metricKey
+		for _, k := range metrics {
+			if !keep[k] && r.matchMetric(k) {
+				matched = append(matched, k)
+			}
+		}
+		if len(matched) > 0 && r.sampled(roll) {
+			for _, k := range matched {
+				keep[k] = true
+			}
+		}
+	}
+	if whole {
+		return evt, true
+	}
+	if len(keep) == 0 {
+		return evt, false
+	}
+
+	names := make(map[string]bool, len(keep))
+	for k := range keep {
+		names[k.id] = true
+	}
+	narrowed := evt
+	narrowed.Metrics = make([]string, 0, len(names))
+	for _, m := range evt.Metrics {
+		if names[m] {
+			narrowed.Metrics = append(narrowed.Metrics, m)
+		}
+	}
+	narrowed.Changes = nil
+	for _, c := range evt.Changes {
+		if keep[metricKey{c.ID, c.MType}] {
+			narrowed.Changes = append(narrowed.Changes, c)
+		}
+	}
+	return narrowed, true
+}
+
+// Router forwards to one observer the events its rules select. Rules can be swapped
+// at runtime with SetRules, so routing is reloadable without restarting the sinks.
+type Router struct {
+	obs      Observer
+	rules    atomic.Pointer[[]Rule]
+	roll     func() float64
+	filtered atomic.Int64
+}
+
+// NewRouter wraps obs with rules; nil rules forward every event.
+func NewRouter(obs Observer, rules []Rule) (*Router, error) {
+	r := &Router{obs: obs, roll: rand.Float64}
+	if err := r.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetRules validates and replaces the routing rules; nil forwards every event and an
+// empty slice none. On error the previous rules stay in place.
+func (r *Router) SetRules(rules []Rule) error {
+	if rules == nil {
+		r.rules.Store(nil)
+		return nil
+	}
+	rules = slices.Clone(rules)
+	for i := range rules {
+		rules[i].prefixes = nil
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("audit route %d: %w", i, err)
+		}
+	}
+	r.rules.Store(&rules)
+	return nil
+}
+
+// Filtered returns how many events the rules kept from the observer.
+func (r *Router) Filtered() int64 {
+	return r.filtered.Load()
+}
+
+// Notify forwards evt, possibly narrowed, when the rules select it.
+func (r *Router) Notify(ctx context.Context, evt Event) error {
+	rules := r.rules.Load()
+	if rules == nil {
+		return r.obs.Notify(ctx, evt)
+	}
+	evt, ok := route(*rules, evt, r.roll)
+	if !ok {
+		r.filtered.Add(1)
+		return nil
+	}
+	return r.obs.Notify(ctx, evt)
+}
@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func batchEvent() Event {
+	return Event{
+		Operation: OpBatch,
+		Metrics:   []string{"billing.invoices", "billing.rate", "Alloc"},
+		Changes: []Change{
+			{ID: "billing.invoices", MType: "counter"},
+			{ID: "billing.rate", MType: "gauge"},
+			{ID: "Alloc", MType: "gauge"},
+		},
+		IPAddress: "10.1.2.3",
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes([]byte(`{
+		"remote": [{"metrics": ["billing.*"], "types": ["counter"]}],
+		"syslog": [{"ips": ["10.0.0.0/8", "192.168.1.1"], "operations": ["read"], "sample": 0.5}],
+		"db": [],
+		"file": null
+	}`))
+	if err != nil {
+		t.Fatalf("ParseRoutes: %v", err)
+	}
+	if len(routes["remote"]) != 1 || len(routes["syslog"][0].prefixes) != 2 || routes["db"] == nil || routes["file"] != nil {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+
+	for _, bad := range []string{
+		`{"remote": [{"metrics": ["[billing"]}]}`,
+		`{"remote": [{"types": ["histogram"]}]}`,
+		`{"remote": [{"ips": ["10.0.0.300"]}]}`,
+		`{"remote": [{"operations": ["write"]}]}`,
+		`{"remote": [{"operations": ["delete"]}]}`,
+		`{"remote": [{"sample": 1.5}]}`,
+		`["remote"]`,
+	} {
+		if _, err := ParseRoutes([]byte(bad)); err == nil {
+			t.Fatalf("ParseRoutes(%s): expected error", bad)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	never := func() float64 { return 1 }
+	tests := []struct {
+		name        string
+		rules       []Rule
+		wantOK      bool
+		wantMetrics []string
+	}{
+		{name: "empty rule keeps all", rules: []Rule{{}}, wantOK: true, wantMetrics: []string{"billing.invoices", "billing.rate", "Alloc"}},
+		{name: "no rules drop all", rules: []Rule{}},
+		{name: "billing counters only", rules: []Rule{{Metrics: []string{"billing.*"}, Types: []string{"counter"}}}, wantOK: true, wantMetrics: []string{"billing.invoices"}},
+		{name: "rules are or-ed", rules: []Rule{{Metrics: []string{"Alloc"}}, {Types: []string{"counter"}}}, wantOK: true, wantMetrics: []string{"billing.invoices", "Alloc"}},
+		{name: "cidr match", rules: []Rule{{IPs: []string{"10.0.0.0/8"}}}, wantOK: true, wantMetrics: []string{"billing.invoices", "billing.rate", "Alloc"}},
+		{name: "cidr mismatch", rules: []Rule{{IPs: []string{"192.168.0.0/16", "10.1.2.4"}}}},
+		{name: "operation mismatch", rules: []Rule{{Operations: []Operation{OpUpsert, OpRead}}}},
+		{name: "no metric matches", rules: []Rule{{Metrics: []string{"Heap*"}}}},
+		{name: "sampled out", rules: []Rule{{Sample: 0.5}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Router{roll: never}
+			if err := r.SetRules(tt.rules); err != nil {
+				t.Fatalf("SetRules: %v", err)
+			}
+			got, ok := route(*r.rules.Load(), batchEvent(), never)
+			if ok != tt.wantOK {
+				t.Fatalf("want ok=%v, got %v", tt.wantOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if !slices.Equal(got.Metrics, tt.wantMetrics) {
+				t.Fatalf("want metrics %v, got %v", tt.wantMetrics, got.Metrics)
+			}
+			if len(got.Changes) != len(tt.wantMetrics) {
+				t.Fatalf("changes not narrowed: %+v", got.Changes)
+			}
+		})
+	}
+}
+
+func TestRoute_SameNameGaugeAndCounter(t *testing.T) {
+	never := func() float64 { return 1 }
+	evt := Event{
+		Operation: OpBatch,
+		Metrics:   []string{"requests"},
+		Changes: []Change{
+			{ID: "requests", MType: "counter"},
+			{ID: "requests", MType: "gauge"},
+		},
+	}
+	for _, mType := range []string{"counter", "gauge"} {
+		rules := []Rule{{Types: []string{mType}}}
+		got, ok := route(rules, evt, never)
+		if !ok {
+			t.Fatalf("%s rule dropped the event", mType)
+		}
+		if len(got.Changes) != 1 || got.Changes[0].MType != mType {
+			t.Fatalf("%s rule: want only the %s change, got %+v", mType, mType, got.Changes)
+		}
+		if !slices.Equal(got.Metrics, []string{"requests"}) {
+			t.Fatalf("%s rule: metrics %v", mType, got.Metrics)
+		}
+	}
+}
+
+func TestRouter_SampleAndReload(t *testing.T) {
+	var got []Event
+	sink := ObserverFunc(func(_ context.Context, evt Event) error {
+		got = append(got, evt)
+		return nil
+	})
+	r, err := NewRouter(sink, []Rule{{Sample: 0.25}})
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	rolls := []float64{0.1, 0.3, 0.9, 0.2}
+	r.roll = func() float64 {
+		v := rolls[0]
+		rolls = rolls[1:]
+		return v
+	}
+	for range 4 {
+		if err := r.Notify(context.Background(), batchEvent()); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	if len(got) != 2 || r.Filtered() != 2 {
+		t.Fatalf("want 2 sampled and 2 filtered, got %d and %d", len(got), r.Filtered())
+	}
+
+	if err := r.SetRules([]Rule{{Types: []string{"histogram"}}}); err == nil {
+		t.Fatal("expected invalid rules to be rejected")
+	}
+	if err := r.SetRules(nil); err != nil {
+		t.Fatalf("SetRules: %v", err)
+	}
+	_ = r.Notify(context.Background(), batchEvent())
+	if len(got) != 3 {
+		t.Fatalf("nil rules should forward everything, got %d events", len(got))
+	}
+}
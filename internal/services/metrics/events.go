@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/pkg/observer"
+)
+
+// ChangeObserver receives MetricsChanged events.
+type ChangeObserver = observer.Observer[domain.MetricsChanged]
+
+// ChangeObserverFunc adapts a plain function to the ChangeObserver interface.
+type ChangeObserverFunc = observer.ObserverFunc[domain.MetricsChanged]
+
+// ChangePublisher broadcasts MetricsChanged events.
+type ChangePublisher = observer.Publisher[domain.MetricsChanged]
+
+// ChangeBus fans MetricsChanged events out to independent subscribers such as the persister.
+type ChangeBus = observer.Subject[domain.MetricsChanged]
+
+// NewChangeBus creates an empty bus; subscribers are added with Attach or Subscribe.
+func NewChangeBus() *ChangeBus {
+	return observer.NewSubject[domain.MetricsChanged]()
+}
+
+// WithChangePublisher publishes a MetricsChanged event after every successful write.
+func WithChangePublisher(pub ChangePublisher) Option {
+	return func(s *Service) {
+		s.changes = pub
+	}
+}
+
+func (s *Service) notifyChanged(ctx context.Context, items []domain.Metrics) {
+	if s.changes == nil || len(items) == 0 {
+		return
+	}
+	s.changes.Publish(ctx, domain.MetricsChanged{Items: domain.Fold(items)})
+}
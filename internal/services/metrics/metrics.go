@@ -3,10 +3,9 @@ package metrics
 
 import (
 	"context"
-	"log"
+	"errors"
 	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/vshulcz/Golectra/internal/domain"
@@ -16,62 +15,41 @@ import (
 
 // Service exposes business operations for querying and mutating metrics.
 type Service struct {
-	repo      ports.MetricsRepo
-	onChanged func(context.Context, domain.Snapshot)
-	auditor   audit.Publisher
-	now       func() time.Time
-
-	auditQueue chan auditEvent
-	auditStop  context.CancelFunc
-	auditWG    sync.WaitGroup
-}
-
-// New builds a metrics Service with repository, snapshot hook, and optional auditor.
-func New(repo ports.MetricsRepo, onChanged func(context.Context, domain.Snapshot), auditor audit.Publisher) *Service {
-	s := &Service{repo: repo, onChanged: onChanged, auditor: auditor, now: time.Now}
-	s.initAuditDispatcher()
-	return s
-}
-
-type auditEvent struct {
-	ctx context.Context
-	evt audit.Event
+	repo       ports.MetricsRepo
+	auditor    audit.Publisher
+	changes    ChangePublisher
+	now        func() time.Time
+	auditReads bool
 }
 
-const auditQueueSize = 128
+// Option customizes a Service built by New.
+type Option func(*Service)
 
-func (s *Service) initAuditDispatcher() {
-	if s == nil || s.auditor == nil {
-		return
+// WithReadAudit enables audit events for read operations in addition to writes.
+func WithReadAudit(enabled bool) Option {
+	return func(s *Service) {
+		s.auditReads = enabled
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	s.auditQueue = make(chan auditEvent, auditQueueSize)
-	s.auditStop = cancel
-	s.auditWG.Add(1)
-	go func() {
-		defer s.auditWG.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-s.auditQueue:
-				s.auditor.Publish(msg.ctx, msg.evt)
-			}
-		}
-	}()
 }
 
-// Close stops background workers and releases resources.
-func (s *Service) Close() {
-	if s == nil || s.auditStop == nil {
-		return
+// New builds a metrics Service with repository and optional auditor.
+// The auditor is called inline; sinks that may be slow should be wrapped in an audit.Queue.
+// The auditor also records failed writes and reads, so it is not a MetricsChanged subscriber.
+func New(repo ports.MetricsRepo, auditor audit.Publisher, opts ...Option) *Service {
+	s := &Service{repo: repo, auditor: auditor, now: time.Now}
+	for _, opt := range opts {
+		opt(s)
 	}
-	s.auditStop()
-	s.auditWG.Wait()
-	s.auditStop = nil
-	s.auditQueue = nil
+	return s
 }
 
+// Close is kept for callers of the earlier API. The service no longer runs background
+// workers: audit events are handed to the auditor inline, and audit.Queue drains and
+// closes slow sinks.
+//
+// Deprecated: nothing needs closing; close the audit queues instead.
+func (s *Service) Close() {}
+
 // Ping delegates to the underlying repository health check.
 func (s *Service) Ping(ctx context.Context) error {
 	return s.repo.Ping(ctx)
@@ -79,17 +57,26 @@ func (s *Service) Ping(ctx context.Context) error {
 
 // Get loads a single metric by type and identifier.
 func (s *Service) Get(ctx context.Context, mType, id string) (domain.Metrics, error) {
+	res, err := s.get(ctx, mType, id)
+	if s.auditReads && strings.TrimSpace(id) != "" {
+		ch := audit.Change{ID: strings.TrimSpace(id), MType: mType, NewValue: res.Value, NewDelta: res.Delta}
+		s.notifyAudit(ctx, audit.OpRead, []audit.Change{ch}, err)
+	}
+	return res, err
+}
+
+func (s *Service) get(ctx context.Context, mType, id string) (domain.Metrics, error) {
 	id = strings.TrimSpace(id)
 	if id == "" {
 		return domain.Metrics{}, domain.ErrNotFound
 	}
 	switch mType {
 	case string(domain.Gauge):
-		v, err := s.repo.GetGauge(ctx, id)
+		v, rev, err := s.repo.GetGaugeWithRevision(ctx, id)
 		if err != nil {
 			return domain.Metrics{}, err
 		}
-		return domain.Metrics{ID: id, MType: mType, Value: &v}, nil
+		return domain.Metrics{ID: id, MType: mType, Value: &v, Revision: rev}, nil
 	case string(domain.Counter):
 		d, err := s.repo.GetCounter(ctx, id)
 		if err != nil {
@@ -107,111 +94,287 @@ func (s *Service) Upsert(ctx context.Context, m domain.Metrics) (domain.Metrics,
 	if m.ID == "" {
 		return domain.Metrics{}, domain.ErrNotFound
 	}
+	res, old, err := s.upsert(ctx, m)
+	if s.auditor != nil {
+		s.notifyAudit(ctx, audit.OpUpsert, []audit.Change{upsertChange(m, res, old, err)}, err)
+	}
+	if err == nil {
+		changed := m
+		if m.MType == string(domain.Gauge) {
+			// Report the value the operation produced, as a plain write.
+			changed = domain.Metrics{ID: m.ID, MType: m.MType, Value: res.Value}
+		}
+		s.notifyChanged(ctx, []domain.Metrics{changed})
+	}
+	return res, err
+}
+
+// upsert returns the value the write itself produced: the gauge as its operation left it
+// with the revision it got, or the counter total AddCounter reported, unaffected by
+// concurrent writers. For gauges it also returns the value the write replaced, nil when
+// the write created the gauge. A gauge with ExpectedRevision is only written while it is
+// still at that revision, and one with MustExist only once it exists; only plain sets can
+// carry either.
+func (s *Service) upsert(ctx context.Context, m domain.Metrics) (domain.Metrics, *float64, error) {
 	switch m.MType {
 	case string(domain.Gauge):
-		if m.Value == nil {
-			return domain.Metrics{}, domain.ErrInvalidType
+		if m.Value == nil || !m.Op.Valid() {
+			return domain.Metrics{}, nil, domain.ErrInvalidType
 		}
-		if err := s.repo.SetGauge(ctx, m.ID, *m.Value); err != nil {
-			return domain.Metrics{}, err
+		if m.Op.Effective() != domain.GaugeSet {
+			if m.ExpectedRevision != nil || m.MustExist {
+				return domain.Metrics{}, nil, domain.ErrInvalidType
+			}
+			w, err := s.repo.ApplyGauge(ctx, m.ID, m.Op, *m.Value)
+			if err != nil {
+				return domain.Metrics{}, nil, err
+			}
+			return domain.Metrics{ID: m.ID, MType: m.MType, Value: &w.Value, Revision: w.Revision}, w.Old, nil
 		}
-		res, err := s.Get(ctx, m.MType, m.ID)
-		if err == nil {
-			s.notifyAudit(ctx, []string{m.ID})
+		expected := ports.AnyRevision
+		if m.ExpectedRevision != nil {
+			if *m.ExpectedRevision < 0 {
+				return domain.Metrics{}, nil, domain.ErrInvalidType
+			}
+			expected = *m.ExpectedRevision
+		} else if m.MustExist {
+			// Gauges are never deleted, so one that exists now still exists at the write.
+			if _, _, err := s.repo.GetGaugeWithRevision(ctx, m.ID); errors.Is(err, domain.ErrNotFound) {
+				return domain.Metrics{}, nil, domain.ErrRevisionMismatch
+			} else if err != nil {
+				return domain.Metrics{}, nil, err
+			}
 		}
-		return res, err
-	case string(domain.Counter):
-		if m.Delta == nil {
-			return domain.Metrics{}, domain.ErrInvalidType
+		w, err := s.repo.CompareAndSetGauge(ctx, m.ID, *m.Value, expected)
+		if err != nil {
+			return domain.Metrics{}, nil, err
 		}
-		if err := s.repo.AddCounter(ctx, m.ID, *m.Delta); err != nil {
-			return domain.Metrics{}, err
+		return domain.Metrics{ID: m.ID, MType: m.MType, Value: &w.Value, Revision: w.Revision}, w.Old, nil
+	case string(domain.Counter):
+		if m.Delta == nil || m.ExpectedRevision != nil || m.MustExist || m.Op != "" {
+			return domain.Metrics{}, nil, domain.ErrInvalidType
 		}
-		res, err := s.Get(ctx, m.MType, m.ID)
-		if err == nil {
-			s.notifyAudit(ctx, []string{m.ID})
+		total, err := s.repo.AddCounter(ctx, m.ID, *m.Delta)
+		if err != nil {
+			return domain.Metrics{}, nil, err
 		}
-		return res, err
+		return domain.Metrics{ID: m.ID, MType: m.MType, Delta: &total}, nil, nil
 	default:
-		return domain.Metrics{}, domain.ErrInvalidType
+		return domain.Metrics{}, nil, domain.ErrInvalidType
 	}
 }
 
-// UpsertBatch applies many metrics in a single repository call and triggers snapshot callbacks.
+// UpsertBatch applies many metrics in a single repository call and publishes one MetricsChanged event.
+// Batches are unconditional: items carrying an expected revision are skipped like invalid ones,
+// and so are gauges with an unknown operation and counters with any operation.
 func (s *Service) UpsertBatch(ctx context.Context, items []domain.Metrics) (int, error) {
 	valid := make([]domain.Metrics, 0, len(items))
-	names := make([]string, 0, len(items))
 	for _, it := range items {
 		id := strings.TrimSpace(it.ID)
-		if id == "" {
+		if id == "" || it.ExpectedRevision != nil {
 			continue
 		}
 		it.ID = id
 		switch it.MType {
 		case string(domain.Gauge):
-			if it.Value == nil {
+			if it.Value == nil || !it.Op.Valid() {
 				continue
 			}
 		case string(domain.Counter):
-			if it.Delta == nil {
+			if it.Delta == nil || it.Op != "" {
 				continue
 			}
 		default:
 			continue
 		}
 		valid = append(valid, it)
-		names = append(names, it.ID)
 	}
 	if len(valid) == 0 {
 		return 0, domain.ErrInvalidType
 	}
-	if err := s.repo.UpdateMany(ctx, valid); err != nil {
+	prior, err := s.repo.UpdateMany(ctx, valid)
+	if err != nil {
+		if s.auditor != nil {
+			s.notifyAudit(ctx, audit.OpBatch, batchChanges(valid, nil), err)
+		}
 		return 0, err
 	}
-	s.notifyAudit(ctx, names)
-	if s.onChanged != nil {
-		if snap, err := s.repo.Snapshot(ctx); err == nil {
-			s.onChanged(ctx, snap)
-		}
+	if s.auditor != nil {
+		s.notifyAudit(ctx, audit.OpBatch, batchChanges(valid, &prior), nil)
 	}
+	s.notifyChanged(ctx, valid)
 	return len(valid), nil
 }
 
 // Snapshot returns all known metrics.
 func (s *Service) Snapshot(ctx context.Context) (domain.Snapshot, error) {
-	return s.repo.Snapshot(ctx)
+	snap, err := s.repo.Snapshot(ctx)
+	if s.auditReads {
+		s.notifyAudit(ctx, audit.OpRead, nil, err)
+	}
+	return snap, err
+}
+
+// SnapshotSince returns metrics changed after the given revision.
+func (s *Service) SnapshotSince(ctx context.Context, since int64) (domain.Snapshot, error) {
+	snap, err := s.repo.SnapshotSince(ctx, since)
+	if s.auditReads {
+		s.notifyAudit(ctx, audit.OpRead, nil, err)
+	}
+	return snap, err
+}
+
+// Revision reports the current store revision.
+func (s *Service) Revision(ctx context.Context) (int64, error) {
+	return s.repo.Revision(ctx)
 }
 
-func (s *Service) notifyAudit(ctx context.Context, names []string) {
+// upsertChange describes a single write from what the repository reported for it, so the
+// values belong to this write even with concurrent writers: the gauge values before and
+// after the operation, and the counter total AddCounter returned along with the total
+// before it. A gauge operation other than set is recorded as the write's only step.
+func upsertChange(m domain.Metrics, res domain.Metrics, old *float64, err error) audit.Change {
+	ch := audit.Change{ID: m.ID, MType: m.MType}
+	switch m.MType {
+	case string(domain.Gauge):
+		if m.Value != nil && m.Op.Effective() != domain.GaugeSet {
+			ch.Ops = []audit.GaugeStep{{Op: string(m.Op), Operand: *m.Value}}
+		}
+		if err == nil {
+			ch.OldValue, ch.NewValue = old, res.Value
+		} else if m.Op.Effective() == domain.GaugeSet {
+			ch.NewValue = m.Value
+		}
+	case string(domain.Counter):
+		ch.Delta = m.Delta
+		if err == nil && res.Delta != nil && m.Delta != nil {
+			old := *res.Delta - *m.Delta
+			ch.OldDelta, ch.NewDelta = &old, res.Delta
+		}
+	default:
+	}
+	return ch
+}
+
+// batchChanges folds a batch into one change per metric. prior holds the values the batch
+// replaced as UpdateMany reported them, so the values before and after the batch are the
+// ones it saw and left; it is nil for a failed batch, whose changes then carry the summed
+// counter deltas, and gauge values only when the batch sets them before any other
+// operation. Gauges list their steps when any of them is not a plain set.
+func batchChanges(items []domain.Metrics, prior *domain.Snapshot) []audit.Change {
+	type key struct{ mType, id string }
+	byKey := make(map[key]*audit.Change, len(items))
+	order := make([]key, 0, len(items))
+	for _, it := range items {
+		k := key{it.MType, it.ID}
+		ch, ok := byKey[k]
+		if !ok {
+			ch = newBatchChange(it, prior)
+			byKey[k] = ch
+			order = append(order, k)
+		}
+		switch it.MType {
+		case string(domain.Gauge):
+			v := *it.Value
+			op := it.Op.Effective()
+			ch.Ops = append(ch.Ops, audit.GaugeStep{Op: string(op), Operand: v})
+			switch {
+			case op == domain.GaugeSet:
+				ch.NewValue = &v
+			case ch.NewValue != nil:
+				v = op.Apply(*ch.NewValue, v)
+				ch.NewValue = &v
+			case prior != nil:
+				// A gauge the batch creates starts from its first value.
+				ch.NewValue = &v
+			default:
+			}
+		case string(domain.Counter):
+			var applied int64
+			if ch.Delta != nil {
+				applied = *ch.Delta
+			}
+			applied += *it.Delta
+			ch.Delta = &applied
+		default:
+		}
+	}
+	slices.SortFunc(order, func(a, b key) int {
+		if c := strings.Compare(a.id, b.id); c != 0 {
+			return c
+		}
+		return strings.Compare(a.mType, b.mType)
+	})
+	changes := make([]audit.Change, 0, len(order))
+	for _, k := range order {
+		ch := byKey[k]
+		if !slices.ContainsFunc(ch.Ops, func(s audit.GaugeStep) bool { return s.Op != string(domain.GaugeSet) }) {
+			ch.Ops = nil
+		}
+		if ch.OldDelta != nil && ch.Delta != nil {
+			total := *ch.OldDelta + *ch.Delta
+			ch.NewDelta = &total
+		}
+		changes = append(changes, *ch)
+	}
+	return changes
+}
+
+// newBatchChange starts the change of the item's metric from the value prior says it held.
+func newBatchChange(it domain.Metrics, prior *domain.Snapshot) *audit.Change {
+	ch := &audit.Change{ID: it.ID, MType: it.MType}
+	if prior == nil {
+		return ch
+	}
+	switch it.MType {
+	case string(domain.Gauge):
+		if old, ok := prior.Gauges[it.ID]; ok {
+			cur := old
+			ch.OldValue, ch.NewValue = &old, &cur
+		}
+	case string(domain.Counter):
+		old := prior.Counters[it.ID]
+		ch.OldDelta = &old
+	default:
+	}
+	return ch
+}
+
+func (s *Service) notifyAudit(ctx context.Context, op audit.Operation, changes []audit.Change, opErr error) {
 	if s == nil || s.auditor == nil {
 		return
 	}
+	names := make([]string, 0, len(changes))
+	for i := range changes {
+		names = append(names, changes[i].ID)
+	}
 	uniq := dedupNames(names)
-	if len(uniq) == 0 {
+	if len(uniq) == 0 && op != audit.OpRead {
 		return
 	}
 	var ts int64
 	if s.now != nil {
 		ts = s.now().Unix()
 	}
+	meta := audit.RequestMetaFromContext(ctx)
 	evt := audit.Event{
+		Version:   audit.SchemaVersion,
 		Timestamp: ts,
+		Operation: op,
+		Outcome:   audit.OutcomeSuccess,
 		Metrics:   uniq,
-		IPAddress: audit.ClientIPFromContext(ctx),
+		Changes:   changes,
+		IPAddress: meta.IPAddress,
+		RequestID: meta.RequestID,
+		UserAgent: meta.UserAgent,
+		Actor:     meta.Actor,
+		TraceID:   meta.TraceID,
 	}
-	s.enqueueAudit(ctx, evt)
-}
-
-func (s *Service) enqueueAudit(ctx context.Context, evt audit.Event) {
-	if s.auditQueue == nil {
-		s.auditor.Publish(ctx, evt)
-		return
-	}
-	select {
-	case s.auditQueue <- auditEvent{ctx: ctx, evt: evt}:
-	default:
-		log.Printf("metrics: audit queue full, dropping event (%d metrics)", len(evt.Metrics))
+	if opErr != nil {
+		evt.Outcome = audit.OutcomeFailure
+		evt.Error = opErr.Error()
 	}
+	s.auditor.Publish(ctx, evt)
 }
 
 func dedupNames(names []string) []string {
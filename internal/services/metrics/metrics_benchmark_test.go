@@ -11,7 +11,7 @@ import (
 
 func BenchmarkServiceUpsertBatch(b *testing.B) {
 	repo := memrepo.New()
-	svc := New(repo, nil, nil)
+	svc := New(repo, nil)
 	ctx := context.Background()
 
 	items := make([]domain.Metrics, 0, 200)
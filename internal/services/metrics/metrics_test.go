@@ -5,18 +5,23 @@ import (
 	"errors"
 	"maps"
 	"reflect"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
 	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
 	"github.com/vshulcz/Golectra/internal/services/audit"
 )
 
 type fakeRepo struct {
-	mu       sync.Mutex
-	gauges   map[string]float64
-	counters map[string]int64
+	mu        sync.Mutex
+	gauges    map[string]float64
+	gaugeRevs map[string]int64
+	counters  map[string]int64
+	rev       int64
 
 	setGaugeCalls []struct {
 		name  string
@@ -26,6 +31,7 @@ type fakeRepo struct {
 		name  string
 		delta int64
 	}
+	applyGaugeCalls []domain.GaugeOp
 	updateManyCalls [][]domain.Metrics
 	pingCalls       int
 	snapshotCalls   int
@@ -71,6 +77,7 @@ func (f *fakeAuditor) WaitForEvents(n int, timeout time.Duration) []audit.Event
 func newFakeRepo() *fakeRepo {
 	return &fakeRepo{
 		gauges:        map[string]float64{},
+		gaugeRevs:     map[string]int64{},
 		counters:      map[string]int64{},
 		setGaugeErr:   map[string]error{},
 		addCounterErr: map[string]error{},
@@ -92,6 +99,16 @@ func (r *fakeRepo) GetGauge(_ context.Context, name string) (float64, error) {
 	return v, nil
 }
 
+func (r *fakeRepo) GetGaugeWithRevision(ctx context.Context, name string) (float64, int64, error) {
+	v, err := r.GetGauge(ctx, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return v, r.gaugeRevs[name], nil
+}
+
 func (r *fakeRepo) GetCounter(_ context.Context, name string) (int64, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -105,46 +122,91 @@ func (r *fakeRepo) GetCounter(_ context.Context, name string) (int64, error) {
 	return v, nil
 }
 
-func (r *fakeRepo) SetGauge(_ context.Context, name string, value float64) error {
+func (r *fakeRepo) SetGauge(ctx context.Context, name string, value float64) error {
+	_, err := r.CompareAndSetGauge(ctx, name, value, ports.AnyRevision)
+	return err
+}
+
+func (r *fakeRepo) CompareAndSetGauge(_ context.Context, name string, value float64, expected int64) (domain.GaugeWrite, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if err := r.setGaugeErr[name]; err != nil {
-		return err
+		return domain.GaugeWrite{}, err
+	}
+	if expected != ports.AnyRevision && expected != r.gaugeRevs[name] {
+		return domain.GaugeWrite{}, domain.ErrRevisionMismatch
 	}
 	r.setGaugeCalls = append(r.setGaugeCalls, struct {
 		name  string
 		value float64
 	}{name, value})
+	return r.writeGaugeLocked(name, value), nil
+}
+
+func (r *fakeRepo) ApplyGauge(_ context.Context, name string, op domain.GaugeOp, value float64) (domain.GaugeWrite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.setGaugeErr[name]; err != nil {
+		return domain.GaugeWrite{}, err
+	}
+	r.applyGaugeCalls = append(r.applyGaugeCalls, op)
+	if cur, ok := r.gauges[name]; ok {
+		value = op.Apply(cur, value)
+	}
+	return r.writeGaugeLocked(name, value), nil
+}
+
+func (r *fakeRepo) writeGaugeLocked(name string, value float64) domain.GaugeWrite {
+	w := domain.GaugeWrite{Value: value}
+	if old, ok := r.gauges[name]; ok {
+		w.Old = &old
+	}
 	r.gauges[name] = value
-	return nil
+	r.rev++
+	r.gaugeRevs[name] = r.rev
+	w.Revision = r.rev
+	return w
 }
 
-func (r *fakeRepo) AddCounter(_ context.Context, name string, delta int64) error {
+func (r *fakeRepo) AddCounter(_ context.Context, name string, delta int64) (int64, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if err := r.addCounterErr[name]; err != nil {
-		return err
+		return 0, err
 	}
 	r.addCounterCalls = append(r.addCounterCalls, struct {
 		name  string
 		delta int64
 	}{name, delta})
 	r.counters[name] += delta
-	return nil
+	return r.counters[name], nil
 }
 
-func (r *fakeRepo) UpdateMany(_ context.Context, items []domain.Metrics) error {
+func (r *fakeRepo) UpdateMany(_ context.Context, items []domain.Metrics) (domain.Snapshot, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.updateManyErr != nil {
-		return r.updateManyErr
+		return domain.Snapshot{}, r.updateManyErr
 	}
 	r.updateManyCalls = append(r.updateManyCalls, append([]domain.Metrics(nil), items...))
+	prior := domain.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}
+	for _, it := range items {
+		if v, ok := r.gauges[it.ID]; ok && it.MType == string(domain.Gauge) {
+			prior.Gauges[it.ID] = v
+		}
+		if d, ok := r.counters[it.ID]; ok && it.MType == string(domain.Counter) {
+			prior.Counters[it.ID] = d
+		}
+	}
 	for _, it := range items {
 		switch it.MType {
 		case string(domain.Gauge):
 			if it.Value != nil {
-				r.gauges[it.ID] = *it.Value
+				v := *it.Value
+				if cur, ok := r.gauges[it.ID]; ok {
+					v = it.Op.Apply(cur, v)
+				}
+				r.gauges[it.ID] = v
 			}
 		case string(domain.Counter):
 			if it.Delta != nil {
@@ -153,7 +215,7 @@ func (r *fakeRepo) UpdateMany(_ context.Context, items []domain.Metrics) error {
 		default:
 		}
 	}
-	return nil
+	return prior, nil
 }
 
 func (r *fakeRepo) Snapshot(_ context.Context) (domain.Snapshot, error) {
@@ -172,6 +234,16 @@ func (r *fakeRepo) Snapshot(_ context.Context) (domain.Snapshot, error) {
 	return domain.Snapshot{Gauges: g, Counters: c}, nil
 }
 
+func (r *fakeRepo) SnapshotSince(ctx context.Context, _ int64) (domain.Snapshot, error) {
+	return r.Snapshot(ctx)
+}
+
+func (r *fakeRepo) Revision(_ context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.setGaugeCalls) + len(r.addCounterCalls) + len(r.updateManyCalls)), nil
+}
+
 func (r *fakeRepo) Ping(_ context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -181,7 +253,7 @@ func (r *fakeRepo) Ping(_ context.Context) error {
 
 func TestService_Ping_Error(t *testing.T) {
 	repo := newFakeRepo()
-	s := New(repo, nil, nil)
+	s := New(repo, nil)
 
 	if err := s.Ping(context.Background()); err != nil {
 		t.Fatalf("Ping unexpected err: %v", err)
@@ -197,7 +269,7 @@ func TestService_Get(t *testing.T) {
 	repo.gauges["Alloc"] = 1.25
 	repo.counters["PollCount"] = 9
 
-	svc := New(repo, nil, nil)
+	svc := New(repo, nil)
 
 	tests := []struct {
 		name    string
@@ -255,7 +327,7 @@ func stringsTrim(s string) string {
 
 func TestService_Upsert(t *testing.T) {
 	repo := newFakeRepo()
-	svc := New(repo, nil, nil)
+	svc := New(repo, nil)
 
 	tests := []struct {
 		name    string
@@ -316,15 +388,17 @@ func TestService_UpsertBatch(t *testing.T) {
 
 	var cbMu sync.Mutex
 	var cbCalls int
-	var cbLast domain.Snapshot
-	cb := func(_ context.Context, s domain.Snapshot) {
+	var cbLast domain.MetricsChanged
+	bus := NewChangeBus()
+	bus.Attach(ChangeObserverFunc(func(_ context.Context, evt domain.MetricsChanged) error {
 		cbMu.Lock()
 		defer cbMu.Unlock()
 		cbCalls++
-		cbLast = s
-	}
+		cbLast = evt
+		return nil
+	}))
 
-	svc := New(repo, cb, nil)
+	svc := New(repo, nil, WithChangePublisher(bus))
 
 	validGauge := domain.Metrics{ID: "g", MType: string(domain.Gauge), Value: ptrFloat64(1.5)}
 	validCounter := domain.Metrics{ID: "c", MType: string(domain.Counter), Delta: ptrInt(3)}
@@ -349,16 +423,15 @@ func TestService_UpsertBatch(t *testing.T) {
 			t.Fatal("UpdateMany should not be called")
 		}
 		if cbCalls != 0 {
-			t.Fatal("onChanged should not be called")
+			t.Fatal("MetricsChanged should not be published")
 		}
 	})
 
-	t.Run("mixed_valid_invalid_update_ok_triggers_onChanged", func(t *testing.T) {
+	t.Run("mixed_valid_invalid_update_ok_publishes_changes", func(t *testing.T) {
 		repo.updateManyErr = nil
 		cbMu.Lock()
 		cbCalls = 0
 		cbMu.Unlock()
-		repo.nextSnapshotErr = nil
 
 		in := append([]domain.Metrics{validGauge, validCounter}, invalids...)
 		n, err := svc.UpsertBatch(context.Background(), in)
@@ -371,14 +444,14 @@ func TestService_UpsertBatch(t *testing.T) {
 		cbMu.Lock()
 		defer cbMu.Unlock()
 		if cbCalls != 1 {
-			t.Fatalf("onChanged calls=%d want 1", cbCalls)
+			t.Fatalf("MetricsChanged published %d times, want 1", cbCalls)
 		}
-		if cbLast.Gauges["A"] != 1.0 || cbLast.Counters["C"] != 2 {
-			t.Fatalf("onChanged snapshot mismatch: %+v", cbLast)
+		if len(cbLast.Items) != 2 || cbLast.Items[0].ID != "c" || *cbLast.Items[0].Delta != 3 || cbLast.Items[1].ID != "g" || *cbLast.Items[1].Value != 1.5 {
+			t.Fatalf("MetricsChanged items mismatch: %+v", cbLast.Items)
 		}
 	})
 
-	t.Run("update_err_propagates_and_no_onChanged", func(t *testing.T) {
+	t.Run("update_err_propagates_and_no_changes", func(t *testing.T) {
 		repo.updateManyErr = errors.New("fail")
 		cbMu.Lock()
 		cbCalls = 0
@@ -389,34 +462,214 @@ func TestService_UpsertBatch(t *testing.T) {
 			t.Fatalf("n=%d err=%v want 0, fail", n, err)
 		}
 		if cbCalls != 0 {
-			t.Fatal("onChanged should not be called")
+			t.Fatal("MetricsChanged should not be published")
 		}
 	})
 
-	t.Run("snapshot_err_suppressed_on_onChanged", func(t *testing.T) {
+	t.Run("duplicates_are_folded", func(t *testing.T) {
 		repo.updateManyErr = nil
-		repo.nextSnapshotErr = errors.New("snap-err")
-		cbMu.Lock()
-		cbCalls = 0
-		cbMu.Unlock()
-
-		n, err := svc.UpsertBatch(context.Background(), []domain.Metrics{validCounter})
-		if err != nil || n != 1 {
-			t.Fatalf("n=%d err=%v want 1, nil", n, err)
+		later := domain.Metrics{ID: "g", MType: string(domain.Gauge), Value: ptrFloat64(7)}
+		n, err := svc.UpsertBatch(context.Background(), []domain.Metrics{validCounter, validGauge, validCounter, later})
+		if err != nil || n != 4 {
+			t.Fatalf("n=%d err=%v want 4, nil", n, err)
 		}
 		cbMu.Lock()
 		defer cbMu.Unlock()
-		if cbCalls != 0 {
-			t.Fatal("onChanged should not be called when snapshot fails")
+		if len(cbLast.Items) != 2 || *cbLast.Items[0].Delta != 6 || *cbLast.Items[1].Value != 7 {
+			t.Fatalf("want folded counter 6 and last gauge 7, got %+v", cbLast.Items)
 		}
 	})
 }
 
+func TestService_Upsert_ReturnsOwnWrite(t *testing.T) {
+	// Reading the metric back is no longer part of an upsert.
+	repo := newFakeRepo()
+	repo.getCounterErr["Poll"] = errors.New("read")
+	repo.getGaugeErr["Alloc"] = errors.New("read")
+	svc := New(repo, nil)
+	if got, err := svc.Upsert(context.Background(), domain.Metrics{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(3)}); err != nil || *got.Delta != 3 {
+		t.Fatalf("counter: got %+v, %v", got, err)
+	}
+	if got, err := svc.Upsert(context.Background(), domain.Metrics{ID: "Alloc", MType: string(domain.Gauge), Value: ptrFloat64(1.5)}); err != nil || *got.Value != 1.5 {
+		t.Fatalf("gauge: got %+v, %v", got, err)
+	}
+
+	// Concurrent increments by one each see a total no other caller sees.
+	svc = New(memory.New(), nil)
+	const writers, perWriter = 8, 50
+	totals := make(chan int64, writers*perWriter)
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWriter {
+				got, err := svc.Upsert(context.Background(), domain.Metrics{ID: "Shared", MType: string(domain.Counter), Delta: ptrInt(1)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				totals <- *got.Delta
+			}
+		}()
+	}
+	wg.Wait()
+	close(totals)
+	seen := map[int64]bool{}
+	for total := range totals {
+		if seen[total] {
+			t.Fatalf("total %d returned to two callers", total)
+		}
+		seen[total] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Fatalf("want %d distinct totals, got %d", writers*perWriter, len(seen))
+	}
+}
+
+func TestService_Upsert_ExpectedRevision(t *testing.T) {
+	ctx := context.Background()
+	svc := New(memory.New(), nil)
+	gauge := func(v float64, expected *int64) domain.Metrics {
+		return domain.Metrics{ID: "Temp", MType: string(domain.Gauge), Value: ptrFloat64(v), ExpectedRevision: expected}
+	}
+
+	created, err := svc.Upsert(ctx, gauge(1, ptrInt(0)))
+	if err != nil || created.Revision <= 0 {
+		t.Fatalf("create: got %+v, %v", created, err)
+	}
+	if _, err := svc.Upsert(ctx, gauge(2, ptrInt(0))); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("create over an existing gauge: want ErrRevisionMismatch, got %v", err)
+	}
+	updated, err := svc.Upsert(ctx, gauge(3, &created.Revision))
+	if err != nil || updated.Revision <= created.Revision {
+		t.Fatalf("update: got %+v, %v", updated, err)
+	}
+	if _, err := svc.Upsert(ctx, gauge(4, &created.Revision)); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("stale update: want ErrRevisionMismatch, got %v", err)
+	}
+	got, err := svc.Get(ctx, string(domain.Gauge), "Temp")
+	if err != nil || *got.Value != 3 || got.Revision != updated.Revision {
+		t.Fatalf("want 3 at revision %d, got %+v, %v", updated.Revision, got, err)
+	}
+
+	if _, err := svc.Upsert(ctx, gauge(5, ptrInt(-2))); !errors.Is(err, domain.ErrInvalidType) {
+		t.Fatalf("negative revision: want ErrInvalidType, got %v", err)
+	}
+	counter := domain.Metrics{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(1), ExpectedRevision: ptrInt(0)}
+	if _, err := svc.Upsert(ctx, counter); !errors.Is(err, domain.ErrInvalidType) {
+		t.Fatalf("conditional counter: want ErrInvalidType, got %v", err)
+	}
+	if n, err := svc.UpsertBatch(ctx, []domain.Metrics{gauge(6, &updated.Revision), counter}); !errors.Is(err, domain.ErrInvalidType) || n != 0 {
+		t.Fatalf("conditional batch items should be skipped, got %d, %v", n, err)
+	}
+}
+
+func TestService_Upsert_GaugeOps(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.gauges["Load"] = 4
+	auditor := &fakeAuditor{}
+	var changed []domain.MetricsChanged
+	bus := NewChangeBus()
+	bus.Attach(ChangeObserverFunc(func(_ context.Context, evt domain.MetricsChanged) error {
+		changed = append(changed, evt)
+		return nil
+	}))
+	svc := New(repo, auditor, WithChangePublisher(bus))
+	gauge := func(op domain.GaugeOp, v float64) domain.Metrics {
+		return domain.Metrics{ID: "Load", MType: string(domain.Gauge), Value: ptrFloat64(v), Op: op}
+	}
+
+	res, err := svc.Upsert(ctx, gauge(domain.GaugeAdd, 2))
+	if err != nil || *res.Value != 6 || res.Revision == 0 {
+		t.Fatalf("add: got %+v, %v", res, err)
+	}
+	if len(changed) != 1 || *changed[0].Items[0].Value != 6 || changed[0].Items[0].Op != "" {
+		t.Fatalf("want the result published as a plain write, got %+v", changed)
+	}
+	if res, err := svc.Upsert(ctx, gauge(domain.GaugeMin, 10)); err != nil || *res.Value != 6 {
+		t.Fatalf("min: got %+v, %v", res, err)
+	}
+	if !slices.Equal(repo.applyGaugeCalls, []domain.GaugeOp{domain.GaugeAdd, domain.GaugeMin}) {
+		t.Fatalf("unexpected ApplyGauge calls: %v", repo.applyGaugeCalls)
+	}
+
+	invalid := []domain.Metrics{
+		gauge("avg", 1),
+		{ID: "Load", MType: string(domain.Gauge), Value: ptrFloat64(1), Op: domain.GaugeAdd, ExpectedRevision: ptrInt(1)},
+		{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(1), Op: domain.GaugeAdd},
+	}
+	for _, m := range invalid {
+		if _, err := svc.Upsert(ctx, m); !errors.Is(err, domain.ErrInvalidType) {
+			t.Fatalf("%+v: want ErrInvalidType, got %v", m, err)
+		}
+	}
+
+	n, err := svc.UpsertBatch(ctx, append(invalid, gauge(domain.GaugeAdd, 1), gauge(domain.GaugeMax, 9), gauge(domain.GaugeAdd, 1)))
+	if err != nil || n != 3 {
+		t.Fatalf("batch: %d, %v", n, err)
+	}
+	if v, _ := repo.GetGauge(ctx, "Load"); v != 10 {
+		t.Fatalf("want 10 after the batch, got %v", v)
+	}
+	events := auditor.WaitForEvents(6, time.Second)
+	wantOps := []audit.GaugeStep{{Op: "add", Operand: 1}, {Op: "max", Operand: 9}, {Op: "add", Operand: 1}}
+	last := events[len(events)-1]
+	if len(last.Changes) != 1 || *last.Changes[0].OldValue != 6 || *last.Changes[0].NewValue != 10 || !slices.Equal(last.Changes[0].Ops, wantOps) {
+		t.Fatalf("want the batch audited from 6 to 10 with its steps, got %+v", last.Changes)
+	}
+	add := events[0]
+	if len(add.Changes) != 1 || *add.Changes[0].OldValue != 4 || *add.Changes[0].NewValue != 6 ||
+		!slices.Equal(add.Changes[0].Ops, []audit.GaugeStep{{Op: "add", Operand: 2}}) {
+		t.Fatalf("want the add audited from 4 to 6, got %+v", add.Changes)
+	}
+
+	if _, err := svc.UpsertBatch(ctx, []domain.Metrics{gauge(domain.GaugeAdd, 1), gauge("", 3), gauge(domain.GaugeMax, 5)}); err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	events = auditor.WaitForEvents(7, time.Second)
+	if ch := events[len(events)-1].Changes; len(ch) != 1 || *ch[0].OldValue != 10 || *ch[0].NewValue != 5 || len(ch[0].Ops) != 3 {
+		t.Fatalf("want the batch audited from 10 to 5, got %+v", ch)
+	}
+
+	// A failed batch only reports what its items determine.
+	repo.updateManyErr = errors.New("disk full")
+	if _, err := svc.UpsertBatch(ctx, []domain.Metrics{gauge(domain.GaugeAdd, 1), gauge("", 3)}); err == nil {
+		t.Fatal("want the batch to fail")
+	}
+	events = auditor.WaitForEvents(8, time.Second)
+	if ch := events[len(events)-1].Changes; len(ch) != 1 || ch[0].OldValue != nil || *ch[0].NewValue != 3 || len(ch[0].Ops) != 2 {
+		t.Fatalf("want the failed batch audited with its set only, got %+v", ch)
+	}
+}
+
+func TestService_Upsert_PublishesChange(t *testing.T) {
+	repo := newFakeRepo()
+	var got []domain.MetricsChanged
+	bus := NewChangeBus()
+	bus.Attach(ChangeObserverFunc(func(_ context.Context, evt domain.MetricsChanged) error {
+		got = append(got, evt)
+		return nil
+	}))
+	svc := New(repo, nil, WithChangePublisher(bus))
+
+	if _, err := svc.Upsert(context.Background(), domain.Metrics{ID: "c", MType: string(domain.Counter), Delta: ptrInt(2)}); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if _, err := svc.Upsert(context.Background(), domain.Metrics{ID: "g", MType: string(domain.Gauge)}); err == nil {
+		t.Fatal("expected error for gauge without value")
+	}
+	if len(got) != 1 || len(got[0].Items) != 1 || got[0].Items[0].ID != "c" || *got[0].Items[0].Delta != 2 {
+		t.Fatalf("want one change for c, got %+v", got)
+	}
+}
+
 func TestService_Snapshot_Proxy(t *testing.T) {
 	repo := newFakeRepo()
 	repo.gauges["g"] = 2.2
 	repo.counters["c"] = 8
-	svc := New(repo, nil, nil)
+	svc := New(repo, nil)
 
 	s, err := svc.Snapshot(context.Background())
 	if err != nil {
@@ -435,8 +688,7 @@ func TestService_Snapshot_Proxy(t *testing.T) {
 func TestService_Upsert_EmitsAudit(t *testing.T) {
 	repo := newFakeRepo()
 	aud := &fakeAuditor{}
-	svc := New(repo, nil, aud)
-	t.Cleanup(svc.Close)
+	svc := New(repo, aud)
 	svc.now = func() time.Time { return time.Unix(99, 0) }
 
 	ctx := audit.WithClientIP(context.Background(), "10.0.0.1")
@@ -464,8 +716,7 @@ func TestService_Upsert_EmitsAudit(t *testing.T) {
 func TestService_UpsertBatch_EmitsAuditDedup(t *testing.T) {
 	repo := newFakeRepo()
 	aud := &fakeAuditor{}
-	svc := New(repo, nil, aud)
-	t.Cleanup(svc.Close)
+	svc := New(repo, aud)
 	svc.now = func() time.Time { return time.Unix(5, 0) }
 
 	items := []domain.Metrics{
@@ -495,5 +746,95 @@ func TestService_UpsertBatch_EmitsAuditDedup(t *testing.T) {
 	}
 }
 
+func TestService_AuditEventDetails(t *testing.T) {
+	repo := newFakeRepo()
+	repo.gauges["Alloc"] = 1
+	repo.counters["Poll"] = 10
+	aud := &fakeAuditor{}
+	svc := New(repo, aud)
+
+	ctx := audit.WithRequestMeta(context.Background(), audit.RequestMeta{
+		IPAddress: "10.0.0.2",
+		RequestID: "req-1",
+		UserAgent: "curl/8",
+		Actor:     "agent:host-a",
+	})
+	if _, err := svc.Upsert(ctx, domain.Metrics{ID: "Alloc", MType: string(domain.Gauge), Value: ptrFloat64(2)}); err != nil {
+		t.Fatalf("Upsert err: %v", err)
+	}
+	items := []domain.Metrics{
+		{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(2)},
+		{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(3)},
+	}
+	if _, err := svc.UpsertBatch(ctx, items); err != nil {
+		t.Fatalf("UpsertBatch err: %v", err)
+	}
+	repo.setGaugeErr["Alloc"] = errors.New("disk full")
+	if _, err := svc.Upsert(ctx, domain.Metrics{ID: "Alloc", MType: string(domain.Gauge), Value: ptrFloat64(3)}); err == nil {
+		t.Fatal("expected Upsert error")
+	}
+
+	events := aud.WaitForEvents(3, time.Second)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	up := events[0]
+	if up.Version != audit.SchemaVersion || up.Operation != audit.OpUpsert || up.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("unexpected upsert envelope: %+v", up)
+	}
+	if up.RequestID != "req-1" || up.UserAgent != "curl/8" || up.Actor != "agent:host-a" || up.IPAddress != "10.0.0.2" {
+		t.Fatalf("request meta not propagated: %+v", up)
+	}
+	if len(up.Changes) != 1 || *up.Changes[0].OldValue != 1 || *up.Changes[0].NewValue != 2 || up.Changes[0].Ops != nil {
+		t.Fatalf("unexpected gauge change: %+v", up.Changes)
+	}
+
+	batch := events[1]
+	if batch.Operation != audit.OpBatch || len(batch.Changes) != 1 {
+		t.Fatalf("unexpected batch event: %+v", batch)
+	}
+	ch := batch.Changes[0]
+	if *ch.OldDelta != 10 || *ch.Delta != 5 || *ch.NewDelta != 15 {
+		t.Fatalf("unexpected counter change: %+v", ch)
+	}
+
+	if _, err := svc.Upsert(ctx, domain.Metrics{ID: "Poll", MType: string(domain.Counter), Delta: ptrInt(4)}); err != nil {
+		t.Fatalf("Upsert counter err: %v", err)
+	}
+	events = aud.WaitForEvents(4, time.Second)
+	if ch := events[3].Changes[0]; *ch.OldDelta != 15 || *ch.Delta != 4 || *ch.NewDelta != 19 {
+		t.Fatalf("unexpected counter change: old=%d delta=%d new=%d", *ch.OldDelta, *ch.Delta, *ch.NewDelta)
+	}
+
+	failed := events[2]
+	if failed.Outcome != audit.OutcomeFailure || failed.Error != "disk full" {
+		t.Fatalf("unexpected failure event: %+v", failed)
+	}
+}
+
+func TestService_ReadAudit(t *testing.T) {
+	repo := newFakeRepo()
+	repo.gauges["Alloc"] = 1
+	aud := &fakeAuditor{}
+
+	svc := New(repo, aud)
+	if _, err := svc.Get(context.Background(), string(domain.Gauge), "Alloc"); err != nil {
+		t.Fatalf("Get err: %v", err)
+	}
+	if n := len(aud.Events()); n != 0 {
+		t.Fatalf("reads must not be audited by default, got %d events", n)
+	}
+
+	svc = New(repo, aud, WithReadAudit(true))
+	if _, err := svc.Get(context.Background(), string(domain.Gauge), "Alloc"); err != nil {
+		t.Fatalf("Get err: %v", err)
+	}
+	events := aud.WaitForEvents(1, time.Second)
+	if len(events) != 1 || events[0].Operation != audit.OpRead || !reflect.DeepEqual(events[0].Metrics, []string{"Alloc"}) {
+		t.Fatalf("unexpected read events: %+v", events)
+	}
+}
+
 func ptrFloat64(v float64) *float64 { return &v }
 func ptrInt(v int64) *int64         { return &v }
@@ -0,0 +1,188 @@
+// Package migrate copies metrics from one storage backend to another.
+//
+// A Plan compares a source snapshot with the current state of the target, lists what would
+// change and holds the batch that makes the change. Gauges are always overwritten; counters
+// are either overwritten, so the target ends with the source total, or added on top of what
+// the target already counts. After Apply, Verify checks the target against the state the plan
+// promised. The target should not receive other writes while a plan is applied.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+// CounterMode says how source counters are written into the target.
+type CounterMode string
+
+const (
+	// CountersOverwrite makes each target counter equal to the source counter.
+	CountersOverwrite CounterMode = "overwrite"
+	// CountersAdd adds each source counter to the target counter.
+	CountersAdd CounterMode = "add"
+)
+
+// defaultBatchSize bounds the items written per UpdateMany call.
+const defaultBatchSize = 1000
+
+// maxReported caps the mismatches listed in a Verify error.
+const maxReported = 5
+
+// ParseCounterMode parses overwrite or add.
+func ParseCounterMode(s string) (CounterMode, error) {
+	switch m := CounterMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case CountersOverwrite, CountersAdd:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown counter mode %q: want %s or %s", s, CountersOverwrite, CountersAdd)
+	}
+}
+
+// Summary counts how a plan affects one metric type.
+type Summary struct {
+	New       int
+	Changed   int
+	Unchanged int
+}
+
+// Change is one metric a plan writes. Old is nil for metrics the target does not have yet.
+type Change struct {
+	Old *domain.Metrics
+	New domain.Metrics
+}
+
+// Plan is the set of writes that brings the target in line with the source.
+type Plan struct {
+	// Want is the state the migrated metrics must have in the target afterwards.
+	Want    domain.Snapshot
+	Changes []Change
+	// Items holds the writes: gauge values and counter deltas.
+	Items    []domain.Metrics
+	Gauges   Summary
+	Counters Summary
+	Mode     CounterMode
+}
+
+// NewPlan compares src with the current target state dst.
+func NewPlan(src, dst domain.Snapshot, mode CounterMode) Plan {
+	p := Plan{
+		Mode: mode,
+		Want: domain.Snapshot{
+			Gauges:   make(map[string]float64, len(src.Gauges)),
+			Counters: make(map[string]int64, len(src.Counters)),
+		},
+	}
+	for _, it := range src.Items() {
+		if it.MType == string(domain.Gauge) {
+			p.planGauge(it.ID, *it.Value, dst)
+		} else {
+			p.planCounter(it.ID, *it.Delta, dst)
+		}
+	}
+	return p
+}
+
+func (p *Plan) planGauge(id string, v float64, dst domain.Snapshot) {
+	p.Want.Gauges[id] = v
+	old, ok := dst.Gauges[id]
+	switch {
+	case ok && old == v:
+		p.Gauges.Unchanged++
+		return
+	case ok:
+		p.Gauges.Changed++
+	default:
+		p.Gauges.New++
+	}
+	it := domain.Metrics{ID: id, MType: string(domain.Gauge), Value: &v}
+	p.Items = append(p.Items, it)
+	ch := Change{New: it}
+	if ok {
+		ch.Old = &domain.Metrics{ID: id, MType: it.MType, Value: &old}
+	}
+	p.Changes = append(p.Changes, ch)
+}
+
+func (p *Plan) planCounter(id string, v int64, dst domain.Snapshot) {
+	old, ok := dst.Counters[id]
+	want, delta := v, v-old
+	if p.Mode == CountersAdd {
+		want, delta = old+v, v
+	}
+	p.Want.Counters[id] = want
+	switch {
+	case delta == 0 && ok:
+		p.Counters.Unchanged++
+		return
+	case ok:
+		p.Counters.Changed++
+	default:
+		p.Counters.New++
+	}
+	p.Items = append(p.Items, domain.Metrics{ID: id, MType: string(domain.Counter), Delta: &delta})
+	ch := Change{New: domain.Metrics{ID: id, MType: string(domain.Counter), Delta: &want}}
+	if ok {
+		ch.Old = &domain.Metrics{ID: id, MType: string(domain.Counter), Delta: &old}
+	}
+	p.Changes = append(p.Changes, ch)
+}
+
+// Apply writes the plan to repo in batches of batchSize items (1000 when not positive)
+// and returns the number of batches written.
+func (p Plan) Apply(ctx context.Context, repo ports.MetricsRepo, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	batches := 0
+	for chunk := range slices.Chunk(p.Items, batchSize) {
+		if _, err := repo.UpdateMany(ctx, chunk); err != nil {
+			return batches, fmt.Errorf("write batch %d: %w", batches+1, err)
+		}
+		batches++
+	}
+	return batches, nil
+}
+
+// Verify checks that got holds every migrated metric with the value the plan promised.
+// Metrics the target has beyond the source are ignored.
+func (p Plan) Verify(got domain.Snapshot) error {
+	var errs []error
+	missing := 0
+	report := func(err error) {
+		missing++
+		if missing <= maxReported {
+			errs = append(errs, err)
+		}
+	}
+	for _, it := range p.Want.Items() {
+		if it.MType == string(domain.Gauge) {
+			if v, ok := got.Gauges[it.ID]; !ok || v != *it.Value {
+				report(fmt.Errorf("gauge %s: want %v, got %s", it.ID, *it.Value, describe(v, ok)))
+			}
+			continue
+		}
+		if d, ok := got.Counters[it.ID]; !ok || d != *it.Delta {
+			report(fmt.Errorf("counter %s: want %d, got %s", it.ID, *it.Delta, describe(d, ok)))
+		}
+	}
+	if missing == 0 {
+		return nil
+	}
+	if missing > maxReported {
+		errs = append(errs, fmt.Errorf("and %d more", missing-maxReported))
+	}
+	return fmt.Errorf("target differs from source in %d metrics: %w", missing, errors.Join(errs...))
+}
+
+func describe[T float64 | int64](v T, ok bool) string {
+	if !ok {
+		return "nothing"
+	}
+	return fmt.Sprint(v)
+}
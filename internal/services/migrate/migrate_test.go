@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/vshulcz/Golectra/internal/adapters/repository/memory"
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+	"github.com/vshulcz/Golectra/pkg/repotest"
+)
+
+func snapshot(gauges map[string]float64, counters map[string]int64) domain.Snapshot {
+	return domain.Snapshot{Gauges: gauges, Counters: counters}
+}
+
+func TestParseCounterMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    CounterMode
+		wantErr bool
+	}{
+		{"overwrite", CountersOverwrite, false},
+		{" ADD ", CountersAdd, false},
+		{"merge", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCounterMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("ParseCounterMode(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	src := snapshot(
+		map[string]float64{"A": 1, "B": 2, "C": 3},
+		map[string]int64{"X": 10, "Y": 5, "Z": 7},
+	)
+	dst := snapshot(
+		map[string]float64{"A": 1, "B": 9, "Extra": 4},
+		map[string]int64{"X": 10, "Y": 2},
+	)
+	tests := []struct {
+		name         string
+		mode         CounterMode
+		wantCounters Summary
+		wantDeltas   map[string]int64
+		wantState    map[string]int64
+	}{
+		{
+			name:         "overwrite",
+			mode:         CountersOverwrite,
+			wantCounters: Summary{New: 1, Changed: 1, Unchanged: 1},
+			wantDeltas:   map[string]int64{"Y": 3, "Z": 7},
+			wantState:    map[string]int64{"X": 10, "Y": 5, "Z": 7},
+		},
+		{
+			name:         "add",
+			mode:         CountersAdd,
+			wantCounters: Summary{New: 1, Changed: 2},
+			wantDeltas:   map[string]int64{"X": 10, "Y": 5, "Z": 7},
+			wantState:    map[string]int64{"X": 20, "Y": 7, "Z": 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPlan(src, dst, tt.mode)
+			if want := (Summary{New: 1, Changed: 1, Unchanged: 1}); p.Gauges != want {
+				t.Fatalf("gauges: want %+v, got %+v", want, p.Gauges)
+			}
+			if p.Counters != tt.wantCounters {
+				t.Fatalf("counters: want %+v, got %+v", tt.wantCounters, p.Counters)
+			}
+			deltas := map[string]int64{}
+			for _, it := range p.Items {
+				if it.MType == string(domain.Counter) {
+					deltas[it.ID] = *it.Delta
+				}
+			}
+			if !maps.Equal(deltas, tt.wantDeltas) {
+				t.Fatalf("deltas: want %v, got %v", tt.wantDeltas, deltas)
+			}
+			if !maps.Equal(p.Want.Counters, tt.wantState) {
+				t.Fatalf("want state: %v, got %v", tt.wantState, p.Want.Counters)
+			}
+			if len(p.Changes) != len(p.Items) {
+				t.Fatalf("every write should be listed as a change: %d changes, %d items", len(p.Changes), len(p.Items))
+			}
+		})
+	}
+}
+
+func TestPlan_ApplyAndVerify(t *testing.T) {
+	ctx := context.Background()
+	src := snapshot(map[string]float64{"A": 1, "B": 2, "C": 3}, map[string]int64{"X": 10, "Y": 5})
+
+	for _, mode := range []CounterMode{CountersOverwrite, CountersAdd} {
+		t.Run(string(mode), func(t *testing.T) {
+			target := memory.New()
+			if _, err := target.UpdateMany(ctx, []domain.Metrics{repotest.Gauge("A", 7), repotest.Counter("X", 4), repotest.Gauge("Extra", 1)}); err != nil {
+				t.Fatalf("seed: %v", err)
+			}
+			before, _ := target.Snapshot(ctx)
+			p := NewPlan(src, before, mode)
+
+			batches, err := p.Apply(ctx, target, 2)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if want := (len(p.Items) + 1) / 2; batches != want {
+				t.Fatalf("want %d batches, got %d", want, batches)
+			}
+			after, _ := target.Snapshot(ctx)
+			if err := p.Verify(after); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			wantX := int64(10)
+			if mode == CountersAdd {
+				wantX = 14
+			}
+			repotest.ExpectState(t, target,
+				map[string]float64{"A": 1, "B": 2, "C": 3, "Extra": 1},
+				map[string]int64{"X": wantX, "Y": 5})
+
+			// Applying the same plan again is reported, not silently accepted.
+			if _, err := p.Apply(ctx, target, 0); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			after, _ = target.Snapshot(ctx)
+			if err := p.Verify(after); err == nil || !strings.Contains(err.Error(), "counter X") {
+				t.Fatalf("want a counter mismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPlan_ApplyError(t *testing.T) {
+	p := NewPlan(snapshot(map[string]float64{"A": 1, "B": 2}, nil), domain.Snapshot{}, CountersOverwrite)
+	repo := failingRepo{MetricsRepo: memory.New()}
+	if n, err := p.Apply(context.Background(), repo, 1); !errors.Is(err, errWrite) || n != 0 {
+		t.Fatalf("want the write error after 0 batches, got %d, %v", n, err)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failingRepo struct {
+	ports.MetricsRepo
+}
+
+func (failingRepo) UpdateMany(context.Context, []domain.Metrics) (domain.Snapshot, error) {
+	return domain.Snapshot{}, errWrite
+}
+
+func TestPlan_VerifyReportsFirstMismatches(t *testing.T) {
+	gauges := map[string]float64{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		gauges[id] = 1
+	}
+	p := NewPlan(snapshot(gauges, nil), domain.Snapshot{}, CountersOverwrite)
+	err := p.Verify(domain.Snapshot{})
+	if err == nil || !strings.Contains(err.Error(), "7 metrics") || !strings.Contains(err.Error(), "and 2 more") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,2 +1,8 @@
 // Package observer implements the Observer design pattern.
+//
+// A Subject fans events out to its observers. Observers attached with Attach are called
+// synchronously; Subscribe can instead give an observer its own worker with a bounded
+// buffer (Async), a per-notify deadline (WithTimeout) and a name for error reports, and
+// returns a Subscription whose Detach removes it. Panics are recovered and, like errors,
+// passed to the error handler. Each observer sees events in publish order.
 package observer
@@ -2,7 +2,12 @@ package observer
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
 	"sync"
+	"time"
 )
 
 // Observer defines the callback contract for receiving published events of type T.
@@ -28,48 +33,223 @@ type Publisher[T any] interface {
 	Publish(context.Context, T)
 }
 
+// ErrBufferFull is reported to the error handler when an async observer's buffer
+// is full and the event is dropped for that observer.
+var ErrBufferFull = errors.New("observer buffer full")
+
+// PanicError is reported to the error handler when an observer panics.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+// Error reports the recovered panic value.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("observer panic: %v", e.Value)
+}
+
+// Option configures how Subscribe attaches one observer.
+type Option func(*options)
+
+type options struct {
+	name    string
+	buffer  int
+	timeout time.Duration
+	async   bool
+}
+
+// Async delivers events to the observer from a dedicated worker with a buffer of n events,
+// so a slow observer never blocks Publish or the other observers. Events reach the observer
+// in publish order; when the buffer is full the event is dropped and ErrBufferFull reported.
+func Async(n int) Option {
+	return func(o *options) {
+		o.async = true
+		o.buffer = max(n, 1)
+	}
+}
+
+// WithTimeout bounds every Notify call with a context deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.timeout = d
+		}
+	}
+}
+
+// WithName labels the observer in errors passed to the error handler.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+type delivery[T any] struct {
+	ctx context.Context
+	evt T
+}
+
+// Subscription is the handle of one attached observer.
+type Subscription[T any] struct {
+	subject *Subject[T]
+	obs     Observer[T]
+	queue   chan delivery[T]
+	done    chan struct{}
+	opts    options
+	mu      sync.RWMutex
+	closed  bool
+}
+
+// Detach stops delivering new events to the observer. For an async observer it waits
+// until the events already buffered have been delivered, so it must not be called from
+// that observer's own Notify. Detach is idempotent.
+func (sub *Subscription[T]) Detach() {
+	if sub == nil {
+		return
+	}
+	sub.subject.remove(sub)
+
+	sub.mu.Lock()
+	if sub.closed {
+		sub.mu.Unlock()
+		return
+	}
+	sub.closed = true
+	if sub.queue != nil {
+		close(sub.queue)
+	}
+	sub.mu.Unlock()
+
+	if sub.done != nil {
+		<-sub.done
+	}
+}
+
+func (sub *Subscription[T]) deliver(ctx context.Context, evt T) {
+	sub.mu.RLock()
+	if sub.closed {
+		sub.mu.RUnlock()
+		return
+	}
+	if sub.queue == nil {
+		// Call outside the lock so a synchronous observer may detach itself.
+		sub.mu.RUnlock()
+		sub.notify(ctx, evt)
+		return
+	}
+	defer sub.mu.RUnlock()
+	// The worker outlives the publisher's call, so keep its values but not its cancellation.
+	select {
+	case sub.queue <- delivery[T]{ctx: context.WithoutCancel(ctx), evt: evt}:
+	default:
+		sub.report(ErrBufferFull)
+	}
+}
+
+func (sub *Subscription[T]) run() {
+	defer close(sub.done)
+	for d := range sub.queue {
+		sub.notify(d.ctx, d.evt)
+	}
+}
+
+func (sub *Subscription[T]) notify(ctx context.Context, evt T) {
+	if sub.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sub.opts.timeout)
+		defer cancel()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			sub.report(&PanicError{Value: v, Stack: debug.Stack()})
+		}
+	}()
+	if err := sub.obs.Notify(ctx, evt); err != nil {
+		sub.report(err)
+	}
+}
+
+func (sub *Subscription[T]) report(err error) {
+	handler := sub.subject.errorHandler()
+	if handler == nil {
+		return
+	}
+	if sub.opts.name != "" {
+		err = fmt.Errorf("observer %s: %w", sub.opts.name, err)
+	}
+	handler(err)
+}
+
 // Subject coordinates observer registrations and event fan-out.
 type Subject[T any] struct {
-	mu        sync.RWMutex
-	observers []Observer[T]
-	onError   func(error)
+	mu      sync.RWMutex
+	subs    []*Subscription[T]
+	onError func(error)
 }
 
 // NewSubject constructs a Subject with optional initial observers.
 func NewSubject[T any](observers ...Observer[T]) *Subject[T] {
-	cp := append([]Observer[T](nil), observers...)
-	return &Subject[T]{observers: cp}
+	s := &Subject[T]{}
+	s.Attach(observers...)
+	return s
 }
 
-// Publish invokes every observer with the provided event.
+// Publish hands the event to every observer. Synchronous observers are called in
+// attach order before Publish returns; async observers only have the event queued.
+// Errors and panics are reported to the error handler and never reach the caller.
 func (s *Subject[T]) Publish(ctx context.Context, evt T) {
 	if s == nil {
 		return
 	}
 
 	s.mu.RLock()
-	observers := append([]Observer[T](nil), s.observers...)
-	errHandler := s.onError
+	subs := slices.Clone(s.subs)
 	s.mu.RUnlock()
 
-	for _, obs := range observers {
-		if obs == nil {
-			continue
-		}
-		if err := obs.Notify(ctx, evt); err != nil && errHandler != nil {
-			errHandler(err)
-		}
+	for _, sub := range subs {
+		sub.deliver(ctx, evt)
 	}
 }
 
-// Attach registers additional observers to the subject.
+// Attach registers additional synchronous observers to the subject.
 func (s *Subject[T]) Attach(observers ...Observer[T]) {
-	if s == nil || len(observers) == 0 {
-		return
+	for _, obs := range observers {
+		s.Subscribe(obs)
 	}
+}
+
+// Subscribe registers one observer and returns the handle that detaches it.
+func (s *Subject[T]) Subscribe(obs Observer[T], opts ...Option) *Subscription[T] {
+	if s == nil || obs == nil {
+		return nil
+	}
+	sub := &Subscription[T]{subject: s, obs: obs}
+	for _, opt := range opts {
+		opt(&sub.opts)
+	}
+	if sub.opts.async {
+		sub.queue = make(chan delivery[T], sub.opts.buffer)
+		sub.done = make(chan struct{})
+		go sub.run()
+	}
+
 	s.mu.Lock()
-	s.observers = append(s.observers, observers...)
+	s.subs = append(s.subs, sub)
 	s.mu.Unlock()
+	return sub
+}
+
+// Close detaches every observer, waiting for async observers to drain their buffers.
+func (s *Subject[T]) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	subs := slices.Clone(s.subs)
+	s.mu.RUnlock()
+	for _, sub := range subs {
+		sub.Detach()
+	}
 }
 
 // SetErrorHandler configures a callback for observer failures.
@@ -81,3 +261,15 @@ func (s *Subject[T]) SetErrorHandler(fn func(error)) {
 	s.onError = fn
 	s.mu.Unlock()
 }
+
+func (s *Subject[T]) errorHandler() func(error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.onError
+}
+
+func (s *Subject[T]) remove(sub *Subscription[T]) {
+	s.mu.Lock()
+	s.subs = slices.DeleteFunc(s.subs, func(x *Subscription[T]) bool { return x == sub })
+	s.mu.Unlock()
+}
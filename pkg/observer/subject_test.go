@@ -3,8 +3,12 @@ package observer_test
 import (
 	"context"
 	"errors"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/vshulcz/Golectra/pkg/observer"
 )
@@ -61,3 +65,149 @@ func TestSubject_ErrorHandler(t *testing.T) {
 		t.Fatalf("expected error handler to capture boom, got %+v", errs)
 	}
 }
+
+func TestSubject_Detach(t *testing.T) {
+	subj := observer.NewSubject[testEvent]()
+	var calls int
+	sub := subj.Subscribe(observer.ObserverFunc[testEvent](func(_ context.Context, _ testEvent) error {
+		calls++
+		return nil
+	}))
+
+	subj.Publish(context.Background(), testEvent{})
+	sub.Detach()
+	sub.Detach()
+	subj.Publish(context.Background(), testEvent{})
+
+	if calls != 1 {
+		t.Fatalf("expected 1 call before detach, got %d", calls)
+	}
+}
+
+func TestSubject_PanicRecovered(t *testing.T) {
+	subj := observer.NewSubject[testEvent]()
+	var mu sync.Mutex
+	var errs []error
+	subj.SetErrorHandler(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	var reached bool
+	subj.Subscribe(observer.ObserverFunc[testEvent](func(context.Context, testEvent) error {
+		panic("kaboom")
+	}), observer.WithName("bad"))
+	subj.Attach(observer.ObserverFunc[testEvent](func(context.Context, testEvent) error {
+		reached = true
+		return nil
+	}))
+
+	subj.Publish(context.Background(), testEvent{})
+
+	mu.Lock()
+	defer mu.Unlock()
+	var pe *observer.PanicError
+	if len(errs) != 1 || !errors.As(errs[0], &pe) || pe.Value != "kaboom" || len(pe.Stack) == 0 {
+		t.Fatalf("expected recovered panic, got %+v", errs)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "observer bad: ") {
+		t.Fatalf("expected observer name in error, got %q", errs[0])
+	}
+	if !reached {
+		t.Fatal("observer after the panicking one was not notified")
+	}
+}
+
+func TestSubject_AsyncOrderedAndNonBlocking(t *testing.T) {
+	subj := observer.NewSubject[testEvent]()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+	slow := subj.Subscribe(observer.ObserverFunc[testEvent](func(_ context.Context, evt testEvent) error {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, evt.ID)
+		return nil
+	}), observer.Async(16))
+
+	var fast int
+	subj.Attach(observer.ObserverFunc[testEvent](func(context.Context, testEvent) error {
+		fast++
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := range 10 {
+		subj.Publish(ctx, testEvent{ID: strconv.Itoa(i)})
+	}
+	cancel()
+	if fast != 10 {
+		t.Fatalf("slow async observer blocked the others: fast got %d", fast)
+	}
+
+	close(release)
+	slow.Detach()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("want ordered delivery %v, got %v", want, got)
+	}
+}
+
+func TestSubject_AsyncBufferFull(t *testing.T) {
+	subj := observer.NewSubject[testEvent]()
+	var mu sync.Mutex
+	var errs []error
+	subj.SetErrorHandler(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	subj.Subscribe(observer.ObserverFunc[testEvent](func(context.Context, testEvent) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}), observer.Async(2))
+
+	subj.Publish(context.Background(), testEvent{})
+	<-started
+	for range 3 {
+		subj.Publish(context.Background(), testEvent{})
+	}
+
+	mu.Lock()
+	if len(errs) != 1 || !errors.Is(errs[0], observer.ErrBufferFull) {
+		mu.Unlock()
+		t.Fatalf("expected one ErrBufferFull, got %+v", errs)
+	}
+	mu.Unlock()
+
+	close(release)
+	subj.Close()
+}
+
+func TestSubject_Timeout(t *testing.T) {
+	subj := observer.NewSubject[testEvent]()
+	var got error
+	subj.SetErrorHandler(func(err error) { got = err })
+	subj.Subscribe(observer.ObserverFunc[testEvent](func(ctx context.Context, _ testEvent) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}), observer.WithTimeout(10*time.Millisecond))
+
+	start := time.Now()
+	subj.Publish(context.Background(), testEvent{})
+	if !errors.Is(got, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("expected deadline exceeded, got %v after %v", got, time.Since(start))
+	}
+}
@@ -0,0 +1,640 @@
+// Package repotest is a conformance suite for ports.MetricsRepo implementations.
+//
+// A backend's test calls Run with a factory returning an empty repository; every
+// scenario gets its own. The suite checks not-found errors, gauge and counter
+// namespaces, counter accumulation and the totals AddCounter returns, batch atomicity,
+// revisions, gauge compare-and-set, gauge operations, snapshot isolation, concurrent writers and context
+// cancellation. Backends that persist data can pass
+// WithReopen so the scenarios also read the data back as a restarted server would.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/vshulcz/Golectra/internal/domain"
+	"github.com/vshulcz/Golectra/internal/ports"
+)
+
+// Factory returns an empty repository. It may register cleanup with t.Cleanup and
+// call t.Skip when the backend is unavailable.
+type Factory func(t *testing.T) ports.MetricsRepo
+
+// Reopener returns a repository over the same data as repo, as seen after a restart.
+type Reopener func(t *testing.T, repo ports.MetricsRepo) ports.MetricsRepo
+
+// Option customizes Run.
+type Option func(*suite)
+
+// WithReopen reads data back through reopen in the scenarios that check persisted state.
+// Without it the same repository instance is reused.
+func WithReopen(reopen Reopener) Option {
+	return func(s *suite) {
+		s.reopen = reopen
+	}
+}
+
+// WithConcurrency sets how many goroutines the concurrent-writer scenarios start; the default is 8.
+func WithConcurrency(n int) Option {
+	return func(s *suite) {
+		if n > 0 {
+			s.workers = n
+		}
+	}
+}
+
+type suite struct {
+	newRepo Factory
+	reopen  Reopener
+	workers int
+}
+
+// Run executes every scenario as a subtest of t. Scenarios run sequentially, so a factory
+// may reset shared state such as a database table.
+func Run(t *testing.T, newRepo Factory, opts ...Option) {
+	t.Helper()
+	s := &suite{
+		newRepo: newRepo,
+		reopen:  func(_ *testing.T, repo ports.MetricsRepo) ports.MetricsRepo { return repo },
+		workers: 8,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	scenarios := []struct {
+		name string
+		fn   func(*testing.T)
+	}{
+		{"NotFound", s.testNotFound},
+		{"TypeNamespaces", s.testTypeNamespaces},
+		{"CounterAccumulates", s.testCounterAccumulates},
+		{"BatchFolding", s.testBatchFolding},
+		{"BatchAtomicity", s.testBatchAtomicity},
+		{"Revisions", s.testRevisions},
+		{"CompareAndSetGauge", s.testCompareAndSetGauge},
+		{"GaugeOps", s.testGaugeOps},
+		{"SnapshotIsolation", s.testSnapshotIsolation},
+		{"ConcurrentWriters", s.testConcurrentWriters},
+		{"ContextCanceled", s.testContextCanceled},
+	}
+	for _, sc := range scenarios {
+		t.Run(sc.name, sc.fn)
+	}
+}
+
+// Gauge builds a gauge item for UpdateMany.
+func Gauge(id string, v float64) domain.Metrics {
+	return domain.Metrics{ID: id, MType: string(domain.Gauge), Value: &v}
+}
+
+// Counter builds a counter item for UpdateMany.
+func Counter(id string, d int64) domain.Metrics {
+	return domain.Metrics{ID: id, MType: string(domain.Counter), Delta: &d}
+}
+
+// ExpectState fails t unless repo holds exactly the given gauges and counters,
+// checked through the single-metric getters and through Snapshot.
+func ExpectState(t *testing.T, repo ports.MetricsRepo, gauges map[string]float64, counters map[string]int64) {
+	t.Helper()
+	ctx := context.Background()
+	for id, want := range gauges {
+		got, err := repo.GetGauge(ctx, id)
+		if err != nil || got != want {
+			t.Fatalf("GetGauge(%s) = %v, %v; want %v", id, got, err, want)
+		}
+	}
+	for id, want := range counters {
+		got, err := repo.GetCounter(ctx, id)
+		if err != nil || got != want {
+			t.Fatalf("GetCounter(%s) = %v, %v; want %v", id, got, err, want)
+		}
+	}
+	snap, err := repo.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if !sameMap(snap.Gauges, gauges) || !sameMap(snap.Counters, counters) {
+		t.Fatalf("Snapshot = %v / %v; want %v / %v", snap.Gauges, snap.Counters, gauges, counters)
+	}
+}
+
+func sameMap[V comparable](got, want map[string]V) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, v := range want {
+		if g, ok := got[k]; !ok || g != v {
+			return false
+		}
+	}
+	return true
+}
+
+// addCounter drops the total returned by AddCounter.
+func addCounter(ctx context.Context, repo ports.MetricsRepo, name string, delta int64) error {
+	_, err := repo.AddCounter(ctx, name, delta)
+	return err
+}
+
+// updateMany applies a batch and drops the values it reports replacing.
+func updateMany(ctx context.Context, repo ports.MetricsRepo, items []domain.Metrics) error {
+	_, err := repo.UpdateMany(ctx, items)
+	return err
+}
+
+// expectTotal fails t unless AddCounter returns want.
+func expectTotal(t *testing.T, repo ports.MetricsRepo, name string, delta, want int64) {
+	t.Helper()
+	got, err := repo.AddCounter(context.Background(), name, delta)
+	if err != nil || got != want {
+		t.Fatalf("AddCounter(%s, %d) = %d, %v; want %d", name, delta, got, err, want)
+	}
+}
+
+func must(t *testing.T, err error, what string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+func (s *suite) testNotFound(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	if _, err := repo.GetGauge(ctx, "missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("GetGauge(missing): want ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetCounter(ctx, "missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("GetCounter(missing): want ErrNotFound, got %v", err)
+	}
+	ExpectState(t, repo, map[string]float64{}, map[string]int64{})
+}
+
+func (s *suite) testTypeNamespaces(t *testing.T) {
+	tests := []struct {
+		name         string
+		write        func(ctx context.Context, repo ports.MetricsRepo) error
+		wantGauges   map[string]float64
+		wantCounters map[string]int64
+	}{
+		{
+			name: "counter does not replace gauge",
+			write: func(ctx context.Context, repo ports.MetricsRepo) error {
+				return errors.Join(repo.SetGauge(ctx, "X", 1.5), addCounter(ctx, repo, "X", 3))
+			},
+			wantGauges:   map[string]float64{"X": 1.5},
+			wantCounters: map[string]int64{"X": 3},
+		},
+		{
+			name: "gauge does not reset counter",
+			write: func(ctx context.Context, repo ports.MetricsRepo) error {
+				return errors.Join(addCounter(ctx, repo, "X", 3), repo.SetGauge(ctx, "X", 2.5), addCounter(ctx, repo, "X", 4))
+			},
+			wantGauges:   map[string]float64{"X": 2.5},
+			wantCounters: map[string]int64{"X": 7},
+		},
+		{
+			name: "batch with both types under one name",
+			write: func(ctx context.Context, repo ports.MetricsRepo) error {
+				return updateMany(ctx, repo, []domain.Metrics{
+					Gauge("X", 1), Counter("X", 2), Gauge("X", 3), Counter("X", 5), Gauge("Y", 9),
+				})
+			},
+			wantGauges:   map[string]float64{"X": 3, "Y": 9},
+			wantCounters: map[string]int64{"X": 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := s.newRepo(t)
+			must(t, tt.write(ctx, repo), "write")
+			ExpectState(t, s.reopen(t, repo), tt.wantGauges, tt.wantCounters)
+
+			other := s.reopen(t, repo)
+			for id := range tt.wantGauges {
+				if _, ok := tt.wantCounters[id]; ok {
+					continue
+				}
+				if _, err := other.GetCounter(ctx, id); !errors.Is(err, domain.ErrNotFound) {
+					t.Fatalf("GetCounter(%s): want ErrNotFound for a gauge-only name, got %v", id, err)
+				}
+			}
+		})
+	}
+}
+
+func (s *suite) testCounterAccumulates(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	expectTotal(t, repo, "PollCount", 5, 5)
+	expectTotal(t, repo, "PollCount", -2, 3)
+	repo = s.reopen(t, repo)
+	must(t, updateMany(ctx, repo, []domain.Metrics{Counter("PollCount", 4), Counter("PollCount", 3)}), "UpdateMany")
+	repo = s.reopen(t, repo)
+	expectTotal(t, repo, "PollCount", 1, 11)
+	ExpectState(t, s.reopen(t, repo), map[string]float64{}, map[string]int64{"PollCount": 11})
+}
+
+func (s *suite) testBatchFolding(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	must(t, repo.SetGauge(ctx, "Alloc", 1), "SetGauge")
+	must(t, addCounter(ctx, repo, "NoDelta", 1), "AddCounter")
+	prior, err := repo.UpdateMany(ctx, []domain.Metrics{
+		Gauge("Alloc", 2), Gauge("Alloc", 3),
+		Counter("Hits", 1), Counter("Hits", 1), Counter("Hits", 1),
+		{ID: "NoValue", MType: string(domain.Gauge)},
+		{ID: "NoDelta", MType: string(domain.Counter)},
+	})
+	must(t, err, "UpdateMany")
+	// Only metrics the batch writes and already held a value are reported.
+	expectPrior(t, prior, map[string]float64{"Alloc": 1}, map[string]int64{})
+	must(t, updateMany(ctx, repo, nil), "UpdateMany(nil)")
+	ExpectState(t, s.reopen(t, repo), map[string]float64{"Alloc": 3}, map[string]int64{"Hits": 3, "NoDelta": 1})
+}
+
+// expectPrior fails t unless UpdateMany reported replacing exactly the given values.
+func expectPrior(t *testing.T, prior domain.Snapshot, gauges map[string]float64, counters map[string]int64) {
+	t.Helper()
+	if len(prior.Gauges) != len(gauges) || len(prior.Counters) != len(counters) {
+		t.Fatalf("UpdateMany replaced %v %v; want %v %v", prior.Gauges, prior.Counters, gauges, counters)
+	}
+	for id, v := range gauges {
+		if got, ok := prior.Gauges[id]; !ok || got != v {
+			t.Fatalf("UpdateMany replaced gauge %s = %v (%t); want %v", id, got, ok, v)
+		}
+	}
+	for id, d := range counters {
+		if got, ok := prior.Counters[id]; !ok || got != d {
+			t.Fatalf("UpdateMany replaced counter %s = %d (%t); want %d", id, got, ok, d)
+		}
+	}
+}
+
+// testBatchAtomicity checks that a reader never sees part of a batch: every batch
+// sets A and B to the same value, so a snapshot must never show them apart.
+func (s *suite) testBatchAtomicity(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	must(t, updateMany(ctx, repo, []domain.Metrics{Gauge("A", 0), Gauge("B", 0), Counter("N", 1)}), "UpdateMany")
+
+	const batches = 50
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= batches; i++ {
+			if err := updateMany(ctx, repo, []domain.Metrics{Gauge("A", float64(i)), Counter("N", 1), Gauge("B", float64(i))}); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for {
+		snap, err := repo.Snapshot(ctx)
+		if err != nil {
+			t.Fatalf("Snapshot: %v", err)
+		}
+		a, b, n := snap.Gauges["A"], snap.Gauges["B"], snap.Counters["N"]
+		if a != b || n != int64(a)+1 {
+			t.Fatalf("partial batch visible: A=%v B=%v N=%v", a, b, n)
+		}
+		select {
+		case <-done:
+			select {
+			case err := <-errs:
+				t.Fatalf("UpdateMany: %v", err)
+			default:
+			}
+			ExpectState(t, repo, map[string]float64{"A": batches, "B": batches}, map[string]int64{"N": batches + 1})
+			return
+		default:
+		}
+	}
+}
+
+func (s *suite) testRevisions(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	must(t, repo.SetGauge(ctx, "Old", 1), "SetGauge")
+	must(t, addCounter(ctx, repo, "OldCount", 1), "AddCounter")
+	rev, err := repo.Revision(ctx)
+	must(t, err, "Revision")
+
+	must(t, updateMany(ctx, repo, []domain.Metrics{Gauge("New", 2), Counter("OldCount", 1)}), "UpdateMany")
+	next, err := repo.Revision(ctx)
+	must(t, err, "Revision")
+	if next <= rev {
+		t.Fatalf("revision did not grow: %d -> %d", rev, next)
+	}
+
+	since, err := repo.SnapshotSince(ctx, rev)
+	must(t, err, "SnapshotSince")
+	if !sameMap(since.Gauges, map[string]float64{"New": 2}) || !sameMap(since.Counters, map[string]int64{"OldCount": 2}) {
+		t.Fatalf("SnapshotSince(%d) = %v / %v; want only the later writes", rev, since.Gauges, since.Counters)
+	}
+	if since.Revision < next {
+		t.Fatalf("SnapshotSince revision %d is behind Revision %d", since.Revision, next)
+	}
+	all, err := repo.Snapshot(ctx)
+	must(t, err, "Snapshot")
+	if len(all.Gauges) != 2 || all.Revision < next {
+		t.Fatalf("Snapshot = %+v", all)
+	}
+}
+
+// expectGaugeRevision fails t unless the gauge holds want at revision rev.
+func expectGaugeRevision(t *testing.T, repo ports.MetricsRepo, name string, want float64, rev int64) {
+	t.Helper()
+	got, gotRev, err := repo.GetGaugeWithRevision(context.Background(), name)
+	if err != nil || got != want || gotRev != rev {
+		t.Fatalf("GetGaugeWithRevision(%s) = %v, %d, %v; want %v at %d", name, got, gotRev, err, want, rev)
+	}
+}
+
+func (s *suite) testCompareAndSetGauge(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	w, err := repo.CompareAndSetGauge(ctx, "Temp", 1, 0)
+	must(t, err, "CompareAndSetGauge(create)")
+	created := w.Revision
+	if created <= 0 || w.Old != nil || w.Value != 1 {
+		t.Fatalf("create reported %+v", w)
+	}
+	expectGaugeRevision(t, repo, "Temp", 1, created)
+	if _, err := repo.CompareAndSetGauge(ctx, "Temp", 2, 0); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("create over an existing gauge: want ErrRevisionMismatch, got %v", err)
+	}
+
+	w, err = repo.CompareAndSetGauge(ctx, "Temp", 3, created)
+	must(t, err, "CompareAndSetGauge(update)")
+	updated := w.Revision
+	if updated <= created {
+		t.Fatalf("revision did not grow: %d -> %d", created, updated)
+	}
+	if w.Old == nil || *w.Old != 1 {
+		t.Fatalf("update reported replacing %v; want 1", w.Old)
+	}
+	if _, err := repo.CompareAndSetGauge(ctx, "Temp", 4, created); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("stale update: want ErrRevisionMismatch, got %v", err)
+	}
+	expectGaugeRevision(t, repo, "Temp", 3, updated)
+
+	// Unconditional writes move the revision too.
+	must(t, repo.SetGauge(ctx, "Temp", 5), "SetGauge")
+	if _, err := repo.CompareAndSetGauge(ctx, "Temp", 6, updated); !errors.Is(err, domain.ErrRevisionMismatch) {
+		t.Fatalf("update after SetGauge: want ErrRevisionMismatch, got %v", err)
+	}
+
+	repo = s.reopen(t, repo)
+	_, rev, err := repo.GetGaugeWithRevision(ctx, "Temp")
+	must(t, err, "GetGaugeWithRevision")
+	if _, err := repo.CompareAndSetGauge(ctx, "Temp", 7, rev); err != nil {
+		t.Fatalf("update after reopen: %v", err)
+	}
+
+	// Writers racing from the same revision: exactly one wins.
+	_, rev, err = repo.GetGaugeWithRevision(ctx, "Temp")
+	must(t, err, "GetGaugeWithRevision")
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		won  []float64
+		errs = make(chan error, s.workers)
+	)
+	for w := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.CompareAndSetGauge(ctx, "Temp", float64(100+w), rev)
+			switch {
+			case err == nil:
+				mu.Lock()
+				won = append(won, float64(100+w))
+				mu.Unlock()
+			case !errors.Is(err, domain.ErrRevisionMismatch):
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent compare-and-set: %v", err)
+	}
+	if len(won) != 1 {
+		t.Fatalf("%d writers won the same revision; want exactly one", len(won))
+	}
+	ExpectState(t, s.reopen(t, repo), map[string]float64{"Temp": won[0]}, map[string]int64{})
+}
+
+// GaugeOp builds a gauge item for UpdateMany that combines v with the stored value using op.
+func GaugeOp(id string, op domain.GaugeOp, v float64) domain.Metrics {
+	m := Gauge(id, v)
+	m.Op = op
+	return m
+}
+
+func (s *suite) testGaugeOps(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	steps := []struct {
+		op   domain.GaugeOp
+		v    float64
+		want float64
+	}{
+		{domain.GaugeAdd, 2, 2}, // a missing gauge takes the value whatever the operation
+		{domain.GaugeAdd, 3, 5},
+		{domain.GaugeMax, 4, 5},
+		{domain.GaugeMax, 8, 8},
+		{domain.GaugeMin, 6, 6},
+		{domain.GaugeSet, 1, 1},
+		{"", 1.5, 1.5},
+		{domain.GaugeMin, -3, -3},
+	}
+	var (
+		last int64
+		old  *float64
+	)
+	for _, st := range steps {
+		w, err := repo.ApplyGauge(ctx, "Load", st.op, st.v)
+		must(t, err, fmt.Sprintf("ApplyGauge(%q, %v)", st.op, st.v))
+		if w.Value != st.want || w.Revision <= last {
+			t.Fatalf("ApplyGauge(%q, %v) = %v at %d; want %v after revision %d", st.op, st.v, w.Value, w.Revision, st.want, last)
+		}
+		if (w.Old == nil) != (old == nil) || (old != nil && *w.Old != *old) {
+			t.Fatalf("ApplyGauge(%q, %v) replaced %v; want %v", st.op, st.v, w.Old, old)
+		}
+		expectGaugeRevision(t, repo, "Load", st.want, w.Revision)
+		last, old = w.Revision, &st.want
+	}
+	if _, err := repo.ApplyGauge(ctx, "Load", "avg", 1); !errors.Is(err, domain.ErrInvalidType) {
+		t.Fatalf("unknown operation: want ErrInvalidType, got %v", err)
+	}
+
+	// A batch applies its operations in order, whether or not they fold together.
+	must(t, repo.SetGauge(ctx, "X", 4), "SetGauge")
+	prior, err := repo.UpdateMany(ctx, []domain.Metrics{
+		GaugeOp("X", domain.GaugeAdd, 2), GaugeOp("X", domain.GaugeMax, 5), Counter("X", 1),
+		GaugeOp("Y", domain.GaugeMin, 3), GaugeOp("X", domain.GaugeAdd, 1), Gauge("Y", 1),
+		GaugeOp("Y", domain.GaugeAdd, 2), GaugeOp("Z", domain.GaugeMax, -1), GaugeOp("Y", domain.GaugeMax, 2),
+	})
+	must(t, err, "UpdateMany")
+	expectPrior(t, prior, map[string]float64{"X": 4}, map[string]int64{})
+	want := map[string]float64{"Load": -3, "X": 7, "Y": 3, "Z": -1}
+	ExpectState(t, repo, want, map[string]int64{"X": 1})
+
+	// Concurrent adds all land.
+	const perWorker = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, s.workers)
+	for range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				var err error
+				if i%2 == 0 {
+					_, err = repo.ApplyGauge(ctx, "Sum", domain.GaugeAdd, 0.5)
+				} else {
+					err = updateMany(ctx, repo, []domain.Metrics{GaugeOp("Sum", domain.GaugeAdd, 0.25), GaugeOp("Sum", domain.GaugeAdd, 0.25)})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent add: %v", err)
+	}
+	want["Sum"] = float64(s.workers*perWorker) * 0.5
+	ExpectState(t, s.reopen(t, repo), want, map[string]int64{"X": 1})
+}
+
+func (s *suite) testSnapshotIsolation(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	must(t, updateMany(ctx, repo, []domain.Metrics{Gauge("G", 1), Counter("C", 1)}), "UpdateMany")
+	snap, err := repo.Snapshot(ctx)
+	must(t, err, "Snapshot")
+
+	must(t, updateMany(ctx, repo, []domain.Metrics{Gauge("G", 2), Counter("C", 1), Gauge("Later", 3)}), "UpdateMany")
+	if !sameMap(snap.Gauges, map[string]float64{"G": 1}) || !sameMap(snap.Counters, map[string]int64{"C": 1}) {
+		t.Fatalf("snapshot changed by later writes: %v / %v", snap.Gauges, snap.Counters)
+	}
+
+	// Mutating a snapshot must not reach the store either.
+	snap.Gauges["G"] = 100
+	snap.Counters["Injected"] = 1
+	ExpectState(t, repo, map[string]float64{"G": 2, "Later": 3}, map[string]int64{"C": 2})
+}
+
+func (s *suite) testConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	repo := s.newRepo(t)
+	const perWorker = 24 // even, so the last write of each worker is its gauge
+
+	var wg sync.WaitGroup
+	errs := make(chan error, s.workers)
+	totals := make(chan int64, s.workers*perWorker)
+	for w := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				var err error
+				if i%2 == 0 {
+					var total int64
+					total, err = repo.AddCounter(ctx, "Shared", 1)
+					totals <- total
+				} else {
+					err = updateMany(ctx, repo, []domain.Metrics{Counter("Shared", 1), Gauge(fmt.Sprintf("W%d", w), float64(i))})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(totals)
+	for err := range errs {
+		t.Fatalf("concurrent write: %v", err)
+	}
+	// Every increment by one moves the counter to a total no other write produced, so the
+	// totals AddCounter returns must all differ.
+	seen := make(map[int64]bool, s.workers*perWorker/2)
+	for total := range totals {
+		if total < 1 || total > int64(s.workers*perWorker) || seen[total] {
+			t.Fatalf("AddCounter returned total %d twice or out of range; it must reflect only its own write", total)
+		}
+		seen[total] = true
+	}
+
+	gauges := make(map[string]float64, s.workers)
+	for w := range s.workers {
+		gauges[fmt.Sprintf("W%d", w)] = perWorker - 1
+	}
+	ExpectState(t, repo, gauges, map[string]int64{"Shared": int64(s.workers * perWorker)})
+}
+
+func (s *suite) testContextCanceled(t *testing.T) {
+	repo := s.newRepo(t)
+	must(t, repo.SetGauge(context.Background(), "Kept", 1), "SetGauge")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := map[string]func() error{
+		"SetGauge":   func() error { return repo.SetGauge(ctx, "Lost", 1) },
+		"AddCounter": func() error { return addCounter(ctx, repo, "Lost", 1) },
+		"UpdateMany": func() error { return updateMany(ctx, repo, []domain.Metrics{Gauge("Lost", 1)}) },
+		"GetGauge": func() error {
+			_, err := repo.GetGauge(ctx, "Kept")
+			return err
+		},
+		"CompareAndSetGauge": func() error {
+			_, err := repo.CompareAndSetGauge(ctx, "Lost", 1, 0)
+			return err
+		},
+		"ApplyGauge": func() error {
+			_, err := repo.ApplyGauge(ctx, "Lost", domain.GaugeAdd, 1)
+			return err
+		},
+		"GetGaugeWithRevision": func() error {
+			_, _, err := repo.GetGaugeWithRevision(ctx, "Kept")
+			return err
+		},
+		"GetCounter": func() error {
+			_, err := repo.GetCounter(ctx, "Kept")
+			return err
+		},
+		"Snapshot": func() error {
+			_, err := repo.Snapshot(ctx)
+			return err
+		},
+		"SnapshotSince": func() error {
+			_, err := repo.SnapshotSince(ctx, 0)
+			return err
+		},
+		"Revision": func() error {
+			_, err := repo.Revision(ctx)
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s with canceled context: want context.Canceled, got %v", name, err)
+		}
+	}
+	ExpectState(t, repo, map[string]float64{"Kept": 1}, map[string]int64{})
+}
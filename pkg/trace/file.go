@@ -0,0 +1,65 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileExporter appends spans to a file, one JSON object per line.
+type FileExporter struct {
+	f  *os.File
+	mu sync.Mutex
+}
+
+var _ Exporter = (*FileExporter)(nil)
+
+// NewFileExporter opens path for appending, creating it and its directory when missing.
+func NewFileExporter(path string) (*FileExporter, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create trace dir: %w", err)
+		}
+	}
+	f, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open trace file: %w", err)
+	}
+	return &FileExporter{f: f}, nil
+}
+
+// Export writes span as one JSON line.
+func (e *FileExporter) Export(span Span) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return fmt.Errorf("marshal span: %w", err)
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil {
+		return os.ErrClosed
+	}
+	if _, err := e.f.Write(line); err != nil {
+		return fmt.Errorf("write span: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.f == nil {
+		return nil
+	}
+	err := e.f.Close()
+	e.f = nil
+	if err != nil {
+		return fmt.Errorf("close trace file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Span is one finished operation as handed to an Exporter.
+type Span struct {
+	Start    time.Time         `json:"start"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Error    string            `json:"error,omitempty"`
+	Duration time.Duration     `json:"duration_ns"`
+}
+
+// Exporter receives finished spans.
+type Exporter interface {
+	Export(Span) error
+}
+
+// Tracer records spans and passes them to an Exporter. A nil Tracer still propagates
+// span contexts but records nothing.
+type Tracer struct {
+	exp     Exporter
+	mu      sync.RWMutex
+	onError func(error)
+	now     func() time.Time
+}
+
+// NewTracer returns a Tracer exporting to exp.
+func NewTracer(exp Exporter) *Tracer {
+	return &Tracer{exp: exp, now: time.Now}
+}
+
+// SetErrorHandler configures a callback for export failures.
+func (t *Tracer) SetErrorHandler(fn func(error)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.onError = fn
+	t.mu.Unlock()
+}
+
+// Start begins a span named name as a child of the span in ctx, or as a new trace root
+// when ctx carries none, and returns a context carrying the new span. The returned span
+// is nil when nothing is recorded: for a nil Tracer or when the parent is not sampled.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *ActiveSpan) {
+	parent, ok := FromContext(ctx)
+	sc := NewRoot()
+	if ok {
+		sc = parent.Child()
+	}
+	ctx = ContextWith(ctx, sc)
+	if t == nil || t.exp == nil || !sc.Sampled() {
+		return ctx, nil
+	}
+	span := &ActiveSpan{tracer: t, data: Span{
+		TraceID: sc.TraceID.String(),
+		SpanID:  sc.SpanID.String(),
+		Name:    name,
+		Start:   t.now(),
+	}}
+	if ok {
+		span.data.ParentID = parent.SpanID.String()
+	}
+	return ctx, span
+}
+
+// ActiveSpan is a span that has been started and not yet ended. All methods are safe
+// to call on a nil ActiveSpan.
+type ActiveSpan struct {
+	tracer *Tracer
+	data   Span
+	once   sync.Once
+}
+
+// SetAttr annotates the span; it must not be called concurrently with End.
+func (s *ActiveSpan) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.data.Attrs == nil {
+		s.data.Attrs = make(map[string]string)
+	}
+	s.data.Attrs[key] = value
+}
+
+// End finishes the span, recording err when non-nil, and exports it. Only the first call has effect.
+func (s *ActiveSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		t := s.tracer
+		s.data.Duration = t.now().Sub(s.data.Start)
+		if err != nil {
+			s.data.Error = err.Error()
+		}
+		if xerr := t.exp.Export(s.data); xerr != nil {
+			t.mu.RLock()
+			handler := t.onError
+			t.mu.RUnlock()
+			if handler != nil {
+				handler(xerr)
+			}
+		}
+	})
+}
@@ -0,0 +1,165 @@
+// Package trace implements W3C Trace Context propagation and a minimal span recorder.
+//
+// A SpanContext is carried between processes in the traceparent header and inside a
+// process in a context.Context. A Tracer records spans as children of the span found in
+// the context and hands finished spans to an Exporter; FileExporter appends them as JSON
+// lines to a local file, so traces can be inspected without a collector.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Header is the HTTP header carrying the span context between services.
+const Header = "traceparent"
+
+// ErrInvalidTraceparent is returned when a traceparent header cannot be parsed.
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// TraceID identifies a whole trace across services.
+type TraceID [16]byte
+
+// String returns the lowercase hex form of the ID.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether the ID is not all zeros.
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// SpanID identifies one operation within a trace.
+type SpanID [8]byte
+
+// String returns the lowercase hex form of the ID.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether the ID is not all zeros.
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// flagSampled is the only trace flag defined by the W3C spec.
+const flagSampled byte = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// NewRoot starts a new sampled trace.
+func NewRoot() SpanContext {
+	var sc SpanContext
+	_, _ = rand.Read(sc.TraceID[:])
+	_, _ = rand.Read(sc.SpanID[:])
+	sc.Flags = flagSampled
+	return sc
+}
+
+// Child returns a span context in the same trace with a fresh span ID.
+func (sc SpanContext) Child() SpanContext {
+	child := sc
+	_, _ = rand.Read(child.SpanID[:])
+	return child
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Sampled reports whether the caller asked for the trace to be recorded.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// String formats the span context as a version 00 traceparent value.
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Parse decodes a traceparent value such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Values from future
+// versions are accepted as long as they start with the version 00 fields.
+func Parse(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := decodeHex(s[0:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(s) > 55 && (version[0] == 0 || s[55] != '-') {
+		return sc, ErrInvalidTraceparent
+	}
+	traceID, ok1 := decodeHex(s[3:35])
+	spanID, ok2 := decodeHex(s[36:52])
+	flags, ok3 := decodeHex(s[53:55])
+	if !ok1 || !ok2 || !ok3 {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex accepts lowercase hex only, as the spec requires.
+func decodeHex(s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+type ctxKey struct{}
+
+// ContextWith stores sc in ctx.
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxKey{}, sc)
+}
+
+// FromContext returns the span context stored in ctx, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(ctxKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Derive returns ctx carrying a new span context: a child of the span in ctx, or the root
+// of a new trace when ctx carries none. Use it to propagate a trace without recording spans.
+func Derive(ctx context.Context) context.Context {
+	sc := NewRoot()
+	if parent, ok := FromContext(ctx); ok {
+		sc = parent.Child()
+	}
+	return ContextWith(ctx, sc)
+}
+
+// TraceIDFromContext returns the hex trace ID stored in ctx, or "" when there is none.
+func TraceIDFromContext(ctx context.Context) string {
+	sc, ok := FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return sc.TraceID.String()
+}
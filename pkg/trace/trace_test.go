@@ -0,0 +1,127 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{name: "valid", in: valid},
+		{name: "future version with extra fields", in: "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what"},
+		{name: "version 00 with trailing data", in: valid + "-x", wantErr: true},
+		{name: "version ff", in: "ff" + valid[2:], wantErr: true},
+		{name: "uppercase hex", in: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero trace id", in: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero span id", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{name: "short", in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", wantErr: true},
+		{name: "bad separator", in: "00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := Parse(tt.in)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTraceparent) {
+					t.Fatalf("want ErrInvalidTraceparent, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled() {
+				t.Fatalf("unexpected span context: %+v", sc)
+			}
+		})
+	}
+
+	sc, _ := Parse(valid)
+	if sc.String() != valid {
+		t.Fatalf("String() = %s, want %s", sc, valid)
+	}
+}
+
+func TestTracer_FileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces", "spans.jsonl")
+	exp, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("NewFileExporter: %v", err)
+	}
+	tr := NewTracer(exp)
+
+	parent, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWith(context.Background(), parent)
+	ctx, server := tr.Start(ctx, "http")
+	_, repo := tr.Start(ctx, "repo.UpdateMany")
+	repo.SetAttr("items", "3")
+	repo.End(errors.New("boom"))
+	repo.End(nil)
+	server.End(nil)
+	if TraceIDFromContext(ctx) != parent.TraceID.String() {
+		t.Fatalf("trace id not propagated: %s", TraceIDFromContext(ctx))
+	}
+	if err := exp.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	var spans []Span
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var s Span
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			t.Fatalf("decode %s: %v", sc.Text(), err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(spans))
+	}
+	child, root := spans[0], spans[1]
+	if root.ParentID != "00f067aa0ba902b7" || child.ParentID != root.SpanID || child.TraceID != root.TraceID {
+		t.Fatalf("spans not linked: %+v", spans)
+	}
+	if child.Error != "boom" || child.Attrs["items"] != "3" || child.Name != "repo.UpdateMany" {
+		t.Fatalf("unexpected child span: %+v", child)
+	}
+}
+
+func TestTracer_NotSampledAndNil(t *testing.T) {
+	var exported int
+	tr := NewTracer(exporterFunc(func(Span) error { exported++; return nil }))
+
+	parent, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, span := tr.Start(ContextWith(context.Background(), parent), "http")
+	span.End(nil)
+	if span != nil || exported != 0 {
+		t.Fatalf("unsampled parent must not be recorded")
+	}
+	if TraceIDFromContext(ctx) != parent.TraceID.String() {
+		t.Fatal("unsampled trace must still propagate")
+	}
+
+	var nilTracer *Tracer
+	ctx, span = nilTracer.Start(context.Background(), "http")
+	span.End(nil)
+	if TraceIDFromContext(ctx) == "" {
+		t.Fatal("nil tracer must still start a trace")
+	}
+}
+
+type exporterFunc func(Span) error
+
+func (f exporterFunc) Export(s Span) error { return f(s) }